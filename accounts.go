@@ -0,0 +1,664 @@
+package main
+
+import (
+	"context"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With accounts, every user studies their own collection, kept in a
+// database file of its own under the collections directory, so nothing a
+// request does can reach another user's cards. The users and their login
+// sessions are kept in a separate accounts database. The first account
+// takes over the collection of -db and -media-dir, so a server that gets
+// accounts keeps its cards.
+
+var (
+	ErrInvalidAccount     = errors.New("invalid account")
+	ErrUsernameTaken      = errors.New("username is taken")
+	ErrLoginFailed        = errors.New("wrong username or password")
+	ErrRegistrationClosed = errors.New("registration is closed")
+	ErrSessionNotFound    = errors.New("session not found")
+	ErrAccountDisabled    = errors.New("account is disabled")
+)
+
+const (
+	// sessionCookie is the cookie a login session's token is kept in.
+	sessionCookie = "session"
+	// sessionIdle is how long a login session lasts without being used.
+	sessionIdle = 30 * 24 * time.Hour
+	// sessionRenewal is how often a session in use is renewed for another
+	// sessionIdle, rather than on every request.
+	sessionRenewal = time.Hour
+	// passwordIterations is the PBKDF2 work factor for password hashes.
+	passwordIterations = 600_000
+	// minPasswordLength is the fewest characters a password can have.
+	minPasswordLength = 8
+	// maxUserAgent bounds the length of the User-Agent kept with a session.
+	maxUserAgent = 200
+)
+
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// accounts is the accounts database of -users-db, nil without accounts.
+var accounts *Accounts
+
+// secureCookies marks session cookies Secure even on plain HTTP requests,
+// set from -secure-cookies in main for servers behind an HTTPS proxy.
+var secureCookies bool
+
+// Accounts is the database of users and their login sessions, with the
+// collections of the users opened so far.
+type Accounts struct {
+	*sql.DB
+	collectionsDir   string
+	openRegistration bool // Anyone may register, not just the first account
+
+	mu          sync.Mutex
+	collections map[int]*Collection
+
+	collabMu     sync.Mutex  // Held while shared decks are synced or their members change
+	collabSynced map[int]int // The seq each membership was last synced at
+}
+
+// User is an account.
+type User struct {
+	ID        int       `json:"id"`
+	Username  string    `json:"username"`
+	Admin     bool      `json:"admin"`
+	Disabled  bool      `json:"disabled"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Credentials are what an account registers and logs in with.
+type Credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// PasswordChange asks for an account's password to be changed.
+type PasswordChange struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+// Session is a login session of an account. Its token is only known to
+// the browser or client it was given to.
+type Session struct {
+	ID         int64     `json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	UserAgent  string    `json:"user_agent"`
+	Current    bool      `json:"current"` // The session of the request
+	userID     int
+}
+
+// OpenAccounts opens the accounts database at dbPath, creating it if
+// needed. The collections of accounts other than the first are kept in
+// collectionsDir.
+func OpenAccounts(dbPath, collectionsDir string, openRegistration bool) (*Accounts, error) {
+	sqlDB, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return nil, err
+	}
+	a := &Accounts{DB: sqlDB, collectionsDir: collectionsDir, openRegistration: openRegistration, collections: map[int]*Collection{}, collabSynced: map[int]int{}}
+
+	_, err = a.Exec(`
+	CREATE TABLE IF NOT EXISTS users (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		username TEXT NOT NULL UNIQUE COLLATE NOCASE,
+		password_hash TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS sessions (
+		token_hash TEXT PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		expires_at DATETIME NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_sessions_user ON sessions(user_id);
+	`)
+	if err == nil {
+		_, err = addColumnIfMissing(a, "sessions", "last_seen_at", "DATETIME")
+	}
+	if err == nil {
+		_, err = addColumnIfMissing(a, "sessions", "user_agent", "TEXT NOT NULL DEFAULT ''")
+	}
+	if err == nil {
+		err = createAPITokensTable(a)
+	}
+	if err == nil {
+		_, err = addColumnIfMissing(a, "users", "oidc_subject", "TEXT")
+	}
+	if err == nil {
+		_, err = a.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_users_oidc ON users(oidc_subject)`)
+	}
+	if err == nil {
+		err = createCollaborationTables(a)
+	}
+	if err == nil {
+		err = addAdminColumns(a)
+	}
+	if err != nil {
+		sqlDB.Close()
+		return nil, err
+	}
+	return a, nil
+}
+
+// Close closes the accounts database and the collections opened for it,
+// other than the default collection.
+func (a *Accounts) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, db := range a.collections {
+		if db != defaultCollection {
+			db.Close()
+		}
+	}
+	return a.DB.Close()
+}
+
+// Register creates an account. Unless registration is open, only the
+// first account can be registered.
+func (a *Accounts) Register(c Credentials) (*User, error) {
+	c.Username = strings.TrimSpace(c.Username)
+	if !usernamePattern.MatchString(c.Username) {
+		return nil, fmt.Errorf("%w: username must be 1 to 64 letters, digits, dots, dashes or underscores", ErrInvalidAccount)
+	}
+	if len([]rune(c.Password)) < minPasswordLength {
+		return nil, fmt.Errorf("%w: password must be at least %d characters", ErrInvalidAccount, minPasswordLength)
+	}
+
+	hash, err := hashPassword(c.Password)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := a.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var count int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM users`).Scan(&count); err != nil {
+		return nil, err
+	}
+	if count > 0 && !a.openRegistration {
+		return nil, ErrRegistrationClosed
+	}
+
+	var taken int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM users WHERE username = ?`, c.Username).Scan(&taken); err != nil {
+		return nil, err
+	}
+	if taken > 0 {
+		return nil, ErrUsernameTaken
+	}
+
+	// The first account is an admin
+	res, err := tx.Exec(`INSERT INTO users (username, password_hash, is_admin) VALUES (?, ?, ?)`, c.Username, hash, count == 0)
+	if err != nil {
+		return nil, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return a.user(int(id))
+}
+
+// Login checks a username and password and starts a session for the
+// account from a client, returning the session's token.
+func (a *Accounts) Login(c Credentials, userAgent string) (*User, string, time.Time, error) {
+	var id int
+	var hash string
+	err := a.QueryRow(`SELECT id, password_hash FROM users WHERE username = ?`, strings.TrimSpace(c.Username)).Scan(&id, &hash)
+	if err == sql.ErrNoRows {
+		// Take as long as a wrong password, so usernames can't be probed
+		checkPassword(c.Password, "")
+		return nil, "", time.Time{}, ErrLoginFailed
+	}
+	if err != nil {
+		return nil, "", time.Time{}, err
+	}
+	if !checkPassword(c.Password, hash) {
+		return nil, "", time.Time{}, ErrLoginFailed
+	}
+
+	token, expires, err := a.startSession(id, userAgent)
+	if err != nil {
+		return nil, "", time.Time{}, err
+	}
+	user, err := a.user(id)
+	if err != nil {
+		return nil, "", time.Time{}, err
+	}
+	return user, token, expires, nil
+}
+
+// startSession starts a session for an account from a client, returning
+// its token and when it expires unless used. Disabled accounts can't log
+// in.
+func (a *Accounts) startSession(userID int, userAgent string) (string, time.Time, error) {
+	var disabled bool
+	if err := a.QueryRow(`SELECT disabled FROM users WHERE id = ?`, userID).Scan(&disabled); err != nil {
+		return "", time.Time{}, err
+	}
+	if disabled {
+		return "", time.Time{}, ErrAccountDisabled
+	}
+	token, err := randomToken()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if len(userAgent) > maxUserAgent {
+		userAgent = userAgent[:maxUserAgent]
+	}
+	now := time.Now().UTC()
+	expires := now.Add(sessionIdle)
+	if _, err := a.Exec(`DELETE FROM sessions WHERE expires_at <= ?`, now); err != nil {
+		return "", time.Time{}, err
+	}
+	if _, err := a.Exec(`INSERT INTO sessions (token_hash, user_id, last_seen_at, expires_at, user_agent) VALUES (?, ?, ?, ?, ?)`,
+		hashToken(token), userID, now, expires, userAgent); err != nil {
+		return "", time.Time{}, err
+	}
+	return token, expires, nil
+}
+
+// Logout ends the session of a token.
+func (a *Accounts) Logout(token string) error {
+	_, err := a.Exec(`DELETE FROM sessions WHERE token_hash = ?`, hashToken(token))
+	return err
+}
+
+// session returns the unexpired session of a token, or nil.
+func (a *Accounts) session(token string) (*Session, error) {
+	s := &Session{}
+	var lastSeen sql.NullTime
+	err := a.QueryRow(
+		`SELECT rowid, user_id, created_at, last_seen_at, expires_at, user_agent FROM sessions
+		 WHERE token_hash = ? AND expires_at > ?`,
+		hashToken(token), time.Now().UTC(),
+	).Scan(&s.ID, &s.userID, &s.CreatedAt, &lastSeen, &s.ExpiresAt, &s.UserAgent)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.LastSeenAt = s.CreatedAt
+	if lastSeen.Valid {
+		s.LastSeenAt = lastSeen.Time
+	}
+	s.Current = true
+	return s, nil
+}
+
+// renew extends a session in use for another sessionIdle, returning
+// whether it was due for renewal.
+func (a *Accounts) renew(s *Session) (bool, error) {
+	now := time.Now().UTC()
+	if now.Sub(s.LastSeenAt) < sessionRenewal {
+		return false, nil
+	}
+	s.LastSeenAt, s.ExpiresAt = now, now.Add(sessionIdle)
+	_, err := a.Exec(`UPDATE sessions SET last_seen_at = ?, expires_at = ? WHERE rowid = ?`, s.LastSeenAt, s.ExpiresAt, s.ID)
+	return err == nil, err
+}
+
+// Sessions lists the unexpired sessions of an account, most recently used
+// first, marking current as the current one.
+func (a *Accounts) Sessions(userID int, current int64) ([]Session, error) {
+	rows, err := a.Query(
+		`SELECT rowid, created_at, last_seen_at, expires_at, user_agent FROM sessions
+		 WHERE user_id = ? AND expires_at > ?
+		 ORDER BY COALESCE(last_seen_at, created_at) DESC, rowid DESC`,
+		userID, time.Now().UTC(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		s := Session{userID: userID}
+		var lastSeen sql.NullTime
+		if err := rows.Scan(&s.ID, &s.CreatedAt, &lastSeen, &s.ExpiresAt, &s.UserAgent); err != nil {
+			return nil, err
+		}
+		s.LastSeenAt = s.CreatedAt
+		if lastSeen.Valid {
+			s.LastSeenAt = lastSeen.Time
+		}
+		s.Current = s.ID == current
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// EndSession ends a session of an account.
+func (a *Accounts) EndSession(userID int, id int64) error {
+	res, err := a.Exec(`DELETE FROM sessions WHERE rowid = ? AND user_id = ?`, id, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// EndOtherSessions ends the sessions of an account other than keep,
+// returning how many were ended.
+func (a *Accounts) EndOtherSessions(userID int, keep int64) (int, error) {
+	res, err := a.Exec(`DELETE FROM sessions WHERE user_id = ? AND rowid != ?`, userID, keep)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// ChangePassword changes the password of an account after checking its
+// current one, and ends its sessions other than keep.
+func (a *Accounts) ChangePassword(userID int, keep int64, change PasswordChange) error {
+	var hash string
+	if err := a.QueryRow(`SELECT password_hash FROM users WHERE id = ?`, userID).Scan(&hash); err != nil {
+		return err
+	}
+	if !checkPassword(change.CurrentPassword, hash) {
+		return ErrLoginFailed
+	}
+	if len([]rune(change.NewPassword)) < minPasswordLength {
+		return fmt.Errorf("%w: password must be at least %d characters", ErrInvalidAccount, minPasswordLength)
+	}
+
+	hash, err := hashPassword(change.NewPassword)
+	if err != nil {
+		return err
+	}
+	tx, err := a.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`UPDATE users SET password_hash = ? WHERE id = ?`, hash, userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM sessions WHERE user_id = ? AND rowid != ?`, userID, keep); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (a *Accounts) user(id int) (*User, error) {
+	user := &User{ID: id}
+	err := a.QueryRow(`SELECT username, is_admin, disabled, created_at FROM users WHERE id = ?`, id).
+		Scan(&user.Username, &user.Admin, &user.Disabled, &user.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// collection returns the collection of an account, opening it the first
+// time. The first account's collection is the default collection.
+func (a *Accounts) collection(userID int) (*Collection, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if db, ok := a.collections[userID]; ok {
+		return db, nil
+	}
+
+	db := defaultCollection
+	if userID != 1 {
+		if err := os.MkdirAll(a.collectionsDir, 0o755); err != nil {
+			return nil, err
+		}
+		name := strconv.Itoa(userID)
+		var err error
+		db, err = OpenCollection(filepath.Join(a.collectionsDir, name+".db"), filepath.Join(a.collectionsDir, name+"-media"))
+		if err != nil {
+			return nil, err
+		}
+	}
+	a.collections[userID] = db
+	return db, nil
+}
+
+// hashPassword returns a salted PBKDF2-SHA256 hash of a password, in the
+// form pbkdf2-sha256$iterations$salt$hash.
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, passwordIterations, sha256.Size)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", passwordIterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// checkPassword reports whether password matches a hash made by
+// hashPassword. An empty hash is checked against a dummy one.
+func checkPassword(password, hash string) bool {
+	if hash == "" {
+		hash = "pbkdf2-sha256$" + strconv.Itoa(passwordIterations) + "$AAAAAAAAAAAAAAAAAAAAAA$"
+	}
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations < 1 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, iterations, sha256.Size)
+	if err != nil {
+		return false
+	}
+	return len(want) == len(key) && subtle.ConstantTimeCompare(key, want) == 1
+}
+
+// randomToken returns a new random session token.
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken returns the hash a token is stored as, so the accounts
+// database alone can't be used to log in.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// userKey is the request context key of the logged in account.
+type userKey struct{}
+
+// sessionKey is the request context key of the login session.
+type sessionKey struct{}
+
+// requestUser returns the account a request was made by, or nil without
+// accounts.
+func requestUser(r *http.Request) *User {
+	user, _ := r.Context().Value(userKey{}).(*User)
+	return user
+}
+
+// requestSession returns the login session of a request, or nil without
+// accounts.
+func requestSession(r *http.Request) *Session {
+	s, _ := r.Context().Value(sessionKey{}).(*Session)
+	return s
+}
+
+// publicPaths can be requested without logging in.
+var publicPaths = map[string]bool{
+	"/api/login":    true,
+	"/api/register": true,
+	"/api/version":  true,
+
+	"/api/oidc/login":    true,
+	"/api/oidc/callback": true,
+}
+
+// sessionOnlyPaths manage the account itself, so they need a login
+// session rather than an API token.
+var sessionOnlyPaths = []string{"/api/sessions", "/api/password", "/api/tokens", "/api/admin"}
+
+func isSessionOnly(path string) bool {
+	for _, p := range sessionOnlyPaths {
+		if path == p || strings.HasPrefix(path, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// requireLogin wraps the routes so that, with accounts, the API and media
+// need a login session or an API token, and work on the collection of its
+// account. The static files of the web UI are served to anyone, as are
+// shared decks and CORS preflight requests for quick add, which carry no
+// credentials.
+func requireLogin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if accounts == nil || publicPaths[r.URL.Path] || strings.HasPrefix(r.URL.Path, "/api/shared/") ||
+			!strings.HasPrefix(r.URL.Path, "/api/") && !strings.HasPrefix(r.URL.Path, "/media/") ||
+			r.Method == "OPTIONS" && r.URL.Path == "/api/quickadd" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx := r.Context()
+		var userID int
+		if given, ok := bearerToken(r); ok {
+			token, err := accounts.apiToken(given)
+			if err != nil {
+				respondError(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if token == nil {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="simple-anki"`)
+				respondError(w, "Invalid API token", http.StatusUnauthorized)
+				return
+			}
+			if isSessionOnly(r.URL.Path) {
+				respondError(w, "API tokens can't manage the account; log in instead", http.StatusForbidden)
+				return
+			}
+			userID = token.userID
+			ctx = context.WithValue(ctx, apiTokenKey{}, token)
+		} else {
+			var session *Session
+			cookie, err := r.Cookie(sessionCookie)
+			if err == nil {
+				if session, err = accounts.session(cookie.Value); err != nil {
+					respondError(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+			}
+			if session == nil {
+				respondError(w, "Login required", http.StatusUnauthorized)
+				return
+			}
+
+			renewed, err := accounts.renew(session)
+			if err != nil {
+				respondError(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if renewed {
+				setSessionCookie(w, r, cookie.Value, session.ExpiresAt)
+			}
+			userID = session.userID
+			ctx = context.WithValue(ctx, sessionKey{}, session)
+		}
+
+		user, err := accounts.user(userID)
+		if err != nil {
+			respondError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if user.Disabled {
+			respondError(w, "Account is disabled", http.StatusForbidden)
+			return
+		}
+		db, err := accounts.collection(user.ID)
+		if err != nil {
+			respondError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		ctx = context.WithValue(ctx, userKey{}, user)
+		ctx = context.WithValue(ctx, collectionKey{}, db)
+
+		// Shared decks other members changed are brought up to date before
+		// the request, and whatever it changed is shared after it
+		shared := !readOnly && strings.HasPrefix(r.URL.Path, "/api/")
+		if shared {
+			if err := accounts.syncCollaborations(user.ID, db, true); err != nil {
+				log.Printf("Syncing shared decks of %s: %v", user.Username, err)
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+		if shared && r.Method != "GET" && r.Method != "HEAD" {
+			if err := accounts.syncCollaborations(user.ID, db, false); err != nil {
+				log.Printf("Syncing shared decks of %s: %v", user.Username, err)
+			}
+		}
+	})
+}
+
+// setSessionCookie sets the cookie of a login session. It is Secure when
+// the request came over HTTPS or -secure-cookies is set, kept from
+// scripts, and not sent on cross-site requests other than navigation.
+func setSessionCookie(w http.ResponseWriter, r *http.Request, token string, expires time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   secureCookies || r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Admins look after the accounts of a shared server: they see every
+// account with the storage it takes, reset forgotten passwords, disable
+// accounts and make other accounts admins. The first account is an admin.
+// A disabled account can't log in or use its API tokens, and its share
+// links stop working, but its collection is kept.
+
+var ErrUserNotFound = errors.New("user not found")
+
+// AccountUsage is an account as an admin sees it, with what it stores.
+type AccountUsage struct {
+	User
+	Cards         int        `json:"cards"`
+	DatabaseBytes int64      `json:"database_bytes"`
+	MediaFiles    int        `json:"media_files"`
+	MediaBytes    int64      `json:"media_bytes"`
+	LastSeenAt    *time.Time `json:"last_seen_at"` // Latest use of a session, if any is left
+}
+
+// AccountUpdate changes the role or state of an account. Fields left out
+// are not changed.
+type AccountUpdate struct {
+	Admin    *bool `json:"admin"`
+	Disabled *bool `json:"disabled"`
+}
+
+// addAdminColumns adds the role and state of accounts to the users table.
+// An existing first account becomes an admin.
+func addAdminColumns(a *Accounts) error {
+	added, err := addColumnIfMissing(a, "users", "is_admin", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+	if added {
+		if _, err := a.Exec(`UPDATE users SET is_admin = 1 WHERE id = (SELECT MIN(id) FROM users)`); err != nil {
+			return err
+		}
+	}
+	_, err = addColumnIfMissing(a, "users", "disabled", "INTEGER NOT NULL DEFAULT 0")
+	return err
+}
+
+// Users lists every account with the storage its collection takes.
+func (a *Accounts) Users() ([]AccountUsage, error) {
+	rows, err := a.Query(`SELECT id, username, is_admin, disabled, created_at FROM users ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	var users []AccountUsage
+	for rows.Next() {
+		var u AccountUsage
+		if err := rows.Scan(&u.ID, &u.Username, &u.Admin, &u.Disabled, &u.CreatedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range users {
+		var lastSeen sql.NullTime
+		err := a.QueryRow(`SELECT last_seen_at FROM sessions WHERE user_id = ? ORDER BY last_seen_at DESC LIMIT 1`, users[i].ID).Scan(&lastSeen)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+		if lastSeen.Valid {
+			users[i].LastSeenAt = &lastSeen.Time
+		}
+
+		db, err := a.collection(users[i].ID)
+		if err != nil {
+			return nil, err
+		}
+		if err := collectionUsage(db, &users[i]); err != nil {
+			return nil, err
+		}
+	}
+	return users, nil
+}
+
+// collectionUsage fills in the cards and storage of a collection.
+func collectionUsage(db *Collection, u *AccountUsage) error {
+	err := db.QueryRow(`SELECT COUNT(*) FROM cards`).Scan(&u.Cards)
+	if err == nil {
+		err = db.QueryRow(`SELECT page_count * page_size FROM pragma_page_count(), pragma_page_size()`).Scan(&u.DatabaseBytes)
+	}
+	if err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(db.mediaDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !mediaName.MatchString(e.Name()) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		u.MediaFiles++
+		u.MediaBytes += info.Size()
+	}
+	return nil
+}
+
+// UpdateUser changes the role or state of an account on behalf of an
+// admin, who can't demote or disable their own account. Disabling an
+// account ends its sessions.
+func (a *Accounts) UpdateUser(adminID, id int, update AccountUpdate) (*User, error) {
+	if id == adminID && (update.Admin != nil && !*update.Admin || update.Disabled != nil && *update.Disabled) {
+		return nil, fmt.Errorf("%w: you can't demote or disable your own account", ErrInvalidAccount)
+	}
+
+	tx, err := a.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err := tx.QueryRow(`SELECT COUNT(*) > 0 FROM users WHERE id = ?`, id).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrUserNotFound
+	}
+	if update.Admin != nil {
+		if _, err := tx.Exec(`UPDATE users SET is_admin = ? WHERE id = ?`, *update.Admin, id); err != nil {
+			return nil, err
+		}
+	}
+	if update.Disabled != nil {
+		if _, err := tx.Exec(`UPDATE users SET disabled = ? WHERE id = ?`, *update.Disabled, id); err != nil {
+			return nil, err
+		}
+		if *update.Disabled {
+			if _, err := tx.Exec(`DELETE FROM sessions WHERE user_id = ?`, id); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return a.user(id)
+}
+
+// ResetPassword sets a new password for an account on behalf of an admin,
+// ending its sessions. It also gives accounts from single sign-on a
+// password to log in with.
+func (a *Accounts) ResetPassword(id int, password string) error {
+	if len([]rune(password)) < minPasswordLength {
+		return fmt.Errorf("%w: password must be at least %d characters", ErrInvalidAccount, minPasswordLength)
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	tx, err := a.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`UPDATE users SET password_hash = ? WHERE id = ?`, hash, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrUserNotFound
+	}
+	if _, err := tx.Exec(`DELETE FROM sessions WHERE user_id = ?`, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
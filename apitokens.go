@@ -0,0 +1,155 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// API tokens let scripts, scheduled jobs and browser extensions use the
+// API of an account without a login session, sent as "Authorization:
+// Bearer <token>". A token is shown once when created; only its hash is
+// stored. Tokens can't manage the account itself: its sessions, password
+// and tokens need a login session.
+
+var (
+	ErrInvalidAPIToken  = errors.New("invalid API token")
+	ErrAPITokenNotFound = errors.New("API token not found")
+)
+
+const (
+	// apiTokenPrefix starts every API token, so leaked ones are easy to
+	// recognize.
+	apiTokenPrefix = "sa_"
+	// maxAPITokenName bounds the length of a token's name.
+	maxAPITokenName = 100
+)
+
+// APIToken is an API token of an account. Token is only set when it is
+// created.
+type APIToken struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	Token      string     `json:"token,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	userID     int
+}
+
+// createAPITokensTable adds the api_tokens table to the accounts database.
+func createAPITokensTable(a *Accounts) error {
+	_, err := a.Exec(`
+	CREATE TABLE IF NOT EXISTS api_tokens (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		token_hash TEXT NOT NULL UNIQUE,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		last_used_at DATETIME
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_api_tokens_user ON api_tokens(user_id);
+	`)
+	return err
+}
+
+// CreateAPIToken creates an API token for an account, returning it with
+// the token itself.
+func (a *Accounts) CreateAPIToken(userID int, name string) (*APIToken, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len([]rune(name)) > maxAPITokenName {
+		return nil, fmt.Errorf("%w: name must be 1 to %d characters", ErrInvalidAPIToken, maxAPITokenName)
+	}
+
+	random, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	token := apiTokenPrefix + random
+	res, err := a.Exec(`INSERT INTO api_tokens (user_id, name, token_hash) VALUES (?, ?, ?)`, userID, name, hashToken(token))
+	if err != nil {
+		return nil, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	t := &APIToken{ID: int(id), Name: name, Token: token, userID: userID}
+	if err := a.QueryRow(`SELECT created_at FROM api_tokens WHERE id = ?`, id).Scan(&t.CreatedAt); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// APITokens lists the API tokens of an account, newest first.
+func (a *Accounts) APITokens(userID int) ([]APIToken, error) {
+	rows, err := a.Query(`SELECT id, name, created_at, last_used_at FROM api_tokens WHERE user_id = ? ORDER BY id DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []APIToken{}
+	for rows.Next() {
+		t := APIToken{userID: userID}
+		if err := rows.Scan(&t.ID, &t.Name, &t.CreatedAt, &t.LastUsedAt); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// RevokeAPIToken deletes an API token of an account.
+func (a *Accounts) RevokeAPIToken(userID, id int) error {
+	res, err := a.Exec(`DELETE FROM api_tokens WHERE id = ? AND user_id = ?`, id, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrAPITokenNotFound
+	}
+	return nil
+}
+
+// apiToken returns the API token a request was made with, or nil if there
+// is no such token. Its last use is recorded at most every sessionRenewal.
+func (a *Accounts) apiToken(token string) (*APIToken, error) {
+	t := &APIToken{}
+	err := a.QueryRow(`SELECT id, user_id, name, created_at, last_used_at FROM api_tokens WHERE token_hash = ?`, hashToken(token)).
+		Scan(&t.ID, &t.userID, &t.Name, &t.CreatedAt, &t.LastUsedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	if t.LastUsedAt == nil || now.Sub(*t.LastUsedAt) >= sessionRenewal {
+		if _, err := a.Exec(`UPDATE api_tokens SET last_used_at = ? WHERE id = ?`, now, t.ID); err != nil {
+			return nil, err
+		}
+		t.LastUsedAt = &now
+	}
+	return t, nil
+}
+
+// apiTokenKey is the request context key of the API token a request was
+// made with.
+type apiTokenKey struct{}
+
+// requestAPIToken returns the API token a request was made with, or nil.
+func requestAPIToken(r *http.Request) *APIToken {
+	t, _ := r.Context().Value(apiTokenKey{}).(*APIToken)
+	return t
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header.
+func bearerToken(r *http.Request) (string, bool) {
+	return strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
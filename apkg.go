@@ -0,0 +1,474 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/sha1"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Anki packages (.apkg) are zip files holding an Anki collection, which is
+// an SQLite database, and the media files. Notes keep their fields in one
+// column separated by 0x1f; each card is one template of a note.
+
+// Anki card types and the queue of suspended cards.
+const (
+	ankiTypeNew        = 0
+	ankiTypeLearning   = 1
+	ankiTypeReview     = 2
+	ankiTypeRelearning = 3
+	ankiQueueSuspended = -1
+	ankiModelCloze     = 1
+)
+
+// clozePattern matches a cloze deletion, {{c1::answer}} or {{c1::answer::hint}}.
+var clozePattern = regexp.MustCompile(`\{\{c(\d+)::(.*?)(?:::(.*?))?\}\}`)
+
+// parseApkg reads the cards of an Anki package, with their decks, tags and
+// scheduling. Field HTML is turned into plain text.
+func parseApkg(r io.ReaderAt, size int64) ([]ImportCard, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("%w: not an Anki package: %v", ErrInvalidImport, err)
+	}
+
+	files := make(map[string]*zip.File)
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+	// Packages in the newer format also hold a placeholder collection.anki2
+	if files["collection.anki21b"] != nil {
+		return nil, fmt.Errorf("%w: package uses the newer Anki format; export it with \"Support older Anki versions\" checked", ErrInvalidImport)
+	}
+	collection := files["collection.anki21"]
+	if collection == nil {
+		collection = files["collection.anki2"]
+	}
+	if collection == nil {
+		return nil, fmt.Errorf("%w: package has no Anki collection", ErrInvalidImport)
+	}
+
+	// SQLite needs the collection as a file
+	path, err := extractToTemp(collection)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(path)
+
+	adb, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	defer adb.Close()
+
+	cards, err := readAnkiCollection(adb)
+	if err != nil {
+		return nil, fmt.Errorf("%w: reading Anki collection: %v", ErrInvalidImport, err)
+	}
+	return cards, nil
+}
+
+func extractToTemp(f *zip.File) (string, error) {
+	src, err := openZipEntry(f)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	tmp, err := os.CreateTemp("", "simple-anki-*.anki2")
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(tmp, src); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// readAnkiCollection maps the cards of an Anki collection onto import cards.
+// Cards of a note type with two templates, like "Basic (and reversed
+// card)", have their second template's sides swapped.
+func readAnkiCollection(adb *sql.DB) ([]ImportCard, error) {
+	var crt int64
+	var decksJSON, modelsJSON string
+	if err := adb.QueryRow(`SELECT crt, decks, models FROM col`).Scan(&crt, &decksJSON, &modelsJSON); err != nil {
+		return nil, err
+	}
+
+	var decks map[string]struct {
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal([]byte(decksJSON), &decks); err != nil {
+		return nil, err
+	}
+	var models map[string]struct {
+		Type  int               `json:"type"`
+		Tmpls []json.RawMessage `json:"tmpls"`
+	}
+	if err := json.Unmarshal([]byte(modelsJSON), &models); err != nil {
+		return nil, err
+	}
+
+	// New cards come last, in the order of their positions (due), as cards
+	// are positioned in the order they are created
+	rows, err := adb.Query(
+		`SELECT c.ord, c.did, c.type, c.queue, c.due, c.ivl, c.factor, c.lapses, n.mid, n.flds, n.tags
+		 FROM cards c JOIN notes n ON n.id = c.nid ORDER BY CASE WHEN c.type = ? THEN c.due END, c.id`,
+		ankiTypeNew,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	collectionStart := time.Unix(crt, 0)
+	now := time.Now()
+	var cards []ImportCard
+	for rows.Next() {
+		var ord, cardType, queue, ivl, factor, lapses int
+		var did, due, mid int64
+		var flds, tags string
+		if err := rows.Scan(&ord, &did, &cardType, &queue, &due, &ivl, &factor, &lapses, &mid, &flds, &tags); err != nil {
+			return nil, err
+		}
+
+		fields := strings.Split(flds, "\x1f")
+		field := func(i int) string {
+			if i >= len(fields) {
+				return ""
+			}
+			return htmlToText(fields[i])
+		}
+
+		card := ImportCard{
+			Deck:   decks[strconv.FormatInt(did, 10)].Name,
+			Tags:   strings.Fields(tags),
+			Lapses: lapses,
+		}
+		model := models[strconv.FormatInt(mid, 10)]
+		switch {
+		case model.Type == ankiModelCloze:
+			card.Front = htmlToText(clozeText(fields[0], ord+1, false))
+			card.Back = htmlToText(clozeText(fields[0], ord+1, true))
+			if extra := field(1); extra != "" {
+				card.Back += "\n\n" + extra
+			}
+		case ord == 1 && len(model.Tmpls) == 2:
+			card.Front, card.Back = field(1), field(0)
+		default:
+			card.Front, card.Back = field(0), field(1)
+		}
+
+		switch cardType {
+		case ankiTypeNew:
+			card.State = StateNew
+			card.NextReview = now
+		case ankiTypeLearning, ankiTypeRelearning, ankiTypeReview:
+			card.State = map[int]string{
+				ankiTypeLearning:   StateLearning,
+				ankiTypeRelearning: StateRelearning,
+				ankiTypeReview:     StateReview,
+			}[cardType]
+			// Review cards are due on a day counted from the collection's
+			// creation, learning cards at a Unix time
+			if due > 1_000_000_000 {
+				card.NextReview = time.Unix(due, 0)
+			} else {
+				card.NextReview = collectionStart.AddDate(0, 0, int(due))
+			}
+		}
+		if ivl > 0 {
+			card.Interval = ivl
+		}
+		if factor > 0 {
+			card.Ease = float64(factor) / 1000
+		}
+		card.Suspended = queue == ankiQueueSuspended
+
+		cards = append(cards, card)
+	}
+	return cards, rows.Err()
+}
+
+// clozeText renders cloze number n of a cloze field, hidden as "[...]" (or
+// its hint) on the front and revealed on the back. Other clozes are shown.
+func clozeText(text string, n int, reveal bool) string {
+	return clozePattern.ReplaceAllStringFunc(text, func(m string) string {
+		parts := clozePattern.FindStringSubmatch(m)
+		if reveal || parts[1] != strconv.Itoa(n) {
+			return parts[2]
+		}
+		if parts[3] != "" {
+			return "[" + parts[3] + "]"
+		}
+		return "[...]"
+	})
+}
+
+// ankiSchema is the legacy (schema 11) Anki collection that older and
+// current Anki versions can all import.
+const ankiSchema = `
+CREATE TABLE col (
+	id integer PRIMARY KEY, crt integer NOT NULL, mod integer NOT NULL, scm integer NOT NULL,
+	ver integer NOT NULL, dty integer NOT NULL, usn integer NOT NULL, ls integer NOT NULL,
+	conf text NOT NULL, models text NOT NULL, decks text NOT NULL, dconf text NOT NULL, tags text NOT NULL
+);
+CREATE TABLE notes (
+	id integer PRIMARY KEY, guid text NOT NULL, mid integer NOT NULL, mod integer NOT NULL,
+	usn integer NOT NULL, tags text NOT NULL, flds text NOT NULL, sfld integer NOT NULL,
+	csum integer NOT NULL, flags integer NOT NULL, data text NOT NULL
+);
+CREATE TABLE cards (
+	id integer PRIMARY KEY, nid integer NOT NULL, did integer NOT NULL, ord integer NOT NULL,
+	mod integer NOT NULL, usn integer NOT NULL, type integer NOT NULL, queue integer NOT NULL,
+	due integer NOT NULL, ivl integer NOT NULL, factor integer NOT NULL, reps integer NOT NULL,
+	lapses integer NOT NULL, left integer NOT NULL, odue integer NOT NULL, odid integer NOT NULL,
+	flags integer NOT NULL, data text NOT NULL
+);
+CREATE TABLE revlog (
+	id integer PRIMARY KEY, cid integer NOT NULL, usn integer NOT NULL, ease integer NOT NULL,
+	ivl integer NOT NULL, lastIvl integer NOT NULL, factor integer NOT NULL, time integer NOT NULL,
+	type integer NOT NULL
+);
+CREATE TABLE graves (usn integer NOT NULL, oid integer NOT NULL, type integer NOT NULL);
+CREATE INDEX ix_notes_usn ON notes (usn);
+CREATE INDEX ix_cards_usn ON cards (usn);
+CREATE INDEX ix_revlog_usn ON revlog (usn);
+CREATE INDEX ix_cards_nid ON cards (nid);
+CREATE INDEX ix_cards_sched ON cards (did, queue, due);
+CREATE INDEX ix_revlog_cid ON revlog (cid);
+CREATE INDEX ix_notes_csum ON notes (csum);
+`
+
+// Exported collections use a single note type with Front and Back fields.
+const (
+	ankiExportModelID  = 1_700_000_000_000
+	ankiDefaultDeckID  = 1
+	ankiQueueBuried    = -3
+	ankiLeftOneStep    = 1001 // One learning step left, all of it today
+	ankiExportModelCSS = ".card { font-family: arial; font-size: 20px; text-align: center; color: black; background-color: white; }"
+)
+
+// WriteApkg writes the cards of deckName and its subdecks, or of every deck
+// when deckName is empty, to w as an Anki package. Each card becomes a note
+// of a Basic note type; scheduling, suspension and tags carry over.
+func WriteApkg(db *Collection, w io.Writer, deckName string) error {
+	if deckName != "" {
+		if err := checkDeckExists(db, deckName); err != nil {
+			return err
+		}
+	}
+	cards, _, err := GetAllCards(db, CardFilter{Deck: deckName}, ListOptions{Sort: "created", Limit: -1})
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp("", "simple-anki-*.anki2")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	if err := writeAnkiCollection(tmp.Name(), cards); err != nil {
+		return err
+	}
+
+	zw := zip.NewWriter(w)
+	f, err := zw.Create("collection.anki2")
+	if err != nil {
+		return err
+	}
+	collection, err := os.Open(tmp.Name())
+	if err != nil {
+		return err
+	}
+	defer collection.Close()
+	if _, err := io.Copy(f, collection); err != nil {
+		return err
+	}
+	media, err := zw.Create("media")
+	if err != nil {
+		return err
+	}
+	if _, err := media.Write([]byte("{}")); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func writeAnkiCollection(path string, cards []Card) error {
+	adb, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return err
+	}
+	defer adb.Close()
+
+	if _, err := adb.Exec(ankiSchema); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	crt := studyDayStart(now)
+	idBase := now.UnixMilli()
+
+	// Anki decks, parents included, keyed by name
+	deckIDs := map[string]int64{"Default": ankiDefaultDeckID}
+	for _, card := range cards {
+		parts := strings.Split(card.DeckName, DeckSeparator)
+		for i := range parts {
+			name := strings.Join(parts[:i+1], DeckSeparator)
+			if _, ok := deckIDs[name]; !ok {
+				deckIDs[name] = idBase + int64(len(deckIDs))
+			}
+		}
+	}
+
+	decks := make(map[string]any)
+	for name, id := range deckIDs {
+		decks[strconv.FormatInt(id, 10)] = map[string]any{
+			"id": id, "name": name, "mod": now.Unix(), "usn": -1, "desc": "", "dyn": 0, "conf": 1,
+			"collapsed": false, "extendNew": 0, "extendRev": 0,
+			"newToday": []int{0, 0}, "revToday": []int{0, 0}, "lrnToday": []int{0, 0}, "timeToday": []int{0, 0},
+		}
+	}
+	models := map[string]any{
+		strconv.Itoa(ankiExportModelID): map[string]any{
+			"id": ankiExportModelID, "name": "Simple Anki Basic", "type": 0, "mod": now.Unix(), "usn": -1,
+			"sortf": 0, "did": ankiDefaultDeckID, "css": ankiExportModelCSS, "tags": []string{}, "vers": []any{},
+			"latexPre":  "\\documentclass[12pt]{article}\n\\special{papersize=3in,5in}\n\\usepackage[utf8]{inputenc}\n\\usepackage{amssymb,amsmath}\n\\pagestyle{empty}\n\\setlength{\\parindent}{0in}\n\\begin{document}\n",
+			"latexPost": "\\end{document}",
+			"req":       []any{[]any{0, "any", []int{0}}},
+			"flds": []map[string]any{
+				{"name": "Front", "ord": 0, "sticky": false, "rtl": false, "font": "Arial", "size": 20, "media": []any{}},
+				{"name": "Back", "ord": 1, "sticky": false, "rtl": false, "font": "Arial", "size": 20, "media": []any{}},
+			},
+			"tmpls": []map[string]any{{
+				"name": "Card 1", "ord": 0, "did": nil, "bqfmt": "", "bafmt": "",
+				"qfmt": "{{Front}}", "afmt": "{{FrontSide}}\n\n<hr id=answer>\n\n{{Back}}",
+			}},
+		},
+	}
+	dconf := map[string]any{
+		"1": map[string]any{
+			"id": 1, "name": "Default", "mod": 0, "usn": 0, "maxTaken": 60, "autoplay": true, "timer": 0,
+			"replayq": true, "dyn": false,
+			"new":   map[string]any{"bury": true, "delays": []int{1, 10}, "initialFactor": 2500, "ints": []int{1, 4, 7}, "order": 1, "perDay": 20, "separate": true},
+			"lapse": map[string]any{"delays": []int{10}, "leechAction": 0, "leechFails": 8, "minInt": 1, "mult": 0},
+			"rev":   map[string]any{"bury": true, "ease4": 1.3, "fuzz": 0.05, "ivlFct": 1, "maxIvl": 36500, "minSpace": 1, "perDay": 100},
+		},
+	}
+	conf := map[string]any{
+		"activeDecks": []int{ankiDefaultDeckID}, "curDeck": ankiDefaultDeckID, "newSpread": 0, "collapseTime": 1200,
+		"timeLim": 0, "estTimes": true, "dueCounts": true, "curModel": nil, "nextPos": len(cards) + 1,
+		"sortType": "noteFld", "sortBackwards": false, "addToCur": true,
+	}
+
+	var colJSON [4][]byte
+	for i, v := range []any{conf, models, decks, dconf} {
+		if colJSON[i], err = json.Marshal(v); err != nil {
+			return err
+		}
+	}
+
+	tx, err := adb.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		`INSERT INTO col VALUES (1, ?, ?, ?, 11, 0, 0, 0, ?, ?, ?, ?, '{}')`,
+		crt.Unix(), now.UnixMilli(), now.UnixMilli(),
+		string(colJSON[0]), string(colJSON[1]), string(colJSON[2]), string(colJSON[3]),
+	)
+	if err != nil {
+		return err
+	}
+
+	for i, card := range cards {
+		id := idBase + int64(i)
+		front, back := textToHTML(card.Front), textToHTML(card.Back)
+		tags := ""
+		if len(card.Tags) > 0 {
+			tags = " " + strings.Join(card.Tags, " ") + " "
+		}
+
+		_, err := tx.Exec(
+			`INSERT INTO notes VALUES (?, ?, ?, ?, -1, ?, ?, ?, ?, 0, '')`,
+			id, ankiGUID(card), ankiExportModelID, now.Unix(), tags,
+			front+"\x1f"+back, card.Front, ankiChecksum(card.Front),
+		)
+		if err != nil {
+			return err
+		}
+
+		cardType, queue, due, factor, left := ankiTypeNew, 0, int64(i+1), 0, 0
+		switch card.State {
+		case StateLearning, StateRelearning:
+			cardType, queue, due, left = ankiTypeLearning, 1, card.NextReview.Unix(), ankiLeftOneStep
+			if card.State == StateRelearning {
+				cardType = ankiTypeRelearning
+			}
+		case StateReview:
+			cardType, queue = ankiTypeReview, 2
+			due = int64(math.Round(studyDayStart(card.NextReview).Sub(crt).Hours() / 24))
+		}
+		if card.State != StateNew {
+			factor = int(math.Round(card.Ease * 1000))
+		}
+		if card.Suspended {
+			queue = ankiQueueSuspended
+		} else if card.BuriedUntil != nil && card.BuriedUntil.After(now) {
+			queue = ankiQueueBuried
+		}
+
+		_, err = tx.Exec(
+			`INSERT INTO cards VALUES (?, ?, ?, 0, ?, -1, ?, ?, ?, ?, ?, 0, ?, ?, 0, 0, 0, '')`,
+			id, id, deckIDs[card.DeckName], now.Unix(), cardType, queue, due, card.Interval, factor,
+			card.Lapses, left,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// textToHTML turns plain card text into an Anki field.
+func textToHTML(s string) string {
+	return strings.ReplaceAll(html.EscapeString(s), "\n", "<br>")
+}
+
+// ankiGUID gives a card a stable note GUID, so exporting the same card
+// again updates the note in Anki instead of adding another.
+func ankiGUID(card Card) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("simple-anki:%d:%s", card.ID, card.CreatedAt.UTC().Format(time.RFC3339))))
+	return base64.RawURLEncoding.EncodeToString(sum[:8])
+}
+
+// ankiChecksum is Anki's note checksum: the first 8 hex digits of the SHA-1
+// of the sort field.
+func ankiChecksum(field string) int64 {
+	sum := sha1.Sum([]byte(field))
+	n, _ := strconv.ParseInt(hex.EncodeToString(sum[:4]), 16, 64)
+	return n
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestWriteApkgRoundTrip(t *testing.T) {
+	db := openTestCollection(t)
+	now := time.Now()
+	due := dueAfterDays(now, 10)
+	cards := []*Card{
+		{DeckName: "Spanish", Front: "hola", Back: "hello\n<b>hi</b> & bye", Tags: []string{"greeting"}},
+		{DeckName: "Spanish::Verbs", Front: "comer", Back: "to eat"},
+		{DeckName: "Spanish", Front: "perro", Back: "dog"},
+		{DeckName: "French", Front: "bonjour", Back: "hello"},
+	}
+	for _, c := range cards {
+		if err := CreateCard(db, c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A review card and a suspended one
+	cards[1].State, cards[1].Interval, cards[1].Ease, cards[1].NextReview, cards[1].Lapses = StateReview, 10, 2.6, due, 2
+	cards[2].Suspended = true
+	for _, c := range cards[1:3] {
+		if err := updateCard(db, c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := WriteApkg(db, &buf, "Spanish"); err != nil {
+		t.Fatal(err)
+	}
+	imported, err := parseApkg(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string]ImportCard{}
+	for _, c := range imported {
+		got[c.Front] = c
+	}
+	if len(imported) != 3 || len(got) != 3 {
+		t.Fatalf("exported %d cards, want the 3 in Spanish: %+v", len(imported), imported)
+	}
+	for _, c := range cards[:3] {
+		g, ok := got[c.Front]
+		if !ok {
+			t.Errorf("%s wasn't exported", c.Front)
+			continue
+		}
+		if g.Back != c.Back || g.Deck != c.DeckName || !slices.Equal(g.Tags, c.Tags) {
+			t.Errorf("%s came back as %q in %s tagged %q", c.Front, g.Back, g.Deck, g.Tags)
+		}
+		if g.State != c.State || g.Suspended != c.Suspended || g.Lapses != c.Lapses {
+			t.Errorf("%s came back %s, suspended %v, %d lapses", c.Front, g.State, g.Suspended, g.Lapses)
+		}
+	}
+	if g := got["comer"]; g.Interval != 10 || g.Ease != 2.6 || !g.NextReview.Equal(due) {
+		t.Errorf("review card came back with an interval of %d days, ease %v, due %v, want 10, 2.6, %v",
+			g.Interval, g.Ease, g.NextReview, due)
+	}
+
+	if err := WriteApkg(db, &buf, "German"); !errors.Is(err, ErrDeckNotFound) {
+		t.Errorf("exporting a missing deck = %v, want ErrDeckNotFound", err)
+	}
+}
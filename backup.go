@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// backupVersion is written to every backup; RestoreBackup refuses others.
+const backupVersion = 1
+
+var ErrInvalidBackup = errors.New("invalid backup")
+
+// Backup is a complete copy of the collection: decks and their settings,
+// filtered decks, defined note types, notes, cards with all scheduling state and timestamps,
+// and the review log. Restoring it recreates the collection with the same IDs.
+// Media files are not included, nor are share links, whose tokens belong to
+// the collection they were made in.
+type Backup struct {
+	Version       int                        `json:"version"`
+	CreatedAt     time.Time                  `json:"created_at"`
+	Decks         []Deck                     `json:"decks"`
+	DeckSettings  map[string]json.RawMessage `json:"deck_settings"` // Stored overrides by deck name
+	FilteredDecks []FilteredDeck             `json:"filtered_decks"`
+	NoteTypes     []NoteType                 `json:"note_types"` // Defined ones; built-in types are not included
+	Notes         []Note                     `json:"notes"`
+	Cards         []Card                     `json:"cards"`
+	Reviews       []ReviewLog                `json:"reviews"`
+}
+
+// sqliteTimestamp formats t like SQLite's CURRENT_TIMESTAMP, which is how
+// created_at and updated_at are stored.
+func sqliteTimestamp(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05")
+}
+
+// CreateBackup reads the whole collection in one transaction.
+func CreateBackup(db *Collection) (*Backup, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	b := &Backup{
+		Version:       backupVersion,
+		CreatedAt:     time.Now(),
+		Decks:         []Deck{},
+		DeckSettings:  make(map[string]json.RawMessage),
+		FilteredDecks: []FilteredDeck{},
+		NoteTypes:     []NoteType{},
+		Notes:         []Note{},
+		Cards:         []Card{},
+		Reviews:       []ReviewLog{},
+	}
+
+	rows, err := tx.Query(`SELECT id, name, created_at FROM decks ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var d Deck
+		if err := rows.Scan(&d.ID, &d.Name, &d.CreatedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		b.Decks = append(b.Decks, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = tx.Query(`SELECT deck_name, settings FROM deck_settings ORDER BY deck_name`)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var name, settings string
+		if err := rows.Scan(&name, &settings); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		b.DeckSettings[name] = json.RawMessage(settings)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = tx.Query(`SELECT name, query, card_limit, card_order FROM filtered_decks ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var fd FilteredDeck
+		if err := rows.Scan(&fd.Name, &fd.Query, &fd.Limit, &fd.Order); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		b.FilteredDecks = append(b.FilteredDecks, fd)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = tx.Query(`SELECT name, fields, templates FROM note_types ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var nt NoteType
+		if err := scanNoteType(rows, &nt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		b.NoteTypes = append(b.NoteTypes, nt)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = tx.Query(`SELECT id, note_type, fields, created_at, updated_at FROM notes ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var n Note
+		var fields string
+		if err := rows.Scan(&n.ID, &n.NoteType, &fields, &n.CreatedAt, &n.UpdatedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(fields), &n.Fields); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		b.Notes = append(b.Notes, n)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = tx.Query(`SELECT ` + cardColumns + ` FROM cards ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	cards, err := scanCards(rows)
+	if err != nil {
+		return nil, err
+	}
+	b.Cards = append(b.Cards, cards...)
+
+	rows, err = tx.Query(`SELECT ` + reviewLogColumns + ` FROM review_log ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var l ReviewLog
+		if err := scanReviewLog(rows, &l); err != nil {
+			return nil, err
+		}
+		b.Reviews = append(b.Reviews, l)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// RestoreBackup replaces the whole collection with the backup in one
+// transaction. Cards, reviews and decks keep their IDs and timestamps. Share
+// links of decks the backup doesn't have are revoked; the others keep
+// showing their deck. A dry run checks that the backup restores cleanly and
+// rolls back.
+func RestoreBackup(db *Collection, b *Backup, dryRun bool) error {
+	if b.Version != backupVersion {
+		return fmt.Errorf("%w: unsupported version %d", ErrInvalidBackup, b.Version)
+	}
+	for name, settings := range b.DeckSettings {
+		var s SchedulerSettings
+		if err := json.Unmarshal(settings, &s); err != nil {
+			return fmt.Errorf("%w: settings of deck %q: %v", ErrInvalidBackup, name, err)
+		}
+	}
+	noteTypes := make(map[string]bool)
+	for _, nt := range builtinNoteTypes {
+		noteTypes[nt.Name] = true
+	}
+	for i := range b.NoteTypes {
+		if err := b.NoteTypes[i].check(); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+		}
+		if noteTypes[b.NoteTypes[i].Name] {
+			return fmt.Errorf("%w: note type %q is listed twice", ErrInvalidBackup, b.NoteTypes[i].Name)
+		}
+		noteTypes[b.NoteTypes[i].Name] = true
+	}
+	for _, n := range b.Notes {
+		if !noteTypes[n.NoteType] {
+			return fmt.Errorf("%w: note %d: %v: %q", ErrInvalidBackup, n.ID, ErrUnknownNoteType, n.NoteType)
+		}
+	}
+	for _, card := range b.Cards {
+		if card.ID <= 0 || card.DeckName == "" || card.Front == "" || card.Back == "" {
+			return fmt.Errorf("%w: card %d needs an id, deck_name, front and back", ErrInvalidBackup, card.ID)
+		}
+		if _, err := normalizeTags(card.Tags); err != nil {
+			return fmt.Errorf("%w: card %d: %v", ErrInvalidBackup, card.ID, err)
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, table := range []string{"cards", "collab_deletions", "notes", "note_types", "review_log", "card_tags", "tags", "deck_settings", "filtered_decks", "decks"} {
+		if _, err := tx.Exec(`DELETE FROM ` + table); err != nil {
+			return err
+		}
+	}
+
+	for _, d := range b.Decks {
+		if _, err := tx.Exec(
+			`INSERT INTO decks (id, name, created_at) VALUES (?, ?, ?)`, d.ID, d.Name, sqliteTimestamp(d.CreatedAt),
+		); err != nil {
+			return fmt.Errorf("%w: deck %q: %v", ErrInvalidBackup, d.Name, err)
+		}
+	}
+	for name, settings := range b.DeckSettings {
+		if err := ensureDeck(tx, name); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`INSERT INTO deck_settings (deck_name, settings) VALUES (?, ?)`, name, string(settings)); err != nil {
+			return err
+		}
+	}
+	for _, fd := range b.FilteredDecks {
+		if err := ensureDeck(tx, fd.Name); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(
+			`INSERT INTO filtered_decks (name, query, card_limit, card_order) VALUES (?, ?, ?, ?)`,
+			fd.Name, fd.Query, fd.Limit, fd.Order,
+		); err != nil {
+			return fmt.Errorf("%w: filtered deck %q: %v", ErrInvalidBackup, fd.Name, err)
+		}
+	}
+
+	for i := range b.NoteTypes {
+		if err := saveNoteType(tx, &b.NoteTypes[i], true); err != nil {
+			return err
+		}
+	}
+	for _, n := range b.Notes {
+		fields, err := json.Marshal(n.Fields)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(
+			`INSERT INTO notes (id, note_type, fields, created_at, updated_at) VALUES (?, ?, ?, ?, ?)`,
+			n.ID, n.NoteType, string(fields), sqliteTimestamp(n.CreatedAt), sqliteTimestamp(n.UpdatedAt),
+		)
+		if err != nil {
+			return fmt.Errorf("%w: note %d: %v", ErrInvalidBackup, n.ID, err)
+		}
+	}
+
+	for _, card := range b.Cards {
+		if err := ensureDeck(tx, card.DeckName); err != nil {
+			return err
+		}
+		_, err := tx.Exec(
+			`INSERT INTO cards (id, deck_name, front, back, ease, interval, next_review, created_at, updated_at,
+			                    state, step, lapses, suspended, buried_until, home_deck, note_id, template, source_url, position)
+			 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			card.ID, card.DeckName, card.Front, card.Back, card.Ease, card.Interval, card.NextReview,
+			sqliteTimestamp(card.CreatedAt), sqliteTimestamp(card.UpdatedAt),
+			card.State, card.Step, card.Lapses, card.Suspended, card.BuriedUntil, card.HomeDeck,
+			card.NoteID, card.Template, card.SourceURL, card.Position,
+		)
+		if err != nil {
+			return fmt.Errorf("%w: card %d: %v", ErrInvalidBackup, card.ID, err)
+		}
+		for _, tag := range card.Tags {
+			if err := addCardTag(tx, card.ID, tag); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, l := range b.Reviews {
+		_, err := tx.Exec(
+			`INSERT INTO review_log (`+reviewLogColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			l.ID, l.CardID, l.Score, l.IntervalBefore, l.IntervalAfter, l.EaseBefore, l.EaseAfter,
+			l.NextReviewBefore, l.NextReviewAfter, l.ReviewedAt, l.TimeTakenMs, l.StateBefore, l.StepBefore,
+			l.suspendedBefore, l.deckBefore, l.homeDeckBefore, l.buriedSiblings, l.leechAdded,
+		)
+		if err != nil {
+			return fmt.Errorf("%w: review %d: %v", ErrInvalidBackup, l.ID, err)
+		}
+	}
+
+	if _, err := tx.Exec(`DELETE FROM deck_shares WHERE deck_name NOT IN (SELECT name FROM decks)`); err != nil {
+		return err
+	}
+
+	if dryRun {
+		return nil
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRestoreBackupRevokesStaleShares(t *testing.T) {
+	db := openTestCollection(t)
+	if _, err := CreateDeck(db, "Spanish"); err != nil {
+		t.Fatal(err)
+	}
+	b, err := CreateBackup(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := CreateDeck(db, "French"); err != nil {
+		t.Fatal(err)
+	}
+	kept, err := CreateDeckShare(db, "Spanish", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked, err := CreateDeckShare(db, "French", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RestoreBackup(db, b, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := getDeckShare(db, `token = ?`, kept.Token); err != nil {
+		t.Errorf("share of a restored deck: %v", err)
+	}
+	if _, err := getDeckShare(db, `token = ?`, revoked.Token); !errors.Is(err, ErrShareNotFound) {
+		t.Errorf("share of a deck gone after restoring = %v, want ErrShareNotFound", err)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// Load balancing evens out the reviews due from day to day. Instead of
+// fuzz picking a random day around a review interval, the day within the
+// same range with the fewest review cards due in the collection is taken,
+// leaving out the deck's easy days unless the range has no other days.
+// Cards already scheduled can be rebalanced the same way.
+
+var ErrInvalidRebalance = errors.New("invalid rebalance")
+
+const (
+	// maxRebalanceDays bounds how far ahead cards can be rebalanced.
+	maxRebalanceDays = 365
+	// defaultRebalanceDays is how far ahead cards are rebalanced, unless
+	// asked otherwise.
+	defaultRebalanceDays = 30
+)
+
+// easyDays returns the weekdays named in EasyDays, or nil if a name is not
+// a weekday.
+func (s SchedulerSettings) easyDays() map[time.Weekday]bool {
+	days := map[time.Weekday]bool{}
+	for _, name := range s.EasyDays {
+		found := false
+		for d := time.Sunday; d <= time.Saturday; d++ {
+			if strings.ToLower(d.String()) == name {
+				days[d] = true
+				found = true
+			}
+		}
+		if !found {
+			return nil
+		}
+	}
+	return days
+}
+
+// balanceReview moves a card just scheduled by scheduleReview without fuzz
+// to the least loaded day within the fuzz range of its interval.
+func balanceReview(q querier, card *Card, settings SchedulerSettings) error {
+	lo, hi := fuzzRange(card.Interval, settings.FuzzPercent)
+	if settings.MaxInterval > 0 && hi > settings.MaxInterval {
+		hi = settings.MaxInterval
+	}
+	if lo >= hi {
+		return nil
+	}
+
+	now := time.Now()
+	load, err := dueLoad(q, now, lo, hi)
+	if err != nil {
+		return err
+	}
+	card.Interval = balancedDay(load, lo, hi, card.Interval, now, settings.easyDays())
+	card.NextReview = dueAfterDays(now, card.Interval)
+	return nil
+}
+
+// dueLoad counts the unsuspended review cards of the collection due on
+// each study day from days from to until from today, by days from today.
+func dueLoad(q querier, now time.Time, from, until int) (map[int]int, error) {
+	rows, err := q.Query(
+		`SELECT next_review FROM cards
+		 WHERE state = 'review' AND suspended = 0 AND next_review >= ? AND next_review < ?`,
+		dueAfterDays(now, from).In(time.Local), dueAfterDays(now, until+1).In(time.Local),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	load := map[int]int{}
+	for rows.Next() {
+		var due time.Time
+		if err := rows.Scan(&due); err != nil {
+			return nil, err
+		}
+		load[daysFromToday(now, due)]++
+	}
+	return load, rows.Err()
+}
+
+// daysFromToday returns how many study days after today's t falls on,
+// counted in calendar dates, which daylight saving leaves alone.
+func daysFromToday(now, t time.Time) int {
+	today, _ := time.Parse("2006-01-02", studyDate(now))
+	date, _ := time.Parse("2006-01-02", studyDate(t))
+	return int(math.Round(date.Sub(today).Hours() / 24))
+}
+
+// balancedDay returns the day from lo to hi with the fewest cards due,
+// nearest to target on ties, leaving out easy days unless all of them are.
+func balancedDay(load map[int]int, lo, hi, target int, now time.Time, easy map[time.Weekday]bool) int {
+	best, bestEasy := -1, false
+	for day := lo; day <= hi; day++ {
+		isEasy := easy[dueAfterDays(now, day).In(dayLocation).Weekday()]
+		switch {
+		case best < 0:
+		case isEasy != bestEasy:
+			if isEasy {
+				continue
+			}
+		case load[day] > load[best]:
+			continue
+		case load[day] == load[best] && distance(day, target) >= distance(best, target):
+			continue
+		}
+		best, bestEasy = day, isEasy
+	}
+	return best
+}
+
+func distance(a, b int) int {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+// Rebalance asks for the review cards of a deck and its subdecks, or of
+// the collection, due over the next Days study days to be rebalanced.
+type Rebalance struct {
+	Deck string `json:"deck"`
+	Days int    `json:"days"` // defaultRebalanceDays if 0
+}
+
+// RebalanceResult is how many cards were moved and the review cards of
+// the collection due on each of the days afterwards.
+type RebalanceResult struct {
+	Moved int          `json:"moved_count"`
+	Days  []DayReviews `json:"days"`
+}
+
+// RebalanceCards moves each selected review card due from tomorrow on to
+// the least loaded day within the fuzz range of its interval around its
+// due date, in the order they are due. A moved card's interval changes by
+// as many days as it moved, so the next interval grows from the actual
+// gap between reviews. Today's cards stay where they are.
+func RebalanceCards(db *Collection, req Rebalance) (*RebalanceResult, error) {
+	if req.Days == 0 {
+		req.Days = defaultRebalanceDays
+	}
+	if req.Days < 1 || req.Days > maxRebalanceDays {
+		return nil, fmt.Errorf("%w: days must be between 1 and %d", ErrInvalidRebalance, maxRebalanceDays)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	where, args := CardFilter{Deck: req.Deck}.where()
+	where = append(where, `state = 'review'`, `suspended = 0`, `next_review >= ?`, `next_review < ?`)
+	args = append(args, dueAfterDays(now, 1).In(time.Local), dueAfterDays(now, req.Days+1).In(time.Local))
+	rows, err := tx.Query(`SELECT id, deck_name, home_deck, interval, next_review FROM cards`+whereClause(where)+` ORDER BY next_review, id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	type rebalanced struct {
+		id, interval, day, lo, hi int
+		easy                      map[time.Weekday]bool
+	}
+	var cards []rebalanced
+	settingsByDeck := map[string]SchedulerSettings{}
+	last := req.Days
+	for rows.Next() {
+		var c rebalanced
+		var deck, home string
+		var due time.Time
+		if err := rows.Scan(&c.id, &deck, &home, &c.interval, &due); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if home != "" {
+			deck = home
+		}
+		settings, ok := settingsByDeck[deck]
+		if !ok {
+			if settings, err = getDeckSettings(tx, deck); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			settingsByDeck[deck] = settings
+		}
+
+		lo, hi := fuzzRange(c.interval, settings.FuzzPercent)
+		if settings.MaxInterval > 0 && hi > settings.MaxInterval {
+			hi = settings.MaxInterval
+		}
+		c.day = daysFromToday(now, due)
+		c.lo, c.hi = c.day-(c.interval-lo), c.day+(hi-c.interval)
+		if c.lo < 1 {
+			c.lo = 1
+		}
+		if c.hi > last {
+			last = c.hi
+		}
+		c.easy = settings.easyDays()
+		cards = append(cards, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	load, err := dueLoad(tx, now, 1, last)
+	if err != nil {
+		return nil, err
+	}
+	result := &RebalanceResult{}
+	for _, c := range cards {
+		if c.lo >= c.hi {
+			continue
+		}
+		load[c.day]--
+		day := balancedDay(load, c.lo, c.hi, c.day, now, c.easy)
+		load[day]++
+		if day == c.day {
+			continue
+		}
+
+		interval := c.interval + day - c.day
+		if interval < 1 {
+			interval = 1
+		}
+		if _, err := tx.Exec(`UPDATE cards SET interval = ?, next_review = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?`,
+			interval, dueAfterDays(now, day).In(time.Local), c.id); err != nil {
+			return nil, err
+		}
+		result.Moved++
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	result.Days = []DayReviews{}
+	for day := 1; day <= req.Days; day++ {
+		result.Days = append(result.Days, DayReviews{Date: studyDate(dueAfterDays(now, day)), Count: load[day]})
+	}
+	return result, nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// Basic auth is a lighter alternative to accounts for a single user who
+// reaches the server over Tailscale or through a reverse proxy: every
+// request needs the user name and password of -auth, or of the
+// SIMPLE_ANKI_AUTH environment variable, which keeps the password out of
+// the process list. Quick add is left to its own token, as browser
+// extensions send that in the same Authorization header, and shared decks
+// to theirs.
+
+// basicAuth is the user:password every request needs, empty without basic
+// auth, set from -auth in main.
+var basicAuth = ""
+
+// requireBasicAuth wraps the routes in basic auth, if it is on.
+func requireBasicAuth(next http.Handler) http.Handler {
+	if basicAuth == "" {
+		return next
+	}
+	user, password, _ := strings.Cut(basicAuth, ":")
+	// Comparing hashes keeps the time taken from giving away the lengths
+	wantUser, wantPassword := sha256.Sum256([]byte(user)), sha256.Sum256([]byte(password))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/quickadd" || sharedPagePaths[r.URL.Path] || strings.HasPrefix(r.URL.Path, "/api/shared/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		givenUser, givenPassword, _ := r.BasicAuth()
+		u, p := sha256.Sum256([]byte(givenUser)), sha256.Sum256([]byte(givenPassword))
+		if subtle.ConstantTimeCompare(u[:], wantUser[:])&subtle.ConstantTimeCompare(p[:], wantPassword[:]) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="simple-anki", charset="UTF-8"`)
+			respondError(w, "Login required", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+var (
+	ErrEmptySelection = errors.New("select cards with ids, deck, tag or query")
+	ErrMoveToFiltered = errors.New("cards cannot be moved into a filtered deck")
+	ErrInvalidReplace = errors.New("invalid find and replace")
+)
+
+// CardSelection picks the cards a bulk operation applies to. Its criteria
+// are ANDed; Query is an Anki-style search (see SearchQuery). An empty
+// selection is rejected rather than taken to mean every card.
+type CardSelection struct {
+	IDs   []int  `json:"ids"`
+	Deck  string `json:"deck"`
+	Tag   string `json:"tag"`
+	Query string `json:"query"`
+}
+
+// where returns the conditions on the cards table matching the selection.
+func (s CardSelection) where() ([]string, []any, error) {
+	if len(s.IDs) == 0 && s.Deck == "" && s.Tag == "" && strings.TrimSpace(s.Query) == "" {
+		return nil, nil, ErrEmptySelection
+	}
+
+	where, args := CardFilter{Deck: s.Deck, Tag: s.Tag}.where()
+	if len(s.IDs) > 0 {
+		where = append(where, `id IN (?`+strings.Repeat(`, ?`, len(s.IDs)-1)+`)`)
+		for _, id := range s.IDs {
+			args = append(args, id)
+		}
+	}
+	parsed, err := ParseQuery(s.Query)
+	if err != nil {
+		return nil, nil, err
+	}
+	if parsed.where != "" {
+		where = append(where, parsed.where)
+		args = append(args, parsed.args...)
+	}
+	return where, args, nil
+}
+
+// DeleteCards deletes the selected cards in one transaction and returns how
+// many there were. A dry run only counts them.
+func DeleteCards(db *Collection, sel CardSelection, dryRun bool) (int, error) {
+	where, args, err := sel.where()
+	if err != nil {
+		return 0, err
+	}
+	cond := strings.Join(where, ` AND `)
+
+	if dryRun {
+		var count int
+		err := db.QueryRow(`SELECT COUNT(*) FROM cards WHERE `+cond, args...).Scan(&count)
+		return count, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`DELETE FROM cards WHERE `+cond, args...)
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return int(n), nil
+}
+
+// MoveCards moves the selected cards to deck in one transaction and returns
+// how many were moved. Cards taken out of a filtered deck lose their home
+// deck, so they stay where they were put.
+func MoveCards(db *Collection, sel CardSelection, deck string) (int, error) {
+	where, args, err := sel.where()
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := getFilteredDeck(tx, deck); err == nil {
+		return 0, ErrMoveToFiltered
+	} else if !errors.Is(err, ErrDeckNotFound) {
+		return 0, err
+	}
+	if err := ensureDeck(tx, deck); err != nil {
+		return 0, err
+	}
+
+	result, err := tx.Exec(
+		`UPDATE cards SET deck_name = ?, home_deck = '', updated_at = CURRENT_TIMESTAMP
+		 WHERE `+strings.Join(where, ` AND `),
+		append([]any{deck}, args...)...,
+	)
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return int(n), nil
+}
+
+// Replacement is a find and replace over card text. With Regex set, Find is
+// a Go regular expression and Replace may refer to its groups as $1 or
+// ${name}; otherwise both are plain text.
+type Replacement struct {
+	Find    string   `json:"find"`
+	Replace string   `json:"replace"`
+	Regex   bool     `json:"regex"`
+	Fields  []string `json:"fields"` // "front" and/or "back", both by default
+}
+
+// CardChange is a card whose text a replacement changes, with its text
+// before and after.
+type CardChange struct {
+	ID       int    `json:"id"`
+	DeckName string `json:"deck_name"`
+	Front    string `json:"front"`
+	Back     string `json:"back"`
+	NewFront string `json:"new_front"`
+	NewBack  string `json:"new_back"`
+}
+
+// compile returns a function applying the replacement to one field.
+func (rep Replacement) compile() (front, back func(string) string, err error) {
+	if rep.Find == "" {
+		return nil, nil, fmt.Errorf("%w: find is required", ErrInvalidReplace)
+	}
+
+	replace := func(s string) string { return strings.ReplaceAll(s, rep.Find, rep.Replace) }
+	if rep.Regex {
+		re, err := regexp.Compile(rep.Find)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %v", ErrInvalidReplace, err)
+		}
+		replace = func(s string) string { return re.ReplaceAllString(s, rep.Replace) }
+	}
+
+	keep := func(s string) string { return s }
+	front, back = keep, keep
+	fields := rep.Fields
+	if len(fields) == 0 {
+		fields = []string{"front", "back"}
+	}
+	for _, field := range fields {
+		switch field {
+		case "front":
+			front = replace
+		case "back":
+			back = replace
+		default:
+			return nil, nil, fmt.Errorf("%w: unknown field %q", ErrInvalidReplace, field)
+		}
+	}
+	return front, back, nil
+}
+
+// ReplaceInCards applies a find and replace to the selected cards in one
+// transaction and returns the cards it changed. A dry run only reports the
+// changes.
+func ReplaceInCards(db *Collection, sel CardSelection, rep Replacement, dryRun bool) ([]CardChange, error) {
+	front, back, err := rep.compile()
+	if err != nil {
+		return nil, err
+	}
+	where, args, err := sel.where()
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT `+cardColumns+` FROM cards WHERE `+strings.Join(where, ` AND `)+` ORDER BY id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	cards, err := scanCards(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := []CardChange{}
+	for _, card := range cards {
+		change := CardChange{
+			ID:       card.ID,
+			DeckName: card.DeckName,
+			Front:    card.Front,
+			Back:     card.Back,
+			NewFront: front(card.Front),
+			NewBack:  back(card.Back),
+		}
+		if change.NewFront == card.Front && change.NewBack == card.Back {
+			continue
+		}
+		if change.NewFront == "" || change.NewBack == "" {
+			return nil, fmt.Errorf("%w: card %d would be left without a front or back", ErrInvalidReplace, card.ID)
+		}
+		changes = append(changes, change)
+
+		if dryRun {
+			continue
+		}
+		if card.NoteID != nil {
+			// The note's other cards follow
+			card.Front, card.Back = change.NewFront, change.NewBack
+			if err := editNoteCard(tx, &card); err != nil {
+				return nil, fmt.Errorf("card %d: %w", card.ID, err)
+			}
+			continue
+		}
+		_, err := tx.Exec(
+			`UPDATE cards SET front = ?, back = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?`,
+			change.NewFront, change.NewBack, card.ID,
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if dryRun {
+		return changes, nil
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// TagCards adds and removes tags on the selected cards in one transaction
+// and returns how many cards had their tags changed. Removal only matches
+// the exact tag, not its child tags.
+func TagCards(db *Collection, sel CardSelection, add, remove []string) (int, error) {
+	add, err := normalizeTags(add)
+	if err != nil {
+		return 0, err
+	}
+	remove, err = normalizeTags(remove)
+	if err != nil {
+		return 0, err
+	}
+	where, args, err := sel.where()
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT `+cardColumns+` FROM cards WHERE `+strings.Join(where, ` AND `), args...)
+	if err != nil {
+		return 0, err
+	}
+	cards, err := scanCards(rows)
+	if err != nil {
+		return 0, err
+	}
+
+	changed := 0
+	for _, card := range cards {
+		cardChanged := false
+		for _, tag := range add {
+			if slices.Contains(card.Tags, tag) {
+				continue
+			}
+			if err := addCardTag(tx, card.ID, tag); err != nil {
+				return 0, err
+			}
+			cardChanged = true
+		}
+		for _, tag := range remove {
+			if !slices.Contains(card.Tags, tag) {
+				continue
+			}
+			_, err := tx.Exec(
+				`DELETE FROM card_tags WHERE card_id = ? AND tag_id IN (SELECT id FROM tags WHERE name = ?)`,
+				card.ID, tag,
+			)
+			if err != nil {
+				return 0, err
+			}
+			cardChanged = true
+		}
+		if cardChanged {
+			changed++
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return changed, nil
+}
+
+var ErrInvalidReposition = errors.New("invalid reposition")
+
+// Reposition places new cards at positions Start, Start+Step and so on,
+// in their current order or, with Randomize, shuffled. With Shift, the
+// other new cards from Start on move back to make room.
+type Reposition struct {
+	Start     int  `json:"start"`
+	Step      int  `json:"step"` // 1 if 0
+	Randomize bool `json:"randomize"`
+	Shift     bool `json:"shift"`
+}
+
+// RepositionCards sets the positions of the selected new cards in one
+// transaction and returns how many were repositioned. Cards that are not
+// new are left alone, as positions only order new cards.
+func RepositionCards(db *Collection, sel CardSelection, rep Reposition) (int, error) {
+	if rep.Step == 0 {
+		rep.Step = 1
+	}
+	if rep.Start < 1 || rep.Step < 1 {
+		return 0, fmt.Errorf("%w: start and step must be at least 1", ErrInvalidReposition)
+	}
+	where, args, err := sel.where()
+	if err != nil {
+		return 0, err
+	}
+	where = append(where, `state = 'new'`)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	orderBy := `position, id`
+	if rep.Randomize {
+		orderBy = `random()`
+	}
+	rows, err := tx.Query(`SELECT id FROM cards WHERE `+strings.Join(where, ` AND `)+` ORDER BY `+orderBy, args...)
+	if err != nil {
+		return 0, err
+	}
+	var ids []any
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	if rep.Shift {
+		_, err := tx.Exec(
+			`UPDATE cards SET position = position + ? WHERE state = 'new' AND position >= ?
+			 AND id NOT IN (?`+strings.Repeat(`, ?`, len(ids)-1)+`)`,
+			append([]any{len(ids) * rep.Step, rep.Start}, ids...)...,
+		)
+		if err != nil {
+			return 0, err
+		}
+	}
+	for i, id := range ids {
+		if _, err := tx.Exec(`UPDATE cards SET position = ? WHERE id = ?`, rep.Start+i*rep.Step, id); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return len(ids), nil
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Cloze notes hold a text with deletions marked the way Anki marks them,
+// {{c1::answer}} or {{c1::answer::hint}}. Each cloze number gives a card
+// whose front hides that number's deletions and whose back reveals them;
+// deletions of other numbers are shown on both. Like image occlusion, the
+// cards come from the note rather than from templates: a card's Template
+// is the index of its cloze number, counting the numbers in the text in
+// ascending order.
+
+// noteKindCloze marks the cloze note type.
+const noteKindCloze = "cloze"
+
+// clozeNoteType is the name of the cloze note type.
+const clozeNoteType = "Cloze"
+
+var ErrInvalidCloze = errors.New("invalid cloze request")
+
+// clozeNumbers returns the distinct cloze numbers of text in ascending
+// order.
+func clozeNumbers(text string) []int {
+	seen := make(map[int]bool)
+	var numbers []int
+	for _, m := range clozePattern.FindAllStringSubmatch(text, -1) {
+		n, err := strconv.Atoi(m[1])
+		if err == nil && n > 0 && !seen[n] {
+			seen[n] = true
+			numbers = append(numbers, n)
+		}
+	}
+	sort.Ints(numbers)
+	return numbers
+}
+
+// clozeMarkdown gives the Markdown of a side of the card for cloze number
+// n: its deletions in bold, as "[...]" (or the hint) unless revealed.
+func clozeMarkdown(text string, n int, reveal bool) string {
+	return clozePattern.ReplaceAllStringFunc(text, func(m string) string {
+		parts := clozePattern.FindStringSubmatch(m)
+		switch {
+		case parts[1] != strconv.Itoa(n):
+			return parts[2]
+		case reveal:
+			return "**" + parts[2] + "**"
+		case parts[3] != "":
+			return "**[" + parts[3] + "]**"
+		}
+		return "**[...]**"
+	})
+}
+
+// clozeCards returns the front and back of each card of a cloze note, one
+// per cloze number.
+func clozeCards(fields map[string]string) ([][2]string, error) {
+	text := strings.TrimSpace(fields["Text"])
+	numbers := clozeNumbers(text)
+	if len(numbers) == 0 {
+		return nil, fmt.Errorf("%w: Text needs at least one cloze deletion, like {{c1::answer}}", ErrInvalidNote)
+	}
+
+	extra := strings.TrimSpace(fields["Back Extra"])
+	cards := make([][2]string, len(numbers))
+	for i, n := range numbers {
+		back := clozeMarkdown(text, n, true)
+		if extra != "" {
+			back += "\n\n" + extra
+		}
+		cards[i] = [2]string{clozeMarkdown(text, n, false), back}
+	}
+	return cards, nil
+}
+
+// clozeHTML renders the card of a cloze note at index.
+func clozeHTML(fields map[string]string, index int) (string, string, error) {
+	cards, err := clozeCards(fields)
+	if err != nil {
+		return "", "", err
+	}
+	if index >= len(cards) {
+		return "", "", fmt.Errorf("%w: note has no cloze %d", ErrInvalidNote, index+1)
+	}
+	return renderMarkdown(cards[index][0]), renderMarkdown(cards[index][1]), nil
+}
+
+// ClozeSuggestion is a sentence with suggested cloze deletions, ready to
+// be saved as the Text of a cloze note.
+type ClozeSuggestion struct {
+	Text   string   `json:"text"`
+	Clozes []string `json:"clozes"` // The deleted text, by cloze number
+	Method string   `json:"method"`
+}
+
+const (
+	ClozeHeuristic = "heuristic"
+	ClozeLLM       = "llm"
+)
+
+// maxClozeText bounds the text clozes are suggested for.
+const maxClozeText = 10_000
+
+// SuggestClozes marks cloze deletions in text, either by the heuristics
+// below or by asking the LLM.
+func SuggestClozes(ctx context.Context, text, method string) (*ClozeSuggestion, error) {
+	text = strings.TrimSpace(text)
+	switch {
+	case text == "":
+		return nil, fmt.Errorf("%w: text is required", ErrInvalidCloze)
+	case len(text) > maxClozeText:
+		return nil, fmt.Errorf("%w: text is longer than %d characters", ErrInvalidCloze, maxClozeText)
+	case clozePattern.MatchString(text):
+		return nil, fmt.Errorf("%w: text already has cloze deletions", ErrInvalidCloze)
+	}
+
+	var marked string
+	switch method {
+	case "", ClozeHeuristic:
+		method = ClozeHeuristic
+		marked = heuristicClozes(text)
+	case ClozeLLM:
+		var err error
+		if marked, err = llmClozes(ctx, text); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("%w: method must be %q or %q", ErrInvalidCloze, ClozeHeuristic, ClozeLLM)
+	}
+
+	suggestion := &ClozeSuggestion{Text: marked, Clozes: []string{}, Method: method}
+	for _, n := range clozeNumbers(marked) {
+		var deleted []string
+		for _, m := range clozePattern.FindAllStringSubmatch(marked, -1) {
+			if m[1] == strconv.Itoa(n) {
+				deleted = append(deleted, m[2])
+			}
+		}
+		suggestion.Clozes = append(suggestion.Clozes, strings.Join(deleted, ", "))
+	}
+	return suggestion, nil
+}
+
+// The heuristics look for the facts a sentence is usually learnt for, in
+// this order: text set in bold, dates, numbers with their units, and
+// names. Code spans and math are left alone.
+var (
+	clozeBold   = regexp.MustCompile(`\*\*([^*]+)\*\*`)
+	clozeDate   = regexp.MustCompile(`\b(?:\d{1,2}(?:st|nd|rd|th)? )?(?:January|February|March|April|May|June|July|August|September|October|November|December)(?: \d{1,2}(?:st|nd|rd|th)?,?)?(?: \d{3,4})?\b|\b\d{4}-\d{2}-\d{2}\b|\b\d{1,2}/\d{1,2}/\d{2,4}\b`)
+	clozeNumber = regexp.MustCompile(`\b\d+(?:[.,]\d+)*(?: ?%| (?:percent|thousand|million|billion|trillion|BC|BCE|AD|CE|km|m|cm|mm|kg|g|mg|l|ml|years?|days?|hours?|minutes?|seconds?)\b| ?°[CF])?`)
+	clozeName   = regexp.MustCompile(`\b\p{Lu}[\p{L}'’-]*(?:(?: (?:of|the|de|la|von|van|der|da|del|y))* \p{Lu}[\p{L}'’-]*)*`)
+	clozeSkip   = regexp.MustCompile("`[^`]*`|\\$[^$]*\\$|\\\\\\(.*?\\\\\\)")
+	clozeWord   = regexp.MustCompile(`\p{L}{6,}`)
+)
+
+// sentenceStart reports whether the text before i ends a sentence, so a
+// capital at i does not make a name.
+func sentenceStart(text string, i int) bool {
+	before := strings.TrimRight(text[:i], " \t\n\"'(“")
+	return before == "" || strings.HasSuffix(before, ".") || strings.HasSuffix(before, "!") ||
+		strings.HasSuffix(before, "?") || strings.HasSuffix(before, ":")
+}
+
+// heuristicClozes marks each likely fact in text as a cloze of its own.
+// Text without any gets its longest word deleted.
+func heuristicClozes(text string) string {
+	type span struct{ start, end, inner, innerEnd int }
+	var spans []span
+	taken := func(start, end int) bool {
+		for _, s := range spans {
+			if start < s.end && s.start < end {
+				return true
+			}
+		}
+		return false
+	}
+	// Code and math take their place without being deleted
+	var skipped []span
+	for _, loc := range clozeSkip.FindAllStringIndex(text, -1) {
+		skipped = append(skipped, span{loc[0], loc[1], -1, -1})
+	}
+	spans = append(spans, skipped...)
+
+	add := func(re *regexp.Regexp, names bool) {
+		for _, loc := range re.FindAllStringSubmatchIndex(text, -1) {
+			start, end := loc[0], loc[1]
+			if taken(start, end) {
+				continue
+			}
+			if names {
+				// A lone capitalized word opening a sentence is not a name
+				if sentenceStart(text, start) && !strings.Contains(text[start:end], " ") {
+					continue
+				}
+			}
+			inner, innerEnd := start, end
+			if len(loc) > 2 && loc[2] >= 0 {
+				inner, innerEnd = loc[2], loc[3]
+			}
+			spans = append(spans, span{start, end, inner, innerEnd})
+		}
+	}
+	add(clozeBold, false)
+	add(clozeDate, false)
+	add(clozeNumber, false)
+	add(clozeName, true)
+
+	if len(spans) == len(skipped) {
+		var longest []int
+		for _, loc := range clozeWord.FindAllStringIndex(text, -1) {
+			if !taken(loc[0], loc[1]) && (longest == nil ||
+				utf8.RuneCountInString(text[loc[0]:loc[1]]) > utf8.RuneCountInString(text[longest[0]:longest[1]])) {
+				longest = loc
+			}
+		}
+		if longest == nil {
+			return "{{c1::" + text + "}}"
+		}
+		spans = append(spans, span{longest[0], longest[1], longest[0], longest[1]})
+	}
+
+	sort.Slice(spans, func(i, j int) bool { return spans[i].start < spans[j].start })
+	var b strings.Builder
+	last, n := 0, 0
+	for _, s := range spans {
+		if s.inner < 0 {
+			continue
+		}
+		n++
+		b.WriteString(text[last:s.start])
+		fmt.Fprintf(&b, "{{c%d::%s}}", n, text[s.inner:s.innerEnd])
+		last = s.end
+	}
+	b.WriteString(text[last:])
+	return b.String()
+}
+
+const clozePrompt = `You turn text into cloze deletion flashcards. Mark the key terms, names, numbers and dates worth remembering in the user's text as Anki cloze deletions: {{c1::term}}, {{c2::other term}} and so on, one number per deletion. Deletions that only make sense together may share a number. Do not delete filler words, and leave enough of the text that each deletion can be recalled from what is left.
+
+Keep the text otherwise exactly as it is: do not rephrase, fix or translate it.
+
+Answer with a JSON object: {"text": "the text with cloze deletions"}`
+
+// llmClozes has the LLM mark cloze deletions in text, checking it left the
+// text itself unchanged.
+func llmClozes(ctx context.Context, text string) (string, error) {
+	var answer struct {
+		Text string `json:"text"`
+	}
+	if err := llmChat(ctx, clozePrompt, text, &answer); err != nil {
+		return "", err
+	}
+	marked := strings.TrimSpace(answer.Text)
+	if len(clozeNumbers(marked)) == 0 {
+		return "", fmt.Errorf("%w: model marked no cloze deletions", ErrLLM)
+	}
+	unmarked := clozePattern.ReplaceAllString(marked, "$2")
+	if strings.Join(strings.Fields(unmarked), " ") != strings.Join(strings.Fields(text), " ") {
+		return "", fmt.Errorf("%w: model changed the text instead of only marking it", ErrLLM)
+	}
+	return marked, nil
+}
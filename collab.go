@@ -0,0 +1,739 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// With accounts, the owner of a deck can let other accounts edit it. The
+// content of its cards (front, back and tags) is then kept in the accounts
+// database, apart from the collections, while every member studies a copy
+// of the cards in their own collection with its own scheduling. A member's
+// collection is synced with the shared content on each of their API
+// requests: new cards in the deck, edits and deletions go to the shared
+// content, and those of the other members come back. A card is known by its
+// collab_id in every collection; when two members edit the same card
+// between syncs, the first edit to be synced wins.
+
+var (
+	ErrInvalidCollaborator  = errors.New("invalid collaborator")
+	ErrCollaboratorNotFound = errors.New("collaborator not found")
+	ErrCollaborationExists  = errors.New("deck overlaps a shared deck")
+	ErrNotDeckOwner         = errors.New("only the deck's owner can add and remove collaborators")
+)
+
+// Collaborator is an account taking part in editing a deck. The owner is
+// one of them.
+type Collaborator struct {
+	ID        int       `json:"id"`
+	Deck      string    `json:"deck"` // The deck's name in the collection of the account asking
+	Username  string    `json:"username"`
+	Role      string    `json:"role"` // "owner" or "editor"
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// membership is an account's part in a collaboration.
+type membership struct {
+	id              int
+	collaborationID int
+	ownerID         int
+	deckName        string // Where the account keeps the deck
+	seq             int    // The collaboration's seq
+}
+
+// collabCard is the shared content of a card. version is the collaboration's
+// seq when it was last changed.
+type collabCard struct {
+	id       string
+	subdeck  string // Deck relative to the shared deck, "" or "::Sub"
+	front    string
+	back     string
+	tags     string
+	editorID int
+	version  int
+	deleted  bool
+}
+
+// createCollaborationTables adds the collaboration tables to the accounts
+// database.
+func createCollaborationTables(a *Accounts) error {
+	_, err := a.Exec(`
+	CREATE TABLE IF NOT EXISTS collaborations (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		owner_id INTEGER NOT NULL,
+		seq INTEGER NOT NULL DEFAULT 0,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS collaborators (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		collaboration_id INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,
+		deck_name TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE(collaboration_id, user_id)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_collaborators_user ON collaborators(user_id);
+
+	CREATE TABLE IF NOT EXISTS collab_cards (
+		id TEXT PRIMARY KEY,
+		collaboration_id INTEGER NOT NULL,
+		subdeck TEXT NOT NULL,
+		front TEXT NOT NULL,
+		back TEXT NOT NULL,
+		tags TEXT NOT NULL,
+		editor_id INTEGER NOT NULL,
+		version INTEGER NOT NULL,
+		deleted INTEGER NOT NULL DEFAULT 0
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_collab_cards_collaboration ON collab_cards(collaboration_id);
+	`)
+	return err
+}
+
+// memberships returns the collaborations an account takes part in.
+func (a *Accounts) memberships(userID int) ([]membership, error) {
+	rows, err := a.Query(
+		`SELECT m.id, m.collaboration_id, c.owner_id, m.deck_name, c.seq
+		 FROM collaborators m JOIN collaborations c ON c.id = m.collaboration_id
+		 WHERE m.user_id = ? ORDER BY m.deck_name`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var members []membership
+	for rows.Next() {
+		var m membership
+		if err := rows.Scan(&m.id, &m.collaborationID, &m.ownerID, &m.deckName, &m.seq); err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+// Collaborators lists the members of the decks an account takes part in,
+// or of one of its decks.
+func (a *Accounts) Collaborators(userID int, deckName string) ([]Collaborator, error) {
+	members, err := a.memberships(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	collaborators := []Collaborator{}
+	for _, m := range members {
+		if deckName != "" && m.deckName != deckName {
+			continue
+		}
+		rows, err := a.Query(
+			`SELECT m.id, u.username, m.user_id, m.created_at
+			 FROM collaborators m JOIN users u ON u.id = m.user_id
+			 WHERE m.collaboration_id = ? ORDER BY m.id`, m.collaborationID)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			c := Collaborator{Deck: m.deckName, Role: "editor"}
+			var memberID int
+			if err := rows.Scan(&c.ID, &c.Username, &memberID, &c.CreatedAt); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			if memberID == m.ownerID {
+				c.Role = "owner"
+			}
+			collaborators = append(collaborators, c)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return collaborators, nil
+}
+
+// AddCollaborator lets another account edit one of an account's decks. The
+// deck appears under the same name in the other account's collection, which
+// must not have a deck of that name yet.
+func (a *Accounts) AddCollaborator(ownerID int, deckName, username string) (*Collaborator, error) {
+	a.collabMu.Lock()
+	defer a.collabMu.Unlock()
+
+	owner, err := a.collection(ownerID)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkDeckExists(owner, deckName); err != nil {
+		return nil, err
+	}
+
+	var userID int
+	err = a.QueryRow(`SELECT id FROM users WHERE username = ?`, username).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: no account %q", ErrInvalidCollaborator, username)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if userID == ownerID {
+		return nil, fmt.Errorf("%w: you already own the deck", ErrInvalidCollaborator)
+	}
+
+	// The deck can only be shared by its owner, and can't take in or be
+	// part of another shared deck
+	members, err := a.memberships(ownerID)
+	if err != nil {
+		return nil, err
+	}
+	collaborationID := 0
+	for _, m := range members {
+		switch {
+		case m.deckName == deckName && m.ownerID == ownerID:
+			collaborationID = m.collaborationID
+		case m.deckName == deckName:
+			return nil, ErrNotDeckOwner
+		case isSubdeckOf(m.deckName, deckName) || isSubdeckOf(deckName, m.deckName):
+			return nil, fmt.Errorf("%w: %s", ErrCollaborationExists, m.deckName)
+		}
+	}
+
+	others, err := a.memberships(userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range others {
+		if m.collaborationID == collaborationID {
+			return nil, fmt.Errorf("%w: %s already edits the deck", ErrCollaborationExists, username)
+		}
+		if isSubdeckOf(m.deckName, deckName) || isSubdeckOf(deckName, m.deckName) {
+			return nil, fmt.Errorf("%w: %s shares %s", ErrCollaborationExists, username, m.deckName)
+		}
+	}
+	other, err := a.collection(userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkDeckExists(other, deckName); err == nil {
+		return nil, fmt.Errorf("%w: %s already has a deck named %s", ErrCollaborationExists, username, deckName)
+	} else if !errors.Is(err, ErrDeckNotFound) {
+		return nil, err
+	}
+
+	tx, err := a.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if collaborationID == 0 {
+		res, err := tx.Exec(`INSERT INTO collaborations (owner_id) VALUES (?)`, ownerID)
+		if err != nil {
+			return nil, err
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return nil, err
+		}
+		collaborationID = int(id)
+		_, err = tx.Exec(`INSERT INTO collaborators (collaboration_id, user_id, deck_name) VALUES (?, ?, ?)`, collaborationID, ownerID, deckName)
+		if err != nil {
+			return nil, err
+		}
+	}
+	res, err := tx.Exec(`INSERT INTO collaborators (collaboration_id, user_id, deck_name) VALUES (?, ?, ?)`, collaborationID, userID, deckName)
+	if err != nil {
+		return nil, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Collaborator{ID: int(id), Deck: deckName, Role: "editor"}
+	err = tx.QueryRow(
+		`SELECT u.username, m.created_at FROM collaborators m JOIN users u ON u.id = m.user_id WHERE m.id = ?`, id,
+	).Scan(&c.Username, &c.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// RemoveCollaborator removes a member from a collaboration. The owner can
+// remove any editor, and an editor can leave. The cards stay in the removed
+// account's collection as cards of its own. A collaboration left with only
+// its owner ends.
+func (a *Accounts) RemoveCollaborator(userID, id int) error {
+	a.collabMu.Lock()
+	defer a.collabMu.Unlock()
+
+	var collaborationID, memberID, ownerID int
+	err := a.QueryRow(
+		`SELECT m.collaboration_id, m.user_id, c.owner_id
+		 FROM collaborators m JOIN collaborations c ON c.id = m.collaboration_id WHERE m.id = ?`, id,
+	).Scan(&collaborationID, &memberID, &ownerID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrCollaboratorNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if userID != ownerID && userID != memberID {
+		// Other members can't tell what isn't theirs from what isn't there
+		var member bool
+		err := a.QueryRow(`SELECT COUNT(*) > 0 FROM collaborators WHERE collaboration_id = ? AND user_id = ?`, collaborationID, userID).Scan(&member)
+		if err != nil {
+			return err
+		}
+		if member {
+			return ErrNotDeckOwner
+		}
+		return ErrCollaboratorNotFound
+	}
+	if memberID == ownerID {
+		return fmt.Errorf("%w: the owner can't leave the deck; remove its editors instead", ErrInvalidCollaborator)
+	}
+
+	leaving := []int{memberID}
+	var left int
+	if err := a.QueryRow(`SELECT COUNT(*) FROM collaborators WHERE collaboration_id = ?`, collaborationID).Scan(&left); err != nil {
+		return err
+	}
+	if left <= 2 {
+		leaving = append(leaving, ownerID)
+	}
+	for _, id := range leaving {
+		db, err := a.collection(id)
+		if err != nil {
+			return err
+		}
+		if err := detachCollabCards(db, collaborationID); err != nil {
+			return err
+		}
+	}
+
+	tx, err := a.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if left <= 2 {
+		for _, table := range []string{"collaborators", "collab_cards"} {
+			if _, err := tx.Exec(`DELETE FROM `+table+` WHERE collaboration_id = ?`, collaborationID); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.Exec(`DELETE FROM collaborations WHERE id = ?`, collaborationID); err != nil {
+			return err
+		}
+	} else if _, err := tx.Exec(`DELETE FROM collaborators WHERE id = ?`, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// renameDeck renames a deck in an account's collection, along with the
+// shared decks it is or holds. A shared deck can't be moved into or around
+// another one.
+func (a *Accounts) renameDeck(userID int, db *Collection, oldName, newName string) error {
+	a.collabMu.Lock()
+	defer a.collabMu.Unlock()
+
+	members, err := a.memberships(userID)
+	if err != nil {
+		return err
+	}
+	var moving bool
+	for _, m := range members {
+		if isSubdeckOf(m.deckName, oldName) {
+			moving = true
+		}
+	}
+	for _, m := range members {
+		if moving && !isSubdeckOf(m.deckName, oldName) &&
+			(isSubdeckOf(newName, m.deckName) || isSubdeckOf(m.deckName, newName)) {
+			return fmt.Errorf("%w: %s", ErrCollaborationExists, m.deckName)
+		}
+	}
+
+	if err := RenameDeck(db, oldName, newName); err != nil {
+		return err
+	}
+	if !moving {
+		return nil
+	}
+	filter, args := deckFilter("deck_name", oldName)
+	_, err = a.Exec(
+		`UPDATE collaborators SET deck_name = ? || substr(deck_name, ?) WHERE user_id = ? AND `+filter,
+		append([]any{newName, utf8.RuneCountInString(oldName) + 1, userID}, args...)...,
+	)
+	if err != nil {
+		// Put the deck back where its membership says it is
+		if err := RenameDeck(db, newName, oldName); err != nil {
+			log.Printf("Renaming %s back to %s: %v", newName, oldName, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// collabPrefix starts the collab_id of every card of a collaboration.
+func collabPrefix(collaborationID int) string {
+	return strconv.Itoa(collaborationID) + "-"
+}
+
+// detachCollabCards makes the cards of a collaboration in a collection
+// cards of its own.
+func detachCollabCards(db *Collection, collaborationID int) error {
+	like := collabPrefix(collaborationID) + "%"
+	if _, err := db.Exec(`UPDATE cards SET collab_id = '', collab_version = 0 WHERE collab_id LIKE ?`, like); err != nil {
+		return err
+	}
+	_, err := db.Exec(`DELETE FROM collab_deletions WHERE collab_id LIKE ?`, like)
+	return err
+}
+
+// syncCollaborations syncs the shared decks in an account's collection.
+// With changedOnly, only those changed by other members since the account
+// last synced them are, to bring the collection up to date without looking
+// for changes of its own.
+func (a *Accounts) syncCollaborations(userID int, db *Collection, changedOnly bool) error {
+	a.collabMu.Lock()
+	defer a.collabMu.Unlock()
+
+	members, err := a.memberships(userID)
+	if err != nil {
+		return err
+	}
+	for _, m := range members {
+		if changedOnly && a.collabSynced[m.id] == m.seq {
+			continue
+		}
+		if err := a.syncCollaboration(userID, db, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// commitSync commits a transaction of a sync, and lets tests make it fail.
+var commitSync = (*sql.Tx).Commit
+
+// syncCollaboration syncs a shared deck in a member's collection: cards the
+// member deleted are deleted from the shared content, cards changed since
+// they were last synced go to it, and what the other members changed comes
+// back.
+func (a *Accounts) syncCollaboration(userID int, db *Collection, m membership) error {
+	atx, err := a.Begin()
+	if err != nil {
+		return err
+	}
+	defer atx.Rollback()
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var seq int
+	if err := atx.QueryRow(`SELECT seq FROM collaborations WHERE id = ?`, m.collaborationID).Scan(&seq); err != nil {
+		return err
+	}
+	shared, err := loadCollabCards(atx, m.collaborationID)
+	if err != nil {
+		return err
+	}
+	saveShared := func(c *collabCard) error {
+		seq++
+		c.version, c.editorID = seq, userID
+		_, err := atx.Exec(
+			`INSERT OR REPLACE INTO collab_cards (id, collaboration_id, subdeck, front, back, tags, editor_id, version, deleted)
+			 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			c.id, m.collaborationID, c.subdeck, c.front, c.back, c.tags, c.editorID, c.version, c.deleted)
+		return err
+	}
+
+	// Deleted by the member
+	prefix := collabPrefix(m.collaborationID)
+	rows, err := tx.Query(`SELECT collab_id FROM collab_deletions WHERE collab_id LIKE ?`, prefix+"%")
+	if err != nil {
+		return err
+	}
+	var deleted []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		deleted = append(deleted, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, id := range deleted {
+		if c, ok := shared[id]; ok && !c.deleted {
+			c.deleted = true
+			if err := saveShared(c); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Cards the member has
+	rows, err = tx.Query(
+		`SELECT id, collab_id, collab_version, front, back,
+		        (SELECT group_concat(t.name, ' ') FROM card_tags ct JOIN tags t ON t.id = ct.tag_id WHERE ct.card_id = cards.id)
+		 FROM cards WHERE collab_id LIKE ?`, prefix+"%")
+	if err != nil {
+		return err
+	}
+	type copyCard struct {
+		id      int
+		version int
+		content collabCard
+	}
+	var copies []copyCard
+	for rows.Next() {
+		var c copyCard
+		var tags sql.NullString
+		if err := rows.Scan(&c.id, &c.content.id, &c.version, &c.content.front, &c.content.back, &tags); err != nil {
+			rows.Close()
+			return err
+		}
+		c.content.tags = collabTags(tags.String)
+		copies = append(copies, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	has := map[string]bool{}
+	for _, c := range copies {
+		has[c.content.id] = true
+		s, ok := shared[c.content.id]
+		switch {
+		case !ok:
+			// Left over from before the member left and joined again
+			if _, err := tx.Exec(`UPDATE cards SET collab_id = '', collab_version = 0 WHERE id = ?`, c.id); err != nil {
+				return err
+			}
+		case s.deleted:
+			if _, err := tx.Exec(`DELETE FROM cards WHERE id = ?`, c.id); err != nil {
+				return err
+			}
+			if _, err := tx.Exec(`DELETE FROM collab_deletions WHERE collab_id = ?`, c.content.id); err != nil {
+				return err
+			}
+		case c.version < s.version:
+			if err := pullCollabCard(a, tx, db, c.id, s); err != nil {
+				return err
+			}
+		case c.content.front != s.front || c.content.back != s.back || c.content.tags != s.tags:
+			s.front, s.back, s.tags = c.content.front, c.content.back, c.content.tags
+			if err := saveShared(s); err != nil {
+				return err
+			}
+			if _, err := tx.Exec(`UPDATE cards SET collab_version = ? WHERE id = ?`, s.version, c.id); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Cards the other members added
+	for id, s := range shared {
+		if s.deleted || has[id] {
+			continue
+		}
+		card := &Card{DeckName: m.deckName + s.subdeck, Front: s.front, Back: s.back, Tags: strings.Fields(s.tags)}
+		if err := createCard(tx, card); err != nil {
+			return err
+		}
+		if err := copyCollabMedia(a, tx, db, s); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`UPDATE cards SET collab_id = ?, collab_version = ? WHERE id = ?`, id, s.version, card.ID); err != nil {
+			return err
+		}
+	}
+
+	// Cards the member added
+	filter, args := sharedCardFilter(m.deckName)
+	rows, err = tx.Query(
+		`SELECT id, CASE WHEN home_deck != '' THEN home_deck ELSE deck_name END, front, back,
+		        (SELECT group_concat(t.name, ' ') FROM card_tags ct JOIN tags t ON t.id = ct.tag_id WHERE ct.card_id = cards.id)
+		 FROM cards WHERE collab_id = '' AND `+filter, args...)
+	if err != nil {
+		return err
+	}
+	type newCard struct {
+		id      int
+		content collabCard
+	}
+	var added []newCard
+	for rows.Next() {
+		var c newCard
+		var deck string
+		var tags sql.NullString
+		if err := rows.Scan(&c.id, &deck, &c.content.front, &c.content.back, &tags); err != nil {
+			rows.Close()
+			return err
+		}
+		c.content.subdeck = strings.TrimPrefix(deck, m.deckName)
+		c.content.tags = collabTags(tags.String)
+		added = append(added, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, c := range added {
+		random, err := randomToken()
+		if err != nil {
+			return err
+		}
+		c.content.id = prefix + random
+		if err := saveShared(&c.content); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`UPDATE cards SET collab_id = ?, collab_version = ? WHERE id = ?`, c.content.id, c.content.version, c.id); err != nil {
+			return err
+		}
+	}
+
+	if _, err := atx.Exec(`UPDATE collaborations SET seq = ? WHERE id = ?`, seq, m.collaborationID); err != nil {
+		return err
+	}
+	// The collection goes first: should the shared content then fail to
+	// commit, the cards added here have collab_ids it doesn't know, so the
+	// next sync detaches and adds them again instead of adding them twice
+	if err := commitSync(tx); err != nil {
+		return err
+	}
+	if err := commitSync(atx); err != nil {
+		return err
+	}
+	// Deletions are forgotten only once shared; sharing one again is harmless
+	for _, id := range deleted {
+		if _, err := db.Exec(`DELETE FROM collab_deletions WHERE collab_id = ?`, id); err != nil {
+			return err
+		}
+	}
+	a.collabSynced[m.id] = seq
+	return nil
+}
+
+// loadCollabCards returns the shared content of a collaboration's cards.
+func loadCollabCards(q querier, collaborationID int) (map[string]*collabCard, error) {
+	rows, err := q.Query(
+		`SELECT id, subdeck, front, back, tags, editor_id, version, deleted FROM collab_cards WHERE collaboration_id = ?`,
+		collaborationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cards := map[string]*collabCard{}
+	for rows.Next() {
+		c := &collabCard{}
+		if err := rows.Scan(&c.id, &c.subdeck, &c.front, &c.back, &c.tags, &c.editorID, &c.version, &c.deleted); err != nil {
+			return nil, err
+		}
+		cards[c.id] = c
+	}
+	return cards, rows.Err()
+}
+
+// collabTags returns the shared tags of a card, sorted and space
+// separated. The leech tag comes from the member's own reviews, so it
+// isn't shared.
+func collabTags(tags string) string {
+	var shared []string
+	for _, tag := range strings.Fields(tags) {
+		if tag != LeechTag {
+			shared = append(shared, tag)
+		}
+	}
+	sort.Strings(shared)
+	return strings.Join(shared, " ")
+}
+
+// pullCollabCard updates a member's copy of a card with the shared content.
+// Only the text of a card made from a note changes, not the note.
+func pullCollabCard(a *Accounts, tx querier, db *Collection, cardID int, s *collabCard) error {
+	if err := copyCollabMedia(a, tx, db, s); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`UPDATE cards SET front = ?, back = ?, collab_version = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?`,
+		s.front, s.back, s.version, cardID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		`DELETE FROM card_tags WHERE card_id = ? AND tag_id NOT IN (SELECT id FROM tags WHERE name = ?)`, cardID, LeechTag)
+	if err != nil {
+		return err
+	}
+	for _, tag := range strings.Fields(s.tags) {
+		if err := addCardTag(tx, cardID, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyCollabMedia copies the media a shared card uses into a member's
+// collection from the collection of whoever last edited it.
+func copyCollabMedia(a *Accounts, tx querier, db *Collection, s *collabCard) error {
+	var from *Collection
+	for _, name := range mediaRef.FindAllString(s.front+" "+s.back, -1) {
+		if _, err := mediaFile(db, name); err == nil {
+			continue
+		}
+		if from == nil {
+			var err error
+			if from, err = a.collection(s.editorID); err != nil {
+				return err
+			}
+		}
+		path, err := mediaFile(from, name)
+		if err != nil {
+			// Deleted since; the card shows it missing as it would there
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err := writeMediaFile(db, name, data); err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		_, err = tx.Exec(
+			`INSERT OR IGNORE INTO media (name, content_type, size, original_hash, original_size) VALUES (?, ?, ?, ?, ?)`,
+			name, mediaContentType(name), len(data), hex.EncodeToString(sum[:]), len(data))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// collabTest is an owner sharing the deck Spanish, with a card, with an
+// editor.
+type collabTest struct {
+	a                 *Accounts
+	owner, editor     *User
+	ownerDB, editorDB *Collection
+}
+
+func newCollabTest(t *testing.T) *collabTest {
+	t.Helper()
+	dir := t.TempDir()
+	a, err := OpenAccounts(filepath.Join(dir, "users.db"), filepath.Join(dir, "collections"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { a.Close() })
+	saved := defaultCollection
+	t.Cleanup(func() { defaultCollection = saved })
+	defaultCollection = openTestCollection(t)
+
+	c := &collabTest{a: a}
+	if c.owner, err = a.Register(Credentials{Username: "owner", Password: "password123"}); err != nil {
+		t.Fatal(err)
+	}
+	if c.editor, err = a.Register(Credentials{Username: "editor", Password: "password123"}); err != nil {
+		t.Fatal(err)
+	}
+	if c.ownerDB, err = a.collection(c.owner.ID); err != nil {
+		t.Fatal(err)
+	}
+	if c.editorDB, err = a.collection(c.editor.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CreateCard(c.ownerDB, &Card{DeckName: "Spanish", Front: "hola", Back: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.AddCollaborator(c.owner.ID, "Spanish", "editor"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.syncCollaborations(c.owner.ID, c.ownerDB, false); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// syncAll syncs the owner and then the editor, twice over.
+func (c *collabTest) syncAll(t *testing.T) {
+	t.Helper()
+	for range 2 {
+		for _, u := range []struct {
+			id int
+			db *Collection
+		}{{c.owner.ID, c.ownerDB}, {c.editor.ID, c.editorDB}} {
+			if err := c.a.syncCollaborations(u.id, u.db, false); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestRenameSharedDeck(t *testing.T) {
+	c := newCollabTest(t)
+	a, owner, ownerDB, editorDB := c.a, c.owner, c.ownerDB, c.editorDB
+
+	if err := a.renameDeck(owner.ID, ownerDB, "Spanish", "Languages::Spanish"); err != nil {
+		t.Fatal(err)
+	}
+	if err := CreateCard(editorDB, &Card{DeckName: "Spanish", Front: "adiós", Back: "goodbye"}); err != nil {
+		t.Fatal(err)
+	}
+	c.syncAll(t)
+
+	if _, n, err := GetAllCards(ownerDB, CardFilter{Deck: "Spanish"}, ListOptions{}); err != nil || n != 0 {
+		t.Errorf("renamed deck came back with %d cards (%v) after syncing", n, err)
+	}
+	if _, n, err := GetAllCards(ownerDB, CardFilter{Deck: "Languages::Spanish"}, ListOptions{}); err != nil || n != 2 {
+		t.Errorf("renamed deck has %d cards (%v), want 2", n, err)
+	}
+	if _, n, err := GetAllCards(editorDB, CardFilter{Deck: "Spanish"}, ListOptions{}); err != nil || n != 2 {
+		t.Errorf("editor's deck has %d cards (%v), want 2", n, err)
+	}
+
+	// Another shared deck can't be moved into it
+	if err := CreateCard(ownerDB, &Card{DeckName: "French", Front: "bonjour", Back: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.AddCollaborator(owner.ID, "French", "editor"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.renameDeck(owner.ID, ownerDB, "French", "Languages::Spanish::French"); !errors.Is(err, ErrCollaborationExists) {
+		t.Errorf("moving a shared deck into another = %v, want ErrCollaborationExists", err)
+	}
+}
+
+func TestSyncCommitFailure(t *testing.T) {
+	defer func(commit func(*sql.Tx) error) { commitSync = commit }(commitSync)
+	for _, fail := range []int{1, 2} {
+		c := newCollabTest(t)
+		c.syncAll(t)
+		cards, _, err := GetAllCards(c.ownerDB, CardFilter{Deck: "Spanish"}, ListOptions{})
+		if err != nil || len(cards) != 1 {
+			t.Fatalf("owner has %d cards (%v), want 1", len(cards), err)
+		}
+		if err := DeleteCard(c.ownerDB, cards[0].ID); err != nil {
+			t.Fatal(err)
+		}
+		if err := CreateCard(c.ownerDB, &Card{DeckName: "Spanish", Front: "adiós", Back: "goodbye"}); err != nil {
+			t.Fatal(err)
+		}
+
+		// The collection commits first, then the shared content
+		commits := 0
+		commitSync = func(tx *sql.Tx) error {
+			if commits++; commits == fail {
+				tx.Rollback()
+				return errors.New("commit failed")
+			}
+			return tx.Commit()
+		}
+		if err := c.a.syncCollaborations(c.owner.ID, c.ownerDB, false); err == nil {
+			t.Fatalf("commit %d: sync didn't fail", fail)
+		}
+		commitSync = (*sql.Tx).Commit
+		c.syncAll(t)
+
+		for _, db := range []*Collection{c.ownerDB, c.editorDB} {
+			cards, _, err := GetAllCards(db, CardFilter{Deck: "Spanish"}, ListOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var fronts []string
+			for _, card := range cards {
+				fronts = append(fronts, card.Front)
+			}
+			if !reflect.DeepEqual(fronts, []string{"adiós"}) {
+				t.Errorf("commit %d failing left %q, want just adiós", fail, fronts)
+			}
+		}
+	}
+}
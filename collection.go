@@ -0,0 +1,20 @@
+package main
+
+import (
+	"net/http"
+)
+
+// collectionKey is the request context key of the collection a request
+// works on.
+type collectionKey struct{}
+
+// defaultCollection is the collection of the -db flag.
+var defaultCollection *Collection
+
+// requestCollection returns the collection a request works on.
+func requestCollection(r *http.Request) *Collection {
+	if db, ok := r.Context().Value(collectionKey{}).(*Collection); ok {
+		return db
+	}
+	return defaultCollection
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// CORS lets web pages on other origins, such as a separately hosted
+// frontend, a browser extension or a mobile web client, call the API.
+// Browsers only let them read the answers of origins listed in
+// -cors-origins, and first ask with a preflight OPTIONS request before
+// requests that change something or send credentials. Listed origins may
+// send cookies, which browsers only do for the same site, so frontends
+// on other sites log in with an API token; "*" lets any origin call the
+// API, without cookies. Quick add answers any origin by itself.
+
+// corsOrigins are the origins allowed to call the API, "*" for any, set
+// from -cors-origins in main.
+var corsOrigins []string
+
+const (
+	corsMethods = "GET, POST, PUT, PATCH, DELETE, OPTIONS"
+	corsHeaders = "Authorization, Content-Type, X-CSRF-Token"
+	// corsExposed are the response headers of the API clients may read.
+	corsExposed = "X-Total-Count, X-New-Cards-Remaining, X-Reviews-Remaining, Content-Disposition, Retry-After, X-CSRF-Token"
+)
+
+// parseCORSOrigins parses the comma-separated origins of -cors-origins,
+// each a scheme and host such as https://anki.example.com or "*".
+func parseCORSOrigins(list string) ([]string, error) {
+	var origins []string
+	for _, origin := range strings.Split(list, ",") {
+		origin = strings.TrimSuffix(strings.TrimSpace(origin), "/")
+		if origin == "" {
+			continue
+		}
+		if origin != "*" {
+			u, err := url.Parse(origin)
+			if err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" || u.RawQuery != "" || u.User != nil {
+				return nil, fmt.Errorf("%q is not an origin such as https://anki.example.com", origin)
+			}
+			origin = strings.ToLower(origin)
+		}
+		origins = append(origins, origin)
+	}
+	return origins, nil
+}
+
+// allowedOrigin reports whether an origin may call the API, and whether
+// it may send credentials.
+func allowedOrigin(origin string) (allowed, credentials bool) {
+	origin = strings.ToLower(origin)
+	for _, o := range corsOrigins {
+		if o == origin {
+			return true, true
+		}
+		if o == "*" {
+			allowed = true
+		}
+	}
+	return allowed, false
+}
+
+// handleCORS wraps the routes in the CORS headers of -cors-origins on
+// /api/, answering preflight requests before they reach the login.
+func handleCORS(next http.Handler) http.Handler {
+	if len(corsOrigins) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if !strings.HasPrefix(r.URL.Path, "/api/") || r.URL.Path == "/api/quickadd" || origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		allowed, credentials := allowedOrigin(origin)
+		if !allowed {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if credentials {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		}
+		if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", corsMethods)
+			w.Header().Set("Access-Control-Allow-Headers", corsHeaders)
+			w.Header().Set("Access-Control-Max-Age", "86400")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Access-Control-Expose-Headers", corsExposed)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestParseCORSOrigins(t *testing.T) {
+	origins, err := parseCORSOrigins(" https://Anki.example.com/, *,,http://localhost:3000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"https://anki.example.com", "*", "http://localhost:3000"}
+	if !slices.Equal(origins, want) {
+		t.Errorf("parseCORSOrigins = %q, want %q", origins, want)
+	}
+
+	for _, list := range []string{"anki.example.com", "https://anki.example.com/app", "https://user@anki.example.com", "https://anki.example.com?x=1"} {
+		if _, err := parseCORSOrigins(list); err == nil {
+			t.Errorf("parseCORSOrigins(%q) succeeded", list)
+		}
+	}
+}
+
+func TestHandleCORS(t *testing.T) {
+	defer func(origins []string) { corsOrigins = origins }(corsOrigins)
+	reached := false
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { reached = true })
+	serve := func(method, path, origin string, preflight bool) *httptest.ResponseRecorder {
+		t.Helper()
+		reached = false
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, path, nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		if preflight {
+			r.Header.Set("Access-Control-Request-Method", "POST")
+		}
+		handleCORS(next).ServeHTTP(w, r)
+		return w
+	}
+
+	// Without -cors-origins nothing is added
+	corsOrigins = nil
+	if w := serve("GET", "/api/cards", "https://anki.example.com", false); w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("without -cors-origins, CORS headers were sent: %v", w.Header())
+	}
+
+	corsOrigins = []string{"https://anki.example.com"}
+	w := serve("GET", "/api/cards", "https://Anki.example.com", false)
+	if w.Header().Get("Access-Control-Allow-Origin") != "https://Anki.example.com" ||
+		w.Header().Get("Access-Control-Allow-Credentials") != "true" ||
+		w.Header().Get("Access-Control-Expose-Headers") != corsExposed || !reached {
+		t.Errorf("a listed origin got %v", w.Header())
+	}
+
+	// Preflight requests are answered without reaching the routes
+	w = serve("OPTIONS", "/api/cards", "https://anki.example.com", true)
+	if w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Allow-Methods") != corsMethods ||
+		w.Header().Get("Access-Control-Allow-Headers") != corsHeaders || reached {
+		t.Errorf("preflight got %d %v, reaching the routes: %v", w.Code, w.Header(), reached)
+	}
+
+	for _, tt := range []struct{ name, path, origin string }{
+		{"other origin", "/api/cards", "https://evil.example"},
+		{"outside the API", "/login", "https://anki.example.com"},
+		{"quick add", "/api/quickadd", "https://anki.example.com"},
+	} {
+		w := serve("OPTIONS", tt.path, tt.origin, true)
+		if w.Header().Get("Access-Control-Allow-Origin") != "" || !reached {
+			t.Errorf("%s got %v, reaching the routes: %v", tt.name, w.Header(), reached)
+		}
+	}
+
+	// Any origin, but without credentials
+	corsOrigins = []string{"*"}
+	w = serve("GET", "/api/cards", "https://evil.example", false)
+	if w.Header().Get("Access-Control-Allow-Origin") != "*" || w.Header().Get("Access-Control-Allow-Credentials") != "" {
+		t.Errorf("with *, an origin got %v", w.Header())
+	}
+}
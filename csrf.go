@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// CSRF protection keeps other sites from making changes with the
+// credentials a browser sends on its own, the session cookie of accounts
+// or the password of basic auth. The server gives every browser a random
+// token in the csrf_token cookie, which other sites can't read, and
+// requests that change something must send it back in the X-CSRF-Token
+// header. API clients with a token in an "Authorization: Bearer" header
+// are exempt, as browsers never send one on their own, and so are scripts
+// that send no cookies and aren't browsers.
+
+const (
+	// csrfCookie is the cookie the CSRF token of a browser is kept in.
+	csrfCookie = "csrf_token"
+	// csrfHeader is the header requests send the CSRF token back in.
+	csrfHeader = "X-CSRF-Token"
+)
+
+// checkCSRF wraps the routes in CSRF protection when there are credentials
+// for other sites to abuse, with accounts or basic auth.
+func checkCSRF(next http.Handler) http.Handler {
+	if accounts == nil && basicAuth == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var token string
+		if cookie, err := r.Cookie(csrfCookie); err == nil && cookie.Value != "" {
+			token = cookie.Value
+		} else {
+			var err error
+			if token, err = randomToken(); err != nil {
+				respondError(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			setCSRFCookie(w, r, token)
+		}
+		// Frontends on other origins of the site can't read the cookie
+		w.Header().Set(csrfHeader, token)
+
+		if csrfExempt(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		given := r.Header.Get(csrfHeader)
+		if given == "" || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			respondError(w, "Missing or invalid CSRF token", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// csrfExempt reports whether a request needs no CSRF token: it changes
+// nothing, is outside the API, authenticates with a bearer token, or
+// doesn't come from a browser.
+func csrfExempt(r *http.Request) bool {
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return true
+	}
+	if !strings.HasPrefix(r.URL.Path, "/api/") || r.URL.Path == "/api/quickadd" {
+		return true
+	}
+	if _, ok := bearerToken(r); ok {
+		return true
+	}
+	// Browsers send an Origin or Sec-Fetch-Site header with every request
+	// that changes something; scripts send neither
+	fromBrowser := r.Header.Get("Cookie") != "" || r.Header.Get("Origin") != "" || r.Header.Get("Sec-Fetch-Site") != ""
+	return !fromBrowser
+}
+
+// setCSRFCookie sets the cookie of a browser's CSRF token. Unlike the
+// session cookie, scripts of the web UI can read it to send it back.
+func setCSRFCookie(w http.ResponseWriter, r *http.Request, token string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    token,
+		Path:     "/",
+		Secure:   secureCookies || r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckCSRF(t *testing.T) {
+	defer func(auth string) { basicAuth = auth }(basicAuth)
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	// Without credentials to abuse there is nothing to protect
+	basicAuth = ""
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/api/cards", nil)
+	r.Header.Set("Origin", "https://evil.example")
+	checkCSRF(next).ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Header().Get(csrfHeader) != "" {
+		t.Errorf("without credentials, a cross-site POST = %d with token %q", w.Code, w.Header().Get(csrfHeader))
+	}
+
+	basicAuth = "user:password"
+	handler := checkCSRF(next)
+
+	// A browser gets a token with its first request
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	token := w.Header().Get(csrfHeader)
+	cookies := w.Result().Cookies()
+	if token == "" || len(cookies) != 1 || cookies[0].Name != csrfCookie || cookies[0].Value != token {
+		t.Fatalf("first request got token %q and cookies %v", token, cookies)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		header map[string]string
+		want   int
+	}{
+		{"token", "POST", "/api/cards", map[string]string{"Cookie": csrfCookie + "=" + token, csrfHeader: token}, http.StatusOK},
+		{"no token", "POST", "/api/cards", map[string]string{"Cookie": csrfCookie + "=" + token}, http.StatusForbidden},
+		{"wrong token", "DELETE", "/api/cards/1", map[string]string{"Cookie": csrfCookie + "=" + token, csrfHeader: "guess"}, http.StatusForbidden},
+		{"cross-site without cookie", "POST", "/api/cards", map[string]string{"Origin": "https://evil.example"}, http.StatusForbidden},
+		{"fetch metadata", "POST", "/api/cards", map[string]string{"Sec-Fetch-Site": "cross-site"}, http.StatusForbidden},
+		{"GET", "GET", "/api/cards", map[string]string{"Cookie": csrfCookie + "=" + token}, http.StatusOK},
+		{"outside the API", "POST", "/login", map[string]string{"Cookie": csrfCookie + "=" + token}, http.StatusOK},
+		{"quick add", "POST", "/api/quickadd", map[string]string{"Origin": "https://evil.example"}, http.StatusOK},
+		{"bearer token", "POST", "/api/cards", map[string]string{"Cookie": "session=x", "Authorization": "Bearer abc"}, http.StatusOK},
+		{"script", "POST", "/api/cards", nil, http.StatusOK},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(tt.method, tt.path, nil)
+		for k, v := range tt.header {
+			r.Header.Set(k, v)
+		}
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: %s %s = %d, want %d", tt.name, tt.method, tt.path, w.Code, tt.want)
+		}
+	}
+}
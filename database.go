@@ -2,36 +2,100 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
-var db *sql.DB
+// Collection is a database of cards, their reviews and everything else
+// studied, with the directory its media files are kept in: the collection
+// of one account, or of the whole server without accounts.
+type Collection struct {
+	*sql.DB
+	mediaDir  string
+	refsCache mediaRefsCache
+}
+
+// querier is satisfied by both *sql.DB and *sql.Tx, so helpers can run
+// inside or outside a transaction.
+type querier interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
 
 type Card struct {
-	ID         int       `json:"id"`
-	DeckName   string    `json:"deck_name"`
-	Front      string    `json:"front"`
-	Back       string    `json:"back"`
-	Ease       float64   `json:"ease"`
-	Interval   int       `json:"interval"`
-	NextReview time.Time `json:"next_review"`
-	CreatedAt  time.Time `json:"created_at"`
-	UpdatedAt  time.Time `json:"updated_at"`
+	ID          int        `json:"id"`
+	DeckName    string     `json:"deck_name"`
+	Front       string     `json:"front"`
+	Back        string     `json:"back"`
+	Ease        float64    `json:"ease"`
+	Interval    int        `json:"interval"`
+	NextReview  time.Time  `json:"next_review"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	State       string     `json:"state"` // new, learning, review or relearning
+	Step        int        `json:"step"`  // Current learning step index
+	Lapses      int        `json:"lapses"`
+	Suspended   bool       `json:"suspended"`
+	BuriedUntil *time.Time `json:"buried_until"`         // Hidden from the queue until then
+	HomeDeck    string     `json:"home_deck"`            // Deck to return to while in a filtered deck, else ""
+	NoteID      *int       `json:"note_id"`              // Note the card was made from, if any
+	Template    int        `json:"template"`             // Index of the note type's template that made the card
+	SourceURL   string     `json:"source_url,omitempty"` // Page the card was captured from, if any
+	Position    int        `json:"position"`             // Place among the new cards, the creation order unless repositioned
+	Tags        []string   `json:"tags"`
+
+	// Set when creating a card to also create its reversed Back→Front
+	// card; both become cards of a "Basic (and reversed card)" note
+	Reverse bool `json:"reverse,omitempty"`
 }
 
-type ReviewResult struct {
-	CardID int    `json:"card_id"`
-	Score  int    `json:"score"` // 1=Again, 2=Hard, 3=Good, 4=Easy
+// cardColumns lists the columns scanned by scanCard, in order. Tags are
+// collected into one space-separated column.
+const cardColumns = `id, deck_name, front, back, ease, interval, next_review, created_at, updated_at, state, step, lapses, suspended, buried_until, home_deck, note_id, template, source_url, position,
+	(SELECT group_concat(t.name, ' ') FROM card_tags ct JOIN tags t ON t.id = ct.tag_id WHERE ct.card_id = cards.id)`
+
+// scanner is satisfied by both *sql.Row and *sql.Rows.
+type scanner interface {
+	Scan(dest ...any) error
 }
 
-func InitDB(dbPath string) error {
-	var err error
-	db, err = sql.Open("sqlite3", dbPath)
+func scanCard(row scanner, card *Card) error {
+	var tags sql.NullString
+	err := row.Scan(&card.ID, &card.DeckName, &card.Front, &card.Back, &card.Ease, &card.Interval, &card.NextReview, &card.CreatedAt, &card.UpdatedAt, &card.State, &card.Step, &card.Lapses, &card.Suspended, &card.BuriedUntil, &card.HomeDeck, &card.NoteID, &card.Template, &card.SourceURL, &card.Position, &tags)
 	if err != nil {
 		return err
 	}
+	card.Tags = strings.Fields(tags.String)
+	sort.Strings(card.Tags)
+	return nil
+}
+
+type ReviewResult struct {
+	CardID int `json:"card_id"`
+	Score  int `json:"score"`   // 1=Again, 2=Hard, 3=Good, 4=Easy
+	TimeMs int `json:"time_ms"` // Optional time taken to answer
+
+	// TypedAnswer is checked against the back when given; without a
+	// score, the suggested score is used.
+	TypedAnswer *string `json:"typed_answer,omitempty"`
+}
+
+// OpenCollection opens the collection database at dbPath, creating or
+// migrating it as needed, with its media in mediaDir.
+func OpenCollection(dbPath, mediaDir string) (*Collection, error) {
+	sqlDB, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return nil, err
+	}
+	db := &Collection{DB: sqlDB, mediaDir: mediaDir}
 
 	schema := `
 	CREATE TABLE IF NOT EXISTS cards (
@@ -43,29 +107,418 @@ func InitDB(dbPath string) error {
 		interval INTEGER DEFAULT 0,
 		next_review DATETIME DEFAULT CURRENT_TIMESTAMP,
 		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		state TEXT NOT NULL DEFAULT 'new',
+		step INTEGER NOT NULL DEFAULT 0,
+		lapses INTEGER NOT NULL DEFAULT 0,
+		suspended INTEGER NOT NULL DEFAULT 0,
+		buried_until DATETIME,
+		home_deck TEXT NOT NULL DEFAULT '',
+		note_id INTEGER,
+		template INTEGER NOT NULL DEFAULT 0,
+		source_url TEXT NOT NULL DEFAULT '',
+		position INTEGER NOT NULL DEFAULT 0
 	);
 
 	CREATE INDEX IF NOT EXISTS idx_deck_name ON cards(deck_name);
 	CREATE INDEX IF NOT EXISTS idx_next_review ON cards(next_review);
+
+	CREATE TABLE IF NOT EXISTS review_log (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		card_id INTEGER NOT NULL,
+		score INTEGER NOT NULL,
+		interval_before INTEGER NOT NULL,
+		interval_after INTEGER NOT NULL,
+		ease_before REAL NOT NULL,
+		ease_after REAL NOT NULL,
+		next_review_before DATETIME NOT NULL,
+		next_review_after DATETIME NOT NULL,
+		reviewed_at DATETIME NOT NULL,
+		time_taken_ms INTEGER DEFAULT 0,
+		state_before TEXT NOT NULL DEFAULT '',
+		step_before INTEGER NOT NULL DEFAULT 0
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_review_log_card ON review_log(card_id);
+	CREATE INDEX IF NOT EXISTS idx_review_log_reviewed_at ON review_log(reviewed_at);
+
+	CREATE TABLE IF NOT EXISTS decks (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL UNIQUE,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS deck_settings (
+		deck_name TEXT PRIMARY KEY,
+		settings TEXT NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS filtered_decks (
+		name TEXT PRIMARY KEY,
+		query TEXT NOT NULL,
+		card_limit INTEGER NOT NULL,
+		card_order TEXT NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS notes (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		note_type TEXT NOT NULL,
+		fields TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS note_types (
+		name TEXT PRIMARY KEY,
+		fields TEXT NOT NULL,
+		templates TEXT NOT NULL,
+		css TEXT NOT NULL DEFAULT ''
+	);
+
+	CREATE TABLE IF NOT EXISTS media (
+		name TEXT PRIMARY KEY,
+		content_type TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		original_hash TEXT NOT NULL DEFAULT '',
+		original_size INTEGER NOT NULL DEFAULT 0,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS embeddings (
+		model TEXT NOT NULL,
+		text_hash TEXT NOT NULL,
+		vector BLOB NOT NULL,
+		PRIMARY KEY (model, text_hash)
+	);
+
+	CREATE TABLE IF NOT EXISTS tags (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL UNIQUE
+	);
+
+	CREATE TABLE IF NOT EXISTS card_tags (
+		card_id INTEGER NOT NULL,
+		tag_id INTEGER NOT NULL,
+		PRIMARY KEY (card_id, tag_id)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_card_tags_tag ON card_tags(tag_id);
+
+	CREATE TABLE IF NOT EXISTS deck_shares (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		deck_name TEXT NOT NULL,
+		token TEXT NOT NULL UNIQUE,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TRIGGER IF NOT EXISTS cards_delete_tags AFTER DELETE ON cards BEGIN
+		DELETE FROM card_tags WHERE card_id = old.id;
+	END;
 	`
 
-	_, err = db.Exec(schema)
-	return err
+	if _, err = db.Exec(schema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := initSearch(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
 }
 
-func CloseDB() error {
-	if db != nil {
-		return db.Close()
+// migrate brings databases created by older versions up to the current schema.
+func migrate(db *Collection) error {
+	added, err := addColumnIfMissing(db, "cards", "state", "TEXT NOT NULL DEFAULT 'new'")
+	if err != nil {
+		return err
+	}
+	if added {
+		// Cards that already have an interval have graduated
+		if _, err := db.Exec(`UPDATE cards SET state = 'review' WHERE interval > 0`); err != nil {
+			return err
+		}
+	}
+	if _, err := addColumnIfMissing(db, "cards", "step", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if _, err := addColumnIfMissing(db, "cards", "suspended", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if _, err := addColumnIfMissing(db, "cards", "buried_until", "DATETIME"); err != nil {
+		return err
+	}
+	if _, err := addColumnIfMissing(db, "cards", "home_deck", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+
+	added, err = addColumnIfMissing(db, "review_log", "state_before", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		return err
+	}
+	if added {
+		// Best guess for older entries: a card's first review was when it was
+		// new, and a card without an interval was still learning
+		_, err := db.Exec(
+			`UPDATE review_log SET state_before = CASE
+				WHEN interval_before > 0 THEN 'review'
+				WHEN id = (SELECT MIN(id) FROM review_log r WHERE r.card_id = review_log.card_id) THEN 'new'
+				ELSE 'learning' END`,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := addColumnIfMissing(db, "review_log", "step_before", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+
+	added, err = addColumnIfMissing(db, "cards", "lapses", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+	if added {
+		// Count the failed answers to review cards already in the log
+		_, err := db.Exec(
+			`UPDATE cards SET lapses = (SELECT COUNT(*) FROM review_log r
+				WHERE r.card_id = cards.id AND r.state_before = 'review' AND r.score < 3)`,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := addColumnIfMissing(db, "cards", "note_id", "INTEGER"); err != nil {
+		return err
+	}
+	if _, err := addColumnIfMissing(db, "cards", "template", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if _, err := addColumnIfMissing(db, "cards", "source_url", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	added, err = addColumnIfMissing(db, "cards", "position", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+	if added {
+		// New cards have so far been introduced in creation order
+		if _, err := db.Exec(`UPDATE cards SET position = id`); err != nil {
+			return err
+		}
+	}
+	if _, err := addColumnIfMissing(db, "note_types", "css", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	added, err = addColumnIfMissing(db, "media", "original_hash", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		return err
+	}
+	if _, err := addColumnIfMissing(db, "media", "original_size", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if added {
+		// Media stored so far is as uploaded
+		if _, err := db.Exec(`UPDATE media SET original_hash = substr(name, 1, 64), original_size = size`); err != nil {
+			return err
+		}
+	}
+	if _, err := db.Exec(`CREATE INDEX IF NOT EXISTS idx_media_original ON media(original_hash)`); err != nil {
+		return err
+	}
+
+	// A note goes away with its last card
+	_, err = db.Exec(`
+		CREATE INDEX IF NOT EXISTS idx_cards_note ON cards(note_id);
+		CREATE TRIGGER IF NOT EXISTS cards_delete_note AFTER DELETE ON cards WHEN old.note_id IS NOT NULL BEGIN
+			DELETE FROM notes WHERE id = old.note_id AND NOT EXISTS (SELECT 1 FROM cards WHERE note_id = old.note_id);
+		END;`)
+	if err != nil {
+		return err
+	}
+
+	// Cards of shared decks keep their ID in the shared content, and their
+	// deletions are kept until synced
+	if _, err := addColumnIfMissing(db, "cards", "collab_id", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if _, err := addColumnIfMissing(db, "cards", "collab_version", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS collab_deletions (collab_id TEXT PRIMARY KEY);
+		CREATE TRIGGER IF NOT EXISTS cards_delete_collab AFTER DELETE ON cards WHEN old.collab_id != '' BEGIN
+			INSERT OR IGNORE INTO collab_deletions (collab_id) VALUES (old.collab_id);
+		END;`)
+	if err != nil {
+		return err
+	}
+
+	// What a review changed besides scheduling, so that it can be undone
+	if _, err := addColumnIfMissing(db, "review_log", "suspended_before", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if _, err := addColumnIfMissing(db, "review_log", "deck_before", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if _, err := addColumnIfMissing(db, "review_log", "home_deck_before", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if _, err := addColumnIfMissing(db, "review_log", "buried_siblings", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if _, err := addColumnIfMissing(db, "review_log", "leech_added", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+
+	// Counts changes to the text of cards and notes, so the media they
+	// name can be cached until the next one
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS media_refs_version (version INTEGER NOT NULL);
+		INSERT INTO media_refs_version (version) SELECT 0 WHERE NOT EXISTS (SELECT 1 FROM media_refs_version);
+		CREATE TRIGGER IF NOT EXISTS cards_insert_media_refs AFTER INSERT ON cards BEGIN
+			UPDATE media_refs_version SET version = version + 1;
+		END;
+		CREATE TRIGGER IF NOT EXISTS cards_update_media_refs AFTER UPDATE OF front, back ON cards
+		WHEN old.front IS NOT new.front OR old.back IS NOT new.back BEGIN
+			UPDATE media_refs_version SET version = version + 1;
+		END;
+		CREATE TRIGGER IF NOT EXISTS cards_delete_media_refs AFTER DELETE ON cards BEGIN
+			UPDATE media_refs_version SET version = version + 1;
+		END;
+		CREATE TRIGGER IF NOT EXISTS notes_insert_media_refs AFTER INSERT ON notes BEGIN
+			UPDATE media_refs_version SET version = version + 1;
+		END;
+		CREATE TRIGGER IF NOT EXISTS notes_update_media_refs AFTER UPDATE OF fields ON notes
+		WHEN old.fields IS NOT new.fields BEGIN
+			UPDATE media_refs_version SET version = version + 1;
+		END;
+		CREATE TRIGGER IF NOT EXISTS notes_delete_media_refs AFTER DELETE ON notes BEGIN
+			UPDATE media_refs_version SET version = version + 1;
+		END;`)
+	if err != nil {
+		return err
+	}
+
+	// Cards are added in creation order unless given a position
+	_, err = db.Exec(`
+		CREATE TRIGGER IF NOT EXISTS cards_position AFTER INSERT ON cards WHEN new.position = 0 BEGIN
+			UPDATE cards SET position = new.id WHERE id = new.id;
+		END;`)
+	if err != nil {
+		return err
+	}
+
+	// Decks used to exist only through cards.deck_name
+	if _, err := db.Exec(`INSERT OR IGNORE INTO decks (name) SELECT DISTINCT deck_name FROM cards`); err != nil {
+		return err
+	}
+	return ensureParentDecks(db)
+}
+
+// ensureParentDecks creates missing parent decks of existing subdecks.
+func ensureParentDecks(db *Collection) error {
+	names, err := GetDecks(db)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if strings.Contains(name, DeckSeparator) {
+			if err := ensureDeck(db, name); err != nil {
+				return err
+			}
+		}
 	}
 	return nil
 }
 
-func CreateCard(card *Card) error {
-	result, err := db.Exec(
-		`INSERT INTO cards (deck_name, front, back, ease, interval, next_review)
-		 VALUES (?, ?, ?, ?, ?, ?)`,
-		card.DeckName, card.Front, card.Back, 2.5, 0, time.Now(),
+// addColumnIfMissing adds a column to an existing table and reports whether
+// it had to be added.
+func addColumnIfMissing(q querier, table, column, definition string) (bool, error) {
+	rows, err := q.Query(`SELECT name FROM pragma_table_info(?)`, table)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return false, err
+		}
+		if name == column {
+			return false, nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+	rows.Close()
+
+	_, err = q.Exec(`ALTER TABLE ` + table + ` ADD COLUMN ` + column + ` ` + definition)
+	return err == nil, err
+}
+
+func CreateCard(db *Collection, card *Card) error {
+	return createCard(db, card)
+}
+
+// CreateCards creates several cards in one transaction; either all of them
+// are created or none.
+func CreateCards(db *Collection, cards []Card) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for i := range cards {
+		if err := createCard(tx, &cards[i]); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func createCard(q querier, card *Card) error {
+	if card.Reverse {
+		return createReversedCard(q, card)
+	}
+
+	settings, err := getDeckSettings(q, card.DeckName)
+	if err != nil {
+		return err
+	}
+
+	card.Ease = settings.StartingEase
+	card.Interval = 0
+	card.NextReview = time.Now()
+	card.State = StateNew
+	card.Step = 0
+	card.Lapses = 0
+	card.Suspended = false
+	card.BuriedUntil = nil
+	card.HomeDeck = ""
+
+	tags, err := normalizeTags(card.Tags)
+	if err != nil {
+		return err
+	}
+	card.Tags = tags
+
+	if err := ensureDeck(q, card.DeckName); err != nil {
+		return err
+	}
+
+	result, err := q.Exec(
+		`INSERT INTO cards (deck_name, front, back, ease, interval, next_review, state, step, note_id, template, source_url)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		card.DeckName, card.Front, card.Back, card.Ease, card.Interval, card.NextReview, card.State, card.Step,
+		card.NoteID, card.Template, card.SourceURL,
 	)
 	if err != nil {
 		return err
@@ -76,96 +529,477 @@ func CreateCard(card *Card) error {
 		return err
 	}
 	card.ID = int(id)
+
+	for _, tag := range card.Tags {
+		if err := addCardTag(q, card.ID, tag); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func GetCard(id int) (*Card, error) {
-	card := &Card{}
-	err := db.QueryRow(
-		`SELECT id, deck_name, front, back, ease, interval, next_review, created_at, updated_at
-		 FROM cards WHERE id = ?`,
-		id,
-	).Scan(&card.ID, &card.DeckName, &card.Front, &card.Back, &card.Ease, &card.Interval, &card.NextReview, &card.CreatedAt, &card.UpdatedAt)
+// Import dedup strategies for cards whose front already exists in the
+// target deck, compared exactly as ?mode=upsert always has.
+const (
+	DedupDuplicate = "duplicate" // Create the card anyway
+	DedupSkip      = "skip"      // Leave the existing cards alone
+	DedupUpdate    = "update"    // Update the existing cards' back, keeping their scheduling
+)
+
+var ErrInvalidDedup = errors.New("dedup must be 'skip', 'update' or 'duplicate'")
+
+// ImportResult counts what an import did with its cards.
+type ImportResult struct {
+	Created int
+	Updated int
+	Skipped int
+	Decks   []string // Decks the cards went to, in order of first use
+}
+
+// importDeck is what ImportCards knows about one target deck.
+type importDeck struct {
+	settings SchedulerSettings
+	existing map[string][]int64 // Cards with each front
+	queued   map[string]int     // Cards waiting to be inserted, by batch index
+}
 
+// importBatchSize is how many cards ImportCards inserts at a time. Each
+// takes 11 parameters, so a batch fits in one statement.
+const importBatchSize = 80
+
+// ImportCards adds cards to their decks inside a single transaction,
+// handling cards whose front already exists in the deck according to dedup.
+// Cards earlier in the same import count as existing. Cards with a State
+// keep their scheduling; the rest start as new cards. Cards with Reverse
+// set also get a reversed card, which starts as new. New cards are
+// inserted in batches of multi-row statements. A dry run rolls the
+// transaction back, so only the counts are left.
+func ImportCards(db *Collection, cards []Card, dedup string, dryRun bool) (*ImportResult, error) {
+	return importCards(db, cards, dedup, dryRun, nil)
+}
+
+// importCards is ImportCards reporting progress: after each batch it calls
+// progress, if set, with how many cards have been processed.
+func importCards(db *Collection, cards []Card, dedup string, dryRun bool, progress func(processed int)) (*ImportResult, error) {
+	switch dedup {
+	case DedupDuplicate, DedupSkip, DedupUpdate:
+	default:
+		return nil, ErrInvalidDedup
+	}
+
+	tx, err := db.Begin()
 	if err != nil {
 		return nil, err
 	}
-	return card, nil
+	defer tx.Rollback()
+
+	result := &ImportResult{}
+	decks := make(map[string]*importDeck)
+	batch := make([]Card, 0, importBatchSize)
+	flush := func() error {
+		reversed, err := addReverseNotes(tx, batch, decks)
+		if err != nil {
+			return err
+		}
+		if err := insertCardBatch(tx, batch); err != nil {
+			return err
+		}
+		if err := insertCardBatch(tx, reversed); err != nil {
+			return err
+		}
+		for _, card := range batch {
+			deck := decks[card.DeckName]
+			deck.existing[card.Front] = append(deck.existing[card.Front], int64(card.ID))
+			delete(deck.queued, card.Front)
+		}
+		batch = batch[:0]
+		return nil
+	}
+
+	for i, card := range cards {
+		if progress != nil && i > 0 && i%importBatchSize == 0 {
+			progress(i)
+		}
+
+		deck := decks[card.DeckName]
+		if deck == nil {
+			if deck, err = loadImportDeck(tx, card.DeckName, dedup != DedupDuplicate); err != nil {
+				return nil, err
+			}
+			decks[card.DeckName] = deck
+			result.Decks = append(result.Decks, card.DeckName)
+		}
+
+		if dedup != DedupDuplicate {
+			if ids, ok := deck.existing[card.Front]; ok {
+				if dedup == DedupSkip {
+					result.Skipped++
+					continue
+				}
+				for _, id := range ids {
+					if err := updateImportedBack(tx, id, card.Back); err != nil {
+						return nil, err
+					}
+				}
+				result.Updated++
+				continue
+			}
+			if i, ok := deck.queued[card.Front]; ok {
+				if dedup == DedupSkip {
+					result.Skipped++
+				} else {
+					batch[i].Back = card.Back
+					result.Updated++
+				}
+				continue
+			}
+		}
+
+		if card.State == "" {
+			card.State = StateNew
+			card.Ease = deck.settings.StartingEase
+			card.Interval = 0
+			card.NextReview = time.Now()
+			card.Lapses = 0
+			card.Suspended = false
+		} else if card.Ease == 0 {
+			card.Ease = deck.settings.StartingEase
+		}
+
+		deck.queued[card.Front] = len(batch)
+		batch = append(batch, card)
+		result.Created++
+		if len(batch) == importBatchSize {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+
+	if dryRun {
+		return result, nil
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return result, nil
 }
 
-func GetAllCards(deckName string) ([]Card, error) {
-	var rows *sql.Rows
-	var err error
+// updateImportedBack gives an existing card the back of an imported card.
+// A card made from a note has its note updated instead, so the note's
+// other cards change too.
+func updateImportedBack(q querier, id int64, back string) error {
+	res, err := q.Exec(
+		`UPDATE cards SET back = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ? AND note_id IS NULL`,
+		back, id,
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+
+	card, err := getCard(q, int(id))
+	if err != nil {
+		return err
+	}
+	card.Back = back
+	return editNoteCard(q, card)
+}
 
-	if deckName == "" {
-		rows, err = db.Query(
-			`SELECT id, deck_name, front, back, ease, interval, next_review, created_at, updated_at
-			 FROM cards ORDER BY created_at DESC`,
-		)
-	} else {
-		rows, err = db.Query(
-			`SELECT id, deck_name, front, back, ease, interval, next_review, created_at, updated_at
-			 FROM cards WHERE deck_name = ? ORDER BY created_at DESC`,
-			deckName,
-		)
+// addReverseNotes creates a "Basic (and reversed card)" note for each card
+// of a batch with Reverse set, links the card to it and returns the
+// reversed cards to insert after the batch.
+func addReverseNotes(q querier, batch []Card, decks map[string]*importDeck) ([]Card, error) {
+	var args []any
+	for _, card := range batch {
+		if card.Reverse {
+			fields, err := json.Marshal(map[string]string{"Front": card.Front, "Back": card.Back})
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, reversedNoteType, string(fields))
+		}
+	}
+	if len(args) == 0 {
+		return nil, nil
 	}
 
+	res, err := q.Exec(`INSERT INTO notes (note_type, fields) VALUES (?, ?)`+strings.Repeat(`, (?, ?)`, len(args)/2-1), args...)
+	if err != nil {
+		return nil, err
+	}
+	last, err := res.LastInsertId()
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
 
-	var cards []Card
-	for rows.Next() {
-		var card Card
-		err := rows.Scan(&card.ID, &card.DeckName, &card.Front, &card.Back, &card.Ease, &card.Interval, &card.NextReview, &card.CreatedAt, &card.UpdatedAt)
-		if err != nil {
-			return nil, err
+	noteID := int(last) - len(args)/2
+	var reversed []Card
+	for i := range batch {
+		if !batch[i].Reverse {
+			continue
 		}
-		cards = append(cards, card)
+		noteID++
+		id := noteID
+		batch[i].NoteID, batch[i].Template = &id, 0
+		reversed = append(reversed, Card{
+			DeckName:   batch[i].DeckName,
+			Front:      batch[i].Back,
+			Back:       batch[i].Front,
+			Ease:       decks[batch[i].DeckName].settings.StartingEase,
+			NextReview: time.Now(),
+			State:      StateNew,
+			NoteID:     &id,
+			Template:   1,
+			Tags:       batch[i].Tags,
+		})
+	}
+	return reversed, nil
+}
+
+// insertCardBatch inserts up to importBatchSize cards with one statement and
+// sets their IDs, then tags them. The cards must already have their
+// scheduling.
+func insertCardBatch(q querier, cards []Card) error {
+	if len(cards) == 0 {
+		return nil
 	}
 
-	return cards, nil
+	args := make([]any, 0, len(cards)*11)
+	for _, card := range cards {
+		args = append(args, card.DeckName, card.Front, card.Back, card.Ease, card.Interval, card.NextReview,
+			card.State, card.Lapses, card.Suspended, card.NoteID, card.Template)
+	}
+	res, err := q.Exec(
+		`INSERT INTO cards (deck_name, front, back, ease, interval, next_review, state, lapses, suspended, note_id, template)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`+strings.Repeat(`, (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, len(cards)-1),
+		args...,
+	)
+	if err != nil {
+		return err
+	}
+	// AUTOINCREMENT hands out consecutive IDs within the write transaction
+	last, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	for i := range cards {
+		cards[i].ID = int(last) - len(cards) + 1 + i
+	}
+
+	var tags, pairs []any
+	seen := make(map[string]bool)
+	for _, card := range cards {
+		for _, tag := range card.Tags {
+			if !seen[tag] {
+				seen[tag] = true
+				tags = append(tags, tag)
+			}
+			pairs = append(pairs, card.ID, tag)
+		}
+	}
+	if err := execValues(q, `INSERT OR IGNORE INTO tags (name) VALUES `, `(?)`, 1, tags); err != nil {
+		return err
+	}
+	return execValues(q, `INSERT OR IGNORE INTO card_tags (card_id, tag_id) VALUES `,
+		`(?, (SELECT id FROM tags WHERE name = ?))`, 2, pairs)
 }
 
-func GetDueCards(deckName string, limit int) ([]Card, error) {
-	var rows *sql.Rows
-	var err error
+// maxSQLParams is the most parameters execValues puts in one statement,
+// below SQLite's limit of 999 in older builds.
+const maxSQLParams = 900
 
-	if deckName == "" {
-		rows, err = db.Query(
-			`SELECT id, deck_name, front, back, ease, interval, next_review, created_at, updated_at
-			 FROM cards WHERE next_review <= ? ORDER BY next_review LIMIT ?`,
-			time.Now(), limit,
-		)
-	} else {
-		rows, err = db.Query(
-			`SELECT id, deck_name, front, back, ease, interval, next_review, created_at, updated_at
-			 FROM cards WHERE deck_name = ? AND next_review <= ? ORDER BY next_review LIMIT ?`,
-			deckName, time.Now(), limit,
-		)
+// execValues runs a multi-row INSERT of args, perRow values per row, in as
+// few statements as the parameter limit allows.
+func execValues(q querier, insert, row string, perRow int, args []any) error {
+	rows := maxSQLParams / perRow
+	for len(args) > 0 {
+		n := len(args) / perRow
+		if n > rows {
+			n = rows
+		}
+		_, err := q.Exec(insert+row+strings.Repeat(`, `+row, n-1), args[:n*perRow]...)
+		if err != nil {
+			return err
+		}
+		args = args[n*perRow:]
 	}
+	return nil
+}
 
+// loadImportDeck creates the deck if needed and, when dedup is set, reads
+// the fronts already in it.
+func loadImportDeck(q querier, name string, dedup bool) (*importDeck, error) {
+	if err := ensureDeck(q, name); err != nil {
+		return nil, err
+	}
+	settings, err := getDeckSettings(q, name)
 	if err != nil {
 		return nil, err
 	}
+
+	deck := &importDeck{settings: settings, existing: make(map[string][]int64), queued: make(map[string]int)}
+	if !dedup {
+		return deck, nil
+	}
+
+	rows, err := q.Query(`SELECT id, front FROM cards WHERE deck_name = ? ORDER BY id`, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var front string
+		if err := rows.Scan(&id, &front); err != nil {
+			return nil, err
+		}
+		deck.existing[front] = append(deck.existing[front], id)
+	}
+	return deck, rows.Err()
+}
+
+// scanCards reads every row of a card query and closes rows.
+func scanCards(rows *sql.Rows) ([]Card, error) {
 	defer rows.Close()
 
 	var cards []Card
 	for rows.Next() {
 		var card Card
-		err := rows.Scan(&card.ID, &card.DeckName, &card.Front, &card.Back, &card.Ease, &card.Interval, &card.NextReview, &card.CreatedAt, &card.UpdatedAt)
-		if err != nil {
+		if err := scanCard(rows, &card); err != nil {
 			return nil, err
 		}
 		cards = append(cards, card)
 	}
 
-	return cards, nil
+	return cards, rows.Err()
 }
 
-func GetDecks() ([]string, error) {
-	rows, err := db.Query(`SELECT DISTINCT deck_name FROM cards ORDER BY deck_name`)
+func GetCard(db *Collection, id int) (*Card, error) {
+	return getCard(db, id)
+}
+
+func getCard(q querier, id int) (*Card, error) {
+	card := &Card{}
+	err := scanCard(q.QueryRow(`SELECT `+cardColumns+` FROM cards WHERE id = ?`, id), card)
+	if err != nil {
+		return nil, err
+	}
+	return card, nil
+}
+
+// CardFilter narrows down the cards returned by GetAllCards and GetDueCards.
+type CardFilter struct {
+	Deck         string    // Deck name, including its subdecks
+	Tag          string    // Only cards with this tag
+	Leech        bool      // Only cards tagged as leeches
+	CreatedAfter time.Time // Only cards created after this time, if set
+	DueBefore    time.Time // Only cards due before this time, if set
+	MinInterval  int       // Only cards with at least this interval in days
+}
+
+// where returns the filter's WHERE conditions on the cards table.
+func (f CardFilter) where() ([]string, []any) {
+	var where []string
+	var args []any
+
+	if f.Deck != "" {
+		cond, condArgs := deckFilter("deck_name", f.Deck)
+		where = append(where, cond)
+		args = append(args, condArgs...)
+	}
+	if f.Tag != "" {
+		cond, condArgs := tagFilter("id", f.Tag)
+		where = append(where, cond)
+		args = append(args, condArgs...)
+	}
+	if f.Leech {
+		cond, condArgs := tagFilter("id", LeechTag)
+		where = append(where, cond)
+		args = append(args, condArgs...)
+	}
+	if !f.CreatedAfter.IsZero() {
+		// created_at is set by SQLite's CURRENT_TIMESTAMP, in UTC
+		where = append(where, `created_at > ?`)
+		args = append(args, f.CreatedAfter.UTC().Format("2006-01-02 15:04:05"))
+	}
+	if !f.DueBefore.IsZero() {
+		where = append(where, `next_review < ?`)
+		args = append(args, f.DueBefore.In(time.Local))
+	}
+	if f.MinInterval > 0 {
+		where = append(where, `interval >= ?`)
+		args = append(args, f.MinInterval)
+	}
+	return where, args
+}
+
+// ListOptions sorts a card listing and selects a page of it. A zero Limit
+// means no limit.
+type ListOptions struct {
+	Sort   string // One of cardSorts, "created" by default
+	Desc   bool
+	Limit  int
+	Offset int
+}
+
+// cardSorts maps ListOptions.Sort values to the column sorted by.
+var cardSorts = map[string]string{
+	"created":  "created_at",
+	"due":      "next_review",
+	"ease":     "ease",
+	"position": "position",
+}
+
+// GetAllCards returns the cards matching the filter in the requested order
+// and page, along with the total number of matching cards.
+func GetAllCards(db *Collection, filter CardFilter, opts ListOptions) ([]Card, int, error) {
+	where, args := filter.where()
+	whereSQL := ""
+	if len(where) > 0 {
+		whereSQL = ` WHERE ` + strings.Join(where, ` AND `)
+	}
+
+	var total int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM cards`+whereSQL, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	// SQLite treats a negative LIMIT as no limit
+	limit := opts.Limit
+	if limit == 0 {
+		limit = -1
+	}
+	column, ok := cardSorts[opts.Sort]
+	if !ok {
+		column = cardSorts["created"]
+	}
+	direction := ` ASC`
+	if opts.Desc {
+		direction = ` DESC`
+	}
+
+	rows, err := db.Query(
+		`SELECT `+cardColumns+` FROM cards`+whereSQL+` ORDER BY `+column+direction+`, id`+direction+` LIMIT ? OFFSET ?`,
+		append(args, limit, opts.Offset)...,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	cards, err := scanCards(rows)
+	if err != nil {
+		return nil, 0, err
+	}
+	return cards, total, nil
+}
+
+func GetDecks(db *Collection) ([]string, error) {
+	rows, err := db.Query(`SELECT name FROM decks ORDER BY name`)
 	if err != nil {
 		return nil, err
 	}
@@ -183,64 +1017,356 @@ func GetDecks() ([]string, error) {
 	return decks, nil
 }
 
-func UpdateCard(card *Card) error {
-	_, err := db.Exec(
-		`UPDATE cards SET deck_name = ?, front = ?, back = ?, ease = ?, interval = ?, next_review = ?, updated_at = CURRENT_TIMESTAMP
+// UpdateCard saves a card. A new front or back of a card made from a note
+// goes into the note's fields, updating the note's other cards too.
+func UpdateCard(db *Collection, card *Card) error {
+	if card.NoteID == nil {
+		return updateCard(db, card)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	before, err := getCard(tx, card.ID)
+	if err != nil {
+		return err
+	}
+	if card.Front != before.Front || card.Back != before.Back {
+		if err := editNoteCard(tx, card); err != nil {
+			return err
+		}
+		rendered, err := getCard(tx, card.ID)
+		if err != nil {
+			return err
+		}
+		card.Front, card.Back = rendered.Front, rendered.Back
+	}
+	if err := updateCard(tx, card); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func updateCard(q querier, card *Card) error {
+	if err := ensureDeck(q, card.DeckName); err != nil {
+		return err
+	}
+
+	_, err := q.Exec(
+		`UPDATE cards SET deck_name = ?, front = ?, back = ?, ease = ?, interval = ?, next_review = ?, state = ?, step = ?,
+		                  lapses = ?, suspended = ?, buried_until = ?, home_deck = ?, updated_at = CURRENT_TIMESTAMP
 		 WHERE id = ?`,
-		card.DeckName, card.Front, card.Back, card.Ease, card.Interval, card.NextReview, card.ID,
+		card.DeckName, card.Front, card.Back, card.Ease, card.Interval, card.NextReview, card.State, card.Step,
+		card.Lapses, card.Suspended, card.BuriedUntil, card.HomeDeck, card.ID,
 	)
 	return err
 }
 
-func DeleteCard(id int) error {
+// SetSuspended suspends or unsuspends a card. Suspended cards keep their
+// scheduling but are left out of the review queue.
+func SetSuspended(db *Collection, id int, suspended bool) (*Card, error) {
+	_, err := db.Exec(
+		`UPDATE cards SET suspended = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?`,
+		suspended, id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return GetCard(db, id)
+}
+
+// SetBuried hides a card from the review queue until the next study day
+// starts, or makes a buried card available again.
+func SetBuried(db *Collection, id int, buried bool) (*Card, error) {
+	var until *time.Time
+	if buried {
+		t := dueAfterDays(time.Now(), 1)
+		until = &t
+	}
+
+	_, err := db.Exec(
+		`UPDATE cards SET buried_until = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?`,
+		until, id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return GetCard(db, id)
+}
+
+var ErrInvalidReschedule = errors.New("invalid reschedule")
+
+// maxRescheduleDays bounds how far ahead a card can be rescheduled.
+const maxRescheduleDays = 36500
+
+// Reschedule sets the day a card is due, given as a Date (YYYY-MM-DD) or
+// as Days from today. The ease is kept unless ResetEase is set.
+type Reschedule struct {
+	Date string `json:"date"`
+	Days *int   `json:"days"`
+	// SetInterval also makes the interval the days until the new due date,
+	// so the following interval grows from it
+	SetInterval bool `json:"set_interval"`
+	// ResetEase sets the ease back to the deck's starting ease
+	ResetEase bool `json:"reset_ease"`
+}
+
+// RescheduleCard makes a card due at the start of the study day asked for.
+// New and learning cards become review cards with an interval of the days
+// until then, as do cards rescheduled with SetInterval.
+func RescheduleCard(db *Collection, id int, req Reschedule) (*Card, error) {
+	now := time.Now()
+	var days int
+	switch {
+	case req.Date != "" && req.Days != nil:
+		return nil, fmt.Errorf("%w: give either date or days", ErrInvalidReschedule)
+	case req.Date != "":
+		date, err := time.ParseInLocation("2006-01-02", req.Date, dayLocation)
+		if err != nil {
+			return nil, fmt.Errorf("%w: date must be YYYY-MM-DD", ErrInvalidReschedule)
+		}
+		// Counted in calendar dates, which daylight saving leaves alone
+		today, _ := time.ParseInLocation("2006-01-02", studyDate(now), dayLocation)
+		days = int(math.Round(date.Sub(today).Hours() / 24))
+	case req.Days != nil:
+		days = *req.Days
+	default:
+		return nil, fmt.Errorf("%w: date or days is required", ErrInvalidReschedule)
+	}
+	if days < 0 || days > maxRescheduleDays {
+		return nil, fmt.Errorf("%w: the due date must be from today to %d days ahead", ErrInvalidReschedule, maxRescheduleDays)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	card, err := getCard(tx, id)
+	if err != nil {
+		return nil, err
+	}
+	settings, err := getCardSettings(tx, card)
+	if err != nil {
+		return nil, err
+	}
+
+	if card.State != StateReview || req.SetInterval {
+		card.Interval = clampInterval(days, settings)
+	}
+	if req.ResetEase {
+		card.Ease = settings.StartingEase
+	}
+	card.State = StateReview
+	card.Step = 0
+	card.BuriedUntil = nil
+	card.NextReview = dueAfterDays(now, days)
+	if err := updateCard(tx, card); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return card, nil
+}
+
+// ForgetCard resets a card to new, as if it had never been studied, for
+// cards rewritten enough to be learned again: the ease goes back to the
+// deck's starting ease, and the interval, learning step and lapses to 0.
+// It keeps its content, tags and place among the new cards, but is no
+// longer a leech. The review log is kept.
+func ForgetCard(db *Collection, id int) (*Card, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	card, err := getCard(tx, id)
+	if err != nil {
+		return nil, err
+	}
+	settings, err := getCardSettings(tx, card)
+	if err != nil {
+		return nil, err
+	}
+
+	card.Ease = settings.StartingEase
+	card.Interval = 0
+	card.NextReview = time.Now()
+	card.State = StateNew
+	card.Step = 0
+	card.Lapses = 0
+	card.BuriedUntil = nil
+	if err := updateCard(tx, card); err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec(
+		`DELETE FROM card_tags WHERE card_id = ? AND tag_id IN (SELECT id FROM tags WHERE name = ?)`,
+		id, LeechTag,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if card, err = getCard(tx, id); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return card, nil
+}
+
+func DeleteCard(db *Collection, id int) error {
 	_, err := db.Exec(`DELETE FROM cards WHERE id = ?`, id)
 	return err
 }
 
-// Simple SM-2 algorithm implementation
-func CalculateNextReview(card *Card, score int) {
-	// score: 1=Again, 2=Hard, 3=Good, 4=Easy
+// DuplicateGroup is a set of cards sharing the same normalized front,
+// ordered oldest first.
+type DuplicateGroup struct {
+	NormalizedFront string `json:"normalized_front"`
+	Cards           []Card `json:"cards"`
+}
 
-	if score < 3 {
-		// Failed: reset interval
-		card.Interval = 0
-		card.Ease = max(1.3, card.Ease-0.2)
-		card.NextReview = time.Now().Add(1 * time.Minute) // Review again in 1 minute
-	} else {
-		// Passed: increase interval
-		if card.Interval == 0 {
-			card.Interval = 1
-		} else if card.Interval == 1 {
-			card.Interval = 6
-		} else {
-			card.Interval = int(float64(card.Interval) * card.Ease)
+// DedupeGroup describes how one duplicate group is (or would be) merged.
+type DedupeGroup struct {
+	NormalizedFront string `json:"normalized_front"`
+	Kept            Card   `json:"kept"`
+	Removed         []Card `json:"removed"`
+}
+
+// DedupeReport is returned by DedupeDeck for both dry and real runs.
+type DedupeReport struct {
+	DeckName     string        `json:"deck_name"`
+	DryRun       bool          `json:"dry_run"`
+	Groups       []DedupeGroup `json:"groups"`
+	RemovedCount int           `json:"removed_count"`
+}
+
+// normalizeFront folds case and whitespace so near-identical fronts compare equal.
+func normalizeFront(front string) string {
+	return strings.Join(strings.Fields(strings.ToLower(front)), " ")
+}
+
+// groupDuplicates groups cards by normalized front, keeping only groups with
+// more than one card. Cards within a group are ordered oldest first.
+func groupDuplicates(cards []Card) []DuplicateGroup {
+	sort.SliceStable(cards, func(i, j int) bool {
+		if !cards[i].CreatedAt.Equal(cards[j].CreatedAt) {
+			return cards[i].CreatedAt.Before(cards[j].CreatedAt)
+		}
+		return cards[i].ID < cards[j].ID
+	})
+
+	index := make(map[string]int)
+	var groups []DuplicateGroup
+	for _, card := range cards {
+		key := normalizeFront(card.Front)
+		i, ok := index[key]
+		if !ok {
+			i = len(groups)
+			index[key] = i
+			groups = append(groups, DuplicateGroup{NormalizedFront: key})
 		}
+		groups[i].Cards = append(groups[i].Cards, card)
+	}
 
-		// Adjust ease factor
-		if score == 3 {
-			// Good - no change to ease
-		} else if score == 4 {
-			// Easy - increase ease
-			card.Ease = min(card.Ease+0.15, 2.5)
-		} else if score == 2 {
-			// Hard - decrease ease
-			card.Ease = max(1.3, card.Ease-0.15)
+	duplicates := []DuplicateGroup{}
+	for _, group := range groups {
+		if len(group.Cards) > 1 {
+			duplicates = append(duplicates, group)
 		}
+	}
+	return duplicates
+}
 
-		card.NextReview = time.Now().Add(time.Duration(card.Interval) * 24 * time.Hour)
+// FindDuplicates returns groups of cards in deckName that share a normalized front.
+// Subdecks are not included.
+func FindDuplicates(db *Collection, deckName string) ([]DuplicateGroup, error) {
+	rows, err := db.Query(`SELECT `+cardColumns+` FROM cards WHERE deck_name = ?`, deckName)
+	if err != nil {
+		return nil, err
+	}
+	cards, err := scanCards(rows)
+	if err != nil {
+		return nil, err
 	}
+	return groupDuplicates(cards), nil
 }
 
-func max(a, b float64) float64 {
-	if a > b {
-		return a
+// FindAllDuplicates returns groups of cards matching filter that share a
+// normalized front, across decks. Unlike FindDuplicates, a deck filter
+// includes subdecks.
+func FindAllDuplicates(db *Collection, filter CardFilter) ([]DuplicateGroup, error) {
+	query := `SELECT ` + cardColumns + ` FROM cards`
+	where, args := filter.where()
+	if len(where) > 0 {
+		query += ` WHERE ` + strings.Join(where, ` AND `)
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
 	}
-	return b
+	cards, err := scanCards(rows)
+	if err != nil {
+		return nil, err
+	}
+	return groupDuplicates(cards), nil
 }
 
-func min(a, b float64) float64 {
-	if a < b {
-		return a
+// DedupeDeck merges duplicate cards in deckName, keeping the oldest card of
+// each group. With dryRun set the report is built but nothing is deleted.
+func DedupeDeck(db *Collection, deckName string, dryRun bool) (*DedupeReport, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(
+		`SELECT `+cardColumns+`
+		 FROM cards WHERE deck_name = ?`,
+		deckName,
+	)
+	if err != nil {
+		return nil, err
+	}
+	cards, err := scanCards(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &DedupeReport{DeckName: deckName, DryRun: dryRun, Groups: []DedupeGroup{}}
+	for _, group := range groupDuplicates(cards) {
+		report.Groups = append(report.Groups, DedupeGroup{
+			NormalizedFront: group.NormalizedFront,
+			Kept:            group.Cards[0],
+			Removed:         group.Cards[1:],
+		})
+		report.RemovedCount += len(group.Cards) - 1
+	}
+
+	if dryRun {
+		return report, nil
+	}
+
+	for _, group := range report.Groups {
+		for _, card := range group.Removed {
+			if _, err := tx.Exec(`DELETE FROM cards WHERE id = ?`, card.ID); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
 	}
-	return b
+	return report, nil
 }
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// DeckSeparator separates the levels of a nested deck name,
+// e.g. "Japanese::Vocab::N5".
+const DeckSeparator = "::"
+
+var (
+	ErrDeckNotFound    = errors.New("deck not found")
+	ErrDeckExists      = errors.New("a deck with that name already exists")
+	ErrDeckNotEmpty    = errors.New("deck still contains cards")
+	ErrDeckIntoSubdeck = errors.New("a deck cannot be moved into its own subdeck")
+)
+
+// Deck is a named collection of cards. Cards reference their deck by name.
+type Deck struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	CardCount int       `json:"card_count"` // Including subdecks
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// DeckNode is one level of the deck hierarchy returned by GetDeckTree.
+// Counts include all subdecks.
+type DeckNode struct {
+	Name       string      `json:"name"`      // Last path component, e.g. "N5"
+	FullName   string      `json:"full_name"` // e.g. "Japanese::Vocab::N5"
+	TotalCount int         `json:"total_count"`
+	DueCount   int         `json:"due_count"` // Learning and review cards due now
+	NewCount   int         `json:"new_count"` // Never reviewed cards
+	Children   []*DeckNode `json:"children"`
+}
+
+// deckFilter returns a WHERE fragment matching column against a deck and all
+// of its subdecks. The range comparison (":;" sorts right after "::") keeps
+// the index usable and avoids LIKE escaping.
+func deckFilter(column, deckName string) (string, []any) {
+	return `(` + column + ` = ? OR (` + column + ` >= ? AND ` + column + ` < ?))`,
+		[]any{deckName, deckName + DeckSeparator, deckName + ":;"}
+}
+
+// isSubdeckOf reports whether name is deckName itself or one of its subdecks.
+func isSubdeckOf(name, deckName string) bool {
+	return name == deckName || strings.HasPrefix(name, deckName+DeckSeparator)
+}
+
+// ensureDeck creates the deck row for name, and for each of its parents,
+// if they do not exist yet.
+func ensureDeck(q querier, name string) error {
+	parts := strings.Split(name, DeckSeparator)
+	for i := range parts {
+		path := strings.Join(parts[:i+1], DeckSeparator)
+		if _, err := q.Exec(`INSERT OR IGNORE INTO decks (name) VALUES (?)`, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func GetDeck(db *Collection, name string) (*Deck, error) {
+	filter, args := deckFilter("c.deck_name", name)
+
+	deck := &Deck{}
+	err := db.QueryRow(
+		`SELECT d.id, d.name, d.created_at, (SELECT COUNT(*) FROM cards c WHERE `+filter+`)
+		 FROM decks d WHERE d.name = ?`,
+		append(args, name)...,
+	).Scan(&deck.ID, &deck.Name, &deck.CreatedAt, &deck.CardCount)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrDeckNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return deck, nil
+}
+
+// GetDeckTree returns all decks arranged by their "::" hierarchy, with card
+// counts for each deck.
+func GetDeckTree(db *Collection) ([]*DeckNode, error) {
+	names, err := GetDecks(db)
+	if err != nil {
+		return nil, err
+	}
+	tree := buildDeckTree(names)
+
+	// Suspended and buried cards are not counted as due or new
+	now := time.Now()
+	rows, err := db.Query(
+		`SELECT deck_name, COUNT(*),
+		        COALESCE(SUM(state != 'new' AND next_review <= ? AND suspended = 0 AND (buried_until IS NULL OR buried_until <= ?)), 0),
+		        COALESCE(SUM(state = 'new' AND suspended = 0 AND (buried_until IS NULL OR buried_until <= ?)), 0)
+		 FROM cards GROUP BY deck_name`,
+		now, now, now,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]DeckNode)
+	for rows.Next() {
+		var name string
+		var c DeckNode
+		if err := rows.Scan(&name, &c.TotalCount, &c.DueCount, &c.NewCount); err != nil {
+			return nil, err
+		}
+		counts[name] = c
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, node := range tree {
+		sumDeckCounts(node, counts)
+	}
+	return tree, nil
+}
+
+// sumDeckCounts fills in the counts of node from its own cards plus those
+// of its children.
+func sumDeckCounts(node *DeckNode, counts map[string]DeckNode) {
+	own := counts[node.FullName]
+	node.TotalCount, node.DueCount, node.NewCount = own.TotalCount, own.DueCount, own.NewCount
+
+	for _, child := range node.Children {
+		sumDeckCounts(child, counts)
+		node.TotalCount += child.TotalCount
+		node.DueCount += child.DueCount
+		node.NewCount += child.NewCount
+	}
+}
+
+// buildDeckTree arranges sorted deck names into a tree, adding nodes for
+// parents that have no deck row of their own.
+func buildDeckTree(names []string) []*DeckNode {
+	roots := []*DeckNode{}
+	nodes := make(map[string]*DeckNode)
+
+	for _, name := range names {
+		parts := strings.Split(name, DeckSeparator)
+		for i := range parts {
+			fullName := strings.Join(parts[:i+1], DeckSeparator)
+			if _, ok := nodes[fullName]; ok {
+				continue
+			}
+
+			node := &DeckNode{Name: parts[i], FullName: fullName, Children: []*DeckNode{}}
+			nodes[fullName] = node
+			if i == 0 {
+				roots = append(roots, node)
+			} else {
+				parent := nodes[strings.Join(parts[:i], DeckSeparator)]
+				parent.Children = append(parent.Children, node)
+			}
+		}
+	}
+
+	return roots
+}
+
+// CreateDeck creates an empty deck (and any missing parents).
+func CreateDeck(db *Collection, name string) (*Deck, error) {
+	if err := checkDeckExists(db, name); err == nil {
+		return nil, ErrDeckExists
+	} else if !errors.Is(err, ErrDeckNotFound) {
+		return nil, err
+	}
+
+	if err := ensureDeck(db, name); err != nil {
+		return nil, err
+	}
+	return GetDeck(db, name)
+}
+
+// RenameDeck renames a deck and its subdecks, moving their cards, settings
+// and filtered deck definitions along with them.
+func RenameDeck(db *Collection, oldName, newName string) error {
+	if isSubdeckOf(newName, oldName) {
+		return ErrDeckIntoSubdeck
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := checkDeckExists(tx, oldName); err != nil {
+		return err
+	}
+	if err := checkDeckExists(tx, newName); err == nil {
+		return ErrDeckExists
+	} else if !errors.Is(err, ErrDeckNotFound) {
+		return err
+	}
+
+	// Replace the old prefix; substr counts characters, not bytes
+	suffixStart := utf8.RuneCountInString(oldName) + 1
+	renames := []struct{ table, column, extra string }{
+		{"decks", "name", ""},
+		{"cards", "deck_name", ", updated_at = CURRENT_TIMESTAMP"},
+		{"cards", "home_deck", ""},
+		{"deck_settings", "deck_name", ""},
+		{"filtered_decks", "name", ""},
+		{"deck_shares", "deck_name", ""},
+	}
+	for _, r := range renames {
+		filter, args := deckFilter(r.column, oldName)
+		_, err := tx.Exec(
+			`UPDATE `+r.table+` SET `+r.column+` = ? || substr(`+r.column+`, ?)`+r.extra+` WHERE `+filter,
+			append([]any{newName, suffixStart}, args...)...,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The new name may be nested under parents that do not exist yet
+	if err := ensureDeck(tx, newName); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DeleteDeck removes a deck and its subdecks. Cards borrowed by filtered
+// decks are returned home first: filtered decks among them are emptied, and
+// cards from them in other filtered decks come back. Cards still in the
+// decks are then moved to moveTo when it is set, deleted when deleteCards
+// is true, and otherwise cause ErrDeckNotEmpty. It returns the number of
+// cards moved or deleted.
+func DeleteDeck(db *Collection, name string, deleteCards bool, moveTo string) (int, error) {
+	if moveTo != "" && isSubdeckOf(moveTo, name) {
+		return 0, ErrDeckIntoSubdeck
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if err := checkDeckExists(tx, name); err != nil {
+		return 0, err
+	}
+
+	filter, args := deckFilter("deck_name", name)
+	homeFilter, homeArgs := deckFilter("home_deck", name)
+	_, err = tx.Exec(
+		`UPDATE cards SET deck_name = home_deck, home_deck = '', updated_at = CURRENT_TIMESTAMP
+		 WHERE home_deck != '' AND (`+filter+` OR `+homeFilter+`)`,
+		append(append([]any{}, args...), homeArgs...)...,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	var count int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM cards WHERE `+filter, args...).Scan(&count); err != nil {
+		return 0, err
+	}
+
+	if count > 0 {
+		switch {
+		case moveTo != "":
+			if err := ensureDeck(tx, moveTo); err != nil {
+				return 0, err
+			}
+			_, err = tx.Exec(
+				`UPDATE cards SET deck_name = ?, updated_at = CURRENT_TIMESTAMP WHERE `+filter,
+				append([]any{moveTo}, args...)...,
+			)
+		case deleteCards:
+			_, err = tx.Exec(`DELETE FROM cards WHERE `+filter, args...)
+		default:
+			return 0, ErrDeckNotEmpty
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if _, err := tx.Exec(`DELETE FROM deck_settings WHERE `+filter, args...); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`DELETE FROM deck_shares WHERE `+filter, args...); err != nil {
+		return 0, err
+	}
+	nameFilter, nameArgs := deckFilter("name", name)
+	if _, err := tx.Exec(`DELETE FROM filtered_decks WHERE `+nameFilter, nameArgs...); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`DELETE FROM decks WHERE `+nameFilter, nameArgs...); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func checkDeckExists(q querier, name string) error {
+	var id int
+	err := q.QueryRow(`SELECT id FROM decks WHERE name = ?`, name).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrDeckNotFound
+	}
+	return err
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Semantic duplicates are cards whose fronts ask the same thing in other
+// words ("Capital of France?" and "What city is France's capital?"). They
+// are found by comparing embeddings of the fronts from an OpenAI-compatible
+// embeddings API, by default the LLM's (see llm.go). Embeddings are stored
+// in the embeddings table by model and text, so only new and edited fronts
+// are sent to the API.
+
+// embeddingURL and embeddingModel are set from -embedding-url and
+// -embedding-model in main; without -embedding-url the LLM's URL is used.
+var (
+	embeddingURL   = ""
+	embeddingModel = "text-embedding-3-small"
+)
+
+var ErrInvalidDuplicates = errors.New("invalid duplicates request")
+
+const (
+	// embeddingBatch is how many texts are embedded per request.
+	embeddingBatch = 64
+	// maxSemanticCards bounds the cards compared, as every pair is.
+	maxSemanticCards = 5000
+	// maxPossibleDuplicates bounds the pairs reported.
+	maxPossibleDuplicates = 200
+	// defaultSemanticThreshold is the cosine similarity from which two
+	// fronts are reported.
+	defaultSemanticThreshold = 0.9
+)
+
+// PossibleDuplicate is a pair of cards whose fronts mean much the same,
+// oldest first.
+type PossibleDuplicate struct {
+	Similarity float64 `json:"similarity"` // Cosine similarity of the fronts
+	Cards      []Card  `json:"cards"`
+}
+
+func embeddingBase() string {
+	if embeddingURL != "" {
+		return embeddingURL
+	}
+	return llmURL
+}
+
+// embedTexts returns the embeddings of texts, normalized to unit length, from
+// the store or the API.
+func embedTexts(db *Collection, ctx context.Context, texts []string) ([][]float32, error) {
+	if embeddingBase() == "" {
+		return nil, ErrLLMDisabled
+	}
+
+	vectors := make([][]float32, len(texts))
+	hashes := make([]string, len(texts))
+	for i, text := range texts {
+		sum := sha256.Sum256([]byte(text))
+		hashes[i] = hex.EncodeToString(sum[:])
+	}
+
+	stored := make(map[string][]float32)
+	rows, err := db.Query(`SELECT text_hash, vector FROM embeddings WHERE model = ?`, embeddingModel)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var hash string
+		var blob []byte
+		if err := rows.Scan(&hash, &blob); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		stored[hash] = decodeVector(blob)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	missing := make(map[string][]int) // Text hash to the texts needing it
+	var order []string
+	for i, hash := range hashes {
+		if v, ok := stored[hash]; ok {
+			vectors[i] = v
+			continue
+		}
+		if _, ok := missing[hash]; !ok {
+			order = append(order, hash)
+		}
+		missing[hash] = append(missing[hash], i)
+	}
+
+	for start := 0; start < len(order); start += embeddingBatch {
+		end := start + embeddingBatch
+		if end > len(order) {
+			end = len(order)
+		}
+		batch := order[start:end]
+		input := make([]string, len(batch))
+		for i, hash := range batch {
+			input[i] = texts[missing[hash][0]]
+		}
+
+		var resp struct {
+			Data []struct {
+				Index     int       `json:"index"`
+				Embedding []float64 `json:"embedding"`
+			} `json:"data"`
+		}
+		err := llmPost(ctx, embeddingBase(), "/embeddings", map[string]any{"model": embeddingModel, "input": input}, &resp)
+		if err != nil {
+			return nil, err
+		}
+		if len(resp.Data) != len(batch) {
+			return nil, fmt.Errorf("%w: asked for %d embeddings, got %d", ErrLLM, len(batch), len(resp.Data))
+		}
+
+		for _, d := range resp.Data {
+			if d.Index < 0 || d.Index >= len(batch) || len(d.Embedding) == 0 {
+				return nil, fmt.Errorf("%w: unexpected embedding", ErrLLM)
+			}
+			v := normalizeVector(d.Embedding)
+			hash := batch[d.Index]
+			_, err := db.Exec(`INSERT OR REPLACE INTO embeddings (model, text_hash, vector) VALUES (?, ?, ?)`,
+				embeddingModel, hash, encodeVector(v))
+			if err != nil {
+				return nil, err
+			}
+			for _, i := range missing[hash] {
+				vectors[i] = v
+			}
+		}
+	}
+	return vectors, nil
+}
+
+func normalizeVector(v []float64) []float32 {
+	var norm float64
+	for _, x := range v {
+		norm += x * x
+	}
+	norm = math.Sqrt(norm)
+	out := make([]float32, len(v))
+	for i, x := range v {
+		if norm > 0 {
+			out[i] = float32(x / norm)
+		}
+	}
+	return out
+}
+
+func encodeVector(v []float32) []byte {
+	blob := make([]byte, 4*len(v))
+	for i, x := range v {
+		binary.LittleEndian.PutUint32(blob[4*i:], math.Float32bits(x))
+	}
+	return blob
+}
+
+func decodeVector(blob []byte) []float32 {
+	v := make([]float32, len(blob)/4)
+	for i := range v {
+		v[i] = math.Float32frombits(binary.LittleEndian.Uint32(blob[4*i:]))
+	}
+	return v
+}
+
+// FindSemanticDuplicates returns pairs of cards matching filter whose
+// fronts have embeddings at least threshold similar, most similar first.
+// Pairs plain duplicate detection already finds, with the same normalized
+// front, and cards of the same note are left out.
+func FindSemanticDuplicates(db *Collection, ctx context.Context, filter CardFilter, threshold float64) ([]PossibleDuplicate, error) {
+	if threshold <= 0 || threshold > 1 {
+		return nil, fmt.Errorf("%w: threshold must be above 0 and at most 1", ErrInvalidDuplicates)
+	}
+
+	query := `SELECT ` + cardColumns + ` FROM cards`
+	where, args := filter.where()
+	if len(where) > 0 {
+		query += ` WHERE ` + strings.Join(where, ` AND `)
+	}
+	rows, err := db.Query(query+` ORDER BY created_at, id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	all, err := scanCards(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	// Fronts without text, like a lone image, cannot be compared
+	var cards []Card
+	var texts []string
+	for _, card := range all {
+		if text := answerText(card.Front); text != "" {
+			cards = append(cards, card)
+			texts = append(texts, text)
+		}
+	}
+	if len(cards) > maxSemanticCards {
+		return nil, fmt.Errorf("%w: %d cards is too many to compare; narrow it down to at most %d with deck or tag", ErrInvalidDuplicates, len(cards), maxSemanticCards)
+	}
+
+	vectors, err := embedTexts(db, ctx, texts)
+	if err != nil {
+		return nil, err
+	}
+
+	pairs := []PossibleDuplicate{}
+	for i := range cards {
+		for j := i + 1; j < len(cards); j++ {
+			a, b := cards[i], cards[j]
+			if a.NoteID != nil && b.NoteID != nil && *a.NoteID == *b.NoteID {
+				continue
+			}
+			if normalizeFront(a.Front) == normalizeFront(b.Front) || len(vectors[i]) != len(vectors[j]) {
+				continue
+			}
+			var dot float32
+			for k, x := range vectors[i] {
+				dot += x * vectors[j][k]
+			}
+			if similarity := float64(dot); similarity >= threshold {
+				pairs = append(pairs, PossibleDuplicate{Similarity: math.Round(similarity*1000) / 1000, Cards: []Card{a, b}})
+			}
+		}
+	}
+	sort.SliceStable(pairs, func(i, j int) bool { return pairs[i].Similarity > pairs[j].Similarity })
+	if len(pairs) > maxPossibleDuplicates {
+		pairs = pairs[:maxPossibleDuplicates]
+	}
+	return pairs, nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// csvExportHeader names the columns written by WriteCSV.
+var csvExportHeader = []string{
+	"id", "deck", "front", "back", "tags", "state", "step", "ease", "interval",
+	"next_review", "lapses", "suspended", "buried_until", "created_at", "updated_at",
+}
+
+// WriteCSV streams the cards of deckName and its subdecks, or every card
+// when deckName is empty, to w as CSV with a header row. Tags are space
+// separated and times are RFC 3339.
+func WriteCSV(db *Collection, w io.Writer, deckName string) error {
+	query := `SELECT ` + cardColumns + ` FROM cards`
+	var args []any
+	if deckName != "" {
+		var cond string
+		cond, args = deckFilter("deck_name", deckName)
+		query += ` WHERE ` + cond
+	}
+	rows, err := db.Query(query+` ORDER BY id`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvExportHeader); err != nil {
+		return err
+	}
+	for rows.Next() {
+		var card Card
+		if err := scanCard(rows, &card); err != nil {
+			return err
+		}
+		buried := ""
+		if card.BuriedUntil != nil {
+			buried = card.BuriedUntil.Format(time.RFC3339)
+		}
+		err := cw.Write([]string{
+			strconv.Itoa(card.ID),
+			card.DeckName,
+			card.Front,
+			card.Back,
+			strings.Join(card.Tags, " "),
+			card.State,
+			strconv.Itoa(card.Step),
+			strconv.FormatFloat(card.Ease, 'f', -1, 64),
+			strconv.Itoa(card.Interval),
+			card.NextReview.Format(time.RFC3339),
+			strconv.Itoa(card.Lapses),
+			strconv.FormatBool(card.Suspended),
+			buried,
+			card.CreatedAt.Format(time.RFC3339),
+			card.UpdatedAt.Format(time.RFC3339),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteMarkdownZip writes the cards of deckName and its subdecks, or every
+// card when deckName is empty, to w as a zip of Markdown notes, one per
+// deck. Folders follow the deck tree, so "Spanish::Verbs" is written to
+// Spanish/Verbs/Verbs.md and importing the zip gives back the same decks.
+//
+// Each card is a heading holding the front with the back under it. Decks
+// with a multi-line front use "Q:" and "A:" lines instead. Tags every card
+// of a deck shares go in the front matter; other tags end the card as
+// Obsidian-style "#tag" lines.
+func WriteMarkdownZip(db *Collection, w io.Writer, deckName string) error {
+	if deckName != "" {
+		if err := checkDeckExists(db, deckName); err != nil {
+			return err
+		}
+	}
+	cards, _, err := GetAllCards(db, CardFilter{Deck: deckName}, ListOptions{Sort: "created", Limit: -1})
+	if err != nil {
+		return err
+	}
+
+	byDeck := make(map[string][]Card)
+	var decks []string
+	for _, card := range cards {
+		if _, ok := byDeck[card.DeckName]; !ok {
+			decks = append(decks, card.DeckName)
+		}
+		byDeck[card.DeckName] = append(byDeck[card.DeckName], card)
+	}
+	slices.Sort(decks)
+
+	zw := zip.NewWriter(w)
+	for _, deck := range decks {
+		parts := strings.Split(deck, DeckSeparator)
+		for i, part := range parts {
+			parts[i] = strings.NewReplacer("/", "-", "\\", "-").Replace(part)
+		}
+		f, err := zw.Create(path.Join(path.Join(parts...), parts[len(parts)-1]+".md"))
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(f, markdownDeck(deck, byDeck[deck])); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// markdownDeck renders one deck's cards as a Markdown note.
+func markdownDeck(deck string, cards []Card) string {
+	shared := slices.Clone(cards[0].Tags)
+	for _, card := range cards[1:] {
+		shared = slices.DeleteFunc(shared, func(tag string) bool { return !slices.Contains(card.Tags, tag) })
+	}
+	qa := slices.ContainsFunc(cards, func(card Card) bool { return strings.Contains(card.Front, "\n") })
+
+	var b strings.Builder
+	if len(shared) > 0 {
+		quoted := make([]string, len(shared))
+		for i, tag := range shared {
+			quoted[i] = strconv.Quote(markdownTag(tag))
+		}
+		fmt.Fprintf(&b, "---\ntags: [%s]\n---\n", strings.Join(quoted, ", "))
+	}
+	fmt.Fprintf(&b, "# %s\n", deck)
+
+	for _, card := range cards {
+		if qa {
+			fmt.Fprintf(&b, "\nQ: %s\nA: %s\n", card.Front, card.Back)
+		} else {
+			fmt.Fprintf(&b, "\n## %s\n\n%s\n", card.Front, card.Back)
+		}
+		var extra []string
+		for _, tag := range card.Tags {
+			if !slices.Contains(shared, tag) {
+				extra = append(extra, "#"+markdownTag(tag))
+			}
+		}
+		if len(extra) > 0 {
+			fmt.Fprintf(&b, "\n%s\n", strings.Join(extra, " "))
+		}
+	}
+	return b.String()
+}
+
+// markdownTag writes a nested tag the way Obsidian does ("lang/spanish").
+func markdownTag(tag string) string {
+	return strings.ReplaceAll(tag, DeckSeparator, "/")
+}
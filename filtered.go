@@ -0,0 +1,208 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+var ErrInvalidCardOrder = errors.New("order must be 'due', 'random' or 'added'")
+
+// FilteredDeck is a temporary study session built from a search query.
+// Matching cards are moved into the deck and remember their home deck;
+// they return there when answered or when the deck is emptied.
+type FilteredDeck struct {
+	Name      string `json:"name"`
+	Query     string `json:"query"`
+	Limit     int    `json:"limit"` // Most cards pulled in
+	Order     string `json:"order"` // due, random or added
+	CardCount int    `json:"card_count"`
+}
+
+// filteredDeckOrders maps card orders to the ORDER BY used when building.
+var filteredDeckOrders = map[string]string{
+	"due":    `next_review`,
+	"random": `random()`,
+	"added":  `id`,
+}
+
+// CreateFilteredDeck creates a filtered deck and pulls matching cards into it.
+func CreateFilteredDeck(db *Collection, fd *FilteredDeck) error {
+	if fd.Order == "" {
+		fd.Order = "due"
+	}
+	if _, ok := filteredDeckOrders[fd.Order]; !ok {
+		return ErrInvalidCardOrder
+	}
+	if _, err := ParseQuery(fd.Query); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := checkDeckExists(tx, fd.Name); err == nil {
+		return ErrDeckExists
+	} else if !errors.Is(err, ErrDeckNotFound) {
+		return err
+	}
+	if err := ensureDeck(tx, fd.Name); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO filtered_decks (name, query, card_limit, card_order) VALUES (?, ?, ?, ?)`,
+		fd.Name, fd.Query, fd.Limit, fd.Order,
+	)
+	if err != nil {
+		return err
+	}
+
+	if fd.CardCount, err = fillFilteredDeck(tx, fd); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetFilteredDecks returns all filtered decks with their current card counts.
+func GetFilteredDecks(db *Collection) ([]FilteredDeck, error) {
+	rows, err := db.Query(
+		`SELECT f.name, f.query, f.card_limit, f.card_order,
+		        (SELECT COUNT(*) FROM cards c WHERE c.deck_name = f.name AND c.home_deck != '')
+		 FROM filtered_decks f ORDER BY f.name`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	decks := []FilteredDeck{}
+	for rows.Next() {
+		var fd FilteredDeck
+		if err := rows.Scan(&fd.Name, &fd.Query, &fd.Limit, &fd.Order, &fd.CardCount); err != nil {
+			return nil, err
+		}
+		decks = append(decks, fd)
+	}
+	return decks, rows.Err()
+}
+
+// RebuildFilteredDeck returns the deck's cards home and pulls in the cards
+// currently matching its query. It returns the new card count.
+func RebuildFilteredDeck(db *Collection, name string) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	fd, err := getFilteredDeck(tx, name)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := emptyFilteredDeck(tx, name); err != nil {
+		return 0, err
+	}
+	count, err := fillFilteredDeck(tx, fd)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// EmptyFilteredDeck returns all cards of a filtered deck to their home decks
+// and reports how many were returned. The deck itself is kept.
+func EmptyFilteredDeck(db *Collection, name string) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := getFilteredDeck(tx, name); err != nil {
+		return 0, err
+	}
+	count, err := emptyFilteredDeck(tx, name)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// isFilteredDeck reports whether name is a filtered deck.
+func isFilteredDeck(db *Collection, name string) (bool, error) {
+	_, err := getFilteredDeck(db, name)
+	if errors.Is(err, ErrDeckNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func getFilteredDeck(q querier, name string) (*FilteredDeck, error) {
+	fd := &FilteredDeck{}
+	err := q.QueryRow(
+		`SELECT name, query, card_limit, card_order FROM filtered_decks WHERE name = ?`, name,
+	).Scan(&fd.Name, &fd.Query, &fd.Limit, &fd.Order)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrDeckNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return fd, nil
+}
+
+// fillFilteredDeck moves up to fd.Limit cards matching the deck's query into
+// it. Cards already in a filtered deck, suspended and buried cards are left
+// alone.
+func fillFilteredDeck(q querier, fd *FilteredDeck) (int, error) {
+	parsed, err := ParseQuery(fd.Query)
+	if err != nil {
+		return 0, err
+	}
+
+	where := []string{`home_deck = ''`, `suspended = 0`, `(buried_until IS NULL OR buried_until <= ?)`}
+	args := []any{time.Now()}
+	if parsed.where != "" {
+		where = append(where, parsed.where)
+		args = append(args, parsed.args...)
+	}
+
+	result, err := q.Exec(
+		`UPDATE cards SET home_deck = deck_name, deck_name = ?, updated_at = CURRENT_TIMESTAMP
+		 WHERE id IN (SELECT id FROM cards WHERE `+strings.Join(where, ` AND `)+`
+		              ORDER BY `+filteredDeckOrders[fd.Order]+` LIMIT ?)`,
+		append(append([]any{fd.Name}, args...), fd.Limit)...,
+	)
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	return int(n), err
+}
+
+// emptyFilteredDeck returns the cards in a filtered deck to their home decks.
+func emptyFilteredDeck(q querier, name string) (int, error) {
+	result, err := q.Exec(
+		`UPDATE cards SET deck_name = home_deck, home_deck = '', updated_at = CURRENT_TIMESTAMP
+		 WHERE deck_name = ? AND home_deck != ''`,
+		name,
+	)
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	return int(n), err
+}
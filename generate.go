@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Cards are generated from pasted text, such as lecture notes or an
+// article, by the LLM (see llm.go). They are only proposed: the client
+// shows them for editing and creates the ones kept with /api/cards/bulk.
+
+var ErrInvalidGenerate = errors.New("invalid generate request")
+
+const (
+	// maxGenerateText bounds the text sent to the LLM in one request.
+	maxGenerateText = 100_000
+	// defaultGenerateCards and maxGenerateCards bound how many cards are
+	// asked for.
+	defaultGenerateCards = 20
+	maxGenerateCards     = 100
+)
+
+// GenerateRequest asks for cards about Text for DeckName.
+type GenerateRequest struct {
+	Text     string   `json:"text"`
+	DeckName string   `json:"deck_name"`
+	MaxCards int      `json:"max_cards"`
+	Tags     []string `json:"tags"`
+}
+
+// GeneratedCard is a proposed card, shaped for /api/cards/bulk.
+// DuplicateOf is the card in the deck with the same front, if any.
+type GeneratedCard struct {
+	DeckName    string   `json:"deck_name"`
+	Front       string   `json:"front"`
+	Back        string   `json:"back"`
+	Tags        []string `json:"tags"`
+	DuplicateOf *int     `json:"duplicate_of,omitempty"`
+}
+
+const generatePrompt = `You write flashcards for spaced repetition from the text the user gives you.
+
+Rules:
+- Write at most %d cards, fewer if the text does not have that many facts worth remembering.
+- Each card asks about one fact, definition, cause or relationship. Prefer "why" and "how" questions over trivia.
+- Questions must make sense on their own, without the text at hand: name the subject instead of saying "the text" or "it".
+- Answers are short: a word, a phrase or one sentence.
+- Write in the language of the text. Markdown and $...$ LaTeX math are allowed.
+
+Answer with a JSON object: {"cards": [{"front": "question", "back": "answer"}, ...]}`
+
+// GenerateCards has the LLM propose cards from a text.
+func GenerateCards(db *Collection, ctx context.Context, req GenerateRequest) ([]GeneratedCard, error) {
+	text := strings.TrimSpace(req.Text)
+	switch {
+	case text == "":
+		return nil, fmt.Errorf("%w: text is required", ErrInvalidGenerate)
+	case len(text) > maxGenerateText:
+		return nil, fmt.Errorf("%w: text is longer than %d characters", ErrInvalidGenerate, maxGenerateText)
+	case req.MaxCards < 0 || req.MaxCards > maxGenerateCards:
+		return nil, fmt.Errorf("%w: max_cards must be between 1 and %d", ErrInvalidGenerate, maxGenerateCards)
+	}
+	if req.MaxCards == 0 {
+		req.MaxCards = defaultGenerateCards
+	}
+	if req.DeckName == "" {
+		req.DeckName = "Default"
+	}
+	tags, err := normalizeTags(req.Tags)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidGenerate, err)
+	}
+
+	var answer struct {
+		Cards []struct {
+			Front string `json:"front"`
+			Back  string `json:"back"`
+		} `json:"cards"`
+	}
+	if err := llmChat(ctx, fmt.Sprintf(generatePrompt, req.MaxCards), text, &answer); err != nil {
+		return nil, err
+	}
+
+	existing, err := deckFronts(db, req.DeckName)
+	if err != nil {
+		return nil, err
+	}
+	cards := []GeneratedCard{}
+	seen := make(map[string]bool)
+	for _, c := range answer.Cards {
+		front, back := strings.TrimSpace(c.Front), strings.TrimSpace(c.Back)
+		key := normalizeFront(front)
+		if front == "" || back == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		card := GeneratedCard{DeckName: req.DeckName, Front: front, Back: back, Tags: tags}
+		if id, ok := existing[key]; ok {
+			card.DuplicateOf = &id
+		}
+		cards = append(cards, card)
+		if len(cards) == req.MaxCards {
+			break
+		}
+	}
+	return cards, nil
+}
+
+// proposeCards turns cards found in a text into proposals for deckName,
+// dropping repeated fronts and marking those already in the deck.
+func proposeCards(db *Collection, deckName string, found []ImportCard, tags []string) ([]GeneratedCard, error) {
+	existing, err := deckFronts(db, deckName)
+	if err != nil {
+		return nil, err
+	}
+	cards := []GeneratedCard{}
+	seen := make(map[string]bool)
+	for _, c := range found {
+		key := normalizeFront(c.Front)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		card := GeneratedCard{DeckName: deckName, Front: c.Front, Back: c.Back, Tags: tags}
+		if id, ok := existing[key]; ok {
+			card.DuplicateOf = &id
+		}
+		cards = append(cards, card)
+	}
+	return cards, nil
+}
+
+// deckFronts returns the cards of a deck by normalized front.
+func deckFronts(db *Collection, deckName string) (map[string]int, error) {
+	rows, err := db.Query(`SELECT id, front FROM cards WHERE deck_name = ?`, deckName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	fronts := make(map[string]int)
+	for rows.Next() {
+		var id int
+		var front string
+		if err := rows.Scan(&id, &front); err != nil {
+			return nil, err
+		}
+		fronts[normalizeFront(front)] = id
+	}
+	return fronts, rows.Err()
+}
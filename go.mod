@@ -2,4 +2,17 @@ module github.com/lepinkainen/simple-anki
 
 go 1.24.7
 
-require github.com/mattn/go-sqlite3 v1.14.32 // indirect
+require (
+	github.com/alecthomas/chroma/v2 v2.24.1
+	github.com/mattn/go-sqlite3 v1.14.32
+	github.com/microcosm-cc/bluemonday v1.0.27
+	golang.org/x/crypto v0.48.0
+)
+
+require (
+	github.com/aymerick/douceur v0.2.0 // indirect
+	github.com/dlclark/regexp2 v1.12.0 // indirect
+	github.com/gorilla/css v1.0.1 // indirect
+	golang.org/x/net v0.49.0 // indirect
+	golang.org/x/text v0.34.0 // indirect
+)
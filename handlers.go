@@ -1,10 +1,21 @@
 package main
 
 import (
+	"bytes"
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
 	"net/http"
+	"net/url"
+	"path"
 	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 )
 
 func respondJSON(w http.ResponseWriter, data interface{}, status int) {
@@ -19,15 +30,24 @@ func respondError(w http.ResponseWriter, message string, status int) {
 
 // CardsHandler handles /api/cards
 func CardsHandler(w http.ResponseWriter, r *http.Request) {
+	db := requestCollection(r)
 	switch r.Method {
 	case "GET":
-		// Get all cards or filter by deck
-		deckName := r.URL.Query().Get("deck")
-		cards, err := GetAllCards(deckName)
+		filter, opts, err := parseCardListParams(r.URL.Query())
+		if err != nil {
+			respondError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		cards, total, err := GetAllCards(db, filter, opts)
 		if err != nil {
 			respondError(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		if cards == nil {
+			cards = []Card{}
+		}
+		w.Header().Set("X-Total-Count", strconv.Itoa(total))
 		respondJSON(w, cards, http.StatusOK)
 
 	case "POST":
@@ -38,16 +58,12 @@ func CardsHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		if card.Front == "" || card.Back == "" {
-			respondError(w, "Front and back are required", http.StatusBadRequest)
+		if err := validateNewCard(&card); err != nil {
+			respondError(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		if card.DeckName == "" {
-			card.DeckName = "Default"
-		}
-
-		if err := CreateCard(&card); err != nil {
+		if err := CreateCard(db, &card); err != nil {
 			respondError(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
@@ -59,189 +75,3284 @@ func CardsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// CardHandler handles /api/cards/{id}
-func CardHandler(w http.ResponseWriter, r *http.Request) {
-	// Extract ID from path
-	path := strings.TrimPrefix(r.URL.Path, "/api/cards/")
-	id, err := strconv.Atoi(path)
+// validateNewCard checks a card about to be created and fills in the
+// default deck.
+func validateNewCard(card *Card) error {
+	if card.Front == "" || card.Back == "" {
+		return errors.New("Front and back are required")
+	}
+	if card.DeckName == "" {
+		card.DeckName = "Default"
+	}
+	// Cards only get a note through the notes API
+	card.NoteID, card.Template = nil, 0
+	if _, err := normalizeTags(card.Tags); err != nil {
+		return err
+	}
+	return validateSourceURL(card.SourceURL)
+}
+
+// BulkCardResult reports the outcome for one card of a bulk request, by its
+// position in the request.
+type BulkCardResult struct {
+	Index int    `json:"index"`
+	Card  *Card  `json:"card,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// BulkCardsHandler handles POST /api/cards/bulk. The cards are created in
+// one transaction: if any card is invalid, none are created and the results
+// point out the invalid ones.
+func BulkCardsHandler(w http.ResponseWriter, r *http.Request) {
+	db := requestCollection(r)
+	if r.Method != "POST" {
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var cards []Card
+	if err := json.NewDecoder(r.Body).Decode(&cards); err != nil {
+		respondError(w, "Invalid request body: expected an array of cards", http.StatusBadRequest)
+		return
+	}
+	if len(cards) == 0 {
+		respondError(w, "No cards provided", http.StatusBadRequest)
+		return
+	}
+
+	results := make([]BulkCardResult, len(cards))
+	invalid := 0
+	for i := range cards {
+		results[i].Index = i
+		if err := validateNewCard(&cards[i]); err != nil {
+			results[i].Error = err.Error()
+			invalid++
+		}
+	}
+	if invalid > 0 {
+		respondJSON(w, map[string]interface{}{
+			"error":   fmt.Sprintf("%d of %d cards are invalid, none were created", invalid, len(cards)),
+			"results": results,
+		}, http.StatusBadRequest)
+		return
+	}
+
+	if err := CreateCards(db, cards); err != nil {
+		respondError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for i := range cards {
+		results[i].Card = &cards[i]
+	}
+
+	respondJSON(w, map[string]interface{}{
+		"created_count": len(cards),
+		"results":       results,
+	}, http.StatusCreated)
+}
+
+// BulkDeleteHandler handles POST /api/cards/delete?dry_run=true|false
+// The body is a CardSelection; a dry run only counts the matching cards.
+func BulkDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	db := requestCollection(r)
+	if r.Method != "POST" {
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	dryRun, err := parseDryRun(r, false)
 	if err != nil {
-		respondError(w, "Invalid card ID", http.StatusBadRequest)
+		respondError(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	switch r.Method {
-	case "GET":
-		card, err := GetCard(id)
-		if err != nil {
-			respondError(w, "Card not found", http.StatusNotFound)
+	var sel CardSelection
+	if err := json.NewDecoder(r.Body).Decode(&sel); err != nil {
+		respondError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	count, err := DeleteCards(db, sel, dryRun)
+	if err != nil {
+		if errors.Is(err, ErrEmptySelection) || errors.Is(err, ErrInvalidQuery) {
+			respondError(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		respondJSON(w, card, http.StatusOK)
+		respondError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-	case "PUT":
-		var card Card
-		if err := json.NewDecoder(r.Body).Decode(&card); err != nil {
-			respondError(w, "Invalid request body", http.StatusBadRequest)
+	respondJSON(w, map[string]interface{}{
+		"dry_run":       dryRun,
+		"deleted_count": count,
+	}, http.StatusOK)
+}
+
+// BulkRecomputeHandler handles POST /api/cards/recompute?dry_run=true|false
+// The body is a CardSelection. Returns the cards whose schedule changes
+// when their review history is replayed with the current settings; a dry
+// run changes nothing.
+func BulkRecomputeHandler(w http.ResponseWriter, r *http.Request) {
+	db := requestCollection(r)
+	if r.Method != "POST" {
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	dryRun, err := parseDryRun(r, false)
+	if err != nil {
+		respondError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var sel CardSelection
+	if err := json.NewDecoder(r.Body).Decode(&sel); err != nil {
+		respondError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	changes, err := RecomputeSchedules(db, sel, dryRun)
+	if err != nil {
+		if errors.Is(err, ErrEmptySelection) || errors.Is(err, ErrInvalidQuery) {
+			respondError(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		respondError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-		card.ID = id
-		if err := UpdateCard(&card); err != nil {
-			respondError(w, err.Error(), http.StatusInternalServerError)
+	respondJSON(w, map[string]interface{}{
+		"dry_run":       dryRun,
+		"changed_count": len(changes),
+		"changes":       changes,
+	}, http.StatusOK)
+}
+
+// BulkMoveHandler handles POST /api/cards/move
+// The body is a CardSelection plus the target_deck to move the cards to.
+func BulkMoveHandler(w http.ResponseWriter, r *http.Request) {
+	db := requestCollection(r)
+	if r.Method != "POST" {
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		CardSelection
+		TargetDeck string `json:"target_deck"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.TargetDeck == "" {
+		respondError(w, "target_deck is required", http.StatusBadRequest)
+		return
+	}
+
+	count, err := MoveCards(db, req.CardSelection, req.TargetDeck)
+	if err != nil {
+		if errors.Is(err, ErrEmptySelection) || errors.Is(err, ErrInvalidQuery) || errors.Is(err, ErrMoveToFiltered) {
+			respondError(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		respondError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-		respondJSON(w, card, http.StatusOK)
+	respondJSON(w, map[string]interface{}{
+		"target_deck": req.TargetDeck,
+		"moved_count": count,
+	}, http.StatusOK)
+}
 
-	case "DELETE":
-		if err := DeleteCard(id); err != nil {
-			respondError(w, err.Error(), http.StatusInternalServerError)
+// BulkReplaceHandler handles POST /api/cards/replace?dry_run=true|false
+// The body is a CardSelection plus a Replacement. Returns the changed cards
+// with their text before and after; a dry run changes nothing.
+func BulkReplaceHandler(w http.ResponseWriter, r *http.Request) {
+	db := requestCollection(r)
+	if r.Method != "POST" {
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	dryRun, err := parseDryRun(r, false)
+	if err != nil {
+		respondError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		CardSelection
+		Replacement
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	changes, err := ReplaceInCards(db, req.CardSelection, req.Replacement, dryRun)
+	if err != nil {
+		if errors.Is(err, ErrEmptySelection) || errors.Is(err, ErrInvalidQuery) || errors.Is(err, ErrInvalidReplace) ||
+			errors.Is(err, ErrNoteCardEdit) || errors.Is(err, ErrInvalidNote) {
+			respondError(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		respondJSON(w, map[string]string{"message": "Card deleted"}, http.StatusOK)
+		respondError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-	default:
+	respondJSON(w, map[string]interface{}{
+		"dry_run":       dryRun,
+		"changed_count": len(changes),
+		"changes":       changes,
+	}, http.StatusOK)
+}
+
+// BulkTagsHandler handles POST /api/cards/tags
+// The body is a CardSelection plus the tags to add and remove.
+func BulkTagsHandler(w http.ResponseWriter, r *http.Request) {
+	db := requestCollection(r)
+	if r.Method != "POST" {
 		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		CardSelection
+		Add    []string `json:"add"`
+		Remove []string `json:"remove"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(req.Add) == 0 && len(req.Remove) == 0 {
+		respondError(w, "add or remove is required", http.StatusBadRequest)
+		return
 	}
+
+	count, err := TagCards(db, req.CardSelection, req.Add, req.Remove)
+	if err != nil {
+		if errors.Is(err, ErrEmptySelection) || errors.Is(err, ErrInvalidQuery) || errors.Is(err, ErrInvalidTag) {
+			respondError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		respondError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	respondJSON(w, map[string]interface{}{
+		"changed_count": count,
+	}, http.StatusOK)
 }
 
-// DecksHandler handles /api/decks
-func DecksHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "GET" {
+// BulkRepositionHandler handles POST /api/cards/reposition
+// The body is a CardSelection plus a Reposition; only new cards move.
+func BulkRepositionHandler(w http.ResponseWriter, r *http.Request) {
+	db := requestCollection(r)
+	if r.Method != "POST" {
 		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	decks, err := GetDecks()
+	var req struct {
+		CardSelection
+		Reposition
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	count, err := RepositionCards(db, req.CardSelection, req.Reposition)
 	if err != nil {
+		if errors.Is(err, ErrEmptySelection) || errors.Is(err, ErrInvalidQuery) || errors.Is(err, ErrInvalidReposition) {
+			respondError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		respondError(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	respondJSON(w, decks, http.StatusOK)
+	respondJSON(w, map[string]interface{}{
+		"repositioned_count": count,
+	}, http.StatusOK)
 }
 
-// ReviewHandler handles /api/review
-func ReviewHandler(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case "GET":
-		// Get due cards for review
-		deckName := r.URL.Query().Get("deck")
-		limitStr := r.URL.Query().Get("limit")
-		limit := 20
-		if limitStr != "" {
-			if l, err := strconv.Atoi(limitStr); err == nil {
-				limit = l
+// CardDuplicatesHandler handles GET /api/cards/duplicates?deck=DeckName&tag=tag
+// Returns groups of cards sharing a normalized front, across all decks
+// unless scoped. With mode=semantic it returns pairs of cards whose fronts
+// mean much the same instead.
+func CardDuplicatesHandler(w http.ResponseWriter, r *http.Request) {
+	db := requestCollection(r)
+	if r.Method != "GET" {
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filter := CardFilter{
+		Deck: r.URL.Query().Get("deck"),
+		Tag:  r.URL.Query().Get("tag"),
+	}
+
+	// Semantic mode compares embeddings of the fronts
+	switch mode := r.URL.Query().Get("mode"); mode {
+	case "":
+	case "semantic":
+		threshold := defaultSemanticThreshold
+		if v := r.URL.Query().Get("threshold"); v != "" {
+			t, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				respondError(w, "threshold must be a number", http.StatusBadRequest)
+				return
 			}
+			threshold = t
 		}
-
-		cards, err := GetDueCards(deckName, limit)
-		if err != nil {
-			respondError(w, err.Error(), http.StatusInternalServerError)
+		pairs, err := FindSemanticDuplicates(db, r.Context(), filter, threshold)
+		if errors.Is(err, ErrInvalidDuplicates) {
+			respondError(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		respondJSON(w, cards, http.StatusOK)
-
-	case "POST":
-		// Submit review result
-		var result ReviewResult
-		if err := json.NewDecoder(r.Body).Decode(&result); err != nil {
-			respondError(w, "Invalid request body", http.StatusBadRequest)
+		if err != nil {
+			respondError(w, err.Error(), llmErrorStatus(err))
 			return
 		}
+		respondJSON(w, pairs, http.StatusOK)
+		return
+	default:
+		respondError(w, "mode must be 'semantic' or omitted", http.StatusBadRequest)
+		return
+	}
 
-		if result.Score < 1 || result.Score > 4 {
-			respondError(w, "Score must be between 1 and 4", http.StatusBadRequest)
-			return
-		}
+	groups, err := FindAllDuplicates(db, filter)
+	if err != nil {
+		respondError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	respondJSON(w, groups, http.StatusOK)
+}
+
+// parseCardListParams reads the filter, sort and paging parameters of
+// GET /api/cards. The default order is newest first.
+func parseCardListParams(query url.Values) (CardFilter, ListOptions, error) {
+	filter := CardFilter{Deck: query.Get("deck"), Tag: query.Get("tag")}
+	opts := ListOptions{Sort: "created", Desc: true}
 
-		card, err := GetCard(result.CardID)
+	if v := query.Get("leech"); v != "" {
+		b, err := strconv.ParseBool(v)
 		if err != nil {
-			respondError(w, "Card not found", http.StatusNotFound)
-			return
+			return filter, opts, errors.New("leech must be true or false")
 		}
+		filter.Leech = b
+	}
 
-		CalculateNextReview(card, result.Score)
-
-		if err := UpdateCard(card); err != nil {
-			respondError(w, err.Error(), http.StatusInternalServerError)
-			return
+	for param, dest := range map[string]*time.Time{"created_after": &filter.CreatedAfter, "due_before": &filter.DueBefore} {
+		if v := query.Get(param); v != "" {
+			t, err := parseTimeParam(v)
+			if err != nil {
+				return filter, opts, errors.New(param + " must be a date (2006-01-02) or an RFC 3339 time")
+			}
+			*dest = t
 		}
+	}
 
-		respondJSON(w, card, http.StatusOK)
+	for param, dest := range map[string]*int{"min_interval": &filter.MinInterval, "limit": &opts.Limit, "offset": &opts.Offset} {
+		if v := query.Get(param); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return filter, opts, errors.New(param + " must be a non-negative integer")
+			}
+			*dest = n
+		}
+	}
 
+	if v := query.Get("sort"); v != "" {
+		if _, ok := cardSorts[v]; !ok {
+			return filter, opts, errors.New("sort must be 'due', 'created', 'ease' or 'position'")
+		}
+		// Due dates and ease read naturally in ascending order
+		opts.Sort, opts.Desc = v, v == "created"
+	}
+	switch query.Get("order") {
+	case "":
+	case "asc":
+		opts.Desc = false
+	case "desc":
+		opts.Desc = true
 	default:
-		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return filter, opts, errors.New("order must be 'asc' or 'desc'")
 	}
-}
 
-// ImportRequest represents the JSON structure for importing cards
-type ImportRequest struct {
-	DeckName string `json:"deck_name"`
-	Cards    []struct {
-		Front string `json:"front"`
-		Back  string `json:"back"`
-	} `json:"cards"`
+	return filter, opts, nil
 }
 
-// ImportHandler handles /api/import
-func ImportHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+// parseTimeParam parses an RFC 3339 time or a date, which is taken as
+// local midnight.
+func parseTimeParam(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
 	}
+	return time.ParseInLocation("2006-01-02", v, time.Local)
+}
 
-	var importReq ImportRequest
-	if err := json.NewDecoder(r.Body).Decode(&importReq); err != nil {
-		respondError(w, "Invalid JSON format: "+err.Error(), http.StatusBadRequest)
+// CardHandler handles /api/cards/{id} and /api/cards/{id}/{action}
+func CardHandler(w http.ResponseWriter, r *http.Request) {
+	db := requestCollection(r)
+	// Extract ID and optional action from path
+	path := strings.TrimPrefix(r.URL.Path, "/api/cards/")
+	idStr, action, _ := strings.Cut(path, "/")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		respondError(w, "Invalid card ID", http.StatusBadRequest)
 		return
 	}
 
-	// Validate deck_name
-	if importReq.DeckName == "" {
-		respondError(w, "deck_name is required and cannot be empty", http.StatusBadRequest)
+	if tag, ok := strings.CutPrefix(action, "tags/"); ok {
+		cardTagHandler(w, r, id, tag)
 		return
 	}
 
-	// Validate cards array
-	if len(importReq.Cards) == 0 {
-		respondError(w, "cards array is required and must contain at least one card", http.StatusBadRequest)
+	switch action {
+	case "":
+	case "reviews":
+		cardReviewsHandler(w, r, id)
+		return
+	case "render":
+		cardRenderHandler(w, r, id)
+		return
+	case "projections":
+		cardProjectionsHandler(w, r, id)
+		return
+	case "reschedule":
+		cardRescheduleHandler(w, r, id)
+		return
+	case "forget":
+		cardForgetHandler(w, r, id)
+		return
+	case "suspend", "unsuspend":
+		cardSuspendHandler(w, r, id, action == "suspend")
+		return
+	case "bury", "unbury":
+		cardBuryHandler(w, r, id, action == "bury")
+		return
+	case "tags":
+		cardTagsHandler(w, r, id)
+		return
+	default:
+		respondError(w, "Not found", http.StatusNotFound)
 		return
 	}
 
-	// Validate and import each card
-	importedCount := 0
-	for i, cardData := range importReq.Cards {
-		// Validate front and back
-		if cardData.Front == "" {
-			respondError(w, "Card at index "+strconv.Itoa(i)+" has empty 'front' field", http.StatusBadRequest)
+	switch r.Method {
+	case "GET":
+		card, err := GetCard(db, id)
+		if err != nil {
+			respondError(w, "Card not found", http.StatusNotFound)
 			return
 		}
-		if cardData.Back == "" {
-			respondError(w, "Card at index "+strconv.Itoa(i)+" has empty 'back' field", http.StatusBadRequest)
+		respondJSON(w, card, http.StatusOK)
+
+	case "PUT", "PATCH":
+		// Fields missing from the body keep their current values
+		card, err := GetCard(db, id)
+		if err != nil {
+			respondError(w, "Card not found", http.StatusNotFound)
 			return
 		}
-
-		// Create card
-		card := Card{
-			DeckName: importReq.DeckName,
-			Front:    cardData.Front,
-			Back:     cardData.Back,
+		noteID, template := card.NoteID, card.Template
+		if err := json.NewDecoder(r.Body).Decode(card); err != nil {
+			respondError(w, "Invalid request body", http.StatusBadRequest)
+			return
 		}
 
-		if err := CreateCard(&card); err != nil {
-			respondError(w, "Failed to import card at index "+strconv.Itoa(i)+": "+err.Error(), http.StatusInternalServerError)
+		card.ID, card.NoteID, card.Template = id, noteID, template
+		if card.Front == "" || card.Back == "" || card.DeckName == "" {
+			respondError(w, "Front, back and deck name cannot be empty", http.StatusBadRequest)
 			return
 		}
-
-		importedCount++
-	}
-
-	// Success response
-	respondJSON(w, map[string]interface{}{
+		err = UpdateCard(db, card)
+		if errors.Is(err, ErrNoteCardEdit) || errors.Is(err, ErrInvalidNote) {
+			respondError(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			respondError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Re-read so the response shows what was stored (tags are not
+		// changed here)
+		card, err = GetCard(db, id)
+		if err != nil {
+			respondError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		respondJSON(w, card, http.StatusOK)
+
+	case "DELETE":
+		if err := DeleteCard(db, id); err != nil {
+			respondError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		respondJSON(w, map[string]string{"message": "Card deleted"}, http.StatusOK)
+
+	default:
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// cardRenderHandler handles GET /api/cards/{id}/render
+func cardRenderHandler(w http.ResponseWriter, r *http.Request, id int) {
+	db := requestCollection(r)
+	if r.Method != "GET" {
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rendered, err := RenderCard(db, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		respondError(w, "Card not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		respondError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	respondJSON(w, rendered, http.StatusOK)
+}
+
+// cardProjectionsHandler handles GET /api/cards/{id}/projections
+func cardProjectionsHandler(w http.ResponseWriter, r *http.Request, id int) {
+	db := requestCollection(r)
+	if r.Method != "GET" {
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	projections, err := GetProjections(db, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		respondError(w, "Card not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		respondError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	respondJSON(w, projections, http.StatusOK)
+}
+
+// cardSuspendHandler handles POST /api/cards/{id}/suspend and /unsuspend
+func cardSuspendHandler(w http.ResponseWriter, r *http.Request, id int, suspended bool) {
+	db := requestCollection(r)
+	if r.Method != "POST" {
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	card, err := SetSuspended(db, id, suspended)
+	if errors.Is(err, sql.ErrNoRows) {
+		respondError(w, "Card not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		respondError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	respondJSON(w, card, http.StatusOK)
+}
+
+// cardBuryHandler handles POST /api/cards/{id}/bury and /unbury
+func cardBuryHandler(w http.ResponseWriter, r *http.Request, id int, buried bool) {
+	db := requestCollection(r)
+	if r.Method != "POST" {
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	card, err := SetBuried(db, id, buried)
+	if errors.Is(err, sql.ErrNoRows) {
+		respondError(w, "Card not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		respondError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	respondJSON(w, card, http.StatusOK)
+}
+
+// cardRescheduleHandler handles POST /api/cards/{id}/reschedule with a
+// Reschedule
+func cardRescheduleHandler(w http.ResponseWriter, r *http.Request, id int) {
+	db := requestCollection(r)
+	if r.Method != "POST" {
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req Reschedule
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	card, err := RescheduleCard(db, id, req)
+	if errors.Is(err, sql.ErrNoRows) {
+		respondError(w, "Card not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, ErrInvalidReschedule) {
+		respondError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		respondError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	respondJSON(w, card, http.StatusOK)
+}
+
+// cardForgetHandler handles POST /api/cards/{id}/forget
+func cardForgetHandler(w http.ResponseWriter, r *http.Request, id int) {
+	db := requestCollection(r)
+	if r.Method != "POST" {
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	card, err := ForgetCard(db, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		respondError(w, "Card not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		respondError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	respondJSON(w, card, http.StatusOK)
+}
+
+// cardTagsHandler handles POST /api/cards/{id}/tags with {"tags": [...]}
+func cardTagsHandler(w http.ResponseWriter, r *http.Request, id int) {
+	db := requestCollection(r)
+	if r.Method != "POST" {
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Tags []string `json:"tags"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	card, err := AddCardTags(db, id, req.Tags)
+	if errors.Is(err, ErrInvalidTag) {
+		respondError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		respondError(w, "Card not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		respondError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	respondJSON(w, card, http.StatusOK)
+}
+
+// cardTagHandler handles DELETE /api/cards/{id}/tags/{tag}
+func cardTagHandler(w http.ResponseWriter, r *http.Request, id int, tag string) {
+	db := requestCollection(r)
+	if r.Method != "DELETE" {
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	card, err := RemoveCardTag(db, id, tag)
+	if errors.Is(err, sql.ErrNoRows) {
+		respondError(w, "Card not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		respondError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	respondJSON(w, card, http.StatusOK)
+}
+
+// NoteTypesHandler handles GET/POST /api/note-types
+func NoteTypesHandler(w http.ResponseWriter, r *http.Request) {
+	db := requestCollection(r)
+	switch r.Method {
+	case "GET":
+		types, err := GetNoteTypes(db)
+		if err != nil {
+			respondError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		respondJSON(w, types, http.StatusOK)
+
+	case "POST":
+		var nt NoteType
+		if err := json.NewDecoder(r.Body).Decode(&nt); err != nil {
+			respondError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		err := CreateNoteType(db, &nt)
+		if errors.Is(err, ErrInvalidNoteType) {
+			respondError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, ErrNoteTypeExists) {
+			respondError(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			respondError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		respondJSON(w, nt, http.StatusCreated)
+
+	default:
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// NoteTypeHandler handles GET, PUT and DELETE /api/note-types/{name}
+func NoteTypeHandler(w http.ResponseWriter, r *http.Request) {
+	db := requestCollection(r)
+	name, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/api/note-types/"))
+	if err != nil || name == "" {
+		respondError(w, "Invalid note type name", http.StatusBadRequest)
+		return
+	}
+
+	var nt NoteType
+	switch r.Method {
+	case "GET":
+		nt, err = GetNoteType(db, name)
+
+	case "PUT":
+		if err := json.NewDecoder(r.Body).Decode(&nt); err != nil {
+			respondError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		err = UpdateNoteType(db, name, &nt)
+
+	case "DELETE":
+		err = DeleteNoteType(db, name)
+
+	default:
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch {
+	case errors.Is(err, ErrUnknownNoteType):
+		respondError(w, "Note type not found", http.StatusNotFound)
+	case errors.Is(err, ErrInvalidNoteType) || errors.Is(err, ErrInvalidNote):
+		respondError(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrBuiltinNoteType) || errors.Is(err, ErrNoteTypeInUse):
+		respondError(w, err.Error(), http.StatusConflict)
+	case err != nil:
+		respondError(w, err.Error(), http.StatusInternalServerError)
+	case r.Method == "DELETE":
+		respondJSON(w, map[string]string{"message": "Note type deleted"}, http.StatusOK)
+	default:
+		respondJSON(w, nt, http.StatusOK)
+	}
+}
+
+// NotesHandler handles POST /api/notes, creating a note and its cards
+func NotesHandler(w http.ResponseWriter, r *http.Request) {
+	db := requestCollection(r)
+	if r.Method != "POST" {
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Note
+		DeckName string   `json:"deck_name"`
+		Tags     []string `json:"tags"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.DeckName == "" {
+		req.DeckName = "Default"
+	}
+	if _, err := normalizeTags(req.Tags); err != nil {
+		respondError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	note := req.Note
+	err := CreateNote(db, &note, req.DeckName, req.Tags)
+	if errors.Is(err, ErrInvalidNote) || errors.Is(err, ErrUnknownNoteType) {
+		respondError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		respondError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	respondJSON(w, note, http.StatusCreated)
+}
+
+// OcclusionNoteHandler handles POST /api/notes/image-occlusion, a
+// multipart form with the image in "image", its masks as JSON in "masks",
+// and optionally deck_name, header, back_extra and space-separated tags.
+func OcclusionNoteHandler(w http.ResponseWriter, r *http.Request) {
+	db := requestCollection(r)
+	if r.Method != "POST" {
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxMediaSize+1<<20)
+	if err := r.ParseMultipartForm(maxMediaSize); err != nil {
+		respondError(w, "Invalid upload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	file, _, err := r.FormFile("image")
+	if err != nil {
+		respondError(w, "image is required", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	image, err := io.ReadAll(file)
+	if err != nil {
+		respondError(w, "Invalid upload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var masks []OcclusionMask
+	if err := json.Unmarshal([]byte(r.FormValue("masks")), &masks); err != nil {
+		respondError(w, "masks must be a JSON array of rectangles", http.StatusBadRequest)
+		return
+	}
+	tags := strings.Fields(r.FormValue("tags"))
+	if _, err := normalizeTags(tags); err != nil {
+		respondError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	deckName := r.FormValue("deck_name")
+	if deckName == "" {
+		deckName = "Default"
+	}
+
+	note, err := CreateOcclusionNote(db, image, masks, r.FormValue("header"), r.FormValue("back_extra"), deckName, tags)
+	if errors.Is(err, ErrInvalidNote) || errors.Is(err, ErrInvalidMedia) {
+		respondError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		respondError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	respondJSON(w, note, http.StatusCreated)
+}
+
+// MediaListHandler handles GET and POST /api/media. POST takes a multipart
+// form with the file in "file".
+func MediaListHandler(w http.ResponseWriter, r *http.Request) {
+	db := requestCollection(r)
+	switch r.Method {
+	case "GET":
+		media, err := GetAllMedia(db)
+		if err != nil {
+			respondError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		respondJSON(w, media, http.StatusOK)
+
+	case "POST":
+		r.Body = http.MaxBytesReader(w, r.Body, maxMediaSize+1<<20)
+		if err := r.ParseMultipartForm(maxMediaSize); err != nil {
+			respondError(w, "Invalid upload: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			respondError(w, "file is required", http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		data, err := io.ReadAll(file)
+		if err != nil {
+			respondError(w, "Invalid upload: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		media, err := SaveMedia(db, data)
+		if errors.Is(err, ErrInvalidMedia) {
+			respondError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			respondError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		respondJSON(w, media, http.StatusCreated)
+
+	default:
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// MediaGCHandler handles POST /api/media/gc?dry_run=true|false
+func MediaGCHandler(w http.ResponseWriter, r *http.Request) {
+	db := requestCollection(r)
+	if r.Method != "POST" {
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	dryRun, err := parseDryRun(r, false)
+	if err != nil {
+		respondError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	collected, err := CollectMedia(db, dryRun)
+	if err != nil {
+		respondError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	respondJSON(w, map[string]interface{}{
+		"dry_run":         dryRun,
+		"collected_count": len(collected),
+		"collected":       collected,
+	}, http.StatusOK)
+}
+
+// MediaHandler handles GET /media/{name}
+func MediaHandler(w http.ResponseWriter, r *http.Request) {
+	db := requestCollection(r)
+	if r.Method != "GET" && r.Method != "HEAD" {
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/media/")
+	path, err := mediaFile(db, name)
+	if err != nil {
+		respondError(w, "Media not found", http.StatusNotFound)
+		return
+	}
+	// A name always holds the same content, though behind a login only
+	// the browser may keep it
+	cacheControl := "public, max-age=31536000, immutable"
+	if accounts != nil || basicAuth != "" {
+		cacheControl = "private, max-age=31536000, immutable"
+	}
+	w.Header().Set("Cache-Control", cacheControl)
+	w.Header().Set("Content-Type", mediaContentType(name))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeFile(w, r, path)
+}
+
+// NoteHandler handles GET, PUT and DELETE /api/notes/{id}
+func NoteHandler(w http.ResponseWriter, r *http.Request) {
+	db := requestCollection(r)
+	id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/api/notes/"))
+	if err != nil {
+		respondError(w, "Invalid note ID", http.StatusBadRequest)
+		return
+	}
+
+	var note *Note
+	switch r.Method {
+	case "GET":
+		note, err = GetNote(db, id)
+
+	case "PUT":
+		var req struct {
+			Fields map[string]string `json:"fields"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		note, err = UpdateNote(db, id, req.Fields)
+
+	case "DELETE":
+		if err := DeleteNote(db, id); errors.Is(err, ErrNoteNotFound) {
+			respondError(w, "Note not found", http.StatusNotFound)
+		} else if err != nil {
+			respondError(w, err.Error(), http.StatusInternalServerError)
+		} else {
+			respondJSON(w, map[string]string{"message": "Note deleted"}, http.StatusOK)
+		}
+		return
+
+	default:
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if errors.Is(err, ErrNoteNotFound) {
+		respondError(w, "Note not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, ErrInvalidNote) {
+		respondError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		respondError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	respondJSON(w, note, http.StatusOK)
+}
+
+// SearchHandler handles GET /api/search?q=...&deck=...&tag=...&limit=50
+func SearchHandler(w http.ResponseWriter, r *http.Request) {
+	db := requestCollection(r)
+	if r.Method != "GET" {
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query().Get("q")
+	if strings.TrimSpace(q) == "" {
+		respondError(w, "q is required", http.StatusBadRequest)
+		return
+	}
+
+	limit := 50
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 {
+			limit = l
+		}
+	}
+
+	filter := CardFilter{Deck: r.URL.Query().Get("deck"), Tag: r.URL.Query().Get("tag")}
+	cards, err := SearchCards(db, q, filter, limit)
+	if errors.Is(err, ErrInvalidQuery) {
+		respondError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		respondError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if cards == nil {
+		cards = []Card{}
+	}
+	respondJSON(w, cards, http.StatusOK)
+}
+
+// FilteredDecksHandler handles GET/POST /api/filtered-decks
+func FilteredDecksHandler(w http.ResponseWriter, r *http.Request) {
+	db := requestCollection(r)
+	switch r.Method {
+	case "GET":
+		decks, err := GetFilteredDecks(db)
+		if err != nil {
+			respondError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		respondJSON(w, decks, http.StatusOK)
+
+	case "POST":
+		var fd FilteredDeck
+		if err := json.NewDecoder(r.Body).Decode(&fd); err != nil {
+			respondError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		fd.Name = strings.TrimSpace(fd.Name)
+		if fd.Name == "" || strings.TrimSpace(fd.Query) == "" {
+			respondError(w, "Name and query are required", http.StatusBadRequest)
+			return
+		}
+		if fd.Limit == 0 {
+			fd.Limit = 100
+		}
+		if fd.Limit < 0 {
+			respondError(w, "limit must be positive", http.StatusBadRequest)
+			return
+		}
+
+		err := CreateFilteredDeck(db, &fd)
+		if errors.Is(err, ErrInvalidQuery) || errors.Is(err, ErrInvalidCardOrder) {
+			respondError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, ErrDeckExists) {
+			respondError(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			respondError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		respondJSON(w, fd, http.StatusCreated)
+
+	default:
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// FilteredDeckHandler handles POST /api/filtered-decks/{name}/rebuild and
+// /empty, and DELETE /api/filtered-decks/{name}
+func FilteredDeckHandler(w http.ResponseWriter, r *http.Request) {
+	db := requestCollection(r)
+	path := strings.TrimPrefix(r.URL.EscapedPath(), "/api/filtered-decks/")
+	escapedName, action, _ := strings.Cut(path, "/")
+	name, err := url.PathUnescape(escapedName)
+	if err != nil || name == "" {
+		respondError(w, "Invalid deck name", http.StatusBadRequest)
+		return
+	}
+
+	// Rebuilding reports the new card count, the others how many cards
+	// went back to their home decks
+	var count int
+	countKey := "returned_count"
+	switch {
+	case action == "rebuild" && r.Method == "POST":
+		count, err = RebuildFilteredDeck(db, name)
+		countKey = "card_count"
+	case action == "empty" && r.Method == "POST":
+		count, err = EmptyFilteredDeck(db, name)
+	case action == "" && r.Method == "DELETE":
+		if count, err = EmptyFilteredDeck(db, name); err == nil {
+			_, err = DeleteDeck(db, name, false, "")
+		}
+	case action == "" || action == "rebuild" || action == "empty":
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	default:
+		respondError(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	if errors.Is(err, ErrDeckNotFound) {
+		respondError(w, "Filtered deck not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, ErrDeckNotEmpty) {
+		respondError(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		respondError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	respondJSON(w, map[string]interface{}{"deck_name": name, countKey: count}, http.StatusOK)
+}
+
+// TagsHandler handles GET /api/tags
+func TagsHandler(w http.ResponseWriter, r *http.Request) {
+	db := requestCollection(r)
+	if r.Method != "GET" {
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	tags, err := GetTagTree(db)
+	if err != nil {
+		respondError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	respondJSON(w, tags, http.StatusOK)
+}
+
+// cardReviewsHandler handles GET /api/cards/{id}/reviews
+func cardReviewsHandler(w http.ResponseWriter, r *http.Request, id int) {
+	db := requestCollection(r)
+	if r.Method != "GET" {
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if _, err := GetCard(db, id); err != nil {
+		respondError(w, "Card not found", http.StatusNotFound)
+		return
+	}
+
+	logs, err := GetReviewLogs(db, id)
+	if err != nil {
+		respondError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	respondJSON(w, logs, http.StatusOK)
+}
+
+// DecksHandler handles /api/decks
+func DecksHandler(w http.ResponseWriter, r *http.Request) {
+	db := requestCollection(r)
+	switch r.Method {
+	case "GET":
+		// Decks nested with "::" are returned as a tree
+		tree, err := GetDeckTree(db)
+		if err != nil {
+			respondError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		respondJSON(w, tree, http.StatusOK)
+
+	case "POST":
+		// Create an empty deck
+		var req struct {
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		name := strings.TrimSpace(req.Name)
+		if name == "" {
+			respondError(w, "Deck name is required", http.StatusBadRequest)
+			return
+		}
+
+		deck, err := CreateDeck(db, name)
+		if errors.Is(err, ErrDeckExists) {
+			respondError(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			respondError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		respondJSON(w, deck, http.StatusCreated)
+
+	default:
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// DeckHandler handles /api/decks/{name} and /api/decks/{name}/{action}
+// The deck name is path-escaped so names containing "/" survive routing.
+func DeckHandler(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.EscapedPath(), "/api/decks/")
+	escapedName, action, _ := strings.Cut(path, "/")
+
+	deckName, err := url.PathUnescape(escapedName)
+	if err != nil || deckName == "" {
+		respondError(w, "Invalid deck name", http.StatusBadRequest)
+		return
+	}
+
+	switch action {
+	case "":
+		deckResourceHandler(w, r, deckName)
+	case "duplicates":
+		deckDuplicatesHandler(w, r, deckName)
+	case "dedupe":
+		deckDedupeHandler(w, r, deckName)
+	case "settings":
+		deckSettingsHandler(w, r, deckName)
+	default:
+		respondError(w, "Not found", http.StatusNotFound)
+	}
+}
+
+// deckResourceHandler handles GET/PUT/DELETE /api/decks/{name}
+// PUT renames the deck. DELETE requires ?cards=delete or ?move_to={deck}
+// when the deck still has cards.
+func deckResourceHandler(w http.ResponseWriter, r *http.Request, deckName string) {
+	db := requestCollection(r)
+	switch r.Method {
+	case "GET":
+		deck, err := GetDeck(db, deckName)
+		if errors.Is(err, ErrDeckNotFound) {
+			respondError(w, "Deck not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			respondError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		respondJSON(w, deck, http.StatusOK)
+
+	case "PUT":
+		var req struct {
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		newName := strings.TrimSpace(req.Name)
+		if newName == "" {
+			respondError(w, "Deck name is required", http.StatusBadRequest)
+			return
+		}
+
+		if newName != deckName {
+			var err error
+			if accounts != nil {
+				err = accounts.renameDeck(requestUser(r).ID, db, deckName, newName)
+			} else {
+				err = RenameDeck(db, deckName, newName)
+			}
+			switch {
+			case errors.Is(err, ErrDeckNotFound):
+				respondError(w, "Deck not found", http.StatusNotFound)
+				return
+			case errors.Is(err, ErrDeckExists), errors.Is(err, ErrCollaborationExists):
+				respondError(w, err.Error(), http.StatusConflict)
+				return
+			case errors.Is(err, ErrDeckIntoSubdeck):
+				respondError(w, err.Error(), http.StatusBadRequest)
+				return
+			case err != nil:
+				respondError(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		deck, err := GetDeck(db, newName)
+		if errors.Is(err, ErrDeckNotFound) {
+			respondError(w, "Deck not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			respondError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		respondJSON(w, deck, http.StatusOK)
+
+	case "DELETE":
+		cardsMode := r.URL.Query().Get("cards")
+		moveTo := strings.TrimSpace(r.URL.Query().Get("move_to"))
+		if cardsMode != "" && cardsMode != "delete" {
+			respondError(w, "cards must be 'delete' or omitted", http.StatusBadRequest)
+			return
+		}
+		if cardsMode == "delete" && moveTo != "" {
+			respondError(w, "Use either cards=delete or move_to, not both", http.StatusBadRequest)
+			return
+		}
+		count, err := DeleteDeck(db, deckName, cardsMode == "delete", moveTo)
+		switch {
+		case errors.Is(err, ErrDeckIntoSubdeck):
+			respondError(w, "Cannot move cards into the deck being deleted", http.StatusBadRequest)
+			return
+		case errors.Is(err, ErrDeckNotFound):
+			respondError(w, "Deck not found", http.StatusNotFound)
+			return
+		case errors.Is(err, ErrDeckNotEmpty):
+			respondError(w, "Deck still contains cards; pass cards=delete or move_to", http.StatusConflict)
+			return
+		case err != nil:
+			respondError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		result := map[string]interface{}{"message": "Deck deleted"}
+		if moveTo != "" {
+			result["moved_count"] = count
+		} else {
+			result["deleted_count"] = count
+		}
+		respondJSON(w, result, http.StatusOK)
+
+	default:
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// deckDuplicatesHandler handles GET /api/decks/{name}/duplicates
+func deckDuplicatesHandler(w http.ResponseWriter, r *http.Request, deckName string) {
+	db := requestCollection(r)
+	if r.Method != "GET" {
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	groups, err := FindDuplicates(db, deckName)
+	if err != nil {
+		respondError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	respondJSON(w, groups, http.StatusOK)
+}
+
+// deckDedupeHandler handles POST /api/decks/{name}/dedupe?dry_run=true|false
+// Dry runs default to true so a bare request never deletes anything.
+func deckDedupeHandler(w http.ResponseWriter, r *http.Request, deckName string) {
+	db := requestCollection(r)
+	if r.Method != "POST" {
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	dryRun, err := parseDryRun(r, true)
+	if err != nil {
+		respondError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	report, err := DedupeDeck(db, deckName, dryRun)
+	if err != nil {
+		respondError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	respondJSON(w, report, http.StatusOK)
+}
+
+// parseDryRun reads the dry_run query parameter, defaulting to def.
+func parseDryRun(r *http.Request, def bool) (bool, error) {
+	v := r.URL.Query().Get("dry_run")
+	if v == "" {
+		return def, nil
+	}
+	dryRun, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, errors.New("dry_run must be true or false")
+	}
+	return dryRun, nil
+}
+
+// deckSettingsHandler handles /api/decks/{name}/settings
+// PUT accepts a partial settings object; omitted fields keep their values.
+func deckSettingsHandler(w http.ResponseWriter, r *http.Request, deckName string) {
+	db := requestCollection(r)
+	settings, err := GetDeckSettings(db, deckName)
+	if err != nil {
+		respondError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		respondJSON(w, settings, http.StatusOK)
+
+	case "PUT":
+		if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+			respondError(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := settings.Validate(); err != nil {
+			respondError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := SaveDeckSettings(db, deckName, settings); err != nil {
+			respondError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		respondJSON(w, settings, http.StatusOK)
+
+	default:
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// ReviewHandler handles /api/review
+func ReviewHandler(w http.ResponseWriter, r *http.Request) {
+	db := requestCollection(r)
+	// Cram mode serves cards regardless of due dates and ignores answers
+	mode := r.URL.Query().Get("mode")
+	if mode != "" && mode != "cram" {
+		respondError(w, "mode must be 'cram' or omitted", http.StatusBadRequest)
+		return
+	}
+	cram := mode == "cram"
+
+	switch r.Method {
+	case "GET":
+		// Get due cards for review, optionally filtered by deck and tag
+		deckName := r.URL.Query().Get("deck")
+		filter := CardFilter{Deck: deckName, Tag: r.URL.Query().Get("tag")}
+		limitStr := r.URL.Query().Get("limit")
+		limit := 20
+		if limitStr != "" {
+			if l, err := strconv.Atoi(limitStr); err == nil {
+				limit = l
+			}
+		}
+
+		if cram {
+			cards, err := GetCramCards(db, filter, limit)
+			if err != nil {
+				respondError(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			respondJSON(w, cards, http.StatusOK)
+			return
+		}
+
+		cards, err := GetDueCards(db, filter, limit)
+		if err != nil {
+			respondError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		reviewsLeft, newLeft, err := RemainingToday(db, deckName)
+		if err != nil {
+			respondError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("X-Reviews-Remaining", strconv.Itoa(reviewsLeft))
+		w.Header().Set("X-New-Cards-Remaining", strconv.Itoa(newLeft))
+
+		respondJSON(w, cards, http.StatusOK)
+
+	case "POST":
+		// Submit review result
+		var result ReviewResult
+		if err := json.NewDecoder(r.Body).Decode(&result); err != nil {
+			respondError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		var check *AnswerCheck
+		if result.TypedAnswer != nil {
+			var err error
+			check, err = CheckTypedAnswer(db, result.CardID, *result.TypedAnswer)
+			if errors.Is(err, sql.ErrNoRows) {
+				respondError(w, "Card not found", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				respondError(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if result.Score == 0 {
+				result.Score = check.SuggestedScore
+			}
+		}
+
+		if result.Score < 1 || result.Score > 4 {
+			respondError(w, "Score must be between 1 and 4", http.StatusBadRequest)
+			return
+		}
+
+		var card *Card
+		var err error
+		if cram {
+			// Nothing is scheduled or logged
+			card, err = GetCard(db, result.CardID)
+		} else {
+			card, err = SubmitReview(db, result)
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			respondError(w, "Card not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			respondError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if check != nil {
+			respondJSON(w, struct {
+				*Card
+				AnswerCheck *AnswerCheck `json:"answer_check"`
+			}{card, check}, http.StatusOK)
+			return
+		}
+		respondJSON(w, card, http.StatusOK)
+
+	default:
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// ReviewCheckHandler handles POST /api/review/check, which checks a typed
+// answer without answering the card.
+func ReviewCheckHandler(w http.ResponseWriter, r *http.Request) {
+	db := requestCollection(r)
+	if r.Method != "POST" {
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		CardID      int    `json:"card_id"`
+		TypedAnswer string `json:"typed_answer"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	check, err := CheckTypedAnswer(db, req.CardID, req.TypedAnswer)
+	if errors.Is(err, sql.ErrNoRows) {
+		respondError(w, "Card not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		respondError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	respondJSON(w, check, http.StatusOK)
+}
+
+// ReviewGradeHandler handles POST /api/review/grade, which has the LLM
+// grade a typed answer without answering the card.
+func ReviewGradeHandler(w http.ResponseWriter, r *http.Request) {
+	db := requestCollection(r)
+	if r.Method != "POST" {
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		CardID      int    `json:"card_id"`
+		TypedAnswer string `json:"typed_answer"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	grade, err := GradeAnswer(db, r.Context(), req.CardID, req.TypedAnswer)
+	if errors.Is(err, sql.ErrNoRows) {
+		respondError(w, "Card not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		respondError(w, err.Error(), llmErrorStatus(err))
+		return
+	}
+	respondJSON(w, grade, http.StatusOK)
+}
+
+// GenerateHandler handles POST /api/generate, which has the LLM propose
+// cards from a text. Nothing is saved.
+func GenerateHandler(w http.ResponseWriter, r *http.Request) {
+	db := requestCollection(r)
+	if r.Method != "POST" {
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, 4*maxGenerateText)
+	var req GenerateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	cards, err := GenerateCards(db, r.Context(), req)
+	if errors.Is(err, ErrInvalidGenerate) {
+		respondError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		respondError(w, err.Error(), llmErrorStatus(err))
+		return
+	}
+	respondJSON(w, cards, http.StatusOK)
+}
+
+// ClozeSuggestHandler handles POST /api/cloze/suggest, which marks
+// suggested cloze deletions in a text.
+func ClozeSuggestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, 4*maxClozeText)
+	var req struct {
+		Text   string `json:"text"`
+		Method string `json:"method"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	suggestion, err := SuggestClozes(r.Context(), req.Text, req.Method)
+	if errors.Is(err, ErrInvalidCloze) {
+		respondError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		respondError(w, err.Error(), llmErrorStatus(err))
+		return
+	}
+	respondJSON(w, suggestion, http.StatusOK)
+}
+
+// LookupHandler handles GET /api/lookup?word=...&lang=..., which looks a
+// word up in an online dictionary.
+func LookupHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	result, err := LookupWord(r.URL.Query().Get("word"), r.URL.Query().Get("lang"))
+	switch {
+	case errors.Is(err, ErrInvalidLookup):
+		respondError(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrWordNotFound):
+		respondError(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrDictionary):
+		respondError(w, err.Error(), http.StatusBadGateway)
+	case err != nil:
+		respondError(w, err.Error(), http.StatusInternalServerError)
+	default:
+		respondJSON(w, result, http.StatusOK)
+	}
+}
+
+// OCRImportHandler handles POST /api/import/ocr, a multipart form with an
+// image or PDF in "file" and optionally deck_name, lang, method, max_cards
+// and space-separated tags. It returns the text read and the cards proposed
+// from it; nothing is saved.
+func OCRImportHandler(w http.ResponseWriter, r *http.Request) {
+	db := requestCollection(r)
+	if r.Method != "POST" {
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxOCRUpload+1<<20)
+	if err := r.ParseMultipartForm(maxImportUpload); err != nil {
+		respondError(w, "Invalid upload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		respondError(w, "file is required", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		respondError(w, "Invalid upload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	maxCards := 0
+	if v := r.FormValue("max_cards"); v != "" {
+		if maxCards, err = strconv.Atoi(v); err != nil {
+			respondError(w, "max_cards must be a number", http.StatusBadRequest)
+			return
+		}
+	}
+
+	result, err := ImportOCR(db, r.Context(), OCRRequest{
+		Data:     data,
+		DeckName: r.FormValue("deck_name"),
+		Lang:     r.FormValue("lang"),
+		Method:   r.FormValue("method"),
+		MaxCards: maxCards,
+		Tags:     strings.Fields(r.FormValue("tags")),
+	})
+	switch {
+	case errors.Is(err, ErrInvalidOCR) || errors.Is(err, ErrInvalidGenerate):
+		respondError(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrOCRUnavailable):
+		respondError(w, err.Error(), http.StatusNotImplemented)
+	case err != nil:
+		respondError(w, err.Error(), llmErrorStatus(err))
+	default:
+		respondJSON(w, result, http.StatusOK)
+	}
+}
+
+// PDFImportHandler handles POST /api/import/pdf, a multipart form with a
+// PDF in "file" and optionally deck_name, method, max_cards, space-separated
+// tags and subdecks. Cards are proposed in the background; the response is
+// the job, whose result has them by section. Nothing is saved.
+func PDFImportHandler(w http.ResponseWriter, r *http.Request) {
+	db := requestCollection(r)
+	if r.Method != "POST" {
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxOCRUpload+1<<20)
+	if err := r.ParseMultipartForm(maxImportUpload); err != nil {
+		respondError(w, "Invalid upload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		respondError(w, "file is required", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		respondError(w, "Invalid upload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	maxCards := 0
+	if v := r.FormValue("max_cards"); v != "" {
+		if maxCards, err = strconv.Atoi(v); err != nil {
+			respondError(w, "max_cards must be a number", http.StatusBadRequest)
+			return
+		}
+	}
+	subdecks := false
+	if v := r.FormValue("subdecks"); v != "" {
+		if subdecks, err = strconv.ParseBool(v); err != nil {
+			respondError(w, "subdecks must be true or false", http.StatusBadRequest)
+			return
+		}
+	}
+
+	job, err := StartPDFDeck(db, r.Context(), PDFDeckRequest{
+		Data:     data,
+		DeckName: r.FormValue("deck_name"),
+		Method:   r.FormValue("method"),
+		MaxCards: maxCards,
+		Tags:     strings.Fields(r.FormValue("tags")),
+		Subdecks: subdecks,
+	})
+	switch {
+	case errors.Is(err, ErrInvalidPDF):
+		respondError(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrOCRUnavailable):
+		respondError(w, err.Error(), http.StatusNotImplemented)
+	case err != nil:
+		respondError(w, err.Error(), llmErrorStatus(err))
+	default:
+		respondJSON(w, map[string]interface{}{
+			"job_id":     job.ID,
+			"status":     job.Status,
+			"total":      job.Total,
+			"status_url": "/api/import/jobs/" + job.ID,
+			"events_url": "/api/import/jobs/" + job.ID + "/events",
+		}, http.StatusAccepted)
+	}
+}
+
+// QuickAddHandler handles POST /api/quickadd, which creates a card captured
+// from a web page by a browser extension or bookmarklet. It is
+// authenticated by the quick add token and answers CORS requests.
+func QuickAddHandler(w http.ResponseWriter, r *http.Request) {
+	db := requestCollection(r)
+	if allowCORS(w, r) {
+		return
+	}
+	if r.Method != "POST" {
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	switch err := checkQuickAddToken(r); {
+	case errors.Is(err, ErrQuickAddDisabled):
+		respondError(w, err.Error(), http.StatusNotImplemented)
+		return
+	case err != nil:
+		w.Header().Set("WWW-Authenticate", `Bearer realm="quickadd"`)
+		respondError(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<20)
+	var req QuickAddRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	card := Card{
+		DeckName:  strings.TrimSpace(req.Deck),
+		Front:     strings.TrimSpace(req.Front),
+		Back:      strings.TrimSpace(req.Back),
+		SourceURL: req.SourceURL,
+		Tags:      req.Tags,
+	}
+	if err := validateNewCard(&card); err != nil {
+		respondError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := CreateCard(db, &card); err != nil {
+		respondError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	respondJSON(w, card, http.StatusCreated)
+}
+
+// StatsHandler handles GET /api/stats?deck=..., the statistics of a deck
+// and its subdecks or of the whole collection,
+// GET /api/stats/today?deck=..., the study day so far with the streaks,
+// GET /api/stats/heatmap?deck=...&days=..., its reviews per day,
+// GET /api/stats/forecast?deck=...&days=..., the cards coming due,
+// GET /api/stats/retention?deck=..., how well they are remembered,
+// GET /api/stats/time?deck=...&days=..., how long reviews took, and
+// GET /api/stats/intervals?deck=... and GET /api/stats/ease?deck=..., the
+// histograms of their intervals and eases.
+func StatsHandler(w http.ResponseWriter, r *http.Request) {
+	db := requestCollection(r)
+	if r.Method != "GET" {
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	deckName := r.URL.Query().Get("deck")
+	days := r.URL.Query().Get("days")
+
+	var stats any
+	var err error
+	switch strings.TrimPrefix(r.URL.Path, "/api/stats") {
+	case "", "/":
+		stats, err = GetStats(db, deckName)
+	case "/today":
+		stats, err = GetToday(db, deckName)
+	case "/heatmap":
+		var n int
+		if n, err = parseDays(days, 365); err == nil {
+			stats, err = GetHeatmap(db, deckName, n)
+		}
+	case "/forecast":
+		var n int
+		if n, err = parseDays(days, 30); err == nil {
+			stats, err = GetForecast(db, deckName, n)
+		}
+	case "/retention":
+		stats, err = GetRetention(db, deckName)
+	case "/time":
+		var n int
+		if n, err = parseDays(days, 30); err == nil {
+			stats, err = GetAnswerTimes(db, deckName, n)
+		}
+	case "/intervals":
+		stats, err = GetIntervalHistogram(db, deckName)
+	case "/ease":
+		stats, err = GetEaseHistogram(db, deckName)
+	case "/simulate":
+		var n int
+		var newPerDay []int
+		if n, err = parseDays(days, 90); err == nil {
+			if newPerDay, err = parseNewPerDay(r.URL.Query().Get("new_cards_per_day")); err == nil {
+				stats, err = SimulateWorkload(db, deckName, n, newPerDay)
+			}
+		}
+	default:
+		respondError(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, ErrInvalidStats) {
+		respondError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		respondError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	respondJSON(w, stats, http.StatusOK)
+}
+
+// parseDays reads a days parameter, def if empty.
+func parseDays(v string, def int) (int, error) {
+	if v == "" {
+		return def, nil
+	}
+	days, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("%w: days must be a number", ErrInvalidStats)
+	}
+	return days, nil
+}
+
+// parseNewPerDay reads the comma-separated new_cards_per_day values of a
+// simulation, none if empty.
+func parseNewPerDay(v string) ([]int, error) {
+	var values []int
+	for _, part := range strings.Split(v, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, fmt.Errorf("%w: new_cards_per_day must be numbers", ErrInvalidStats)
+		}
+		values = append(values, n)
+	}
+	return values, nil
+}
+
+// VersionHandler handles /api/version
+func VersionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	respondJSON(w, map[string]any{
+		"version":    version,
+		"commit":     commit,
+		"build_date": buildDate,
+		"read_only":  readOnly,
+	}, http.StatusOK)
+}
+
+// SharesHandler handles GET /api/shares?deck=, the deck share links,
+// POST /api/shares with {"deck": ...}, sharing a deck, and
+// DELETE /api/shares/{id}
+func SharesHandler(w http.ResponseWriter, r *http.Request) {
+	db := requestCollection(r)
+	idStr := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/shares"), "/")
+
+	switch {
+	case idStr == "" && r.Method == "GET":
+		shares, err := GetDeckShares(db, r.URL.Query().Get("deck"))
+		if err != nil {
+			respondError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		respondJSON(w, shares, http.StatusOK)
+
+	case idStr == "" && r.Method == "POST":
+		var req struct {
+			Deck string `json:"deck"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		userID := 0
+		if user := requestUser(r); user != nil {
+			userID = user.ID
+		}
+		share, err := CreateDeckShare(db, req.Deck, userID)
+		if errors.Is(err, ErrDeckNotFound) {
+			respondError(w, "Deck not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			respondError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		respondJSON(w, share, http.StatusCreated)
+
+	case idStr != "" && r.Method == "DELETE":
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			respondError(w, "Invalid share ID", http.StatusBadRequest)
+			return
+		}
+		err = DeleteDeckShare(db, id)
+		if errors.Is(err, ErrShareNotFound) {
+			respondError(w, "Share not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			respondError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		respondJSON(w, map[string]string{"message": "Share deleted"}, http.StatusOK)
+
+	default:
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// SharedHandler handles the public GET /api/shared/{token}, a shared deck,
+// /api/shared/{token}/cards?limit=&offset=, its cards rendered, and
+// /api/shared/{token}/media/{name}, media used by them
+func SharedHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	token, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/shared/"), "/")
+	db, share, err := sharedCollection(token)
+	if errors.Is(err, ErrShareNotFound) {
+		respondError(w, "Share not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		respondError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch {
+	case action == "":
+		deck, err := GetSharedDeck(db, share)
+		if err != nil {
+			respondError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		respondJSON(w, deck, http.StatusOK)
+
+	case action == "cards":
+		limit, offset := defaultSharedCards, 0
+		for param, dest := range map[string]*int{"limit": &limit, "offset": &offset} {
+			if v := r.URL.Query().Get(param); v != "" {
+				n, err := strconv.Atoi(v)
+				if err != nil || n < 0 {
+					respondError(w, param+" must be a non-negative integer", http.StatusBadRequest)
+					return
+				}
+				*dest = n
+			}
+		}
+		if limit < 1 || limit > maxSharedCards {
+			respondError(w, fmt.Sprintf("limit must be between 1 and %d", maxSharedCards), http.StatusBadRequest)
+			return
+		}
+		cards, total, err := GetSharedCards(db, share, limit, offset)
+		if err != nil {
+			respondError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("X-Total-Count", strconv.Itoa(total))
+		respondJSON(w, cards, http.StatusOK)
+
+	case strings.HasPrefix(action, "media/"):
+		name := strings.TrimPrefix(action, "media/")
+		path, err := sharedMediaFile(db, share, name)
+		if errors.Is(err, ErrMediaNotFound) {
+			respondError(w, "Media not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			respondError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", mediaContentType(name))
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		http.ServeFile(w, r, path)
+
+	default:
+		respondError(w, "Not found", http.StatusNotFound)
+	}
+}
+
+// RegisterHandler handles POST /api/register with Credentials, creating an
+// account and logging it in
+func RegisterHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var c Credentials
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		respondError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	_, err := accounts.Register(c)
+	switch {
+	case errors.Is(err, ErrInvalidAccount):
+		respondError(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, ErrUsernameTaken):
+		respondError(w, err.Error(), http.StatusConflict)
+		return
+	case errors.Is(err, ErrRegistrationClosed):
+		respondError(w, err.Error(), http.StatusForbidden)
+		return
+	case err != nil:
+		respondError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	user, token, expires, err := accounts.Login(c, r.UserAgent())
+	if err != nil {
+		respondError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	setSessionCookie(w, r, token, expires)
+	respondJSON(w, user, http.StatusCreated)
+}
+
+// LoginHandler handles POST /api/login with Credentials, setting the
+// session cookie, and GET /api/login, the ways there are to log in
+func LoginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		respondJSON(w, map[string]bool{
+			"password":          true,
+			"oidc":              oidcEnabled(),
+			"open_registration": accounts.openRegistration,
+		}, http.StatusOK)
+		return
+	}
+	if r.Method != "POST" {
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var c Credentials
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		respondError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	user, token, expires, err := accounts.Login(c, r.UserAgent())
+	if errors.Is(err, ErrLoginFailed) {
+		respondError(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if errors.Is(err, ErrAccountDisabled) {
+		respondError(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		respondError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	setSessionCookie(w, r, token, expires)
+	respondJSON(w, user, http.StatusOK)
+}
+
+// LogoutHandler handles POST /api/logout, ending the session
+func LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		if err := accounts.Logout(cookie.Value); err != nil {
+			respondError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	setSessionCookie(w, r, "", time.Unix(1, 0))
+	respondJSON(w, map[string]string{"message": "Logged out"}, http.StatusOK)
+}
+
+// OIDCLoginHandler handles GET /api/oidc/login, sending the browser to the
+// identity provider to log in
+func OIDCLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !oidcEnabled() {
+		respondError(w, ErrOIDCDisabled.Error(), http.StatusNotImplemented)
+		return
+	}
+
+	target, state, err := OIDCLoginURL(r)
+	if errors.Is(err, ErrOIDC) {
+		respondError(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if err != nil {
+		respondError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	setOIDCStateCookie(w, r, state)
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// OIDCCallbackHandler handles GET /api/oidc/callback, where the identity
+// provider sends the browser back, logging it in and on to the web UI
+func OIDCCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !oidcEnabled() {
+		respondError(w, ErrOIDCDisabled.Error(), http.StatusNotImplemented)
+		return
+	}
+
+	var state string
+	if cookie, err := r.Cookie(oidcStateCookie); err == nil {
+		state = cookie.Value
+	}
+	setOIDCStateCookie(w, r, "")
+	_, token, expires, err := OIDCCallback(r, state)
+	if errors.Is(err, ErrOIDC) {
+		respondError(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if errors.Is(err, ErrAccountDisabled) || errors.Is(err, ErrRegistrationClosed) {
+		respondError(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		respondError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	setSessionCookie(w, r, token, expires)
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// MeHandler handles GET /api/me, the logged in account
+func MeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	respondJSON(w, requestUser(r), http.StatusOK)
+}
+
+// SessionsHandler handles GET /api/sessions, the login sessions of the
+// account, DELETE /api/sessions, ending all but the current one, and
+// DELETE /api/sessions/{id}
+func SessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user, session := requestUser(r), requestSession(r)
+	idStr := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/sessions"), "/")
+
+	switch {
+	case idStr == "" && r.Method == "GET":
+		sessions, err := accounts.Sessions(user.ID, session.ID)
+		if err != nil {
+			respondError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		respondJSON(w, sessions, http.StatusOK)
+
+	case idStr == "" && r.Method == "DELETE":
+		ended, err := accounts.EndOtherSessions(user.ID, session.ID)
+		if err != nil {
+			respondError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		respondJSON(w, map[string]int{"ended_count": ended}, http.StatusOK)
+
+	case idStr != "" && r.Method == "DELETE":
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			respondError(w, "Invalid session ID", http.StatusBadRequest)
+			return
+		}
+		err = accounts.EndSession(user.ID, id)
+		if errors.Is(err, ErrSessionNotFound) {
+			respondError(w, "Session not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			respondError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		respondJSON(w, map[string]string{"message": "Session ended"}, http.StatusOK)
+
+	default:
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// TokensHandler handles GET/POST /api/tokens, the account's API tokens,
+// and DELETE /api/tokens/{id}
+func TokensHandler(w http.ResponseWriter, r *http.Request) {
+	user := requestUser(r)
+	idStr := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/tokens"), "/")
+
+	switch {
+	case idStr == "" && r.Method == "GET":
+		tokens, err := accounts.APITokens(user.ID)
+		if err != nil {
+			respondError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		respondJSON(w, tokens, http.StatusOK)
+
+	case idStr == "" && r.Method == "POST":
+		var req struct {
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		token, err := accounts.CreateAPIToken(user.ID, req.Name)
+		if errors.Is(err, ErrInvalidAPIToken) {
+			respondError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			respondError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		respondJSON(w, token, http.StatusCreated)
+
+	case idStr != "" && r.Method == "DELETE":
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			respondError(w, "Invalid token ID", http.StatusBadRequest)
+			return
+		}
+		err = accounts.RevokeAPIToken(user.ID, id)
+		if errors.Is(err, ErrAPITokenNotFound) {
+			respondError(w, "API token not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			respondError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		respondJSON(w, map[string]string{"message": "API token revoked"}, http.StatusOK)
+
+	default:
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// CollaboratorsHandler handles GET /api/collaborators?deck= (the members
+// of the decks the account takes part in), POST /api/collaborators with a
+// deck and a username to let another account edit a deck, and DELETE
+// /api/collaborators/{id} to remove a member or leave a deck
+func CollaboratorsHandler(w http.ResponseWriter, r *http.Request) {
+	user := requestUser(r)
+	idStr := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/collaborators"), "/")
+
+	switch {
+	case idStr == "" && r.Method == "GET":
+		collaborators, err := accounts.Collaborators(user.ID, r.URL.Query().Get("deck"))
+		if err != nil {
+			respondError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		respondJSON(w, collaborators, http.StatusOK)
+
+	case idStr == "" && r.Method == "POST":
+		var req struct {
+			Deck     string `json:"deck"`
+			Username string `json:"username"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		collaborator, err := accounts.AddCollaborator(user.ID, req.Deck, req.Username)
+		switch {
+		case errors.Is(err, ErrDeckNotFound):
+			respondError(w, "Deck not found", http.StatusNotFound)
+		case errors.Is(err, ErrInvalidCollaborator):
+			respondError(w, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, ErrNotDeckOwner):
+			respondError(w, err.Error(), http.StatusForbidden)
+		case errors.Is(err, ErrCollaborationExists):
+			respondError(w, err.Error(), http.StatusConflict)
+		case err != nil:
+			respondError(w, err.Error(), http.StatusInternalServerError)
+		default:
+			respondJSON(w, collaborator, http.StatusCreated)
+		}
+
+	case idStr != "" && r.Method == "DELETE":
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			respondError(w, "Invalid collaborator ID", http.StatusBadRequest)
+			return
+		}
+		err = accounts.RemoveCollaborator(user.ID, id)
+		switch {
+		case errors.Is(err, ErrCollaboratorNotFound):
+			respondError(w, "Collaborator not found", http.StatusNotFound)
+		case errors.Is(err, ErrInvalidCollaborator):
+			respondError(w, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, ErrNotDeckOwner):
+			respondError(w, err.Error(), http.StatusForbidden)
+		case err != nil:
+			respondError(w, err.Error(), http.StatusInternalServerError)
+		default:
+			respondJSON(w, map[string]string{"message": "Collaborator removed"}, http.StatusOK)
+		}
+
+	default:
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// AdminUsersHandler handles GET /api/admin/users, every account with its
+// storage, PUT /api/admin/users/{id} with an AccountUpdate, and POST
+// /api/admin/users/{id}/password with a new password, for admins only
+func AdminUsersHandler(w http.ResponseWriter, r *http.Request) {
+	if !requestUser(r).Admin {
+		respondError(w, "Admins only", http.StatusForbidden)
+		return
+	}
+	idStr, action, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/admin/users"), "/"), "/")
+
+	if idStr == "" {
+		if r.Method != "GET" {
+			respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		users, err := accounts.Users()
+		if err != nil {
+			respondError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		respondJSON(w, users, http.StatusOK)
+		return
+	}
+
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		respondError(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	switch {
+	case action == "" && r.Method == "PUT":
+		var update AccountUpdate
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			respondError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		user, err := accounts.UpdateUser(requestUser(r).ID, id, update)
+		switch {
+		case errors.Is(err, ErrUserNotFound):
+			respondError(w, "User not found", http.StatusNotFound)
+		case errors.Is(err, ErrInvalidAccount):
+			respondError(w, err.Error(), http.StatusBadRequest)
+		case err != nil:
+			respondError(w, err.Error(), http.StatusInternalServerError)
+		default:
+			respondJSON(w, user, http.StatusOK)
+		}
+
+	case action == "password" && r.Method == "POST":
+		var req struct {
+			NewPassword string `json:"new_password"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		err := accounts.ResetPassword(id, req.NewPassword)
+		switch {
+		case errors.Is(err, ErrUserNotFound):
+			respondError(w, "User not found", http.StatusNotFound)
+		case errors.Is(err, ErrInvalidAccount):
+			respondError(w, err.Error(), http.StatusBadRequest)
+		case err != nil:
+			respondError(w, err.Error(), http.StatusInternalServerError)
+		default:
+			respondJSON(w, map[string]string{"message": "Password reset"}, http.StatusOK)
+		}
+
+	default:
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// PasswordHandler handles POST /api/password with a PasswordChange, which
+// also ends the account's other sessions
+func PasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var change PasswordChange
+	if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+		respondError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	err := accounts.ChangePassword(requestUser(r).ID, requestSession(r).ID, change)
+	switch {
+	case errors.Is(err, ErrLoginFailed):
+		respondError(w, "Current password is wrong", http.StatusForbidden)
+	case errors.Is(err, ErrInvalidAccount):
+		respondError(w, err.Error(), http.StatusBadRequest)
+	case err != nil:
+		respondError(w, err.Error(), http.StatusInternalServerError)
+	default:
+		respondJSON(w, map[string]string{"message": "Password changed"}, http.StatusOK)
+	}
+}
+
+// ReviewSessionHandler handles GET /api/review/session, the study queue of
+// a deck and tag with the queue of each card
+func ReviewSessionHandler(w http.ResponseWriter, r *http.Request) {
+	db := requestCollection(r)
+	if r.Method != "GET" {
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	filter := CardFilter{Deck: r.URL.Query().Get("deck"), Tag: r.URL.Query().Get("tag")}
+	limit := 50
+	if v := r.URL.Query().Get("limit"); v != "" {
+		l, err := strconv.Atoi(v)
+		if err != nil || l < 1 {
+			respondError(w, "limit must be a positive number", http.StatusBadRequest)
+			return
+		}
+		limit = l
+	}
+
+	session, err := GetReviewSession(db, filter, limit)
+	if err != nil {
+		respondError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	respondJSON(w, session, http.StatusOK)
+}
+
+// ReviewPostponeHandler handles POST /api/review/postpone with
+// {"deck": ..., "days": N}, moving the due dates of a deck or the
+// collection N days later
+func ReviewPostponeHandler(w http.ResponseWriter, r *http.Request) {
+	db := requestCollection(r)
+	if r.Method != "POST" {
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Deck string `json:"deck"`
+		Days int    `json:"days"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	count, err := PostponeCards(db, req.Deck, req.Days)
+	if errors.Is(err, ErrInvalidVacation) {
+		respondError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		respondError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	respondJSON(w, map[string]interface{}{
+		"postponed_count": count,
+	}, http.StatusOK)
+}
+
+// ReviewAwayHandler handles POST /api/review/away with an AwayRequest,
+// spreading the cards due while away over the days after the return
+func ReviewAwayHandler(w http.ResponseWriter, r *http.Request) {
+	db := requestCollection(r)
+	if r.Method != "POST" {
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req AwayRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	result, err := SpreadBacklog(db, req)
+	if errors.Is(err, ErrInvalidVacation) {
+		respondError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		respondError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	respondJSON(w, result, http.StatusOK)
+}
+
+// ReviewRebalanceHandler handles POST /api/review/rebalance with a
+// Rebalance, evening out the reviews due over the coming days
+func ReviewRebalanceHandler(w http.ResponseWriter, r *http.Request) {
+	db := requestCollection(r)
+	if r.Method != "POST" {
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req Rebalance
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	result, err := RebalanceCards(db, req)
+	if errors.Is(err, ErrInvalidRebalance) {
+		respondError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		respondError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	respondJSON(w, result, http.StatusOK)
+}
+
+// ReviewUndoHandler handles POST /api/review/undo
+func ReviewUndoHandler(w http.ResponseWriter, r *http.Request) {
+	db := requestCollection(r)
+	if r.Method != "POST" {
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	card, undone, err := UndoLastReview(db)
+	if errors.Is(err, sql.ErrNoRows) {
+		respondError(w, "No review to undo", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		respondError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	respondJSON(w, map[string]interface{}{
+		"card":   card,
+		"undone": undone,
+	}, http.StatusOK)
+}
+
+// ImportRequest represents the JSON structure for importing cards
+type ImportRequest struct {
+	DeckName string       `json:"deck_name"`
+	Cards    []ImportCard `json:"cards"`
+
+	// Instead of cards, a published CSV or TSV file to fetch, read with
+	// the same options as an uploaded one
+	URL         string `json:"url"`
+	Header      bool   `json:"header"`
+	Delimiter   string `json:"delimiter"`
+	FrontColumn string `json:"front_column"`
+	BackColumn  string `json:"back_column"`
+	TagsColumn  string `json:"tags_column"`
+
+	// Give every card a reversed Back→Front sibling
+	Reverse bool `json:"reverse"`
+
+	// Keep the scheduling read from formats that carry it
+	KeepScheduling bool `json:"-"`
+}
+
+// maxImportUpload bounds the size of an uploaded or downloaded import file.
+const maxImportUpload = 32 << 20
+
+// parseImportUpload reads an import from a multipart/form-data upload with
+// the file in the "file" field. The form also carries deck_name and, for
+// CSV and TSV files, delimiter, header and the front/back/tags columns.
+// Anki packages, text exports with a deck column, Markdown zips and Mochi
+// and RemNote exports take their decks from the file unless deck_name is
+// set; packages keep their scheduling with scheduling=true. With
+// reverse=true every card also gets a reversed card. Quizlet exports
+// (format=quizlet) take term_separator and card_separator and may be sent
+// as a "text" field instead of a file.
+func parseImportUpload(r *http.Request) (*ImportRequest, error) {
+	if err := r.ParseMultipartForm(maxImportUpload); err != nil {
+		return nil, err
+	}
+	reverse := false
+	if v := r.FormValue("reverse"); v != "" {
+		var err error
+		if reverse, err = strconv.ParseBool(v); err != nil {
+			return nil, errors.New("reverse must be true or false")
+		}
+	}
+	format := strings.ToLower(r.FormValue("format"))
+	file, fileHeader, err := r.FormFile("file")
+	if err != nil {
+		// Quizlet sets are exported by copying text, so it may be pasted
+		text := r.FormValue("text")
+		if format != "quizlet" || text == "" {
+			return nil, errors.New("file is required")
+		}
+		cards, err := parseQuizlet(strings.NewReader(text), r.FormValue("term_separator"), r.FormValue("card_separator"))
+		if err != nil {
+			return nil, err
+		}
+		return &ImportRequest{DeckName: r.FormValue("deck_name"), Cards: cards, Reverse: reverse}, nil
+	}
+	defer file.Close()
+
+	deckName := r.FormValue("deck_name")
+	if format == "" {
+		format = strings.TrimPrefix(strings.ToLower(path.Ext(fileHeader.Filename)), ".")
+	}
+
+	var cards []ImportCard
+	switch format {
+	case "csv", "tsv", "tab":
+		delimiter := ','
+		if format != "csv" {
+			delimiter = '\t'
+		}
+		if delimiter, err = parseDelimiter(r.FormValue("delimiter"), delimiter); err != nil {
+			return nil, err
+		}
+
+		header := false
+		if v := r.FormValue("header"); v != "" {
+			if header, err = strconv.ParseBool(v); err != nil {
+				return nil, errors.New("header must be true or false")
+			}
+		}
+
+		cards, err = parseDelimited(file, DelimitedOptions{
+			Delimiter: delimiter,
+			Header:    header,
+			Front:     r.FormValue("front_column"),
+			Back:      r.FormValue("back_column"),
+			Tags:      r.FormValue("tags_column"),
+		})
+	case "apkg":
+		cards, err = parseApkg(file, fileHeader.Size)
+	case "txt":
+		cards, err = parseAnkiText(file)
+	case "md", "markdown":
+		var data []byte
+		if data, err = io.ReadAll(file); err == nil {
+			cards = parseMarkdown(string(data))
+		}
+	case "zip":
+		cards, err = parseMarkdownZip(file, fileHeader.Size)
+	case "mochi":
+		cards, err = parseMochi(file, fileHeader.Size)
+	case "remnote":
+		cards, err = parseRemNote(file)
+	case "quizlet":
+		cards, err = parseQuizlet(file, r.FormValue("term_separator"), r.FormValue("card_separator"))
+		// A set is one deck, named after the file unless given
+		if deckName == "" {
+			deckName = strings.TrimSuffix(fileHeader.Filename, path.Ext(fileHeader.Filename))
+		}
+	default:
+		return nil, errors.New("unsupported import format; set format to csv, tsv, txt, apkg, md, zip, quizlet, mochi or remnote")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	keepScheduling := false
+	if v := r.FormValue("scheduling"); v != "" {
+		if keepScheduling, err = strconv.ParseBool(v); err != nil {
+			return nil, errors.New("scheduling must be true or false")
+		}
+	}
+
+	return &ImportRequest{DeckName: deckName, Cards: cards, KeepScheduling: keepScheduling, Reverse: reverse}, nil
+}
+
+// parseDelimiter reads a delimiter option: a single character or "tab".
+// An empty option gives def.
+func parseDelimiter(d string, def rune) (rune, error) {
+	switch {
+	case d == "tab" || d == `\t`:
+		return '\t', nil
+	case utf8.RuneCountInString(d) == 1:
+		r, _ := utf8.DecodeRuneInString(d)
+		return r, nil
+	case d != "":
+		return 0, errors.New("delimiter must be a single character or 'tab'")
+	}
+	return def, nil
+}
+
+// fetchImportURL reads the cards of an import given as a URL.
+func fetchImportURL(req ImportRequest) ([]ImportCard, error) {
+	delimiter, err := parseDelimiter(req.Delimiter, 0)
+	if err != nil {
+		return nil, err
+	}
+	data, detected, err := fetchRemoteCSV(req.URL)
+	if err != nil {
+		return nil, err
+	}
+	if delimiter == 0 {
+		delimiter = detected
+	}
+	return parseDelimited(bytes.NewReader(data), DelimitedOptions{
+		Delimiter: delimiter,
+		Header:    req.Header,
+		Front:     req.FrontColumn,
+		Back:      req.BackColumn,
+		Tags:      req.TagsColumn,
+	})
+}
+
+// importedCard turns a validated import card into a card for ImportCards.
+func importedCard(req ImportRequest, data ImportCard, tags []string) Card {
+	card := Card{DeckName: req.DeckName, Front: data.Front, Back: data.Back, Tags: tags, Reverse: req.Reverse || data.Reverse}
+	if card.DeckName == "" {
+		card.DeckName = data.Deck
+	}
+	if req.KeepScheduling && data.hasScheduling() {
+		card.State = data.State
+		card.Ease = data.Ease
+		card.Interval = data.Interval
+		card.NextReview = data.NextReview
+		card.Lapses = data.Lapses
+		card.Suspended = data.Suspended
+
+		// Cards from other apps often only have an interval and due date
+		if card.State == "" && card.Interval > 0 {
+			card.State = StateReview
+		} else if card.State == "" {
+			card.State = StateNew
+		}
+		if card.NextReview.IsZero() {
+			card.NextReview = time.Now()
+		}
+	}
+	return card
+}
+
+// ExportHandler handles GET /api/export/{format}?deck=DeckName
+// Without deck every card is exported; a deck includes its subdecks. The
+// json format is a backup of the whole collection and ignores deck.
+func ExportHandler(w http.ResponseWriter, r *http.Request) {
+	db := requestCollection(r)
+	if r.Method != "GET" {
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	format := strings.TrimPrefix(r.URL.Path, "/api/export/")
+	deckName := r.URL.Query().Get("deck")
+	filename := "simple-anki"
+	if deckName != "" {
+		filename = strings.NewReplacer(DeckSeparator, "-", "/", "-").Replace(deckName)
+	}
+
+	switch format {
+	case "apkg":
+		// Build the package first so errors can still get a JSON response
+		var buf bytes.Buffer
+		if err := WriteApkg(db, &buf, deckName); err != nil {
+			if errors.Is(err, ErrDeckNotFound) {
+				respondError(w, "Deck not found", http.StatusNotFound)
+				return
+			}
+			respondError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/apkg")
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename + ".apkg"}))
+		w.Write(buf.Bytes())
+	case "csv":
+		if deckName != "" {
+			if err := checkDeckExists(db, deckName); errors.Is(err, ErrDeckNotFound) {
+				respondError(w, "Deck not found", http.StatusNotFound)
+				return
+			}
+		}
+		// Streamed, so a failure part way can only cut the file short
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename + ".csv"}))
+		if err := WriteCSV(db, w, deckName); err != nil {
+			log.Printf("CSV export failed: %v", err)
+		}
+	case "markdown":
+		var buf bytes.Buffer
+		if err := WriteMarkdownZip(db, &buf, deckName); err != nil {
+			if errors.Is(err, ErrDeckNotFound) {
+				respondError(w, "Deck not found", http.StatusNotFound)
+				return
+			}
+			respondError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename + "-markdown.zip"}))
+		w.Write(buf.Bytes())
+	case "json":
+		backup, err := CreateBackup(db)
+		if err != nil {
+			respondError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		name := "simple-anki-backup-" + backup.CreatedAt.Format("2006-01-02") + ".json"
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+		respondJSON(w, backup, http.StatusOK)
+	default:
+		respondError(w, "Unknown export format", http.StatusNotFound)
+	}
+}
+
+// restoreBackup handles POST /api/import?mode=restore&dry_run=true
+func restoreBackup(w http.ResponseWriter, r *http.Request) {
+	db := requestCollection(r)
+	dryRun, err := parseDryRun(r, false)
+	if err != nil {
+		respondError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var backup Backup
+	if err := json.NewDecoder(r.Body).Decode(&backup); err != nil {
+		respondError(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := RestoreBackup(db, &backup, dryRun); err != nil {
+		if errors.Is(err, ErrInvalidBackup) {
+			respondError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		respondError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	message := fmt.Sprintf("Restored %d cards and %d reviews", len(backup.Cards), len(backup.Reviews))
+	if dryRun {
+		message = fmt.Sprintf("Backup is valid: %d cards and %d reviews would be restored", len(backup.Cards), len(backup.Reviews))
+	}
+	respondJSON(w, map[string]interface{}{
+		"dry_run":      dryRun,
+		"deck_count":   len(backup.Decks),
+		"card_count":   len(backup.Cards),
+		"review_count": len(backup.Reviews),
+		"message":      message,
+	}, http.StatusOK)
+}
+
+// ImportRowError reports an invalid card in an import by its index.
+type ImportRowError struct {
+	Index int    `json:"index"`
+	Error string `json:"error"`
+}
+
+// ImportHandler handles /api/import?dedup=skip|update|duplicate&dry_run=true
+// dedup decides what happens to cards whose front already exists in the
+// deck; the default is to create duplicates. The older ?mode=upsert is the
+// same as dedup=update. A dry run writes nothing and reports every invalid
+// card instead of stopping at the first. ?mode=restore takes a backup from
+// GET /api/export/json instead and replaces the whole collection with it.
+// With ?async=true the import runs in the background and the response is
+// a job to follow through ImportJobHandler.
+func ImportHandler(w http.ResponseWriter, r *http.Request) {
+	db := requestCollection(r)
+	if r.Method != "POST" {
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	dedup := r.URL.Query().Get("dedup")
+	mode := r.URL.Query().Get("mode")
+	if mode != "" && mode != "upsert" && mode != "restore" {
+		respondError(w, "mode must be 'upsert', 'restore' or omitted", http.StatusBadRequest)
+		return
+	}
+	if mode == "restore" {
+		restoreBackup(w, r)
+		return
+	}
+	if mode == "upsert" && dedup == "" {
+		dedup = DedupUpdate
+	}
+	if dedup == "" {
+		dedup = DedupDuplicate
+	}
+	if dedup != DedupDuplicate && dedup != DedupSkip && dedup != DedupUpdate {
+		respondError(w, ErrInvalidDedup.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dryRun, err := parseDryRun(r, false)
+	if err != nil {
+		respondError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	async := false
+	if v := r.URL.Query().Get("async"); v != "" {
+		if async, err = strconv.ParseBool(v); err != nil {
+			respondError(w, "async must be true or false", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var importReq ImportRequest
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		r.Body = http.MaxBytesReader(w, r.Body, maxImportUpload+1<<20)
+		upload, err := parseImportUpload(r)
+		if err != nil {
+			respondError(w, "Invalid upload: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		importReq = *upload
+	} else {
+		if err := json.NewDecoder(r.Body).Decode(&importReq); err != nil {
+			respondError(w, "Invalid JSON format: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		// Scheduling in JSON cards is always meant to be kept
+		importReq.KeepScheduling = true
+	}
+
+	// A URL stands in for the cards, so importing it again refreshes the deck
+	if importReq.URL != "" {
+		if len(importReq.Cards) > 0 {
+			respondError(w, "Give either cards or url, not both", http.StatusBadRequest)
+			return
+		}
+		cards, err := fetchImportURL(importReq)
+		if err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, ErrRemoteFetch) {
+				status = http.StatusBadGateway
+			}
+			respondError(w, "Invalid import URL: "+err.Error(), status)
+			return
+		}
+		importReq.Cards = cards
+	}
+
+	// Validate deck_name, unless every card brings its own deck
+	if importReq.DeckName == "" {
+		for _, cardData := range importReq.Cards {
+			if cardData.Deck == "" {
+				respondError(w, "deck_name is required and cannot be empty", http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	// Validate cards array
+	if len(importReq.Cards) == 0 {
+		respondError(w, "cards array is required and must contain at least one card", http.StatusBadRequest)
+		return
+	}
+
+	// Validate every card before touching the database
+	cards := make([]Card, 0, len(importReq.Cards))
+	rowErrors := []ImportRowError{}
+	for i, cardData := range importReq.Cards {
+		var msg string
+		switch {
+		case cardData.Front == "":
+			msg = "Card at index " + strconv.Itoa(i) + " has empty 'front' field"
+		case cardData.Back == "":
+			msg = "Card at index " + strconv.Itoa(i) + " has empty 'back' field"
+		default:
+			tags, err := normalizeTags(cardData.Tags)
+			if err == nil {
+				err = cardData.validateScheduling()
+			}
+			if err == nil {
+				cards = append(cards, importedCard(importReq, cardData, tags))
+				continue
+			}
+			msg = "Card at index " + strconv.Itoa(i) + ": " + err.Error()
+		}
+		if !dryRun {
+			respondError(w, msg, http.StatusBadRequest)
+			return
+		}
+		rowErrors = append(rowErrors, ImportRowError{Index: i, Error: msg})
+	}
+
+	if async {
+		job := startImportJob(db, len(cards), len(rowErrors), func(progress func(int)) (map[string]interface{}, int) {
+			return runImport(db, importReq, cards, rowErrors, dedup, dryRun, progress)
+		})
+		respondJSON(w, map[string]interface{}{
+			"job_id":     job.ID,
+			"status":     job.Status,
+			"total":      job.Total,
+			"status_url": "/api/import/jobs/" + job.ID,
+			"events_url": "/api/import/jobs/" + job.ID + "/events",
+		}, http.StatusAccepted)
+		return
+	}
+
+	body, status := runImport(db, importReq, cards, rowErrors, dedup, dryRun, nil)
+	respondJSON(w, body, status)
+}
+
+// runImport imports validated cards and returns the response for it.
+func runImport(db *Collection, importReq ImportRequest, cards []Card, rowErrors []ImportRowError, dedup string, dryRun bool,
+	progress func(int)) (map[string]interface{}, int) {
+	result, err := importCards(db, cards, dedup, dryRun, progress)
+	if err != nil {
+		return map[string]interface{}{"error": "Failed to import cards: " + err.Error()}, http.StatusInternalServerError
+	}
+
+	target := "deck '" + importReq.DeckName + "'"
+	if len(result.Decks) == 1 {
+		target = "deck '" + result.Decks[0] + "'"
+	} else if importReq.DeckName == "" {
+		target = strconv.Itoa(len(result.Decks)) + " decks"
+	}
+
+	// Updated cards count as imported, as they always have with upserts
+	imported := result.Created + result.Updated
+	if dryRun {
+		return map[string]interface{}{
+			"dry_run":        true,
+			"valid":          len(rowErrors) == 0,
+			"imported_count": imported,
+			"created_count":  result.Created,
+			"updated_count":  result.Updated,
+			"skipped_count":  result.Skipped,
+			"errors":         rowErrors,
+			"dedup":          dedup,
+			"deck_name":      importReq.DeckName,
+			"decks":          result.Decks,
+			"message": fmt.Sprintf("Would import %d cards into %s (%d created, %d updated, %d skipped, %d invalid)",
+				imported, target, result.Created, result.Updated, result.Skipped, len(rowErrors)),
+		}, http.StatusOK
+	}
+
+	message := "Successfully imported " + strconv.Itoa(imported) + " cards into " + target
+	if dedup != DedupDuplicate {
+		message += fmt.Sprintf(" (%d created, %d updated, %d skipped)", result.Created, result.Updated, result.Skipped)
+	}
+
+	// Success response
+	return map[string]interface{}{
 		"success":        true,
-		"imported_count": importedCount,
+		"imported_count": imported,
+		"created_count":  result.Created,
+		"updated_count":  result.Updated,
+		"skipped_count":  result.Skipped,
+		"dedup":          dedup,
 		"deck_name":      importReq.DeckName,
-		"message":        "Successfully imported " + strconv.Itoa(importedCount) + " cards into deck '" + importReq.DeckName + "'",
-	}, http.StatusCreated)
+		"decks":          result.Decks,
+		"message":        message,
+	}, http.StatusCreated
+}
+
+// ImportJobHandler handles GET /api/import/jobs/{id} and
+// GET /api/import/jobs/{id}/events, which streams the job's progress as
+// Server-Sent Events: "progress" events with the job status, then a "done"
+// or "failed" event once it finishes.
+func ImportJobHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/import/jobs/"), "/")
+	job, ok := getImportJob(requestCollection(r), id)
+	if !ok || (action != "" && action != "events") {
+		respondError(w, "Import job not found", http.StatusNotFound)
+		return
+	}
+
+	if action == "" {
+		status, _ := job.snapshot()
+		respondJSON(w, status, http.StatusOK)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		respondError(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	// Comments keep proxies from closing a quiet stream
+	heartbeat := time.NewTicker(15 * time.Second)
+	defer heartbeat.Stop()
+	for {
+		status, changed := job.snapshot()
+		event := "progress"
+		if status.Status != "running" {
+			event = status.Status
+		}
+		data, _ := json.Marshal(status)
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+		flusher.Flush()
+		if event != "progress" {
+			return
+		}
+
+	wait:
+		for {
+			select {
+			case <-changed:
+				break wait
+			case <-heartbeat.C:
+				fmt.Fprint(w, ": ping\n\n")
+				flusher.Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
 }
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/alecthomas/chroma/v2"
+	chromahtml "github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/alecthomas/chroma/v2/styles"
+)
+
+// Fenced code blocks in card text are highlighted on the server with
+// chroma. The block's language comes from its fence (```go) or, without
+// one, is guessed from the code. Tokens are marked with CSS classes, and
+// the theme's CSS, set with -code-theme, is sent along with cards that
+// have code.
+
+// codeTheme is the chroma style code is highlighted with, set from
+// -code-theme in main.
+var codeTheme = "github"
+
+var (
+	codeFormatter = chromahtml.New(chromahtml.WithClasses(true), chromahtml.PreventSurroundingPre(true))
+	codeCSSOnce   sync.Once
+	codeCSSText   string
+)
+
+// codeClass marks highlighted code blocks, so their theme is added to the
+// card's CSS.
+const codeClass = `class="chroma"`
+
+// checkCodeTheme reports whether name is a known chroma style.
+func checkCodeTheme(name string) error {
+	if _, ok := styles.Registry[strings.ToLower(name)]; !ok {
+		return fmt.Errorf("unknown code theme %q (choose from %s)", name, strings.Join(styles.Names(), ", "))
+	}
+	return nil
+}
+
+// codeCSS returns the CSS of the code theme.
+func codeCSS() string {
+	codeCSSOnce.Do(func() {
+		var b strings.Builder
+		if err := codeFormatter.WriteCSS(&b, styles.Get(codeTheme)); err == nil {
+			codeCSSText = b.String()
+		}
+	})
+	return codeCSSText
+}
+
+// codeSignatures give away the language of common snippets, which chroma's
+// own analysis mostly misses. The first match wins.
+var codeSignatures = []struct {
+	lang    string
+	pattern *regexp.Regexp
+}{
+	{"go", regexp.MustCompile(`(?m)^package \w+$|\bfunc (\(\w+ \*?\w+\) )?\w+\(|:= `)},
+	{"rust", regexp.MustCompile(`(?m)\bfn \w+\(|\blet mut \b|^use \w+::`)},
+	{"java", regexp.MustCompile(`\bpublic (static )?(class|void|final)\b|System\.out\.print`)},
+	{"cpp", regexp.MustCompile(`(?m)^#include\s*[<"]|\bstd::`)},
+	{"python", regexp.MustCompile(`(?m)^\s*(def \w+\(.*\):|class \w+(\(.*\))?:|from [\w.]+ import |import \w+$)|\bprint\(`)},
+	{"javascript", regexp.MustCompile(`\b(const|let|var) \w+ = |=> |\bfunction\s*\w*\(|console\.log\(`)},
+	{"sql", regexp.MustCompile(`(?i)\b(select\b.+\bfrom|insert into|update \w+ set|create table)\b`)},
+	{"html", regexp.MustCompile(`(?i)<(!doctype|html|div|span|p|a|ul|li|head|body)\b[^>]*>`)},
+	{"bash", regexp.MustCompile(`(?m)^\s*(\$ )?(echo|cd|ls|grep|sudo|export|git|apt|brew|curl) `)},
+}
+
+// guessLexer picks a lexer for code of unknown language: by its shebang
+// line, by codeSignatures, or by chroma's analysis of the text. It returns
+// nil when no language fits.
+func guessLexer(code string) chroma.Lexer {
+	if line, _, _ := strings.Cut(code, "\n"); strings.HasPrefix(line, "#!") {
+		fields := strings.Fields(strings.TrimPrefix(line, "#!"))
+		if len(fields) > 1 && path.Base(fields[0]) == "env" {
+			fields = fields[1:]
+		}
+		if len(fields) > 0 {
+			if lexer := lexers.Get(path.Base(fields[0])); lexer != nil {
+				return lexer
+			}
+		}
+	}
+	for _, sig := range codeSignatures {
+		if sig.pattern.MatchString(code) {
+			return lexers.Get(sig.lang)
+		}
+	}
+	return lexers.Analyse(code)
+}
+
+// highlightCode renders a code block in lang, guessing the language if lang
+// is empty or unknown.
+func highlightCode(lang, code string) string {
+	var lexer chroma.Lexer
+	if lang != "" {
+		lexer = lexers.Get(lang)
+	}
+	if lexer == nil {
+		lexer = guessLexer(code)
+	}
+	name := "text"
+	if lexer != nil {
+		name = strings.ToLower(lexer.Config().Name)
+		if aliases := lexer.Config().Aliases; len(aliases) > 0 {
+			name = aliases[0]
+		}
+	} else {
+		lexer = lexers.Fallback
+	}
+	lexer = chroma.Coalesce(lexer)
+
+	var b strings.Builder
+	tokens, err := lexer.Tokenise(nil, code)
+	if err == nil {
+		err = codeFormatter.Format(&b, styles.Get(codeTheme), tokens)
+	}
+	if err != nil {
+		b.Reset()
+		b.WriteString(html.EscapeString(code))
+	}
+	return `<pre ` + codeClass + `><code class="language-` + html.EscapeString(name) + `">` + b.String() + `</code></pre>`
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+var ErrInvalidImport = errors.New("invalid import file")
+
+// maxUnzippedImport bounds what an uploaded archive may unpack to, so a
+// small zip bomb can't fill the disk.
+const maxUnzippedImport = 512 << 20
+
+// openZipEntry opens a file of an uploaded archive, refusing one that
+// unpacks to more than maxUnzippedImport. The reader stops at the size
+// the archive gives for the file.
+func openZipEntry(f *zip.File) (io.ReadCloser, error) {
+	if f.UncompressedSize64 > maxUnzippedImport {
+		return nil, fmt.Errorf("%w: %s unpacks to more than %d MB", ErrInvalidImport, f.Name, maxUnzippedImport>>20)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(rc, int64(f.UncompressedSize64)), rc}, nil
+}
+
+// checkZipSize refuses an uploaded archive whose files unpack to more
+// than maxUnzippedImport in all. archive/zip refuses files unpacking to
+// more than the archive gives for them.
+func checkZipSize(zr *zip.Reader) error {
+	var total uint64
+	for _, f := range zr.File {
+		total += f.UncompressedSize64
+		if total > maxUnzippedImport {
+			return fmt.Errorf("%w: archive unpacks to more than %d MB", ErrInvalidImport, maxUnzippedImport>>20)
+		}
+	}
+	return nil
+}
+
+// ImportCard is one card of an import, whichever format it came from.
+type ImportCard struct {
+	Front string   `json:"front"`
+	Back  string   `json:"back"`
+	Tags  []string `json:"tags"`
+
+	// Also create a reversed Back→Front card; see ImportRequest.Reverse
+	// for the whole import
+	Reverse bool `json:"reverse,omitempty"`
+
+	// Set by formats that carry decks; the import's deck_name otherwise
+	Deck string `json:"-"`
+
+	// Optional scheduling, for cards coming from another app. JSON imports
+	// keep it; uploads only with scheduling=true. A card without any
+	// starts as new.
+	State      string    `json:"state,omitempty"`
+	Ease       float64   `json:"ease,omitempty"`        // Deck's starting ease if 0
+	Interval   int       `json:"interval,omitempty"`    // Days
+	NextReview time.Time `json:"next_review,omitempty"` // Now if unset
+	Lapses     int       `json:"lapses,omitempty"`
+	Suspended  bool      `json:"suspended,omitempty"`
+}
+
+// hasScheduling reports whether the card carries any scheduling.
+func (c ImportCard) hasScheduling() bool {
+	return c.State != "" || c.Ease != 0 || c.Interval != 0 || !c.NextReview.IsZero() || c.Lapses != 0 || c.Suspended
+}
+
+// validateScheduling checks the card's scheduling fields.
+func (c ImportCard) validateScheduling() error {
+	switch c.State {
+	case "", StateNew, StateLearning, StateReview, StateRelearning:
+	default:
+		return errors.New("state must be new, learning, review or relearning")
+	}
+	if c.Ease < 0 || c.Interval < 0 || c.Lapses < 0 {
+		return errors.New("ease, interval and lapses cannot be negative")
+	}
+	return nil
+}
+
+// DelimitedOptions describes how to read a CSV or TSV file. Columns are
+// numbered from 1, or named after the header row when Header is set.
+type DelimitedOptions struct {
+	Delimiter rune
+	Header    bool   // The first row holds column names, not a card
+	Front     string // Column of the front, "1" by default
+	Back      string // Column of the back, "2" by default
+	Tags      string // Optional column of space separated tags
+}
+
+// parseDelimited reads cards from a CSV or TSV file. Rows missing a column
+// give cards with an empty front or back, left for import validation to
+// report.
+func parseDelimited(r io.Reader, opts DelimitedOptions) ([]ImportCard, error) {
+	records, err := readDelimited(r, opts.Delimiter)
+	if err != nil {
+		return nil, err
+	}
+
+	var header []string
+	if opts.Header && len(records) > 0 {
+		header, records = records[0], records[1:]
+	}
+
+	if opts.Front == "" {
+		opts.Front = "1"
+	}
+	if opts.Back == "" {
+		opts.Back = "2"
+	}
+	front, err := columnIndex(opts.Front, header)
+	if err != nil {
+		return nil, err
+	}
+	back, err := columnIndex(opts.Back, header)
+	if err != nil {
+		return nil, err
+	}
+	tags := -1
+	if opts.Tags != "" {
+		if tags, err = columnIndex(opts.Tags, header); err != nil {
+			return nil, err
+		}
+	}
+
+	field := func(record []string, i int) string {
+		if i < 0 || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	cards := make([]ImportCard, 0, len(records))
+	for _, record := range records {
+		cards = append(cards, ImportCard{
+			Front: field(record, front),
+			Back:  field(record, back),
+			Tags:  strings.Fields(field(record, tags)),
+		})
+	}
+	return cards, nil
+}
+
+// readDelimited reads every record of a CSV or TSV file, which may have
+// rows of different lengths.
+func readDelimited(r io.Reader, delimiter rune) ([][]string, error) {
+	// Spreadsheets often start UTF-8 files with a byte order mark
+	br := bufio.NewReader(r)
+	if bom, err := br.Peek(3); err == nil && string(bom) == "\ufeff" {
+		br.Discard(3)
+	}
+
+	reader := csv.NewReader(br)
+	reader.Comma = delimiter
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidImport, err)
+	}
+	return records, nil
+}
+
+// columnIndex resolves a column given by number (from 1) or by header name
+// to a zero-based index.
+func columnIndex(column string, header []string) (int, error) {
+	if n, err := strconv.Atoi(column); err == nil {
+		if n < 1 {
+			return 0, fmt.Errorf("%w: column numbers start at 1", ErrInvalidImport)
+		}
+		return n - 1, nil
+	}
+	for i, name := range header {
+		if strings.EqualFold(strings.TrimSpace(name), column) {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: no column named %q", ErrInvalidImport, column)
+}
+
+// remNoteColumns maps header names in RemNote's flashcard CSV export to the
+// parts of a card.
+var remNoteColumns = map[string]string{
+	"front": "front", "question": "front",
+	"back": "back", "answer": "back",
+	"tags": "tags",
+	"deck": "deck", "path": "deck", "document": "deck",
+}
+
+// remNotePath splits the document path RemNote gives a card.
+var remNotePath = regexp.MustCompile(`\s*(?:>|/|::)\s*`)
+
+// parseRemNote reads RemNote's flashcard CSV export. Columns are found by
+// their header names; a file without a header has the front, back and
+// document path in its first three columns. The document path becomes the
+// deck, so "Spanish > Verbs" goes to Spanish::Verbs. Fields are HTML.
+func parseRemNote(r io.Reader) ([]ImportCard, error) {
+	records, err := readDelimited(r, ',')
+	if err != nil {
+		return nil, err
+	}
+
+	columns := map[string]int{"front": 0, "back": 1, "deck": 2, "tags": -1}
+	if len(records) > 0 {
+		header := make(map[string]int)
+		for i, name := range records[0] {
+			if part, ok := remNoteColumns[strings.ToLower(strings.TrimSpace(name))]; ok {
+				if _, seen := header[part]; !seen {
+					header[part] = i
+				}
+			}
+		}
+		if _, ok := header["front"]; ok {
+			columns = map[string]int{"front": -1, "back": -1, "deck": -1, "tags": -1}
+			for part, i := range header {
+				columns[part] = i
+			}
+			records = records[1:]
+		}
+	}
+
+	field := func(record []string, part string) string {
+		i := columns[part]
+		if i < 0 || i >= len(record) {
+			return ""
+		}
+		return record[i]
+	}
+
+	cards := make([]ImportCard, 0, len(records))
+	for _, record := range records {
+		var deck []string
+		for _, name := range remNotePath.Split(htmlToText(field(record, "deck")), -1) {
+			if name != "" {
+				deck = append(deck, name)
+			}
+		}
+		cards = append(cards, ImportCard{
+			Front: htmlToText(field(record, "front")),
+			Back:  htmlToText(field(record, "back")),
+			Tags:  strings.FieldsFunc(field(record, "tags"), func(r rune) bool { return r == ',' || r == ' ' }),
+			Deck:  strings.Join(deck, DeckSeparator),
+		})
+	}
+	return cards, nil
+}
+
+var (
+	htmlBreak  = regexp.MustCompile(`(?i)<br\s*/?>|</div>|</p>|</li>`)
+	htmlTag    = regexp.MustCompile(`<[^>]*>`)
+	ankiSound  = regexp.MustCompile(`\[sound:[^\]]*\]`)
+	blankLines = regexp.MustCompile(`\n{3,}`)
+)
+
+// htmlToText turns the HTML of a card field from another app into plain
+// text, keeping line breaks. Media references are dropped.
+func htmlToText(s string) string {
+	s = htmlBreak.ReplaceAllString(s, "\n")
+	s = htmlTag.ReplaceAllString(s, "")
+	s = ankiSound.ReplaceAllString(s, "")
+	s = html.UnescapeString(s)
+	s = strings.ReplaceAll(s, "\u00a0", " ")
+	s = blankLines.ReplaceAllString(s, "\n\n")
+	return strings.TrimSpace(s)
+}
+
+// ankiTextSeparators maps the names Anki's "#separator:" header uses.
+var ankiTextSeparators = map[string]rune{
+	"tab": '\t', "comma": ',', "semicolon": ';', "space": ' ', "pipe": '|', "colon": ':',
+}
+
+// parseAnkiText reads Anki's "Notes in Plain Text" export: tab separated
+// fields, optionally preceded by "#key:value" header lines naming the
+// separator, whether fields are HTML and which columns hold the tags, deck,
+// note type and GUID. The first two remaining columns are the front and
+// back.
+func parseAnkiText(r io.Reader) ([]ImportCard, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	text := strings.TrimPrefix(string(data), "\ufeff")
+
+	separator := '\t'
+	isHTML := false
+	special := make(map[int]string) // Column index to "tags", "deck", ...
+	for strings.HasPrefix(text, "#") {
+		line, rest, _ := strings.Cut(text, "\n")
+		text = rest
+		key, value, ok := strings.Cut(strings.TrimSpace(line[1:]), ":")
+		if !ok {
+			continue
+		}
+		key, value = strings.ToLower(strings.TrimSpace(key)), strings.TrimSpace(value)
+		switch key {
+		case "separator":
+			if sep, ok := ankiTextSeparators[strings.ToLower(value)]; ok {
+				separator = sep
+			} else if utf8.RuneCountInString(value) == 1 {
+				separator, _ = utf8.DecodeRuneInString(value)
+			} else {
+				return nil, fmt.Errorf("%w: unknown separator %q", ErrInvalidImport, value)
+			}
+		case "html":
+			isHTML = value == "true"
+		case "tags column", "deck column", "notetype column", "guid column":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("%w: bad %s %q", ErrInvalidImport, key, value)
+			}
+			special[n-1] = strings.TrimSuffix(key, " column")
+		}
+	}
+
+	reader := csv.NewReader(strings.NewReader(text))
+	reader.Comma = separator
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidImport, err)
+	}
+
+	cards := make([]ImportCard, 0, len(records))
+	for _, record := range records {
+		var card ImportCard
+		var fields []string
+		for i, value := range record {
+			switch special[i] {
+			case "tags":
+				card.Tags = strings.Fields(value)
+			case "deck":
+				card.Deck = strings.TrimSpace(value)
+			case "notetype", "guid":
+			default:
+				if isHTML {
+					value = htmlToText(value)
+				}
+				fields = append(fields, strings.TrimSpace(value))
+			}
+		}
+		if len(fields) > 0 {
+			card.Front = fields[0]
+		}
+		if len(fields) > 1 {
+			card.Back = fields[1]
+		}
+		cards = append(cards, card)
+	}
+	return cards, nil
+}
+
+// quizletSeparators maps the choices of Quizlet's export dialog; anything
+// else is taken as a custom separator.
+var quizletSeparators = map[string]string{
+	"tab": "\t", "comma": ",", "newline": "\n", "semicolon": ";",
+}
+
+// parseQuizlet reads a Quizlet set export: cards separated by cardSep, each
+// a term and a definition separated by termSep (tab and newline by
+// default, as in Quizlet's export dialog). Quizlet does not quote fields,
+// so definitions spanning lines need a custom card separator.
+func parseQuizlet(r io.Reader, termSep, cardSep string) ([]ImportCard, error) {
+	if sep, ok := quizletSeparators[strings.ToLower(termSep)]; ok {
+		termSep = sep
+	}
+	if sep, ok := quizletSeparators[strings.ToLower(cardSep)]; ok {
+		cardSep = sep
+	}
+	if termSep == "" {
+		termSep = "\t"
+	}
+	if cardSep == "" {
+		cardSep = "\n"
+	}
+	if termSep == cardSep {
+		return nil, fmt.Errorf("%w: term and card separators must differ", ErrInvalidImport)
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	text := strings.ReplaceAll(strings.TrimPrefix(string(data), "\ufeff"), "\r\n", "\n")
+
+	var cards []ImportCard
+	for _, entry := range strings.Split(text, cardSep) {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		term, definition, _ := strings.Cut(entry, termSep)
+		cards = append(cards, ImportCard{
+			Front: strings.TrimSpace(term),
+			Back:  strings.TrimSpace(definition),
+		})
+	}
+	return cards, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// zipWithEntry makes an archive of one stored file claiming to unpack to
+// size bytes.
+func zipWithEntry(t *testing.T, name string, data []byte, size uint64) *bytes.Reader {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.CreateRaw(&zip.FileHeader{
+		Name:               name,
+		Method:             zip.Store,
+		CompressedSize64:   uint64(len(data)),
+		UncompressedSize64: size,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return bytes.NewReader(buf.Bytes())
+}
+
+func TestZipBombsRefused(t *testing.T) {
+	huge := uint64(maxUnzippedImport + 1)
+	parsers := []struct {
+		name  string
+		entry string
+		parse func(r *bytes.Reader) error
+	}{
+		{"apkg", "collection.anki2", func(r *bytes.Reader) error { _, err := parseApkg(r, r.Size()); return err }},
+		{"mochi", "data.json", func(r *bytes.Reader) error { _, err := parseMochi(r, r.Size()); return err }},
+		{"markdown", "note.md", func(r *bytes.Reader) error { _, err := parseMarkdownZip(r, r.Size()); return err }},
+	}
+	for _, p := range parsers {
+		t.Run(p.name, func(t *testing.T) {
+			err := p.parse(zipWithEntry(t, p.entry, []byte("x"), huge))
+			if !errors.Is(err, ErrInvalidImport) || !strings.Contains(err.Error(), "unpacks to more than") {
+				t.Errorf("parsing a zip bomb = %v, want ErrInvalidImport", err)
+			}
+		})
+	}
+}
+
+func TestImportUpsert(t *testing.T) {
+	db := openTestCollection(t)
+	for _, front := range []string{"hola", "hola", "Hola "} {
+		if err := CreateCard(db, &Card{DeckName: "Spanish", Front: front, Back: "hi"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cards := []Card{
+		{DeckName: "Spanish", Front: "hola", Back: "hello"},
+		{DeckName: "Spanish", Front: "adiós", Back: "goodbye"},
+	}
+	resp, status := runImport(db, ImportRequest{DeckName: "Spanish"}, cards, nil, DedupUpdate, false, nil)
+	if status != http.StatusCreated {
+		t.Fatalf("import = %d %v", status, resp)
+	}
+	for key, want := range map[string]int{"imported_count": 2, "created_count": 1, "updated_count": 1} {
+		if resp[key] != want {
+			t.Errorf("%s = %v, want %d", key, resp[key], want)
+		}
+	}
+
+	all, _, err := GetAllCards(db, CardFilter{Deck: "Spanish"}, ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	backs := map[string][]string{}
+	for _, c := range all {
+		backs[c.Front] = append(backs[c.Front], c.Back)
+	}
+	want := map[string][]string{"hola": {"hello", "hello"}, "Hola ": {"hi"}, "adiós": {"goodbye"}}
+	if !reflect.DeepEqual(backs, want) {
+		t.Errorf("backs after upsert = %v, want %v", backs, want)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// importJobTTL is how long a finished import job can still be looked up.
+const importJobTTL = 10 * time.Minute
+
+// ImportJobStatus is the progress of an import running in the background,
+// started with POST /api/import?async=true.
+type ImportJobStatus struct {
+	ID         string    `json:"id"`
+	Status     string    `json:"status"` // running, done or failed
+	Total      int       `json:"total"`
+	Processed  int       `json:"processed"`
+	Invalid    int       `json:"invalid"` // Cards failing validation in a dry run
+	ETASeconds float64   `json:"eta_seconds"`
+	StartedAt  time.Time `json:"started_at"`
+
+	// Once finished, the response the import would have given without
+	// async, and its HTTP status
+	Result     map[string]interface{} `json:"result,omitempty"`
+	StatusCode int                    `json:"status_code,omitempty"`
+}
+
+type importJob struct {
+	db      *Collection // The collection imported into, which alone may look the job up
+	mu      sync.Mutex
+	status  ImportJobStatus
+	changed chan struct{} // Closed and replaced on every update
+}
+
+var (
+	importJobsMu sync.Mutex
+	importJobs   = make(map[string]*importJob)
+)
+
+// startImportJob runs an import in the background. run gets a function to
+// report how many cards it has processed and returns the response body and
+// status the import finished with.
+func startImportJob(db *Collection, total, invalid int, run func(progress func(int)) (map[string]interface{}, int)) ImportJobStatus {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	job := &importJob{
+		db: db,
+		status: ImportJobStatus{
+			ID:        hex.EncodeToString(buf),
+			Status:    "running",
+			Total:     total,
+			Invalid:   invalid,
+			StartedAt: time.Now(),
+		},
+		changed: make(chan struct{}),
+	}
+
+	importJobsMu.Lock()
+	importJobs[job.status.ID] = job
+	importJobsMu.Unlock()
+
+	go func() {
+		result, code := run(func(processed int) {
+			job.update(func(s *ImportJobStatus) {
+				s.Processed = processed
+				if elapsed := time.Since(s.StartedAt).Seconds(); processed > 0 {
+					s.ETASeconds = elapsed / float64(processed) * float64(s.Total-processed)
+				}
+			})
+		})
+		job.update(func(s *ImportJobStatus) {
+			s.Status = "done"
+			if code >= 400 {
+				s.Status = "failed"
+			} else {
+				s.Processed = s.Total
+			}
+			s.ETASeconds = 0
+			s.Result = result
+			s.StatusCode = code
+		})
+
+		time.AfterFunc(importJobTTL, func() {
+			importJobsMu.Lock()
+			delete(importJobs, job.status.ID)
+			importJobsMu.Unlock()
+		})
+	}()
+
+	status, _ := job.snapshot()
+	return status
+}
+
+// getImportJob looks up a running or recently finished import into a
+// collection.
+func getImportJob(db *Collection, id string) (*importJob, bool) {
+	importJobsMu.Lock()
+	defer importJobsMu.Unlock()
+	job, ok := importJobs[id]
+	if !ok || job.db != db {
+		return nil, false
+	}
+	return job, ok
+}
+
+// snapshot returns the job's status and a channel closed on its next
+// change.
+func (j *importJob) snapshot() (ImportJobStatus, <-chan struct{}) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.status, j.changed
+}
+
+func (j *importJob) update(change func(*ImportJobStatus)) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	change(&j.status)
+	close(j.changed)
+	j.changed = make(chan struct{})
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// The LLM features talk to an OpenAI-compatible chat completions API: the
+// OpenAI API itself or a local server such as Ollama or llama.cpp. They are
+// off unless -llm-url is set. The API key, if the server needs one, is read
+// from the LLM_API_KEY environment variable so it stays out of the process
+// list.
+
+// llmURL is the base URL of the API (e.g. https://api.openai.com/v1) and
+// llmModel the model asked, set from -llm-url and -llm-model in main.
+var (
+	llmURL   = ""
+	llmModel = "gpt-4o-mini"
+)
+
+var (
+	ErrLLMDisabled = errors.New("no LLM is configured; start the server with -llm-url")
+	ErrLLM         = errors.New("LLM request failed")
+)
+
+// llmClient is not limited to public addresses like remoteClient, as the
+// LLM is often a local server; its URL comes from the operator, not users.
+var llmClient = &http.Client{Timeout: 2 * time.Minute}
+
+// maxLLMResponse bounds the response read from the LLM.
+const maxLLMResponse = 4 << 20
+
+// llmChat sends a system and a user message and decodes the JSON object
+// the model answers with into out.
+func llmChat(ctx context.Context, system, user string, out any) error {
+	if llmURL == "" {
+		return ErrLLMDisabled
+	}
+
+	var completion struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+	}
+	err := llmPost(ctx, llmURL, "/chat/completions", map[string]any{
+		"model": llmModel,
+		"messages": []map[string]string{
+			{"role": "system", "content": system},
+			{"role": "user", "content": user},
+		},
+		"temperature":     0.2,
+		"response_format": map[string]string{"type": "json_object"},
+	}, &completion)
+	if err != nil {
+		return err
+	}
+	if len(completion.Choices) == 0 {
+		return fmt.Errorf("%w: unexpected response", ErrLLM)
+	}
+
+	// Models asked for JSON sometimes wrap it in a code fence anyway
+	content := strings.TrimSpace(completion.Choices[0].Message.Content)
+	content = strings.TrimPrefix(content, "```json")
+	content = strings.TrimPrefix(content, "```")
+	content = strings.TrimSuffix(content, "```")
+	if err := json.Unmarshal([]byte(content), out); err != nil {
+		return fmt.Errorf("%w: model did not answer with the expected JSON: %v", ErrLLM, err)
+	}
+	return nil
+}
+
+// llmPost posts a JSON request to path under the API at base and decodes
+// the JSON response into out.
+func llmPost(ctx context.Context, base, path string, request, out any) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", strings.TrimSuffix(base, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrLLM, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if key := os.Getenv("LLM_API_KEY"); key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+
+	resp, err := llmClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrLLM, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxLLMResponse))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrLLM, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: server answered %s: %s", ErrLLM, resp.Status, strings.TrimSpace(string(data)))
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("%w: unexpected response", ErrLLM)
+	}
+	return nil
+}
+
+// llmErrorStatus returns the HTTP status for an error from an LLM feature.
+func llmErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrLLMDisabled):
+		return http.StatusNotImplemented
+	case errors.Is(err, ErrLLM):
+		return http.StatusBadGateway
+	}
+	return http.StatusInternalServerError
+}
+
+// AnswerGrade is an LLM's grade of a typed answer.
+type AnswerGrade struct {
+	Score       int    `json:"score"` // 1=Again, 2=Hard, 3=Good, 4=Easy
+	Correct     bool   `json:"correct"`
+	Explanation string `json:"explanation"`
+}
+
+const gradePrompt = `You grade answers to flashcards. Compare the student's answer with the expected answer and judge whether it means the same, ignoring wording, spelling slips and word order that do not change the meaning.
+
+Answer with a JSON object: {"score": S, "correct": C, "explanation": E}
+- S is 1 if the answer is wrong or missing the point, 2 if it is right but incomplete or partly wrong, 3 if it is right, and 4 if it is right and complete in every detail.
+- C is true for scores 3 and 4.
+- E explains the grade to the student in one or two short sentences, naming what is missing or wrong.`
+
+// GradeAnswer asks the LLM to grade a typed answer to a card, for answers
+// that are sentences rather than words a character diff can check.
+func GradeAnswer(db *Collection, ctx context.Context, cardID int, typed string) (*AnswerGrade, error) {
+	card, err := GetCard(db, cardID)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(typed) == "" {
+		return &AnswerGrade{Score: 1, Explanation: "No answer was given."}, nil
+	}
+
+	prompt := fmt.Sprintf("Question:\n%s\n\nExpected answer:\n%s\n\nStudent's answer:\n%s",
+		answerText(card.Front), answerText(card.Back), strings.TrimSpace(typed))
+	grade := &AnswerGrade{}
+	if err := llmChat(ctx, gradePrompt, prompt, grade); err != nil {
+		return nil, err
+	}
+	if grade.Score < 1 || grade.Score > 4 {
+		return nil, fmt.Errorf("%w: model gave a score of %d", ErrLLM, grade.Score)
+	}
+	grade.Correct = grade.Score >= 3
+	return grade, nil
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Words are looked up in free online dictionaries to fill in new cards:
+// English in the Free Dictionary API (dictionaryapi.dev), which has
+// pronunciations, Japanese in Jisho, which has kana readings, and every
+// other language in English Wiktionary. Requests go through remoteClient,
+// so they only reach public addresses.
+
+var (
+	ErrInvalidLookup = errors.New("invalid lookup")
+	ErrWordNotFound  = errors.New("word not found")
+	ErrDictionary    = errors.New("dictionary lookup failed")
+)
+
+// The dictionary APIs, each taking the escaped word at the end.
+var (
+	freeDictionaryURL = "https://api.dictionaryapi.dev/api/v2/entries/en/"
+	jishoURL          = "https://jisho.org/api/v1/search/words?keyword="
+	wiktionaryURL     = "https://en.wiktionary.org/api/rest_v1/page/definition/"
+)
+
+const (
+	// maxLookupResponse bounds the response read from a dictionary.
+	maxLookupResponse = 2 << 20
+	// maxLookupEntries, maxLookupDefinitions and maxLookupExamples bound
+	// what is returned, as cards only need the common senses.
+	maxLookupEntries     = 5
+	maxLookupDefinitions = 5
+	maxLookupExamples    = 3
+)
+
+// lookupLang matches ISO 639 language codes.
+var lookupLang = regexp.MustCompile(`^[a-z]{2,3}$`)
+
+// LookupResult is what the dictionaries know of a word. Front and Back
+// are the text of a card for it, in Markdown.
+type LookupResult struct {
+	Word    string        `json:"word"`
+	Lang    string        `json:"lang"`
+	Source  string        `json:"source"`
+	Entries []LookupEntry `json:"entries"`
+	Front   string        `json:"front"`
+	Back    string        `json:"back"`
+}
+
+// LookupEntry is one sense group of a word, by part of speech.
+type LookupEntry struct {
+	PartOfSpeech string   `json:"part_of_speech"`
+	Reading      string   `json:"reading,omitempty"` // Pronunciation or kana
+	Definitions  []string `json:"definitions"`
+	Examples     []string `json:"examples"`
+}
+
+// LookupWord looks a word up in the dictionary for lang, "en" by default.
+func LookupWord(word, lang string) (*LookupResult, error) {
+	word = strings.TrimSpace(word)
+	if lang == "" {
+		lang = "en"
+	}
+	switch {
+	case word == "":
+		return nil, fmt.Errorf("%w: word is required", ErrInvalidLookup)
+	case len(word) > 100:
+		return nil, fmt.Errorf("%w: word is too long", ErrInvalidLookup)
+	case !lookupLang.MatchString(lang):
+		return nil, fmt.Errorf("%w: lang must be a language code such as en, es or ja", ErrInvalidLookup)
+	}
+
+	result := &LookupResult{Word: word, Lang: lang}
+	var err error
+	switch lang {
+	case "en":
+		result.Source = "dictionaryapi.dev"
+		result.Entries, err = lookupFreeDictionary(word)
+	case "ja":
+		result.Source = "jisho.org"
+		result.Entries, err = lookupJisho(word)
+	default:
+		result.Source = "wiktionary.org"
+		result.Entries, err = lookupWiktionary(word, lang)
+	}
+	if err != nil {
+		return nil, err
+	}
+	entries := []LookupEntry{}
+	for _, e := range result.Entries {
+		if len(e.Definitions) > 0 {
+			entries = append(entries, e)
+		}
+	}
+	result.Entries = entries
+	if len(result.Entries) == 0 {
+		return nil, fmt.Errorf("%w: %q", ErrWordNotFound, word)
+	}
+	if len(result.Entries) > maxLookupEntries {
+		result.Entries = result.Entries[:maxLookupEntries]
+	}
+	result.Front, result.Back = word, lookupBack(result.Entries)
+	return result, nil
+}
+
+// fetchDictionary gets a dictionary's JSON answer about a word. Not found
+// answers give a nil body.
+func fetchDictionary(rawURL string) ([]byte, error) {
+	req, err := http.NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", "simple-anki/"+version+" (https://github.com/lepinkainen/simple-anki)")
+
+	resp, err := remoteClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDictionary, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: server answered %s", ErrDictionary, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxLookupResponse))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDictionary, err)
+	}
+	return data, nil
+}
+
+func lookupFreeDictionary(word string) ([]LookupEntry, error) {
+	data, err := fetchDictionary(freeDictionaryURL + url.PathEscape(strings.ToLower(word)))
+	if err != nil || data == nil {
+		return nil, err
+	}
+	return parseFreeDictionary(data)
+}
+
+// parseFreeDictionary reads the Free Dictionary API's entries, merging
+// the senses of each part of speech across them.
+func parseFreeDictionary(data []byte) ([]LookupEntry, error) {
+	var words []struct {
+		Phonetic  string `json:"phonetic"`
+		Phonetics []struct {
+			Text string `json:"text"`
+		} `json:"phonetics"`
+		Meanings []struct {
+			PartOfSpeech string `json:"partOfSpeech"`
+			Definitions  []struct {
+				Definition string `json:"definition"`
+				Example    string `json:"example"`
+			} `json:"definitions"`
+		} `json:"meanings"`
+	}
+	if err := json.Unmarshal(data, &words); err != nil {
+		return nil, fmt.Errorf("%w: unexpected response", ErrDictionary)
+	}
+
+	var entries []LookupEntry
+	index := make(map[string]int)
+	for _, w := range words {
+		reading := w.Phonetic
+		for _, p := range w.Phonetics {
+			if reading == "" {
+				reading = p.Text
+			}
+		}
+		for _, m := range w.Meanings {
+			i, ok := index[m.PartOfSpeech]
+			if !ok {
+				i = len(entries)
+				index[m.PartOfSpeech] = i
+				entries = append(entries, LookupEntry{PartOfSpeech: m.PartOfSpeech, Reading: reading})
+			}
+			for _, d := range m.Definitions {
+				entries[i].addDefinition(d.Definition)
+				entries[i].addExample(d.Example)
+			}
+		}
+	}
+	return entries, nil
+}
+
+func lookupJisho(word string) ([]LookupEntry, error) {
+	data, err := fetchDictionary(jishoURL + url.QueryEscape(word))
+	if err != nil || data == nil {
+		return nil, err
+	}
+	return parseJisho(data, word)
+}
+
+// parseJisho reads Jisho's search results, keeping those written or read
+// as word: a search also finds words merely containing it.
+func parseJisho(data []byte, word string) ([]LookupEntry, error) {
+	var search struct {
+		Data []struct {
+			Japanese []struct {
+				Word    string `json:"word"`
+				Reading string `json:"reading"`
+			} `json:"japanese"`
+			Senses []struct {
+				EnglishDefinitions []string `json:"english_definitions"`
+				PartsOfSpeech      []string `json:"parts_of_speech"`
+			} `json:"senses"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(data, &search); err != nil {
+		return nil, fmt.Errorf("%w: unexpected response", ErrDictionary)
+	}
+
+	var entries []LookupEntry
+	for _, result := range search.Data {
+		match, reading := false, ""
+		for _, j := range result.Japanese {
+			if j.Word == word || j.Reading == word {
+				match, reading = true, j.Reading
+				break
+			}
+		}
+		if !match {
+			continue
+		}
+		entry := LookupEntry{Reading: reading}
+		for _, sense := range result.Senses {
+			if entry.PartOfSpeech == "" && len(sense.PartsOfSpeech) > 0 {
+				entry.PartOfSpeech = strings.ToLower(sense.PartsOfSpeech[0])
+			}
+			entry.addDefinition(strings.Join(sense.EnglishDefinitions, "; "))
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func lookupWiktionary(word, lang string) ([]LookupEntry, error) {
+	data, err := fetchDictionary(wiktionaryURL + url.PathEscape(word))
+	if err != nil || data == nil {
+		return nil, err
+	}
+	return parseWiktionary(data, lang)
+}
+
+// parseWiktionary reads Wiktionary's definitions of a word in lang. They
+// come as HTML, which is turned into plain text.
+func parseWiktionary(data []byte, lang string) ([]LookupEntry, error) {
+	var languages map[string][]struct {
+		PartOfSpeech string `json:"partOfSpeech"`
+		Definitions  []struct {
+			Definition string   `json:"definition"`
+			Examples   []string `json:"examples"`
+		} `json:"definitions"`
+	}
+	if err := json.Unmarshal(data, &languages); err != nil {
+		return nil, fmt.Errorf("%w: unexpected response", ErrDictionary)
+	}
+
+	var entries []LookupEntry
+	for _, usage := range languages[lang] {
+		entry := LookupEntry{PartOfSpeech: strings.ToLower(usage.PartOfSpeech)}
+		for _, d := range usage.Definitions {
+			entry.addDefinition(htmlToText(d.Definition))
+			for _, example := range d.Examples {
+				entry.addExample(htmlToText(example))
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (e *LookupEntry) addDefinition(definition string) {
+	if definition = strings.TrimSpace(definition); definition != "" && len(e.Definitions) < maxLookupDefinitions {
+		e.Definitions = append(e.Definitions, definition)
+	}
+	if e.Examples == nil {
+		e.Examples = []string{}
+	}
+}
+
+func (e *LookupEntry) addExample(example string) {
+	if example = strings.TrimSpace(example); example != "" && len(e.Examples) < maxLookupExamples {
+		e.Examples = append(e.Examples, example)
+	}
+}
+
+// lookupBack writes the back of a card from dictionary entries: each part
+// of speech with its reading and numbered definitions, then an example.
+func lookupBack(entries []LookupEntry) string {
+	var parts []string
+	for _, e := range entries {
+		var b strings.Builder
+		if e.PartOfSpeech != "" {
+			b.WriteString("*" + e.PartOfSpeech + "*")
+		}
+		if e.Reading != "" {
+			if b.Len() > 0 {
+				b.WriteString(" ")
+			}
+			b.WriteString(e.Reading)
+		}
+		for i, d := range e.Definitions {
+			if b.Len() > 0 {
+				b.WriteString("\n")
+			}
+			fmt.Fprintf(&b, "%d. %s", i+1, d)
+		}
+		if len(e.Examples) > 0 {
+			b.WriteString("\n\n> " + e.Examples[0])
+		}
+		parts = append(parts, b.String())
+	}
+	return strings.Join(parts, "\n\n")
+}
@@ -3,23 +3,187 @@ package main
 import (
 	"embed"
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"strings"
+	"time"
+	_ "time/tzdata" // Timezones for -timezone on systems without a zoneinfo database
 )
 
 //go:embed static/*
 var staticFiles embed.FS
 
+// Build information, stamped at build time with
+// -ldflags "-X main.version=... -X main.commit=... -X main.buildDate=..."
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
 func main() {
 	port := flag.String("port", "8080", "Port to run the server on")
 	dbPath := flag.String("db", "flashcards.db", "Path to SQLite database")
+	flag.StringVar(&mediaDir, "media-dir", mediaDir, "Directory for uploaded media such as card images")
+	flag.StringVar(&codeTheme, "code-theme", codeTheme, "Chroma style for highlighting code blocks in cards, e.g. github, monokai or dracula")
+	flag.IntVar(&maxImageDimension, "max-image-size", maxImageDimension, "Longest side in pixels uploaded JPEG and PNG images are scaled down to (0 stores them as uploaded)")
+	flag.StringVar(&llmURL, "llm-url", llmURL, "Base URL of an OpenAI-compatible API for LLM features, e.g. https://api.openai.com/v1 (key from LLM_API_KEY)")
+	flag.StringVar(&llmModel, "llm-model", llmModel, "Model used by the LLM features")
+	flag.StringVar(&embeddingURL, "embedding-url", embeddingURL, "Base URL of an OpenAI-compatible embeddings API for semantic duplicate detection (default: -llm-url)")
+	flag.StringVar(&embeddingModel, "embedding-model", embeddingModel, "Model used for embeddings")
+	flag.StringVar(&ocrEngine, "ocr", ocrEngine, "OCR engine for photographed notes: tesseract, or llm for the -llm-url vision model")
+	flag.StringVar(&tesseractPath, "tesseract", tesseractPath, "Path to the tesseract command used for OCR")
+	flag.StringVar(&pdftoppmPath, "pdftoppm", pdftoppmPath, "Path to poppler's pdftoppm command, used to OCR PDFs")
+	flag.StringVar(&pdftotextPath, "pdftotext", pdftotextPath, "Path to poppler's pdftotext command, used to make decks of PDFs")
+	learningSteps := flag.String("learning-steps", "1m,10m", "Comma-separated learning steps for new cards (e.g. 1m,10m,1d)")
+	relearningSteps := flag.String("relearning-steps", "10m", "Comma-separated relearning steps for lapsed cards")
+	newIntervalPercent := flag.Float64("new-interval-percent", 0, "Percentage of the old interval kept by a lapsed card after relearning")
+	newCardsPerDay := flag.Int("new-cards-per-day", 20, "Default daily limit of new cards per deck, also the collection-wide limit")
+	reviewsPerDay := flag.Int("reviews-per-day", 200, "Default daily limit of review cards per deck, also the collection-wide limit")
+	dayStart := flag.Int("day-start-hour", 4, "Hour (0-23) at which a new study day starts")
+	timezone := flag.String("timezone", "", "IANA timezone for study days, e.g. Europe/Helsinki (default: system timezone)")
+	fuzzPercent := flag.Float64("fuzz-percent", 5, "Default random spread of review intervals, in percent")
+	loadBalance := flag.Bool("load-balance", false, "Default for picking the least busy day within the fuzz range for review intervals")
+	easyDays := flag.String("easy-days", "", "Default comma-separated weekdays to keep reviews off where possible when load balancing, e.g. saturday,sunday")
+	fuzzSeed := flag.Uint64("fuzz-seed", 0, "Seed for interval fuzz, for reproducible scheduling (default: random)")
+	maxInterval := flag.Int("max-interval", 3650, "Default maximum review interval in days")
+	dailyGoal := flag.Int("daily-goal", 0, "Default number of reviews a day to aim for, also the collection-wide goal (0 sets no goal)")
+	maxAnswerSeconds := flag.Int("max-answer-seconds", 60, "Default maximum time recorded for answering a card, in seconds")
+	importMarkdown := flag.String("import-markdown", "", "Import cards from a folder of Markdown notes and exit (folders become decks)")
+	importDeck := flag.String("import-deck", "", "Deck for notes at the top of the -import-markdown folder")
+	usersDB := flag.String("users-db", "", "Path to a SQLite database of user accounts; enables accounts, each with its own collection (default: no accounts or login)")
+	collectionsDir := flag.String("collections-dir", "collections", "Directory for the collections and media of accounts other than the first, which uses -db and -media-dir")
+	openRegistration := flag.Bool("open-registration", false, "Let anyone register an account, not just the first account")
+	flag.StringVar(&oidcIssuer, "oidc-issuer", oidcIssuer, "Issuer URL of an OpenID Connect provider for single sign-on, e.g. https://auth.example.com (client secret from OIDC_CLIENT_SECRET)")
+	flag.StringVar(&oidcClientID, "oidc-client-id", oidcClientID, "Client ID registered with the -oidc-issuer provider")
+	flag.StringVar(&oidcRedirectURL, "oidc-redirect-url", oidcRedirectURL, "Callback URL registered with the provider, e.g. https://anki.example.com/api/oidc/callback (default: from the request's host)")
+	flag.StringVar(&oidcAllowedEmails, "oidc-allowed-emails", oidcAllowedEmails, "Comma-separated emails or @domains whose verified email may create an account through single sign-on without -open-registration")
+	flag.BoolVar(&secureCookies, "secure-cookies", secureCookies, "Mark session cookies Secure on plain HTTP requests too, for a server behind an HTTPS proxy")
+	flag.BoolVar(&readOnly, "readonly", readOnly, "Refuse every request that would change a collection; cards can still be studied in cram mode and exported")
+	flag.IntVar(&rateLimit, "rate-limit", rateLimit, "API requests a client (IP address or token) may make a minute (0 for no limit)")
+	flag.IntVar(&expensiveRateLimit, "rate-limit-expensive", expensiveRateLimit, "Imports, exports, searches, LLM calls and logins a client may make a minute with -rate-limit (0 for no further limit)")
+	flag.BoolVar(&trustProxy, "trust-proxy", trustProxy, "Take clients' IP addresses from the X-Forwarded-For header of a reverse proxy")
+	allowOrigins := flag.String("cors-origins", "", "Comma-separated origins allowed to call the API from other web pages, e.g. https://app.example.com, or * for any (default: none)")
+	flag.StringVar(&tlsCert, "tls-cert", tlsCert, "PEM certificate file to serve HTTPS with, together with -tls-key")
+	flag.StringVar(&tlsKey, "tls-key", tlsKey, "PEM private key file of -tls-cert")
+	flag.StringVar(&acmeDomain, "acme-domain", acmeDomain, "Comma-separated domains to serve HTTPS for with certificates from Let's Encrypt, e.g. anki.example.com")
+	flag.StringVar(&acmeCache, "acme-cache", acmeCache, "Directory the Let's Encrypt certificates of -acme-domain are kept in")
+	flag.StringVar(&acmeEmail, "acme-email", acmeEmail, "Email address Let's Encrypt may contact about the certificates of -acme-domain")
+	flag.StringVar(&basicAuth, "auth", basicAuth, "user:password required of every request with HTTP basic auth, for a single user (default: SIMPLE_ANKI_AUTH)")
+	showVersion := flag.Bool("version", false, "Print version information and exit")
 	flag.Parse()
 
+	if *showVersion {
+		fmt.Printf("simple-anki %s (commit %s, built %s)\n", version, commit, buildDate)
+		return
+	}
+
+	steps, err := ParseSteps(*learningSteps)
+	if err != nil {
+		log.Fatalf("Invalid -learning-steps: %v", err)
+	}
+	schedulerSettings.LearningSteps = steps
+
+	steps, err = ParseSteps(*relearningSteps)
+	if err != nil {
+		log.Fatalf("Invalid -relearning-steps: %v", err)
+	}
+	schedulerSettings.RelearningSteps = steps
+	schedulerSettings.NewIntervalPercent = *newIntervalPercent
+	schedulerSettings.NewCardsPerDay = *newCardsPerDay
+	schedulerSettings.ReviewsPerDay = *reviewsPerDay
+	schedulerSettings.FuzzPercent = *fuzzPercent
+	schedulerSettings.MaxInterval = *maxInterval
+	schedulerSettings.LoadBalance = *loadBalance
+	for _, day := range strings.Split(*easyDays, ",") {
+		if day = strings.ToLower(strings.TrimSpace(day)); day != "" {
+			schedulerSettings.EasyDays = append(schedulerSettings.EasyDays, day)
+		}
+	}
+	schedulerSettings.DailyGoal = *dailyGoal
+	schedulerSettings.MaxAnswerSeconds = *maxAnswerSeconds
+
+	if err := schedulerSettings.Validate(); err != nil {
+		log.Fatalf("Invalid scheduler settings: %v", err)
+	}
+
+	if ocrEngine != OCRTesseract && ocrEngine != OCRLLM {
+		log.Fatalf("Invalid -ocr: must be %s or %s", OCRTesseract, OCRLLM)
+	}
+
+	if err := checkCodeTheme(codeTheme); err != nil {
+		log.Fatalf("Invalid -code-theme: %v", err)
+	}
+
+	if *dayStart < 0 || *dayStart > 23 {
+		log.Fatalf("-day-start-hour must be between 0 and 23")
+	}
+	dayStartHour = *dayStart
+
+	if *fuzzSeed != 0 {
+		SeedFuzz(*fuzzSeed)
+	}
+
+	if *timezone != "" {
+		loc, err := time.LoadLocation(*timezone)
+		if err != nil {
+			log.Fatalf("Invalid -timezone: %v", err)
+		}
+		dayLocation = loc
+	}
+
 	// Initialize database
-	if err := InitDB(*dbPath); err != nil {
+	db, err := OpenCollection(*dbPath, mediaDir)
+	if err != nil {
 		log.Fatalf("Failed to initialize database: %v", err)
 	}
-	defer CloseDB()
+	defer db.Close()
+	defaultCollection = db
+
+	if basicAuth == "" {
+		basicAuth = os.Getenv("SIMPLE_ANKI_AUTH")
+	}
+	if user, password, ok := strings.Cut(basicAuth, ":"); basicAuth != "" && (!ok || user == "" || password == "") {
+		log.Fatalf("Invalid -auth: must be user:password")
+	}
+	if basicAuth != "" && *usersDB != "" {
+		log.Fatalf("-auth and -users-db can't be used together; accounts have their own login")
+	}
+
+	if err := checkTLSFlags(port); err != nil {
+		log.Fatalf("Invalid TLS flags: %v", err)
+	}
+
+	if corsOrigins, err = parseCORSOrigins(*allowOrigins); err != nil {
+		log.Fatalf("Invalid -cors-origins: %v", err)
+	}
+
+	if (oidcIssuer != "") != (oidcClientID != "") {
+		log.Fatalf("-oidc-issuer and -oidc-client-id must be set together")
+	}
+	if oidcIssuer != "" && *usersDB == "" {
+		log.Fatalf("-oidc-issuer needs accounts; set -users-db")
+	}
+
+	if *usersDB != "" {
+		accounts, err = OpenAccounts(*usersDB, *collectionsDir, *openRegistration)
+		if err != nil {
+			log.Fatalf("Failed to open accounts database: %v", err)
+		}
+		defer accounts.Close()
+	}
+
+	if *importMarkdown != "" {
+		result, err := ImportMarkdownDir(db, *importMarkdown, *importDeck)
+		if err != nil {
+			log.Fatalf("Markdown import failed: %v", err)
+		}
+		fmt.Printf("Imported %d new cards, updated %d, into %s\n",
+			result.Created, result.Updated, strings.Join(result.Decks, ", "))
+		return
+	}
 
 	// Setup routes
 	mux := http.NewServeMux()
@@ -27,15 +191,82 @@ func main() {
 	// API endpoints
 	mux.HandleFunc("/api/cards", CardsHandler)
 	mux.HandleFunc("/api/cards/", CardHandler)
+	mux.HandleFunc("/api/cards/bulk", BulkCardsHandler)
+	mux.HandleFunc("/api/cards/delete", BulkDeleteHandler)
+	mux.HandleFunc("/api/cards/move", BulkMoveHandler)
+	mux.HandleFunc("/api/cards/replace", BulkReplaceHandler)
+	mux.HandleFunc("/api/cards/tags", BulkTagsHandler)
+	mux.HandleFunc("/api/cards/reposition", BulkRepositionHandler)
+	mux.HandleFunc("/api/cards/recompute", BulkRecomputeHandler)
+	mux.HandleFunc("/api/cards/duplicates", CardDuplicatesHandler)
+	mux.HandleFunc("/api/notes", NotesHandler)
+	mux.HandleFunc("/api/notes/", NoteHandler)
+	mux.HandleFunc("/api/notes/image-occlusion", OcclusionNoteHandler)
+	mux.HandleFunc("/api/media", MediaListHandler)
+	mux.HandleFunc("/api/media/gc", MediaGCHandler)
+	mux.HandleFunc("/api/note-types", NoteTypesHandler)
+	mux.HandleFunc("/api/note-types/", NoteTypeHandler)
 	mux.HandleFunc("/api/decks", DecksHandler)
+	mux.HandleFunc("/api/decks/", DeckHandler)
+	mux.HandleFunc("/api/filtered-decks", FilteredDecksHandler)
+	mux.HandleFunc("/api/filtered-decks/", FilteredDeckHandler)
+	mux.HandleFunc("/api/tags", TagsHandler)
+	mux.HandleFunc("/api/search", SearchHandler)
 	mux.HandleFunc("/api/review", ReviewHandler)
+	mux.HandleFunc("/api/review/session", ReviewSessionHandler)
+	mux.HandleFunc("/api/review/undo", ReviewUndoHandler)
+	mux.HandleFunc("/api/review/postpone", ReviewPostponeHandler)
+	mux.HandleFunc("/api/review/away", ReviewAwayHandler)
+	mux.HandleFunc("/api/review/rebalance", ReviewRebalanceHandler)
+	mux.HandleFunc("/api/review/check", ReviewCheckHandler)
+	mux.HandleFunc("/api/review/grade", ReviewGradeHandler)
+	mux.HandleFunc("/api/generate", GenerateHandler)
+	mux.HandleFunc("/api/cloze/suggest", ClozeSuggestHandler)
+	mux.HandleFunc("/api/lookup", LookupHandler)
+	mux.HandleFunc("/api/quickadd", QuickAddHandler)
+	mux.HandleFunc("/api/stats", StatsHandler)
+	mux.HandleFunc("/api/stats/", StatsHandler)
 	mux.HandleFunc("/api/import", ImportHandler)
+	mux.HandleFunc("/api/import/jobs/", ImportJobHandler)
+	mux.HandleFunc("/api/import/ocr", OCRImportHandler)
+	mux.HandleFunc("/api/import/pdf", PDFImportHandler)
+	mux.HandleFunc("/api/export/", ExportHandler)
+	mux.HandleFunc("/api/version", VersionHandler)
+	mux.HandleFunc("/api/shares", SharesHandler)
+	mux.HandleFunc("/api/shares/", SharesHandler)
+	mux.HandleFunc("/api/shared/", SharedHandler)
+	if accounts != nil {
+		mux.HandleFunc("/api/register", RegisterHandler)
+		mux.HandleFunc("/api/login", LoginHandler)
+		mux.HandleFunc("/api/logout", LogoutHandler)
+		mux.HandleFunc("/api/me", MeHandler)
+		mux.HandleFunc("/api/oidc/login", OIDCLoginHandler)
+		mux.HandleFunc("/api/oidc/callback", OIDCCallbackHandler)
+		mux.HandleFunc("/api/sessions", SessionsHandler)
+		mux.HandleFunc("/api/sessions/", SessionsHandler)
+		mux.HandleFunc("/api/password", PasswordHandler)
+		mux.HandleFunc("/api/tokens", TokensHandler)
+		mux.HandleFunc("/api/tokens/", TokensHandler)
+		mux.HandleFunc("/api/collaborators", CollaboratorsHandler)
+		mux.HandleFunc("/api/collaborators/", CollaboratorsHandler)
+		mux.HandleFunc("/api/admin/users", AdminUsersHandler)
+		mux.HandleFunc("/api/admin/users/", AdminUsersHandler)
+	}
+
+	// Uploaded media, by content hash
+	mux.HandleFunc("/media/", MediaHandler)
 
 	// Serve static files from embedded filesystem
-	mux.Handle("/", http.FileServer(http.FS(staticFiles)))
+	static := http.FileServer(http.FS(staticFiles))
+	mux.Handle("/static/share.html", protectSharePage(static))
+	mux.Handle("/", static)
 
-	log.Printf("Server starting on http://localhost:%s", *port)
-	if err := http.ListenAndServe(":"+*port, mux); err != nil {
+	scheme := "http"
+	if serveTLS() {
+		scheme = "https"
+	}
+	log.Printf("Server starting on %s://localhost:%s", scheme, *port)
+	if err := listenAndServe(":"+*port, handleCORS(limitRate(requireBasicAuth(checkCSRF(requireLogin(requireWritable(mux))))))); err != nil {
 		log.Fatalf("Server failed: %v", err)
 	}
 }
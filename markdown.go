@@ -0,0 +1,243 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+var (
+	mdHeading  = regexp.MustCompile(`^#{1,6}\s+(.*?)\s*#*\s*$`)
+	mdQuestion = regexp.MustCompile(`^(?i)q:\s*`)
+	mdAnswer   = regexp.MustCompile(`^(?i)a:\s*`)
+	mdTagLine  = regexp.MustCompile(`^#[^\s#]*[^\s#\d][^\s#]*(\s+#[^\s#]*[^\s#\d][^\s#]*)*$`)
+)
+
+// parseMarkdown reads cards from one Markdown note. A note with "Q:" lines
+// gives a card per question, answered by the "A:" text after it. Any other
+// note gives a card per heading with the text under it as the back;
+// headings with nothing under them, like section titles, are skipped. Tags
+// in the YAML front matter go on every card of the note, and a last line of
+// Obsidian-style "#tag"s adds tags to its card.
+func parseMarkdown(text string) []ImportCard {
+	text = strings.ReplaceAll(strings.TrimPrefix(text, "\ufeff"), "\r\n", "\n")
+	tags, text := markdownFrontMatter(text)
+	lines := strings.Split(text, "\n")
+
+	// Headings and Q: inside fenced code blocks are card text, not markers
+	inCode := make([]bool, len(lines))
+	fenced := false
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			fenced = !fenced
+			inCode[i] = true
+			continue
+		}
+		inCode[i] = fenced
+	}
+
+	qa := false
+	for i, line := range lines {
+		if !inCode[i] && mdQuestion.MatchString(line) {
+			qa = true
+			break
+		}
+	}
+
+	var cards []ImportCard
+	var front, back []string
+	inBack := false
+	flush := func() {
+		card := ImportCard{
+			Front: strings.TrimSpace(strings.Join(front, "\n")),
+			Back:  strings.TrimSpace(strings.Join(back, "\n")),
+			Tags:  tags,
+		}
+		// A back of nothing but tags is kept as text
+		if i := strings.LastIndex(card.Back, "\n"); i >= 0 && mdTagLine.MatchString(card.Back[i+1:]) {
+			last := card.Back[i+1:]
+			card.Back = strings.TrimSpace(card.Back[:i])
+			card.Tags = slices.Clone(tags)
+			for _, tag := range strings.Fields(last) {
+				card.Tags = append(card.Tags, obsidianTag(tag))
+			}
+		}
+		if card.Front != "" && card.Back != "" {
+			cards = append(cards, card)
+		}
+		front, back, inBack = nil, nil, false
+	}
+
+	for i, line := range lines {
+		switch {
+		case inCode[i]:
+		case qa && mdQuestion.MatchString(line):
+			flush()
+			front = []string{mdQuestion.ReplaceAllString(line, "")}
+			continue
+		case qa && mdAnswer.MatchString(line) && front != nil:
+			inBack = true
+			back = []string{mdAnswer.ReplaceAllString(line, "")}
+			continue
+		case mdHeading.MatchString(line):
+			// In Q/A notes a heading ends the answer; otherwise it starts a card
+			flush()
+			if !qa {
+				front = []string{mdHeading.FindStringSubmatch(line)[1]}
+				inBack = true
+				back = []string{}
+			}
+			continue
+		}
+		if inBack {
+			back = append(back, line)
+		} else if front != nil {
+			front = append(front, line)
+		}
+	}
+	flush()
+	return cards
+}
+
+// markdownFrontMatter splits YAML front matter off a note and returns the
+// tags it lists, either inline ("tags: [a, b]" or "tags: a b") or as a
+// "- a" list. Obsidian's leading '#' is dropped and its nested tags
+// ("lang/spanish") nest the way tags do here ("lang::spanish").
+func markdownFrontMatter(text string) ([]string, string) {
+	if !strings.HasPrefix(text, "---\n") {
+		return nil, text
+	}
+	end := strings.Index(text[4:], "\n---")
+	if end < 0 {
+		return nil, text
+	}
+	header := text[4 : 4+end]
+	_, body, _ := strings.Cut(text[4+end+4:], "\n")
+
+	var tags []string
+	addTag := func(tag string) {
+		if tag = obsidianTag(strings.Trim(tag, `"'`)); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	inList := false
+	for _, line := range strings.Split(header, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if inList {
+			if item, ok := strings.CutPrefix(trimmed, "- "); ok {
+				addTag(item)
+				continue
+			}
+			inList = false
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok || !strings.EqualFold(strings.TrimSpace(key), "tags") {
+			continue
+		}
+		value = strings.Trim(strings.TrimSpace(value), "[]")
+		if value == "" {
+			inList = true
+			continue
+		}
+		for _, tag := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' }) {
+			addTag(tag)
+		}
+	}
+	return tags, body
+}
+
+// obsidianTag turns an Obsidian tag like "#lang/spanish" into a tag here,
+// "lang::spanish".
+func obsidianTag(tag string) string {
+	return strings.ReplaceAll(strings.TrimPrefix(tag, "#"), "/", DeckSeparator)
+}
+
+// parseMarkdownFS reads every Markdown note under fsys. Notes in a folder
+// go to the deck named after its path ("Spanish/Verbs" becomes
+// "Spanish::Verbs"); notes at the top have no deck of their own. Hidden
+// folders such as .obsidian and .trash are skipped.
+func parseMarkdownFS(fsys fs.FS) ([]ImportCard, error) {
+	var cards []ImportCard
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		base := path.Base(name)
+		if name != "." && (strings.HasPrefix(base, ".") || base == "__MACOSX") {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		ext := strings.ToLower(path.Ext(name))
+		if d.IsDir() || (ext != ".md" && ext != ".markdown") {
+			return nil
+		}
+
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		deck := ""
+		if dir := path.Dir(name); dir != "." {
+			deck = strings.ReplaceAll(dir, "/", DeckSeparator)
+		}
+		for _, card := range parseMarkdown(string(data)) {
+			card.Deck = deck
+			cards = append(cards, card)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidImport, err)
+	}
+	return cards, nil
+}
+
+// parseMarkdownZip reads the Markdown notes in an uploaded zip of a folder.
+func parseMarkdownZip(r io.ReaderAt, size int64) ([]ImportCard, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("%w: not a zip file", ErrInvalidImport)
+	}
+	if err := checkZipSize(zr); err != nil {
+		return nil, err
+	}
+	return parseMarkdownFS(zr)
+}
+
+// ImportMarkdownDir imports the Markdown notes under dir, for one-way card
+// generation from a notes folder. Cards whose front is already in their
+// deck get the new back, so re-running it picks up edited answers. Notes at
+// the top of dir go to deck.
+func ImportMarkdownDir(db *Collection, dir, deck string) (*ImportResult, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+	parsed, err := parseMarkdownFS(os.DirFS(dir))
+	if err != nil {
+		return nil, err
+	}
+
+	cards := make([]Card, 0, len(parsed))
+	for _, data := range parsed {
+		tags, err := normalizeTags(data.Tags)
+		if err != nil {
+			return nil, fmt.Errorf("card %q: %w", data.Front, err)
+		}
+		if data.Deck == "" {
+			data.Deck = deck
+		}
+		if data.Deck == "" {
+			return nil, fmt.Errorf("card %q is at the top of the folder; name a deck for it", data.Front)
+		}
+		cards = append(cards, Card{DeckName: data.Deck, Front: data.Front, Back: data.Back, Tags: tags})
+	}
+	return ImportCards(db, cards, DedupUpdate, false)
+}
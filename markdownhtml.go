@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Card text is written in Markdown and rendered to HTML when cards are
+// shown. The renderer is small and safe by construction: all text is
+// escaped, and the only HTML in its output is what it generates itself,
+// a short list of attribute-free formatting tags passed through from the
+// text, and links and images whose URLs use a safe scheme. Plain text
+// renders as itself, with line breaks as <br>. RenderCard still passes
+// the result through sanitizeCardHTML, as templates around it may not be
+// as careful.
+//
+// Supported: paragraphs, # headings, > quotes, - and 1. lists, ``` fenced
+// code (highlighted, see highlight.go), `code`, **bold**, *italic*, ~~strikethrough~~, [links](url),
+// ![images](url), --- rules, [image:NAME]/[sound:NAME] media tags and
+// math (see math.go).
+
+var (
+	mdFence      = regexp.MustCompile("^\\s*(```+|~~~+)\\s*([A-Za-z0-9_+#.-]*)")
+	mdATXHeading = regexp.MustCompile(`^\s{0,3}(#{1,6})\s+(.*?)\s*#*\s*$`)
+	mdRule       = regexp.MustCompile(`^\s{0,3}((\*\s*){3,}|(-\s*){3,}|(_\s*){3,})$`)
+	mdQuote      = regexp.MustCompile(`^\s{0,3}>\s?(.*)$`)
+	mdBullet     = regexp.MustCompile(`^\s{0,3}[-*+]\s+(.*)$`)
+	mdNumbered   = regexp.MustCompile(`^\s{0,3}(\d{1,9})[.)]\s+(.*)$`)
+	mdCodeSpan   = regexp.MustCompile("``(.+?)``|`([^`]+)`")
+	mdImage      = regexp.MustCompile(`!\[([^\]]*)\]\(((?:[^()\s]|\([^()\s]*\))+)\)`)
+	mdLink       = regexp.MustCompile(`\[([^\]]+)\]\(((?:[^()\s]|\([^()\s]*\))+)\)`)
+	mdTag        = regexp.MustCompile(`(?i)<(/?)(b|i|u|em|strong|s|del|sub|sup|mark|kbd|small|br)\s*/?>`)
+	mdStrong     = regexp.MustCompile(`\*\*([^\s*](?:[^*]*[^\s*])?)\*\*|\b__([^\s_](?:[^_]*[^\s_])?)__\b`)
+	mdEmphasis   = regexp.MustCompile(`\*([^\s*](?:[^*]*[^\s*])?)\*|\b_([^\s_](?:[^_]*[^\s_])?)_\b`)
+	mdStrike     = regexp.MustCompile(`~~([^\s~](?:[^~]*[^\s~])?)~~`)
+	mdSlot       = regexp.MustCompile("\x00(\\d+)\x00")
+	mdSafeScheme = map[string]bool{"": true, "http": true, "https": true, "mailto": true}
+)
+
+// renderMarkdown renders card text to HTML. Text making up a single
+// paragraph is not wrapped in <p>, so a card's one-line answer stays
+// inline.
+func renderMarkdown(text string) string {
+	blocks := markdownBlocks(strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n"))
+	if len(blocks) == 1 && strings.HasPrefix(blocks[0], "<p>") {
+		return strings.TrimSuffix(strings.TrimPrefix(blocks[0], "<p>"), "</p>")
+	}
+	return strings.Join(blocks, "\n")
+}
+
+// markdownBlocks renders lines of Markdown as HTML blocks.
+func markdownBlocks(lines []string) []string {
+	var blocks []string
+	for i := 0; i < len(lines); {
+		if math, n, ok := mathBlock(lines[i:]); ok {
+			blocks = append(blocks, math)
+			i += n
+			continue
+		}
+		line := lines[i]
+		switch {
+		case strings.TrimSpace(line) == "":
+			i++
+
+		case mdFence.MatchString(line):
+			m := mdFence.FindStringSubmatch(line)
+			var code []string
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), m[1]); i++ {
+				code = append(code, lines[i])
+			}
+			i++ // The closing fence, or past the end
+			blocks = append(blocks, highlightCode(m[2], strings.Join(code, "\n")))
+
+		case mdATXHeading.MatchString(line):
+			m := mdATXHeading.FindStringSubmatch(line)
+			blocks = append(blocks, fmt.Sprintf("<h%d>%s</h%d>", len(m[1]), renderInline(m[2]), len(m[1])))
+			i++
+
+		case mdRule.MatchString(line):
+			blocks = append(blocks, "<hr>")
+			i++
+
+		case mdQuote.MatchString(line):
+			var quoted []string
+			for ; i < len(lines) && mdQuote.MatchString(lines[i]); i++ {
+				quoted = append(quoted, mdQuote.FindStringSubmatch(lines[i])[1])
+			}
+			blocks = append(blocks, "<blockquote>"+strings.Join(markdownBlocks(quoted), "\n")+"</blockquote>")
+
+		case mdBullet.MatchString(line):
+			var items []string
+			for ; i < len(lines) && mdBullet.MatchString(lines[i]); i++ {
+				items = append(items, "<li>"+renderInline(mdBullet.FindStringSubmatch(lines[i])[1])+"</li>")
+			}
+			blocks = append(blocks, "<ul>"+strings.Join(items, "")+"</ul>")
+
+		case mdNumbered.MatchString(line):
+			start := mdNumbered.FindStringSubmatch(line)[1]
+			var items []string
+			for ; i < len(lines) && mdNumbered.MatchString(lines[i]); i++ {
+				items = append(items, "<li>"+renderInline(mdNumbered.FindStringSubmatch(lines[i])[2])+"</li>")
+			}
+			open := "<ol>"
+			if n, _ := strconv.Atoi(start); n != 1 {
+				open = fmt.Sprintf(`<ol start="%d">`, n)
+			}
+			blocks = append(blocks, open+strings.Join(items, "")+"</ol>")
+
+		default:
+			// A paragraph runs to a blank line or another block, its line
+			// breaks kept
+			var para []string
+			for ; i < len(lines) && strings.TrimSpace(lines[i]) != "" && (len(para) == 0 || !startsBlock(lines[i:])); i++ {
+				para = append(para, renderInline(strings.TrimSpace(lines[i])))
+			}
+			blocks = append(blocks, "<p>"+strings.Join(para, "<br>")+"</p>")
+		}
+	}
+	return blocks
+}
+
+// startsBlock reports whether lines begin with a block other than a
+// paragraph.
+func startsBlock(lines []string) bool {
+	if _, _, ok := mathBlock(lines); ok {
+		return true
+	}
+	line := lines[0]
+	return mdFence.MatchString(line) || mdATXHeading.MatchString(line) || mdRule.MatchString(line) ||
+		mdQuote.MatchString(line) || mdBullet.MatchString(line) || mdNumbered.MatchString(line)
+}
+
+// safeURL reports whether a link or image URL can be put in a page: it is
+// relative or uses http, https or mailto, never javascript: and the like.
+func safeURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && mdSafeScheme[strings.ToLower(u.Scheme)]
+}
+
+// renderInline renders the inline Markdown of a line. The HTML it makes is
+// set aside in slots while the rest of the text is escaped and formatted.
+func renderInline(text string) string {
+	var slots []string
+	slot := func(s string) string {
+		slots = append(slots, s)
+		return fmt.Sprintf("\x00%d\x00", len(slots)-1)
+	}
+	text = strings.ReplaceAll(text, "\x00", "")
+
+	text = mdCodeSpan.ReplaceAllStringFunc(text, func(s string) string {
+		m := mdCodeSpan.FindStringSubmatch(s)
+		return slot("<code>" + html.EscapeString(strings.TrimSpace(m[1]+m[2])) + "</code>")
+	})
+	text = replaceMath(text, slot)
+	text = mediaTag.ReplaceAllStringFunc(text, func(s string) string {
+		return slot(mediaTagHTML(s))
+	})
+	text = mdImage.ReplaceAllStringFunc(text, func(s string) string {
+		m := mdImage.FindStringSubmatch(s)
+		if !safeURL(m[2]) {
+			return slot(html.EscapeString(m[1]))
+		}
+		return slot(`<img src="` + html.EscapeString(m[2]) + `" alt="` + html.EscapeString(m[1]) + `">`)
+	})
+	text = mdLink.ReplaceAllStringFunc(text, func(s string) string {
+		m := mdLink.FindStringSubmatch(s)
+		if !safeURL(m[2]) {
+			return slot(renderInline(m[1]))
+		}
+		return slot(`<a href="` + html.EscapeString(m[2]) + `" target="_blank" rel="noopener noreferrer">` + renderInline(m[1]) + `</a>`)
+	})
+
+	// Formatting tags typed as HTML are kept, balanced so they cannot
+	// reach past the text
+	var open []string
+	text = mdTag.ReplaceAllStringFunc(text, func(s string) string {
+		m := mdTag.FindStringSubmatch(s)
+		name := strings.ToLower(m[2])
+		switch {
+		case name == "br":
+			return slot("<br>")
+		case m[1] == "":
+			open = append(open, name)
+			return slot("<" + name + ">")
+		}
+		for i := len(open) - 1; i >= 0; i-- {
+			if open[i] == name {
+				closed := ""
+				for j := len(open) - 1; j >= i; j-- {
+					closed += "</" + open[j] + ">"
+				}
+				open = open[:i]
+				return slot(closed)
+			}
+		}
+		return "" // Nothing to close
+	})
+
+	text = html.EscapeString(text)
+	text = mdStrong.ReplaceAllString(text, "<strong>$1$2</strong>")
+	text = mdEmphasis.ReplaceAllString(text, "<em>$1$2</em>")
+	text = mdStrike.ReplaceAllString(text, "<del>$1</del>")
+	for i := len(open) - 1; i >= 0; i-- {
+		text += "</" + open[i] + ">"
+	}
+
+	return mdSlot.ReplaceAllStringFunc(text, func(s string) string {
+		i, _ := strconv.Atoi(mdSlot.FindStringSubmatch(s)[1])
+		return slots[i]
+	})
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"html"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestRenderMarkdown(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"plain text", "hello\nworld", "hello<br>world"},
+		{"formatting", "**bold** *em* ~~gone~~ `x < y`", "<strong>bold</strong> <em>em</em> <del>gone</del> <code>x &lt; y</code>"},
+		{"link", "[site](https://example.com)", `<a href="https://example.com" target="_blank" rel="noopener noreferrer">site</a>`},
+		{"image", "![a cat](cat.png)", `<img src="cat.png" alt="a cat">`},
+		{"typed tags kept", "<b>bold</b><br/>", "<b>bold</b><br>"},
+		{"unclosed tag closed", "<b>bold", "<b>bold</b>"},
+		{"stray close dropped", "text</i>", "text"},
+		{"html escaped", `<span title="x">&amp;</span>`, "&lt;span title=&#34;x&#34;&gt;&amp;amp;&lt;/span&gt;"},
+		{"list", "- one\n- two", "<ul><li>one</li><li>two</li></ul>"},
+		{"unsafe link keeps its text", "[click](javascript:alert(1))", "click"},
+		{"unsafe image keeps its alt", "![pic](data:image/png;base64,AAAA)", "pic"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := renderMarkdown(tt.in); got != tt.want {
+				t.Errorf("renderMarkdown(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+var (
+	renderedTag  = regexp.MustCompile(`<(/?)([a-zA-Z][a-zA-Z0-9]*)([^>]*)>`)
+	renderedAttr = regexp.MustCompile(`([a-zA-Z-]+)(?:="([^"]*)")?`)
+	// markdownTags are the elements renderMarkdown may make, with their
+	// attributes
+	markdownTags = map[string]map[string]bool{
+		"a": {"href": true, "target": true, "rel": true}, "img": {"src": true, "alt": true},
+		"audio": {"controls": true, "src": true}, "ol": {"start": true},
+		"span": {"class": true}, "div": {"class": true}, "pre": {"class": true}, "code": {"class": true},
+	}
+	markdownPlainTags = "p br hr h1 h2 h3 h4 h5 h6 blockquote ul li b i u em strong s del sub sup mark kbd small"
+)
+
+// checkMarkdownHTML fails the test if html has an element, attribute or
+// URL renderMarkdown should never make.
+func checkMarkdownHTML(t *testing.T, in, out string) {
+	t.Helper()
+	for _, m := range renderedTag.FindAllStringSubmatch(out, -1) {
+		name := strings.ToLower(m[2])
+		attrs, ok := markdownTags[name]
+		if !ok && !strings.Contains(" "+markdownPlainTags+" ", " "+name+" ") {
+			t.Errorf("renderMarkdown(%q) made a <%s>: %q", in, name, out)
+			continue
+		}
+		for _, a := range renderedAttr.FindAllStringSubmatch(m[3], -1) {
+			if !attrs[strings.ToLower(a[1])] {
+				t.Errorf("renderMarkdown(%q) made a %s attribute on <%s>: %q", in, a[1], name, out)
+			}
+			value := strings.ToLower(strings.Map(func(r rune) rune {
+				if r <= ' ' {
+					return -1
+				}
+				return r
+			}, html.UnescapeString(a[2])))
+			for _, scheme := range []string{"javascript:", "vbscript:", "data:"} {
+				if strings.HasPrefix(value, scheme) {
+					t.Errorf("renderMarkdown(%q) made a %s URL: %q", in, scheme, out)
+				}
+			}
+		}
+	}
+}
+
+func TestRenderMarkdownPayloads(t *testing.T) {
+	payloads := []string{
+		`<script>alert(1)</script>`,
+		`<img src=x onerror=alert(1)>`,
+		`<svg onload=alert(1)>`,
+		`<svg/onload=alert(1)>`,
+		`<b onclick="alert(1)">x</b>`,
+		`<B>unclosed <I>tags`,
+		`<a href="javascript:alert(1)">x</a>`,
+		`<iframe src="https://evil.example"></iframe>`,
+		`<style>body{display:none}</style>`,
+		`[x](javascript:alert(1))`,
+		`[x](JaVaScRiPt:alert(1))`,
+		`[x](&#106;avascript:alert(1))`,
+		`[x](&#x6A;avascript:alert(1))`,
+		`[x](java&#x09;script:alert(1))`,
+		`[x](javascript&colon;alert(1))`,
+		"[x](java\tscript:alert(1))",
+		"[x](\x01javascript:alert(1))",
+		`[x](vbscript:msgbox(1))`,
+		`[x](data:text/html,<script>alert(1)</script>)`,
+		`![x](data:image/svg+xml;base64,PHN2ZyBvbmxvYWQ9YWxlcnQoMSk+)`,
+		`![" onerror="alert(1)](x.png)`,
+		`[<img src=x onerror=alert(1)>](https://example.com)`,
+		`[x](https://example.com" onmouseover="alert(1))`,
+		"`<script>alert(1)</script>`",
+		`$<img src=x onerror=alert(1)>$`,
+		"$$\n<script>alert(1)</script>\n$$",
+		"```html\n<script>alert(1)</script>\n```",
+		"> <svg onload=alert(1)>\n- <script>x</script>",
+		`[image:` + strings.Repeat("a", 64) + `.png" onerror="alert(1)]`,
+		"<b\x00>x</b>",
+	}
+	for _, p := range payloads {
+		checkMarkdownHTML(t, p, renderMarkdown(p))
+	}
+}
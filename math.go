@@ -0,0 +1,89 @@
+package main
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+// Math in card text, $...$ or \(...\) inline and $$...$$ or \[...\] on
+// its own, is not rendered on the server. It is kept out of Markdown
+// formatting and marked up for a client to typeset, as an escaped
+// \(...\) in <span class="math math-inline"> or \[...\] in
+// <div class="math math-display">, the delimiters KaTeX and MathJax look
+// for. \$ gives a literal dollar sign.
+
+var (
+	mathDisplay = regexp.MustCompile(`\$\$([^\x00]+?)\$\$|\\\[([^\x00]+?)\\\]`)
+	// A $ opens math before a non-space and closes after one, so prices
+	// like "$5 and $10" stay text. Neither spans text already set aside.
+	mathInline = regexp.MustCompile(`\\\(([^\x00]+?)\\\)|\$([^\s$\x00](?:[^$\x00]*[^\s$\\\x00])?)\$`)
+	mathOpen   = regexp.MustCompile(`^\s*(\$\$|\\\[)(.*)$`)
+)
+
+// mathClass marks the elements holding math, so clients know to load a
+// typesetter.
+const mathClass = `class="math `
+
+func inlineMathHTML(tex string) string {
+	return `<span class="math math-inline">\(` + html.EscapeString(strings.TrimSpace(tex)) + `\)</span>`
+}
+
+func displayMathHTML(tex string) string {
+	return `<div class="math math-display">\[` + html.EscapeString(strings.TrimSpace(tex)) + `\]</div>`
+}
+
+// mathBlock returns the display math starting at lines[0] when it runs
+// over several lines, and how many lines it takes.
+func mathBlock(lines []string) (string, int, bool) {
+	m := mathOpen.FindStringSubmatch(lines[0])
+	if m == nil {
+		return "", 0, false
+	}
+	closer := "$$"
+	if m[1] != "$$" {
+		closer = `\]`
+	}
+	if strings.Contains(m[2], closer) {
+		return "", 0, false // On one line, rendered inline
+	}
+
+	tex := []string{m[2]}
+	for i := 1; i < len(lines); i++ {
+		if before, _, found := strings.Cut(lines[i], closer); found {
+			tex = append(tex, before)
+			return displayMathHTML(strings.Join(tex, "\n")), i + 1, true
+		}
+		tex = append(tex, lines[i])
+	}
+	return "", 0, false // Never closed
+}
+
+// replaceMath sets the math in a line of text aside with slot.
+func replaceMath(text string, slot func(string) string) string {
+	text = strings.ReplaceAll(text, `\$`, slot("$"))
+	text = mathDisplay.ReplaceAllStringFunc(text, func(s string) string {
+		m := mathDisplay.FindStringSubmatch(s)
+		return slot(displayMathHTML(m[1] + m[2]))
+	})
+
+	var b strings.Builder
+	last := 0
+	for _, loc := range mathInline.FindAllStringSubmatchIndex(text, -1) {
+		// A closing $ right before a digit is a price, not math
+		if loc[4] >= 0 && loc[1] < len(text) && text[loc[1]] >= '0' && text[loc[1]] <= '9' {
+			continue
+		}
+		tex := ""
+		if loc[2] >= 0 {
+			tex = text[loc[2]:loc[3]]
+		} else {
+			tex = text[loc[4]:loc[5]]
+		}
+		b.WriteString(text[last:loc[0]])
+		b.WriteString(slot(inlineMathHTML(tex)))
+		last = loc[1]
+	}
+	b.WriteString(text[last:])
+	return b.String()
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Media files live in the collection's media directory, named after the
+// SHA-256 of their content, so the same file uploaded twice is stored once
+// and a name never changes meaning. The media table records them; cards
+// refer to them by name with [image:NAME] and [sound:NAME] in their text,
+// and they are served under /media/. A file's references are counted by
+// scanning the cards and notes for its name, and files no longer referenced
+// can be collected.
+
+// mediaDir is where media files of the default collection are stored, set
+// from -media-dir in main.
+var mediaDir = "media"
+
+var (
+	ErrInvalidMedia  = errors.New("invalid media")
+	ErrMediaNotFound = errors.New("media not found")
+)
+
+// maxMediaSize bounds an uploaded media file.
+const maxMediaSize = 10 << 20
+
+// mediaGCGrace keeps fresh uploads from being collected before the card
+// using them is saved.
+const mediaGCGrace = time.Hour
+
+// mediaType is a kind of file accepted as media.
+type mediaType struct {
+	ContentType string
+	Ext         string
+	Image       bool
+}
+
+var mediaTypes = []mediaType{
+	{"image/png", ".png", true},
+	{"image/jpeg", ".jpg", true},
+	{"image/gif", ".gif", true},
+	{"image/webp", ".webp", true},
+	{"audio/mpeg", ".mp3", false},
+	{"audio/wave", ".wav", false},
+	{"audio/ogg", ".ogg", false},
+}
+
+// mediaName matches the names media files are stored under.
+var mediaName = regexp.MustCompile(`^[0-9a-f]{64}\.[a-z0-9]+$`)
+
+// mediaRef finds media names in card and note text.
+var mediaRef = regexp.MustCompile(`[0-9a-f]{64}\.[a-z0-9]+`)
+
+// mediaTag matches the media tags card text embeds files with.
+var mediaTag = regexp.MustCompile(`\[(image|sound):([0-9a-f]{64}\.[a-z0-9]+)\]`)
+
+// Media is a stored media file. OriginalHash and OriginalSize describe the
+// file as uploaded, before it was optimized (see optimize.go). Refs counts
+// the cards and notes whose text names it.
+type Media struct {
+	Name         string    `json:"name"`
+	ContentType  string    `json:"content_type"`
+	Size         int64     `json:"size"`
+	OriginalHash string    `json:"original_hash"`
+	OriginalSize int64     `json:"original_size"`
+	URL          string    `json:"url"`
+	Tag          string    `json:"tag"` // Embeds the file in card text
+	Refs         int       `json:"refs"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+func (m *Media) fill() {
+	m.URL = "/media/" + m.Name
+	kind := "sound"
+	if strings.HasPrefix(m.ContentType, "image/") {
+		kind = "image"
+	}
+	m.Tag = "[" + kind + ":" + m.Name + "]"
+}
+
+// sniffMedia finds the media type of data from its content.
+func sniffMedia(data []byte) (mediaType, bool) {
+	contentType := http.DetectContentType(data)
+	switch {
+	case contentType == "application/ogg":
+		contentType = "audio/ogg"
+	case len(data) > 1 && data[0] == 0xFF && data[1]&0xE0 == 0xE0:
+		// An MP3 frame header, for files without an ID3 tag
+		contentType = "audio/mpeg"
+	}
+	for _, t := range mediaTypes {
+		if t.ContentType == contentType {
+			return t, true
+		}
+	}
+	return mediaType{ContentType: contentType}, false
+}
+
+// SaveMedia stores an uploaded image or audio file.
+func SaveMedia(db *Collection, data []byte) (*Media, error) {
+	return saveMedia(db, data, false)
+}
+
+// saveImage stores an uploaded image.
+func saveImage(db *Collection, data []byte) (*Media, error) {
+	return saveMedia(db, data, true)
+}
+
+// saveMedia checks the size and type of data, optimizes images and stores
+// the result under its content hash, unless it is already there.
+func saveMedia(db *Collection, data []byte, imageOnly bool) (*Media, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("%w: file is empty", ErrInvalidMedia)
+	}
+	if len(data) > maxMediaSize {
+		return nil, fmt.Errorf("%w: file is larger than %d MB", ErrInvalidMedia, maxMediaSize>>20)
+	}
+	t, ok := sniffMedia(data)
+	if !ok || (imageOnly && !t.Image) {
+		if imageOnly {
+			return nil, fmt.Errorf("%w: %s is not a PNG, JPEG, GIF or WebP image", ErrInvalidMedia, t.ContentType)
+		}
+		return nil, fmt.Errorf("%w: %s is not a supported image (PNG, JPEG, GIF, WebP) or audio (MP3, WAV, Ogg) file", ErrInvalidMedia, t.ContentType)
+	}
+
+	// An image uploaded before is not optimized again
+	sum := sha256.Sum256(data)
+	originalHash := hex.EncodeToString(sum[:])
+	var name string
+	err := db.QueryRow(`SELECT name FROM media WHERE original_hash = ?`, originalHash).Scan(&name)
+	if err == nil {
+		if path, err := mediaFile(db, name); err == nil {
+			if err := renewMediaFile(path); err != nil {
+				return nil, err
+			}
+			return GetMedia(db, name)
+		}
+	} else if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	stored, err := optimizeImage(data, t)
+	if err != nil {
+		return nil, err
+	}
+	sum = sha256.Sum256(stored)
+	name = hex.EncodeToString(sum[:]) + t.Ext
+	if err := writeMediaFile(db, name, stored); err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(
+		`INSERT OR IGNORE INTO media (name, content_type, size, original_hash, original_size) VALUES (?, ?, ?, ?, ?)`,
+		name, t.ContentType, len(stored), originalHash, len(data),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return GetMedia(db, name)
+}
+
+// writeMediaFile writes a media file unless it already exists, in which
+// case its time is renewed.
+func writeMediaFile(db *Collection, name string, data []byte) error {
+	path := filepath.Join(db.mediaDir, name)
+	if _, err := os.Stat(path); err == nil {
+		return renewMediaFile(path)
+	}
+
+	if err := os.MkdirAll(db.mediaDir, 0o755); err != nil {
+		return err
+	}
+	// Written aside and renamed, so a half-written file is never served
+	tmp, err := os.CreateTemp(db.mediaDir, ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// renewMediaFile updates the time of a media file uploaded again, so
+// collecting unused media spares it for a while again.
+func renewMediaFile(path string) error {
+	now := time.Now()
+	return os.Chtimes(path, now, now)
+}
+
+const mediaColumns = `name, content_type, size, original_hash, original_size, created_at`
+
+func scanMedia(row interface{ Scan(...any) error }, m *Media) error {
+	return row.Scan(&m.Name, &m.ContentType, &m.Size, &m.OriginalHash, &m.OriginalSize, &m.CreatedAt)
+}
+
+// GetMedia returns a stored media file with its reference count.
+func GetMedia(db *Collection, name string) (*Media, error) {
+	m := &Media{}
+	err := scanMedia(db.QueryRow(`SELECT `+mediaColumns+` FROM media WHERE name = ?`, name), m)
+	if err == sql.ErrNoRows {
+		return nil, ErrMediaNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	refs, err := mediaRefs(db)
+	if err != nil {
+		return nil, err
+	}
+	m.Refs = refs[m.Name]
+	m.fill()
+	return m, nil
+}
+
+// GetAllMedia returns the stored media files, newest first.
+func GetAllMedia(db *Collection) ([]Media, error) {
+	rows, err := db.Query(`SELECT ` + mediaColumns + ` FROM media ORDER BY created_at DESC, name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	media := []Media{}
+	for rows.Next() {
+		var m Media
+		if err := scanMedia(rows, &m); err != nil {
+			return nil, err
+		}
+		media = append(media, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	refs, err := mediaRefs(db)
+	if err != nil {
+		return nil, err
+	}
+	for i := range media {
+		media[i].Refs = refs[media[i].Name]
+		media[i].fill()
+	}
+	return media, nil
+}
+
+// mediaRefsCache keeps the media references of a collection until the
+// text of a card or note changes, which the triggers on them count in
+// media_refs_version.
+type mediaRefsCache struct {
+	mu      sync.Mutex
+	version int
+	refs    map[string]int
+}
+
+// mediaRefs counts, per media name, the cards and notes naming it. The
+// counts are shared between callers, which must not change them.
+func mediaRefs(db *Collection) (map[string]int, error) {
+	var version int
+	if err := db.QueryRow(`SELECT version FROM media_refs_version`).Scan(&version); err != nil {
+		return nil, err
+	}
+
+	c := &db.refsCache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.refs != nil && c.version == version {
+		return c.refs, nil
+	}
+	refs, err := countMediaRefs(db)
+	if err != nil {
+		return nil, err
+	}
+	c.version, c.refs = version, refs
+	return refs, nil
+}
+
+// countMediaRefs reads every card and note for the media they name.
+func countMediaRefs(db *Collection) (map[string]int, error) {
+	refs := make(map[string]int)
+	for _, query := range []string{
+		`SELECT front || char(10) || back FROM cards`,
+		`SELECT fields FROM notes`,
+	} {
+		rows, err := db.Query(query)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var text string
+			if err := rows.Scan(&text); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			seen := make(map[string]bool)
+			for _, name := range mediaRef.FindAllString(text, -1) {
+				if !seen[name] {
+					seen[name] = true
+					refs[name]++
+				}
+			}
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return refs, nil
+}
+
+// CollectMedia deletes the media files no card or note names, sparing those
+// stored within mediaGCGrace, and returns their names. A dry run only
+// finds them.
+func CollectMedia(db *Collection, dryRun bool) ([]string, error) {
+	media, err := GetAllMedia(db)
+	if err != nil {
+		return nil, err
+	}
+
+	collected := []string{}
+	for _, m := range media {
+		if m.Refs > 0 {
+			continue
+		}
+		path := filepath.Join(db.mediaDir, m.Name)
+		// The file's time, which uploading the file again renews
+		if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) < mediaGCGrace {
+			continue
+		}
+		if !dryRun {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+			if _, err := db.Exec(`DELETE FROM media WHERE name = ?`, m.Name); err != nil {
+				return nil, err
+			}
+		}
+		collected = append(collected, m.Name)
+	}
+	return collected, nil
+}
+
+// mediaFile returns the path of the media file called name.
+func mediaFile(db *Collection, name string) (string, error) {
+	if !mediaName.MatchString(name) {
+		return "", ErrMediaNotFound
+	}
+	path := filepath.Join(db.mediaDir, name)
+	if _, err := os.Stat(path); err != nil {
+		return "", ErrMediaNotFound
+	}
+	return path, nil
+}
+
+// mediaTagHTML returns the HTML showing the file a media tag names.
+func mediaTagHTML(tag string) string {
+	m := mediaTag.FindStringSubmatch(tag)
+	src := html.EscapeString("/media/" + m[2])
+	if m[1] == "image" {
+		return `<img src="` + src + `" alt="">`
+	}
+	return `<audio controls src="` + src + `"></audio>`
+}
+
+// mediaContentType returns the content type files named name are served
+// with.
+func mediaContentType(name string) string {
+	ext := filepath.Ext(name)
+	for _, t := range mediaTypes {
+		if t.Ext == ext {
+			return t.ContentType
+		}
+	}
+	return "application/octet-stream"
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMediaRefsFollowCardChanges(t *testing.T) {
+	db := openTestCollection(t)
+	a, b := strings.Repeat("a", 64)+".png", strings.Repeat("b", 64)+".mp3"
+	assertRefs := func(step string, want map[string]int) {
+		t.Helper()
+		refs, err := mediaRefs(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, n := range want {
+			if refs[name] != n {
+				t.Errorf("%s: %d references to %s, want %d", step, refs[name], name[:1], n)
+			}
+		}
+	}
+
+	card := &Card{DeckName: "Default", Front: "[image:" + a + "]", Back: "back"}
+	if err := CreateCard(db, card); err != nil {
+		t.Fatal(err)
+	}
+	assertRefs("created", map[string]int{a: 1, b: 0})
+
+	card.Back = "[sound:" + b + "]"
+	if err := UpdateCard(db, card); err != nil {
+		t.Fatal(err)
+	}
+	assertRefs("edited", map[string]int{a: 1, b: 1})
+
+	if _, err := db.Exec(`UPDATE cards SET front = 'plain' WHERE id = ?`, card.ID); err != nil {
+		t.Fatal(err)
+	}
+	assertRefs("changed in SQL", map[string]int{a: 0, b: 1})
+
+	if err := DeleteCard(db, card.ID); err != nil {
+		t.Fatal(err)
+	}
+	assertRefs("deleted", map[string]int{a: 0, b: 0})
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Mochi exports (.mochi) are zip files holding data.json, or data.edn in
+// older exports, and the media. The data lists decks, each pointing at its
+// parent deck, and cards whose Markdown content holds the sides separated
+// by "---" lines.
+
+type mochiData struct {
+	Decks []mochiDeck `json:"decks"`
+	Cards mochiCards  `json:"cards"` // Some exports list cards apart from decks
+}
+
+type mochiDeck struct {
+	ID       string     `json:"id"`
+	Name     string     `json:"name"`
+	ParentID string     `json:"parent-id"`
+	Cards    mochiCards `json:"cards"`
+	Archived bool       `json:"archived?"`
+	Trashed  any        `json:"trashed?"`
+}
+
+type mochiCard struct {
+	DeckID   string                `json:"deck-id"`
+	Content  string                `json:"content"`
+	Fields   map[string]mochiField `json:"fields"`
+	Tags     []string              `json:"tags"`
+	Archived bool                  `json:"archived?"`
+	Trashed  any                   `json:"trashed?"`
+}
+
+type mochiField struct {
+	Value string `json:"value"`
+}
+
+// mochiCards reads a card list written either as an array or as an object
+// holding it under "list".
+type mochiCards []mochiCard
+
+func (c *mochiCards) UnmarshalJSON(data []byte) error {
+	var list []mochiCard
+	if err := json.Unmarshal(data, &list); err == nil {
+		*c = list
+		return nil
+	}
+	var wrapped struct {
+		List []mochiCard `json:"list"`
+	}
+	if err := json.Unmarshal(data, &wrapped); err != nil {
+		return err
+	}
+	*c = wrapped.List
+	return nil
+}
+
+// mochiSide splits card content into sides.
+var mochiSide = regexp.MustCompile(`(?m)^---\s*$`)
+
+// parseMochi reads the cards of a Mochi export. Nested decks become
+// "Parent::Child" decks; archived and trashed decks and cards are skipped.
+func parseMochi(r io.ReaderAt, size int64) ([]ImportCard, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("%w: not a Mochi export: %v", ErrInvalidImport, err)
+	}
+
+	var dataFile *zip.File
+	hasEDN := false
+	for _, f := range zr.File {
+		switch f.Name {
+		case "data.json":
+			dataFile = f
+		case "data.edn":
+			hasEDN = true
+		}
+	}
+	if dataFile == nil && hasEDN {
+		return nil, fmt.Errorf("%w: export uses Mochi's EDN format; export the decks as JSON", ErrInvalidImport)
+	}
+	if dataFile == nil {
+		return nil, fmt.Errorf("%w: export has no data.json", ErrInvalidImport)
+	}
+
+	src, err := openZipEntry(dataFile)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	var data mochiData
+	if err := json.NewDecoder(src).Decode(&data); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidImport, err)
+	}
+
+	decks := make(map[string]mochiDeck)
+	for _, deck := range data.Decks {
+		decks[deck.ID] = deck
+	}
+	// deckPath follows parent links, guarding against cycles
+	deckPath := func(id string) (string, bool) {
+		var names []string
+		for seen := 0; id != "" && seen <= len(decks); seen++ {
+			deck, ok := decks[id]
+			if !ok {
+				break
+			}
+			if deck.Archived || mochiTrashed(deck.Trashed) {
+				return "", false
+			}
+			names = append([]string{strings.TrimSpace(deck.Name)}, names...)
+			id = deck.ParentID
+		}
+		return strings.Join(names, DeckSeparator), true
+	}
+
+	var cards []ImportCard
+	add := func(card mochiCard, deckID string) {
+		if card.Archived || mochiTrashed(card.Trashed) {
+			return
+		}
+		deck, ok := deckPath(deckID)
+		if !ok {
+			return
+		}
+		front, back := mochiSides(card)
+		cards = append(cards, ImportCard{Front: front, Back: back, Tags: card.Tags, Deck: deck})
+	}
+	for _, deck := range data.Decks {
+		for _, card := range deck.Cards {
+			add(card, deck.ID)
+		}
+	}
+	for _, card := range data.Cards {
+		add(card, card.DeckID)
+	}
+	return cards, nil
+}
+
+// mochiSides returns the front and back of a card: the first side of its
+// content and the rest. Cards made from a template have their content in
+// fields instead; the "name" field is the front and the others follow in
+// order of their IDs.
+func mochiSides(card mochiCard) (string, string) {
+	sides := mochiSide.Split(card.Content, -1)
+	if strings.TrimSpace(card.Content) == "" && len(card.Fields) > 0 {
+		ids := make([]string, 0, len(card.Fields))
+		for id := range card.Fields {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool {
+			if (ids[i] == "name") != (ids[j] == "name") {
+				return ids[i] == "name"
+			}
+			return ids[i] < ids[j]
+		})
+		sides = sides[:0]
+		for _, id := range ids {
+			sides = append(sides, card.Fields[id].Value)
+		}
+	}
+
+	front := strings.TrimSpace(sides[0])
+	var back []string
+	for _, side := range sides[1:] {
+		if side = strings.TrimSpace(side); side != "" {
+			back = append(back, side)
+		}
+	}
+	return front, strings.Join(back, "\n\n")
+}
+
+// mochiTrashed reports whether a "trashed?" value marks a deck or card as
+// deleted; Mochi writes the time it was trashed.
+func mochiTrashed(v any) bool {
+	switch v := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case string:
+		return v != ""
+	case map[string]any:
+		return len(v) > 0
+	default:
+		return true
+	}
+}
@@ -0,0 +1,709 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// A note holds the content of one or more cards as named fields. Its note
+// type lists the fields and the card templates made from them; every
+// template whose front and back come out non-empty gives the note a card.
+// Cards keep their rendered front and back, so reviewing, searching and
+// exporting treat them like any other card, and editing the note renders
+// them again. Cards created on their own have no note.
+
+var (
+	ErrNoteNotFound    = errors.New("note not found")
+	ErrInvalidNote     = errors.New("invalid note")
+	ErrUnknownNoteType = errors.New("unknown note type")
+	ErrInvalidNoteType = errors.New("invalid note type")
+	ErrNoteTypeExists  = errors.New("note type already exists")
+	ErrNoteTypeInUse   = errors.New("note type is used by notes")
+	ErrBuiltinNoteType = errors.New("built-in note types cannot be changed")
+	ErrNoteCardEdit    = errors.New("card text comes from its note")
+)
+
+// CardTemplate makes one card of a note. Its sides are text with {{Field}}
+// placeholders, giving the card's stored front and back. FrontHTML and
+// BackHTML optionally give the HTML shown when reviewing (see render.go).
+type CardTemplate struct {
+	Name      string `json:"name"`
+	Front     string `json:"front"`
+	Back      string `json:"back"`
+	FrontHTML string `json:"front_html,omitempty"`
+	BackHTML  string `json:"back_html,omitempty"`
+}
+
+// NoteType names the fields of a kind of note and the cards made from it.
+// Besides the built-in types, note types with any fields can be defined;
+// they are stored in the note_types table.
+type NoteType struct {
+	Name      string         `json:"name"`
+	Fields    []string       `json:"fields"`
+	Templates []CardTemplate `json:"templates"`
+	CSS       string         `json:"css"` // Styles the rendered cards
+	Builtin   bool           `json:"builtin"`
+
+	// Kind marks built-in note types whose cards are not made from their
+	// templates, image occlusion (see occlusion.go) and cloze (cloze.go)
+	Kind string `json:"kind,omitempty"`
+}
+
+// DefaultNoteType is used for notes created without a note type.
+const DefaultNoteType = "Basic"
+
+// reversedNoteType is the note type of cards created with Reverse set.
+const reversedNoteType = "Basic (and reversed card)"
+
+var builtinNoteTypes = []NoteType{
+	{
+		Name:   "Basic",
+		Fields: []string{"Front", "Back"},
+		Templates: []CardTemplate{
+			{Name: "Card 1", Front: "{{Front}}", Back: "{{Back}}"},
+		},
+		CSS:     defaultCardCSS,
+		Builtin: true,
+	},
+	{
+		Name:   reversedNoteType,
+		Fields: []string{"Front", "Back"},
+		Templates: []CardTemplate{
+			{Name: "Card 1", Front: "{{Front}}", Back: "{{Back}}"},
+			{Name: "Card 2", Front: "{{Back}}", Back: "{{Front}}"},
+		},
+		CSS:     defaultCardCSS,
+		Builtin: true,
+	},
+	{
+		Name:   occlusionNoteType,
+		Fields: []string{"Image", "Masks", "Header", "Back Extra"},
+		// Describes the cards; one is made per mask
+		Templates: []CardTemplate{
+			{Name: "Mask", Front: "{{Header}}", Back: "{{Back Extra}}"},
+		},
+		CSS:     occlusionCSS,
+		Builtin: true,
+		Kind:    noteKindOcclusion,
+	},
+	{
+		Name:   clozeNoteType,
+		Fields: []string{"Text", "Back Extra"},
+		// Describes the cards; one is made per cloze number
+		Templates: []CardTemplate{
+			{Name: "Cloze", Front: "{{Text}}", Back: "{{Text}}\n\n{{Back Extra}}"},
+		},
+		CSS:     defaultCardCSS,
+		Builtin: true,
+		Kind:    noteKindCloze,
+	},
+}
+
+// GetNoteTypes returns the built-in note types followed by the defined
+// ones, by name.
+func GetNoteTypes(db *Collection) ([]NoteType, error) {
+	rows, err := db.Query(`SELECT name, fields, templates, css FROM note_types ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	types := append([]NoteType{}, builtinNoteTypes...)
+	for rows.Next() {
+		var nt NoteType
+		if err := scanNoteType(rows, &nt); err != nil {
+			return nil, err
+		}
+		types = append(types, nt)
+	}
+	return types, rows.Err()
+}
+
+func GetNoteType(db *Collection, name string) (NoteType, error) {
+	return getNoteType(db, name)
+}
+
+func getNoteType(q querier, name string) (NoteType, error) {
+	for _, nt := range builtinNoteTypes {
+		if nt.Name == name {
+			return nt, nil
+		}
+	}
+	var nt NoteType
+	err := scanNoteType(q.QueryRow(`SELECT name, fields, templates, css FROM note_types WHERE name = ?`, name), &nt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return NoteType{}, fmt.Errorf("%w: %q", ErrUnknownNoteType, name)
+	}
+	return nt, err
+}
+
+// scanNoteType reads a note type stored with its fields and templates as
+// JSON.
+func scanNoteType(row scanner, nt *NoteType) error {
+	var fields, templates string
+	if err := row.Scan(&nt.Name, &fields, &templates, &nt.CSS); err != nil {
+		return err
+	}
+	if err := json.Unmarshal([]byte(fields), &nt.Fields); err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(templates), &nt.Templates)
+}
+
+// check validates a note type being defined: it needs a name, at least one
+// field, and at least one template, each with a distinct name and sides
+// only using the type's fields. A template's front must use a field.
+func (nt *NoteType) check() error {
+	nt.Name = strings.TrimSpace(nt.Name)
+	if nt.Name == "" {
+		return fmt.Errorf("%w: name is required", ErrInvalidNoteType)
+	}
+	if nt.Kind != "" {
+		return fmt.Errorf("%w: kind is reserved for built-in note types", ErrInvalidNoteType)
+	}
+	if len(nt.Fields) == 0 {
+		return fmt.Errorf("%w: at least one field is required", ErrInvalidNoteType)
+	}
+	fields := make(map[string]bool)
+	for i, field := range nt.Fields {
+		field = strings.TrimSpace(field)
+		if field == "" || strings.ContainsAny(field, "{}") {
+			return fmt.Errorf("%w: field names cannot be empty or contain braces", ErrInvalidNoteType)
+		}
+		if fields[field] {
+			return fmt.Errorf("%w: field %q is listed twice", ErrInvalidNoteType, field)
+		}
+		fields[field] = true
+		nt.Fields[i] = field
+	}
+
+	if len(nt.Templates) == 0 {
+		return fmt.Errorf("%w: at least one template is required", ErrInvalidNoteType)
+	}
+	names := make(map[string]bool)
+	for i, t := range nt.Templates {
+		if t.Name = strings.TrimSpace(t.Name); t.Name == "" {
+			t.Name = fmt.Sprintf("Card %d", i+1)
+		}
+		if names[t.Name] {
+			return fmt.Errorf("%w: template %q is listed twice", ErrInvalidNoteType, t.Name)
+		}
+		names[t.Name] = true
+		if !templateField.MatchString(t.Front) {
+			return fmt.Errorf("%w: front of template %q uses no field", ErrInvalidNoteType, t.Name)
+		}
+		for _, m := range templateField.FindAllStringSubmatch(t.Front+t.Back+t.FrontHTML, -1) {
+			if !fields[m[1]] {
+				return fmt.Errorf("%w: template %q uses unknown field %q", ErrInvalidNoteType, t.Name, m[1])
+			}
+		}
+		// The HTML back may also show the rendered front
+		for _, m := range templateField.FindAllStringSubmatch(t.BackHTML, -1) {
+			if !fields[m[1]] && m[1] != frontSideField {
+				return fmt.Errorf("%w: template %q uses unknown field %q", ErrInvalidNoteType, t.Name, m[1])
+			}
+		}
+		nt.Templates[i] = t
+	}
+	nt.Builtin = false
+	return nil
+}
+
+// CreateNoteType defines a new note type.
+func CreateNoteType(db *Collection, nt *NoteType) error {
+	if err := nt.check(); err != nil {
+		return err
+	}
+	if _, err := getNoteType(db, nt.Name); err == nil {
+		return ErrNoteTypeExists
+	} else if !errors.Is(err, ErrUnknownNoteType) {
+		return err
+	}
+	return saveNoteType(db, nt, true)
+}
+
+func saveNoteType(q querier, nt *NoteType, create bool) error {
+	fields, err := json.Marshal(nt.Fields)
+	if err != nil {
+		return err
+	}
+	templates, err := json.Marshal(nt.Templates)
+	if err != nil {
+		return err
+	}
+	if create {
+		_, err = q.Exec(
+			`INSERT INTO note_types (name, fields, templates, css) VALUES (?, ?, ?, ?)`,
+			nt.Name, string(fields), string(templates), nt.CSS,
+		)
+	} else {
+		_, err = q.Exec(
+			`UPDATE note_types SET fields = ?, templates = ?, css = ? WHERE name = ?`,
+			string(fields), string(templates), nt.CSS, nt.Name,
+		)
+	}
+	return err
+}
+
+// UpdateNoteType replaces the fields, templates and CSS of a defined note type
+// and renders the cards of its notes again. Fields no longer in the type
+// are dropped from its notes, and cards of removed templates (those past
+// the new number of templates) are deleted.
+func UpdateNoteType(db *Collection, name string, nt *NoteType) error {
+	nt.Name = name
+	if err := nt.check(); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	old, err := getNoteType(tx, name)
+	if err != nil {
+		return err
+	}
+	if old.Builtin {
+		return ErrBuiltinNoteType
+	}
+	if err := saveNoteType(tx, nt, false); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(
+		`DELETE FROM cards WHERE template >= ? AND note_id IN (SELECT id FROM notes WHERE note_type = ?)`,
+		len(nt.Templates), name,
+	); err != nil {
+		return err
+	}
+	ids, err := noteIDs(tx, name)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		note, err := getNote(tx, id)
+		if errors.Is(err, ErrNoteNotFound) {
+			continue // Its cards were all deleted
+		}
+		if err != nil {
+			return err
+		}
+		fields := make(map[string]string)
+		for _, field := range nt.Fields {
+			if v, ok := note.Fields[field]; ok {
+				fields[field] = v
+			}
+		}
+		if err := saveNoteFields(tx, note, *nt, fields); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// noteIDs returns the IDs of the notes of a note type.
+func noteIDs(q querier, noteType string) ([]int, error) {
+	rows, err := q.Query(`SELECT id FROM notes WHERE note_type = ? ORDER BY id`, noteType)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// DeleteNoteType deletes a defined note type that no note uses.
+func DeleteNoteType(db *Collection, name string) error {
+	nt, err := getNoteType(db, name)
+	if err != nil {
+		return err
+	}
+	if nt.Builtin {
+		return ErrBuiltinNoteType
+	}
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM notes WHERE note_type = ?`, name).Scan(&n); err != nil {
+		return err
+	}
+	if n > 0 {
+		return fmt.Errorf("%w: %d notes", ErrNoteTypeInUse, n)
+	}
+	_, err = db.Exec(`DELETE FROM note_types WHERE name = ?`, name)
+	return err
+}
+
+// templateField matches a {{Field}} placeholder in a card template.
+var templateField = regexp.MustCompile(`\{\{\s*([^{}]+?)\s*\}\}`)
+
+// render fills the template's sides with the note's fields.
+func (t CardTemplate) render(fields map[string]string) (string, string) {
+	fill := func(side string) string {
+		return strings.TrimSpace(templateField.ReplaceAllStringFunc(side, func(m string) string {
+			return fields[templateField.FindStringSubmatch(m)[1]]
+		}))
+	}
+	return fill(t.Front), fill(t.Back)
+}
+
+// assign is the reverse of render: it puts an edited card's front and back
+// into the fields they came from. That only works when each side of the
+// template is a single field.
+func (t CardTemplate) assign(fields map[string]string, front, back string) error {
+	set := map[string]string{}
+	for _, side := range []struct{ template, value string }{{t.Front, front}, {t.Back, back}} {
+		m := templateField.FindStringSubmatch(strings.TrimSpace(side.template))
+		if m == nil || m[0] != strings.TrimSpace(side.template) {
+			return fmt.Errorf("%w: template %q is more than one field; edit the note instead", ErrNoteCardEdit, t.Name)
+		}
+		if v, ok := set[m[1]]; ok && v != side.value {
+			return fmt.Errorf("%w: both sides show field %q; edit the note instead", ErrNoteCardEdit, m[1])
+		}
+		set[m[1]] = side.value
+	}
+	maps.Copy(fields, set)
+	return nil
+}
+
+// validate checks that fields only names fields of the note type.
+func (nt NoteType) validate(fields map[string]string) error {
+	for name := range fields {
+		known := false
+		for _, field := range nt.Fields {
+			known = known || field == name
+		}
+		if !known {
+			return fmt.Errorf("%w: note type %q has no field %q", ErrInvalidNote, nt.Name, name)
+		}
+	}
+	return nil
+}
+
+type Note struct {
+	ID        int               `json:"id"`
+	NoteType  string            `json:"note_type"`
+	Fields    map[string]string `json:"fields"`
+	CreatedAt time.Time         `json:"created_at"`
+	UpdatedAt time.Time         `json:"updated_at"`
+	Cards     []Card            `json:"cards,omitempty"` // Ordered by template
+}
+
+// CreateNote creates a note and its cards in deckName, tagging every card
+// with tags. A note must give at least one card.
+func CreateNote(db *Collection, note *Note, deckName string, tags []string) error {
+	if note.NoteType == "" {
+		note.NoteType = DefaultNoteType
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	nt, err := getNoteType(tx, note.NoteType)
+	if err != nil {
+		return err
+	}
+	if err := nt.validate(note.Fields); err != nil {
+		return err
+	}
+
+	fields, err := json.Marshal(note.Fields)
+	if err != nil {
+		return err
+	}
+	result, err := tx.Exec(`INSERT INTO notes (note_type, fields) VALUES (?, ?)`, note.NoteType, string(fields))
+	if err != nil {
+		return err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	if err := renderNoteCards(tx, int(id), nt, note.Fields, deckName, tags); err != nil {
+		return err
+	}
+	created, err := getNote(tx, int(id))
+	if err != nil {
+		return err
+	}
+	if len(created.Cards) == 0 {
+		return fmt.Errorf("%w: no card template of %q gives a card with a front and back", ErrInvalidNote, nt.Name)
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	*note = *created
+	return nil
+}
+
+// GetNote returns a note with its cards.
+func GetNote(db *Collection, id int) (*Note, error) {
+	return getNote(db, id)
+}
+
+func getNote(q querier, id int) (*Note, error) {
+	note := &Note{}
+	var fields string
+	err := q.QueryRow(`SELECT id, note_type, fields, created_at, updated_at FROM notes WHERE id = ?`, id).
+		Scan(&note.ID, &note.NoteType, &fields, &note.CreatedAt, &note.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNoteNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(fields), &note.Fields); err != nil {
+		return nil, err
+	}
+
+	rows, err := q.Query(`SELECT `+cardColumns+` FROM cards WHERE note_id = ? ORDER BY template`, id)
+	if err != nil {
+		return nil, err
+	}
+	if note.Cards, err = scanCards(rows); err != nil {
+		return nil, err
+	}
+	return note, nil
+}
+
+// UpdateNote replaces a note's fields and renders its cards again. Cards
+// keep their scheduling; templates that now give a card for the first time
+// add one to the deck of the note's cards.
+func UpdateNote(db *Collection, id int, fields map[string]string) (*Note, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	note, err := getNote(tx, id)
+	if err != nil {
+		return nil, err
+	}
+	nt, err := getNoteType(tx, note.NoteType)
+	if err != nil {
+		return nil, err
+	}
+	if err := nt.validate(fields); err != nil {
+		return nil, err
+	}
+	if err := saveNoteFields(tx, note, nt, fields); err != nil {
+		return nil, err
+	}
+
+	if note, err = getNote(tx, id); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return note, nil
+}
+
+// DeleteNote deletes a note and all its cards.
+func DeleteNote(db *Collection, id int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`DELETE FROM notes WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNoteNotFound
+	}
+	if _, err := tx.Exec(`DELETE FROM cards WHERE note_id = ?`, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// saveNoteFields stores new fields for a note read with getNote and renders
+// its cards again.
+func saveNoteFields(q querier, note *Note, nt NoteType, fields map[string]string) error {
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	if _, err := q.Exec(`UPDATE notes SET fields = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?`, string(data), note.ID); err != nil {
+		return err
+	}
+
+	// New cards join the first card in its deck, or its home deck while it
+	// is in a filtered deck
+	deckName, tags := "", []string(nil)
+	if len(note.Cards) > 0 {
+		first := note.Cards[0]
+		deckName, tags = first.DeckName, first.Tags
+		if first.HomeDeck != "" {
+			deckName = first.HomeDeck
+		}
+	}
+	return renderNoteCards(q, note.ID, nt, fields, deckName, tags)
+}
+
+// cardSides returns the text front and back of each card a note of this
+// type makes from fields, by template index. Cards with an empty side are
+// not made.
+func (nt NoteType) cardSides(fields map[string]string) ([][2]string, error) {
+	switch nt.Kind {
+	case noteKindOcclusion:
+		return occlusionCards(fields)
+	case noteKindCloze:
+		return clozeCards(fields)
+	}
+	sides := make([][2]string, len(nt.Templates))
+	for i, t := range nt.Templates {
+		sides[i][0], sides[i][1] = t.render(fields)
+	}
+	return sides, nil
+}
+
+// cardName names the card of this note type at template index i.
+func (nt NoteType) cardName(i int) string {
+	switch nt.Kind {
+	case noteKindOcclusion:
+		return fmt.Sprintf("Mask %d", i+1)
+	case noteKindCloze:
+		return fmt.Sprintf("Cloze %d", i+1)
+	}
+	return nt.Templates[i].Name
+}
+
+// renderNoteCards brings a note's cards in line with its fields: existing
+// cards get their new text, templates without a card get one in deckName,
+// tagged with tags, and cards the note no longer makes are deleted.
+func renderNoteCards(q querier, noteID int, nt NoteType, fields map[string]string, deckName string, tags []string) error {
+	rows, err := q.Query(`SELECT `+cardColumns+` FROM cards WHERE note_id = ?`, noteID)
+	if err != nil {
+		return err
+	}
+	cards, err := scanCards(rows)
+	if err != nil {
+		return err
+	}
+	existing := make(map[int]Card)
+	for _, card := range cards {
+		existing[card.Template] = card
+	}
+
+	sides, err := nt.cardSides(fields)
+	if err != nil {
+		return err
+	}
+	for i, side := range sides {
+		front, back := side[0], side[1]
+		card, ok := existing[i]
+		switch {
+		case ok && (front == "" || back == ""):
+			return fmt.Errorf("%w: card %d (%s) would be left without a front or back", ErrInvalidNote, card.ID, nt.cardName(i))
+		case ok:
+			if front == card.Front && back == card.Back {
+				continue
+			}
+			_, err := q.Exec(
+				`UPDATE cards SET front = ?, back = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?`,
+				front, back, card.ID,
+			)
+			if err != nil {
+				return err
+			}
+		case front != "" && back != "":
+			card := Card{DeckName: deckName, Front: front, Back: back, Tags: tags, NoteID: &noteID, Template: i}
+			if err := createCard(q, &card); err != nil {
+				return err
+			}
+		}
+	}
+	// Only occlusion notes lose cards this way, when masks are removed
+	for i, card := range existing {
+		if i >= len(sides) {
+			if _, err := q.Exec(`DELETE FROM cards WHERE id = ?`, card.ID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// createReversedCard creates card along with its reversed card as the
+// cards of a new note, and fills in card as the first of them.
+func createReversedCard(q querier, card *Card) error {
+	nt, err := getNoteType(q, reversedNoteType)
+	if err != nil {
+		return err
+	}
+	fields := map[string]string{"Front": card.Front, "Back": card.Back}
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	result, err := q.Exec(`INSERT INTO notes (note_type, fields) VALUES (?, ?)`, nt.Name, string(data))
+	if err != nil {
+		return err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	card.Reverse = false
+	if err := renderNoteCards(q, int(id), nt, fields, card.DeckName, card.Tags); err != nil {
+		return err
+	}
+	err = scanCard(q.QueryRow(`SELECT `+cardColumns+` FROM cards WHERE note_id = ? AND template = 0`, id), card)
+	card.Reverse = true
+	return err
+}
+
+// editNoteCard saves an edited front and back of a card made from a note
+// into the note's fields, and renders the note's other cards again.
+func editNoteCard(q querier, card *Card) error {
+	note, err := getNote(q, *card.NoteID)
+	if err != nil {
+		return err
+	}
+	nt, err := getNoteType(q, note.NoteType)
+	if err != nil {
+		return err
+	}
+	switch nt.Kind {
+	case noteKindOcclusion:
+		return fmt.Errorf("%w: edit the occlusion note's masks instead", ErrNoteCardEdit)
+	case noteKindCloze:
+		return fmt.Errorf("%w: edit the cloze note's text instead", ErrNoteCardEdit)
+	}
+	if card.Template >= len(nt.Templates) {
+		return fmt.Errorf("%w: note type %q has no template %d", ErrInvalidNote, nt.Name, card.Template)
+	}
+
+	fields := maps.Clone(note.Fields)
+	if fields == nil {
+		fields = map[string]string{}
+	}
+	if err := nt.Templates[card.Template].assign(fields, card.Front, card.Back); err != nil {
+		return err
+	}
+	return saveNoteFields(q, note, nt, fields)
+}
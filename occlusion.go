@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"strings"
+)
+
+// Image occlusion notes hold an image and rectangles masking parts of it.
+// Each mask gives a card whose front shows the image with that region
+// hidden and whose back reveals it. Unlike other note types, the number of
+// cards comes from the note rather than from templates: a card's Template
+// is the index of its mask.
+
+// noteKindOcclusion marks the image occlusion note type.
+const noteKindOcclusion = "image_occlusion"
+
+// occlusionNoteType is the name of the image occlusion note type.
+const occlusionNoteType = "Image Occlusion"
+
+// OcclusionMask is a rectangle over an occlusion image, in fractions of the
+// image's width and height so it fits the image at any size. Label is the
+// answer, shown on the back.
+type OcclusionMask struct {
+	X      float64 `json:"x"`
+	Y      float64 `json:"y"`
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+	Label  string  `json:"label,omitempty"`
+}
+
+// occlusionCSS styles occlusion cards on top of the default card style.
+const occlusionCSS = defaultCardCSS + `
+.io { position: relative; display: inline-block; }
+.io img { display: block; max-width: 100%; }
+.io-mask { position: absolute; background: #ffeba2; border: 1px solid #212121; }
+.io-mask.revealed { background: transparent; border: 2px solid #e74c3c; }`
+
+// parseOcclusionMasks reads the masks of an occlusion note from its Masks
+// field.
+func parseOcclusionMasks(data string) ([]OcclusionMask, error) {
+	var masks []OcclusionMask
+	if err := json.Unmarshal([]byte(data), &masks); err != nil {
+		return nil, fmt.Errorf("%w: masks must be a JSON array of rectangles: %v", ErrInvalidNote, err)
+	}
+	if len(masks) == 0 {
+		return nil, fmt.Errorf("%w: at least one mask is required", ErrInvalidNote)
+	}
+	const slack = 1e-6 // Rounding in clients drawing the masks
+	for i, m := range masks {
+		if m.X < 0 || m.Y < 0 || m.Width <= 0 || m.Height <= 0 || m.X+m.Width > 1+slack || m.Y+m.Height > 1+slack {
+			return nil, fmt.Errorf("%w: mask %d must lie within the image (x, y, width and height between 0 and 1)", ErrInvalidNote, i+1)
+		}
+	}
+	return masks, nil
+}
+
+// occlusionCards returns the text front and back of each card of an
+// occlusion note, one per mask.
+func occlusionCards(fields map[string]string) ([][2]string, error) {
+	if !mediaName.MatchString(fields["Image"]) {
+		return nil, fmt.Errorf("%w: Image must name an uploaded image", ErrInvalidNote)
+	}
+	masks, err := parseOcclusionMasks(fields["Masks"])
+	if err != nil {
+		return nil, err
+	}
+
+	header := strings.TrimSpace(fields["Header"])
+	if header == "" {
+		header = "Image occlusion"
+	}
+	cards := make([][2]string, len(masks))
+	for i, m := range masks {
+		back := strings.TrimSpace(m.Label)
+		if back == "" {
+			back = fmt.Sprintf("Mask %d", i+1)
+		}
+		if extra := strings.TrimSpace(fields["Back Extra"]); extra != "" {
+			back += "\n\n" + extra
+		}
+		cards[i] = [2]string{fmt.Sprintf("%s (%d of %d)", header, i+1, len(masks)), back}
+	}
+	return cards, nil
+}
+
+// occlusionHTML renders the card for the mask at index: the front hides
+// the masked region, the back outlines it and shows its label.
+func occlusionHTML(fields map[string]string, index int) (string, string, error) {
+	masks, err := parseOcclusionMasks(fields["Masks"])
+	if err != nil {
+		return "", "", err
+	}
+	if index >= len(masks) {
+		return "", "", fmt.Errorf("%w: note has no mask %d", ErrInvalidNote, index+1)
+	}
+	m := masks[index]
+
+	image := func(class string) string {
+		return fmt.Sprintf(
+			`<div class="io"><img src="/media/%s" alt=""><div class="%s" style="left: %.4f%%; top: %.4f%%; width: %.4f%%; height: %.4f%%;"></div></div>`,
+			html.EscapeString(fields["Image"]), class, m.X*100, m.Y*100, m.Width*100, m.Height*100,
+		)
+	}
+	header := ""
+	if h := fields["Header"]; h != "" {
+		header = `<div class="io-header">` + renderMarkdown(h) + `</div>`
+	}
+	back := header + image("io-mask revealed")
+	if m.Label != "" {
+		back += `<div class="io-label">` + html.EscapeString(m.Label) + `</div>`
+	}
+	if extra := fields["Back Extra"]; extra != "" {
+		back += `<div class="io-extra">` + renderMarkdown(extra) + `</div>`
+	}
+	return header + image("io-mask"), back, nil
+}
+
+// CreateOcclusionNote stores an image and creates an occlusion note with a
+// card per mask.
+func CreateOcclusionNote(db *Collection, image []byte, masks []OcclusionMask, header, backExtra, deckName string, tags []string) (*Note, error) {
+	data, err := json.Marshal(masks)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := parseOcclusionMasks(string(data)); err != nil {
+		return nil, err
+	}
+	media, err := saveImage(db, image)
+	if err != nil {
+		return nil, err
+	}
+
+	note := &Note{
+		NoteType: occlusionNoteType,
+		Fields: map[string]string{
+			"Image":      media.Name,
+			"Masks":      string(data),
+			"Header":     header,
+			"Back Extra": backExtra,
+		},
+	}
+	if err := CreateNote(db, note, deckName, tags); err != nil {
+		return nil, err
+	}
+	return note, nil
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Photographed notes, whiteboards and handouts are imported by reading
+// their text with OCR and proposing cards from it. Like generated cards
+// (see generate.go) they are only proposed: the client shows them for
+// confirmation and creates the ones kept with /api/cards/bulk.
+//
+// OCR runs the tesseract command by default, or with -ocr llm asks the
+// LLM (see llm.go), which must then be a vision model. PDFs are turned into
+// page images with pdftoppm from poppler first.
+
+// ocrEngine, tesseractPath and pdftoppmPath are set from -ocr, -tesseract
+// and -pdftoppm in main.
+var (
+	ocrEngine     = OCRTesseract
+	tesseractPath = "tesseract"
+	pdftoppmPath  = "pdftoppm"
+)
+
+const (
+	OCRTesseract = "tesseract"
+	OCRLLM       = "llm"
+)
+
+var (
+	ErrInvalidOCR     = errors.New("invalid OCR request")
+	ErrOCRUnavailable = errors.New("OCR is not available")
+	ErrOCR            = errors.New("OCR failed")
+)
+
+const (
+	// maxOCRUpload bounds an uploaded image or PDF.
+	maxOCRUpload = 50 << 20
+	// maxOCRPages bounds the pages of a PDF that are read.
+	maxOCRPages = 20
+	// maxOCRFront bounds the term of a "term: definition" line.
+	maxOCRFront = 80
+)
+
+// ocrLang matches tesseract language lists such as eng or eng+fin.
+var ocrLang = regexp.MustCompile(`^[a-z_]{3,8}(\+[a-z_]{3,8})*$`)
+
+// OCRResult is the text read from an upload and the cards proposed from it.
+type OCRResult struct {
+	Text   string          `json:"text"`
+	Pages  int             `json:"pages"`
+	Method string          `json:"method"`
+	Cards  []GeneratedCard `json:"cards"`
+}
+
+// OCRRequest describes an upload to read. Method is how cards are found in
+// the text: "heuristic" (the default) or "llm".
+type OCRRequest struct {
+	Data     []byte
+	DeckName string
+	Lang     string // Tesseract language, "eng" by default
+	Method   string
+	MaxCards int
+	Tags     []string
+}
+
+// ImportOCR reads the text of an image or PDF and proposes cards from it.
+func ImportOCR(db *Collection, ctx context.Context, req OCRRequest) (*OCRResult, error) {
+	if req.Lang == "" {
+		req.Lang = "eng"
+	}
+	if req.DeckName == "" {
+		req.DeckName = "Default"
+	}
+	switch {
+	case len(req.Data) == 0:
+		return nil, fmt.Errorf("%w: file is required", ErrInvalidOCR)
+	case !ocrLang.MatchString(req.Lang):
+		return nil, fmt.Errorf("%w: lang must be a tesseract language such as eng or eng+fin", ErrInvalidOCR)
+	case req.Method != "" && req.Method != "heuristic" && req.Method != "llm":
+		return nil, fmt.Errorf("%w: method must be \"heuristic\" or \"llm\"", ErrInvalidOCR)
+	}
+
+	var images [][]byte
+	switch contentType := http.DetectContentType(req.Data); contentType {
+	case "application/pdf":
+		var err error
+		if images, err = pdfPages(ctx, req.Data); err != nil {
+			return nil, err
+		}
+	case "image/png", "image/jpeg", "image/gif", "image/bmp", "image/webp":
+		images = [][]byte{req.Data}
+	default:
+		return nil, fmt.Errorf("%w: file must be a PNG, JPEG, GIF, BMP or WebP image or a PDF, not %s", ErrInvalidOCR, contentType)
+	}
+
+	var pages []string
+	for _, image := range images {
+		text, err := ocrImage(ctx, image, req.Lang)
+		if err != nil {
+			return nil, err
+		}
+		if text = strings.TrimSpace(text); text != "" {
+			pages = append(pages, text)
+		}
+	}
+	result := &OCRResult{Text: strings.Join(pages, "\n\n"), Pages: len(images), Method: req.Method, Cards: []GeneratedCard{}}
+	if result.Text == "" {
+		return result, nil
+	}
+
+	if req.Method == "llm" {
+		cards, err := GenerateCards(db, ctx, GenerateRequest{Text: result.Text, DeckName: req.DeckName, MaxCards: req.MaxCards, Tags: req.Tags})
+		if err != nil {
+			return nil, err
+		}
+		result.Cards = cards
+		return result, nil
+	}
+
+	result.Method = "heuristic"
+	tags, err := normalizeTags(req.Tags)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidOCR, err)
+	}
+	if result.Cards, err = proposeCards(db, req.DeckName, textCards(result.Text), tags); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// pdfPages renders the pages of a PDF as PNG images for OCR.
+func pdfPages(ctx context.Context, pdf []byte) ([][]byte, error) {
+	if _, err := exec.LookPath(pdftoppmPath); err != nil {
+		return nil, fmt.Errorf("%w: reading PDFs needs pdftoppm from poppler; install it or set -pdftoppm", ErrOCRUnavailable)
+	}
+	dir, err := os.MkdirTemp("", "simple-anki-ocr-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, pdftoppmPath, "-r", "300", "-png", "-l", fmt.Sprint(maxOCRPages), "-", filepath.Join(dir, "page"))
+	cmd.Stdin = bytes.NewReader(pdf)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%w: could not read the PDF: %s", ErrInvalidOCR, strings.TrimSpace(stderr.String()))
+	}
+
+	// Pages are named page-1.png or page-01.png and so on, zero-padded to
+	// the same width, so they sort in order
+	files, err := filepath.Glob(filepath.Join(dir, "page-*.png"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	var images [][]byte
+	for _, file := range files {
+		image, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, image)
+	}
+	return images, nil
+}
+
+// ocrImage reads the text of an image with the configured OCR engine.
+func ocrImage(ctx context.Context, image []byte, lang string) (string, error) {
+	if ocrEngine == OCRLLM {
+		return llmOCR(ctx, image)
+	}
+
+	if _, err := exec.LookPath(tesseractPath); err != nil {
+		return "", fmt.Errorf("%w: install tesseract, set -tesseract, or use -ocr llm", ErrOCRUnavailable)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, tesseractPath, "stdin", "stdout", "-l", lang)
+	cmd.Stdin = bytes.NewReader(image)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%w: %s", ErrOCR, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+const ocrPrompt = `Transcribe all text in the image exactly as written, keeping its line breaks. Write formulas as $...$ LaTeX. Answer with the text only, without any comments.`
+
+// llmOCR has the LLM transcribe an image.
+func llmOCR(ctx context.Context, image []byte) (string, error) {
+	if llmURL == "" {
+		return "", ErrLLMDisabled
+	}
+
+	dataURL := "data:" + http.DetectContentType(image) + ";base64," + base64.StdEncoding.EncodeToString(image)
+	var completion struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+	}
+	err := llmPost(ctx, llmURL, "/chat/completions", map[string]any{
+		"model": llmModel,
+		"messages": []map[string]any{
+			{"role": "user", "content": []map[string]any{
+				{"type": "text", "text": ocrPrompt},
+				{"type": "image_url", "image_url": map[string]string{"url": dataURL}},
+			}},
+		},
+		"temperature": 0,
+	}, &completion)
+	if err != nil {
+		return "", err
+	}
+	if len(completion.Choices) == 0 {
+		return "", fmt.Errorf("%w: unexpected response", ErrLLM)
+	}
+	return completion.Choices[0].Message.Content, nil
+}
+
+// ocrDefinition matches a "term: definition" line, also with =, a dash or
+// a tab between, and an optional bullet in front.
+var ocrDefinition = regexp.MustCompile(`^(?:[-•*·]\s+|\d+[.)]\s+)?([^:=\t]+?)\s*(?::|=|\s[-–—]\s|\t)\s*(\S.*)$`)
+
+// textCards finds cards in OCR or PDF text: Q:/A: pairs if it has any,
+// and "term: definition" lines otherwise. Lines following a definition
+// that does not end a sentence, or starting in lowercase, continue it, as
+// both break lines where the page did.
+func textCards(text string) []ImportCard {
+	for _, line := range strings.Split(text, "\n") {
+		if mdQuestion.MatchString(strings.TrimSpace(line)) {
+			var cards []ImportCard
+			for _, card := range parseMarkdown(text) {
+				if card.Front != "" && card.Back != "" {
+					cards = append(cards, card)
+				}
+			}
+			return cards
+		}
+	}
+
+	var cards []ImportCard
+	last := -1
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			last = -1
+			continue
+		}
+		m := ocrDefinition.FindStringSubmatch(line)
+		if m != nil && len(m[1]) <= maxOCRFront && !strings.Contains(m[1], "http") {
+			cards = append(cards, ImportCard{Front: m[1], Back: m[2]})
+			last = len(cards) - 1
+			continue
+		}
+		if last >= 0 && (!strings.ContainsAny(cards[last].Back[len(cards[last].Back)-1:], ".!?") ||
+			strings.ToLower(line[:1]) == line[:1]) {
+			back := cards[last].Back
+			if strings.HasSuffix(back, "-") {
+				cards[last].Back = strings.TrimSuffix(back, "-") + line
+			} else {
+				cards[last].Back = back + " " + line
+			}
+			continue
+		}
+		last = -1
+	}
+	return cards
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OpenID Connect single sign-on lets accounts log in through an identity
+// provider such as Authelia, Keycloak or Google with the authorization
+// code flow and PKCE. An account is created on its first login, named
+// after the provider's preferred_username or email, and is tied to the
+// provider's subject from then on. Like registering with a password,
+// that takes -open-registration once the first account exists, unless
+// the verified email is on the -oidc-allowed-emails list. The ID token is taken straight from
+// the provider's token endpoint over HTTPS, which OpenID Connect accepts
+// in place of checking its signature; its issuer, audience, expiry and
+// nonce are checked.
+
+var (
+	ErrOIDCDisabled = errors.New("single sign-on is off; start the server with -oidc-issuer and -oidc-client-id")
+	ErrOIDC         = errors.New("single sign-on failed")
+)
+
+var (
+	oidcIssuer      = ""
+	oidcClientID    = ""
+	oidcRedirectURL = "" // Derived from the request if empty
+	// oidcAllowedEmails are the comma-separated addresses, or @domains,
+	// whose verified email lets a new account be created on its first
+	// login while registration is closed, set from -oidc-allowed-emails.
+	oidcAllowedEmails = ""
+)
+
+const (
+	// oidcStateCookie keeps the state, nonce and PKCE verifier of a login
+	// in progress.
+	oidcStateCookie = "oidc_state"
+	// oidcLoginTimeout is how long a login at the provider may take.
+	oidcLoginTimeout = 10 * time.Minute
+)
+
+var oidcClient = &http.Client{Timeout: 30 * time.Second}
+
+// oidcProvider is the part of the provider's discovery document used.
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+}
+
+var (
+	oidcProviderMu     sync.Mutex
+	oidcProviderCached *oidcProvider
+)
+
+// oidcClientSecret returns the client secret, kept in the
+// OIDC_CLIENT_SECRET environment variable so it stays out of the process
+// list. Public clients have none.
+func oidcClientSecret() string {
+	return os.Getenv("OIDC_CLIENT_SECRET")
+}
+
+// oidcEnabled reports whether single sign-on is configured.
+func oidcEnabled() bool {
+	return accounts != nil && oidcIssuer != "" && oidcClientID != ""
+}
+
+// discoverOIDC fetches the provider's discovery document, once it has
+// been fetched successfully.
+func discoverOIDC() (*oidcProvider, error) {
+	oidcProviderMu.Lock()
+	defer oidcProviderMu.Unlock()
+	if oidcProviderCached != nil {
+		return oidcProviderCached, nil
+	}
+
+	resp, err := oidcClient.Get(strings.TrimSuffix(oidcIssuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrOIDC, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: discovery answered %s", ErrOIDC, resp.Status)
+	}
+	var p oidcProvider
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&p); err != nil {
+		return nil, fmt.Errorf("%w: invalid discovery document: %v", ErrOIDC, err)
+	}
+	if p.Issuer != strings.TrimSuffix(oidcIssuer, "/") && p.Issuer != oidcIssuer {
+		return nil, fmt.Errorf("%w: discovery document is for issuer %q", ErrOIDC, p.Issuer)
+	}
+	if p.AuthorizationEndpoint == "" || p.TokenEndpoint == "" {
+		return nil, fmt.Errorf("%w: discovery document lacks endpoints", ErrOIDC)
+	}
+	// The ID token is trusted for coming from the token endpoint over HTTPS
+	token, err := url.Parse(p.TokenEndpoint)
+	if err != nil || token.Scheme != "https" && token.Hostname() != "localhost" && token.Hostname() != "127.0.0.1" {
+		return nil, fmt.Errorf("%w: token endpoint must use https", ErrOIDC)
+	}
+	oidcProviderCached = &p
+	return &p, nil
+}
+
+// oidcRedirect returns the callback URL the provider sends the browser
+// back to.
+func oidcRedirect(r *http.Request) string {
+	if oidcRedirectURL != "" {
+		return oidcRedirectURL
+	}
+	scheme := "http"
+	if r.TLS != nil || secureCookies {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + "/api/oidc/callback"
+}
+
+// OIDCLoginURL starts a login at the provider, returning the URL to send
+// the browser to and the value of the state cookie to set.
+func OIDCLoginURL(r *http.Request) (string, string, error) {
+	p, err := discoverOIDC()
+	if err != nil {
+		return "", "", err
+	}
+	state, err := randomToken()
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := randomToken()
+	if err != nil {
+		return "", "", err
+	}
+	verifier, err := randomToken()
+	if err != nil {
+		return "", "", err
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+
+	u, err := url.Parse(p.AuthorizationEndpoint)
+	if err != nil {
+		return "", "", fmt.Errorf("%w: invalid authorization endpoint: %v", ErrOIDC, err)
+	}
+	q := u.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", oidcClientID)
+	q.Set("redirect_uri", oidcRedirect(r))
+	q.Set("scope", "openid profile email")
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	q.Set("code_challenge_method", "S256")
+	u.RawQuery = q.Encode()
+	return u.String(), state + "." + nonce + "." + verifier, nil
+}
+
+// oidcClaims are the ID token claims used.
+type oidcClaims struct {
+	Issuer            string          `json:"iss"`
+	Subject           string          `json:"sub"`
+	Audience          json.RawMessage `json:"aud"` // A string or an array of them
+	AuthorizedParty   string          `json:"azp"`
+	Expiry            int64           `json:"exp"`
+	Nonce             string          `json:"nonce"`
+	PreferredUsername string          `json:"preferred_username"`
+	Email             string          `json:"email"`
+	EmailVerified     bool            `json:"email_verified"`
+}
+
+// oidcEmailAllowed reports whether the claims have a verified email on
+// the -oidc-allowed-emails list.
+func oidcEmailAllowed(claims *oidcClaims) bool {
+	if !claims.EmailVerified || claims.Email == "" {
+		return false
+	}
+	email := strings.ToLower(claims.Email)
+	_, domain, _ := strings.Cut(email, "@")
+	for _, allowed := range strings.Split(oidcAllowedEmails, ",") {
+		allowed = strings.ToLower(strings.TrimSpace(allowed))
+		if allowed != "" && (allowed == email || allowed == "@"+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// OIDCCallback finishes a login at the provider: it checks the state
+// against the state cookie, exchanges the code for an ID token and starts
+// a session for the account of its subject, creating the account on the
+// first login.
+func OIDCCallback(r *http.Request, stateCookie string) (*User, string, time.Time, error) {
+	if msg := r.URL.Query().Get("error"); msg != "" {
+		return nil, "", time.Time{}, fmt.Errorf("%w: the provider answered %s", ErrOIDC, msg)
+	}
+	state, rest, _ := strings.Cut(stateCookie, ".")
+	nonce, verifier, _ := strings.Cut(rest, ".")
+	if state == "" || nonce == "" || verifier == "" || r.URL.Query().Get("state") != state {
+		return nil, "", time.Time{}, fmt.Errorf("%w: the login expired or was started elsewhere", ErrOIDC)
+	}
+	code := r.URL.Query().Get("code")
+	if code == "" {
+		return nil, "", time.Time{}, fmt.Errorf("%w: no code", ErrOIDC)
+	}
+
+	p, err := discoverOIDC()
+	if err != nil {
+		return nil, "", time.Time{}, err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {oidcRedirect(r)},
+		"client_id":     {oidcClientID},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(r.Context(), "POST", p.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, "", time.Time{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if secret := oidcClientSecret(); secret != "" {
+		req.SetBasicAuth(url.QueryEscape(oidcClientID), url.QueryEscape(secret))
+	}
+	resp, err := oidcClient.Do(req)
+	if err != nil {
+		return nil, "", time.Time{}, fmt.Errorf("%w: %v", ErrOIDC, err)
+	}
+	defer resp.Body.Close()
+	var tokens struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tokens); err != nil {
+		return nil, "", time.Time{}, fmt.Errorf("%w: token endpoint answered %s", ErrOIDC, resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK || tokens.IDToken == "" {
+		return nil, "", time.Time{}, fmt.Errorf("%w: token endpoint answered %s %s", ErrOIDC, resp.Status, tokens.Error)
+	}
+
+	claims, err := parseIDToken(tokens.IDToken, p.Issuer, nonce)
+	if err != nil {
+		return nil, "", time.Time{}, err
+	}
+	id, err := accounts.oidcUser(p.Issuer, claims)
+	if err != nil {
+		return nil, "", time.Time{}, err
+	}
+	token, expires, err := accounts.startSession(id, r.UserAgent())
+	if err != nil {
+		return nil, "", time.Time{}, err
+	}
+	user, err := accounts.user(id)
+	if err != nil {
+		return nil, "", time.Time{}, err
+	}
+	return user, token, expires, nil
+}
+
+// parseIDToken reads the claims of an ID token from the token endpoint
+// and checks them.
+func parseIDToken(idToken, issuer, nonce string) (*oidcClaims, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed ID token", ErrOIDC)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed ID token", ErrOIDC)
+	}
+	var claims oidcClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("%w: malformed ID token", ErrOIDC)
+	}
+
+	var audience []string
+	if err := json.Unmarshal(claims.Audience, &audience); err != nil {
+		var one string
+		if json.Unmarshal(claims.Audience, &one) == nil {
+			audience = []string{one}
+		}
+	}
+	found := false
+	for _, aud := range audience {
+		found = found || aud == oidcClientID
+	}
+
+	switch {
+	case claims.Issuer != issuer:
+		return nil, fmt.Errorf("%w: ID token from issuer %q", ErrOIDC, claims.Issuer)
+	case !found || claims.AuthorizedParty != "" && claims.AuthorizedParty != oidcClientID:
+		return nil, fmt.Errorf("%w: ID token is for another client", ErrOIDC)
+	case time.Now().Unix() >= claims.Expiry:
+		return nil, fmt.Errorf("%w: ID token expired", ErrOIDC)
+	case claims.Nonce != nonce:
+		return nil, fmt.Errorf("%w: ID token nonce does not match", ErrOIDC)
+	case claims.Subject == "":
+		return nil, fmt.Errorf("%w: ID token has no subject", ErrOIDC)
+	}
+	return &claims, nil
+}
+
+var usernameUnsafe = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// oidcUser returns the ID of the account of an identity provider's
+// subject, creating the account on its first login if registration is
+// open or its email is allowed. Such accounts have no password.
+func (a *Accounts) oidcUser(issuer string, claims *oidcClaims) (int, error) {
+	subject := issuer + " " + claims.Subject
+	var id int
+	err := a.QueryRow(`SELECT id FROM users WHERE oidc_subject = ?`, subject).Scan(&id)
+	if err != sql.ErrNoRows {
+		return id, err
+	}
+
+	base := claims.PreferredUsername
+	if base == "" {
+		base, _, _ = strings.Cut(claims.Email, "@")
+	}
+	base = strings.Trim(usernameUnsafe.ReplaceAllString(base, "-"), "-")
+	if base == "" {
+		base = "user"
+	}
+	if len(base) > 56 {
+		base = base[:56]
+	}
+
+	tx, err := a.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var count int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM users`).Scan(&count); err != nil {
+		return 0, err
+	}
+	if count > 0 && !a.openRegistration && !oidcEmailAllowed(claims) {
+		return 0, ErrRegistrationClosed
+	}
+
+	name := base
+	for n := 2; ; n++ {
+		var taken int
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM users WHERE username = ?`, name).Scan(&taken); err != nil {
+			return 0, err
+		}
+		if taken == 0 {
+			break
+		}
+		name = base + "-" + strconv.Itoa(n)
+	}
+	res, err := tx.Exec(
+		`INSERT INTO users (username, password_hash, oidc_subject, is_admin) VALUES (?, '', ?, ?)`,
+		name, subject, count == 0)
+	if err != nil {
+		return 0, err
+	}
+	newID, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return int(newID), tx.Commit()
+}
+
+// setOIDCStateCookie sets, or with an empty value clears, the cookie of a
+// login in progress. It is Lax so the provider's redirect back brings it.
+func setOIDCStateCookie(w http.ResponseWriter, r *http.Request, value string) {
+	cookie := &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    value,
+		Path:     "/api/oidc/",
+		MaxAge:   int(oidcLoginTimeout / time.Second),
+		HttpOnly: true,
+		Secure:   secureCookies || r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if value == "" {
+		cookie.MaxAge = -1
+	}
+	http.SetCookie(w, cookie)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestOIDCUserRegistration(t *testing.T) {
+	dir := t.TempDir()
+	a, err := OpenAccounts(filepath.Join(dir, "users.db"), filepath.Join(dir, "collections"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	defer func(allowed string) { oidcAllowedEmails = allowed }(oidcAllowedEmails)
+	oidcAllowedEmails = "friend@example.org, @example.com"
+	const issuer = "https://auth.example.com"
+
+	// The first account may always be created, and is an admin
+	first, err := a.oidcUser(issuer, &oidcClaims{Subject: "1", PreferredUsername: "owner"})
+	if err != nil {
+		t.Fatalf("first account: %v", err)
+	}
+	if u, err := a.user(first); err != nil || !u.Admin {
+		t.Fatalf("first account is not an admin: %+v, %v", u, err)
+	}
+	if id, err := a.oidcUser(issuer, &oidcClaims{Subject: "1"}); err != nil || id != first {
+		t.Errorf("existing account logging in again = %d, %v; want %d", id, err, first)
+	}
+
+	tests := []struct {
+		name    string
+		claims  oidcClaims
+		allowed bool
+	}{
+		{"unknown subject", oidcClaims{Subject: "2", Email: "stranger@evil.example", EmailVerified: true}, false},
+		{"unverified allowed email", oidcClaims{Subject: "3", Email: "friend@example.org"}, false},
+		{"allowed email", oidcClaims{Subject: "4", Email: "Friend@Example.org", EmailVerified: true}, true},
+		{"allowed domain", oidcClaims{Subject: "5", Email: "colleague@example.com", EmailVerified: true}, true},
+		{"lookalike domain", oidcClaims{Subject: "6", Email: "x@notexample.com", EmailVerified: true}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := a.oidcUser(issuer, &tt.claims)
+			if tt.allowed {
+				if err != nil {
+					t.Fatalf("oidcUser() = %v, want an account", err)
+				}
+				if u, err := a.user(id); err != nil || u.Admin {
+					t.Errorf("later account is an admin: %+v, %v", u, err)
+				}
+			} else if !errors.Is(err, ErrRegistrationClosed) {
+				t.Errorf("oidcUser() = %d, %v; want ErrRegistrationClosed", id, err)
+			}
+		})
+	}
+
+	a.openRegistration = true
+	if _, err := a.oidcUser(issuer, &oidcClaims{Subject: "2"}); err != nil {
+		t.Errorf("open registration: %v", err)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+)
+
+// Uploaded JPEG and PNG images larger than maxImageDimension are scaled
+// down and re-encoded, turned upright by their EXIF orientation first.
+// Other JPEGs only lose their metadata (EXIF, XMP, IPTC and comments),
+// which can hold the location a photo was taken, without re-encoding. GIF
+// and WebP images are stored as uploaded.
+
+// maxImageDimension is the longest side, in pixels, of stored images, set
+// from -max-image-size in main. Zero turns optimizing off.
+var maxImageDimension = 1920
+
+// maxImagePixels bounds the images decoded for optimizing, as a decoded
+// image takes four bytes per pixel.
+const maxImagePixels = 64 << 20
+
+// jpegQuality is the quality re-encoded JPEGs are written with.
+const jpegQuality = 85
+
+// optimizeImage returns data scaled down and stripped of metadata as
+// described above, or data itself if there is nothing to do.
+func optimizeImage(data []byte, t mediaType) ([]byte, error) {
+	if maxImageDimension <= 0 || (t.ContentType != "image/jpeg" && t.ContentType != "image/png") {
+		return data, nil
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: cannot read image: %v", ErrInvalidMedia, err)
+	}
+	orientation := 1
+	if t.ContentType == "image/jpeg" {
+		orientation = jpegOrientation(data)
+	}
+	if cfg.Width <= maxImageDimension && cfg.Height <= maxImageDimension && orientation == 1 {
+		if t.ContentType == "image/jpeg" {
+			return stripJPEGMetadata(data), nil
+		}
+		return data, nil
+	}
+	if cfg.Width*cfg.Height > maxImagePixels {
+		return nil, fmt.Errorf("%w: image of %dx%d pixels is too large", ErrInvalidMedia, cfg.Width, cfg.Height)
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: cannot read image: %v", ErrInvalidMedia, err)
+	}
+	img := orient(src, orientation)
+	img = shrink(img, maxImageDimension)
+
+	var buf bytes.Buffer
+	if t.ContentType == "image/jpeg" {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: jpegQuality})
+	} else {
+		err = (&png.Encoder{CompressionLevel: png.BestCompression}).Encode(&buf, img)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// jpegSegments calls fn with the marker and the whole of each segment
+// before a JPEG's image data, and returns where the image data starts.
+func jpegSegments(data []byte, fn func(marker byte, segment []byte)) int {
+	i := 2 // After the SOI marker
+	for i+4 <= len(data) && data[i] == 0xFF {
+		marker := data[i+1]
+		if marker == 0xDA { // Start of scan: the image data follows
+			return i
+		}
+		end := i + 2 + int(binary.BigEndian.Uint16(data[i+2:]))
+		if end > len(data) {
+			break
+		}
+		fn(marker, data[i:end])
+		i = end
+	}
+	return -1
+}
+
+// jpegOrientation reads the EXIF orientation of a JPEG, 1 being upright.
+func jpegOrientation(data []byte) int {
+	orientation := 1
+	jpegSegments(data, func(marker byte, segment []byte) {
+		if marker != 0xE1 || !bytes.HasPrefix(segment[4:], []byte("Exif\x00\x00")) {
+			return
+		}
+		tiff := segment[10:]
+		if len(tiff) < 8 {
+			return
+		}
+		var order binary.ByteOrder = binary.BigEndian
+		if string(tiff[:2]) == "II" {
+			order = binary.LittleEndian
+		}
+		ifd := int(order.Uint32(tiff[4:]))
+		if ifd+2 > len(tiff) {
+			return
+		}
+		count := int(order.Uint16(tiff[ifd:]))
+		for n := 0; n < count; n++ {
+			entry := ifd + 2 + n*12
+			if entry+12 > len(tiff) {
+				return
+			}
+			if order.Uint16(tiff[entry:]) == 0x0112 {
+				if o := int(order.Uint16(tiff[entry+8:])); o >= 1 && o <= 8 {
+					orientation = o
+				}
+				return
+			}
+		}
+	})
+	return orientation
+}
+
+// stripJPEGMetadata drops the EXIF, XMP, IPTC and comment segments of a
+// JPEG, keeping the ones that affect how it looks.
+func stripJPEGMetadata(data []byte) []byte {
+	out := append(make([]byte, 0, len(data)), data[:2]...)
+	scan := jpegSegments(data, func(marker byte, segment []byte) {
+		switch marker {
+		case 0xE1, 0xED, 0xFE: // APP1 (EXIF, XMP), APP13 (IPTC), COM
+			return
+		}
+		out = append(out, segment...)
+	})
+	if scan < 0 {
+		return data // Not a JPEG we understand; leave it be
+	}
+	return append(out, data[scan:]...)
+}
+
+// orient turns img upright according to an EXIF orientation.
+func orient(img image.Image, orientation int) *image.RGBA {
+	b := img.Bounds()
+	src := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	if orientation == 1 {
+		return src
+	}
+
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 { // Rotated a quarter turn
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2:
+				sx, sy = w-1-x, y
+			case 3:
+				sx, sy = w-1-x, h-1-y
+			case 4:
+				sx, sy = x, h-1-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, h-1-x
+			case 7:
+				sx, sy = w-1-y, h-1-x
+			case 8:
+				sx, sy = w-1-y, x
+			}
+			copy(dst.Pix[dst.PixOffset(x, y):][:4], src.Pix[src.PixOffset(sx, sy):][:4])
+		}
+	}
+	return dst
+}
+
+// shrink scales img down so neither side exceeds size, averaging the
+// pixels each new pixel covers.
+func shrink(img *image.RGBA, size int) *image.RGBA {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	if w <= size && h <= size {
+		return img
+	}
+	dw, dh := size, h*size/w
+	if h > w {
+		dw, dh = w*size/h, size
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := y*h/dh, (y+1)*h/dh
+		for x := 0; x < dw; x++ {
+			x0, x1 := x*w/dw, (x+1)*w/dw
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				row := img.Pix[img.PixOffset(x0, sy):]
+				for i := 0; i < (x1-x0)*4; i++ {
+					sum[i%4] += int(row[i])
+				}
+			}
+			n := (x1 - x0) * (y1 - y0)
+			p := dst.Pix[dst.PixOffset(x, y):]
+			for c := range sum {
+				p[c] = uint8(sum[c] / n)
+			}
+		}
+	}
+	return dst
+}
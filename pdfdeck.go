@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// A PDF chapter is made into a deck by extracting its text with poppler's
+// pdftotext, splitting it into sections at its headings, and proposing
+// cards for each section, either by the heuristics of photographed notes
+// (see ocr.go) or by the LLM (see generate.go). Asking the LLM about every
+// section takes a while, so it runs as a background job like an async
+// import (see importjob.go), counting sections instead of cards. As with
+// generated cards, nothing is saved.
+
+// pdftotextPath is set from -pdftotext in main.
+var pdftotextPath = "pdftotext"
+
+var ErrInvalidPDF = errors.New("invalid PDF import")
+
+const (
+	// maxPDFPages bounds the pages of a PDF that are read.
+	maxPDFPages = 200
+	// maxPDFSections bounds the sections cards are proposed for.
+	maxPDFSections = 50
+	// minPDFSection is the shortest text kept as a section of its own;
+	// shorter ones are joined to the one before.
+	minPDFSection = 300
+	// maxPDFSection is the longest text sent to the LLM at once; longer
+	// sections are split at paragraphs.
+	maxPDFSection = 12_000
+)
+
+// PDFDeckRequest describes a PDF to make a deck of. With Subdecks each
+// section's cards go to a subdeck of DeckName named after it.
+type PDFDeckRequest struct {
+	Data     []byte
+	DeckName string
+	Method   string // "heuristic" (the default) or "llm"
+	MaxCards int    // Per section, with the LLM
+	Tags     []string
+	Subdecks bool
+}
+
+// PDFSection is a section of a PDF and the cards proposed for it.
+type PDFSection struct {
+	Title string          `json:"title"`
+	Text  string          `json:"-"`
+	Cards []GeneratedCard `json:"cards"`
+}
+
+// pdfHeading matches lines numbered like headings ("3.2 Cell Division",
+// "Chapter 4", "Part II: ...").
+var pdfHeading = regexp.MustCompile(`^(?i:chapter|section|part|appendix)\s+[\dIVXLC]+\b|^\d+(?:\.\d+)*\.?\s+\p{Lu}`)
+
+// StartPDFDeck checks a PDF, extracts and splits its text, and starts the
+// job proposing cards for its sections.
+func StartPDFDeck(db *Collection, ctx context.Context, req PDFDeckRequest) (ImportJobStatus, error) {
+	if req.DeckName == "" {
+		req.DeckName = "Default"
+	}
+	switch {
+	case len(req.Data) == 0:
+		return ImportJobStatus{}, fmt.Errorf("%w: file is required", ErrInvalidPDF)
+	case http.DetectContentType(req.Data) != "application/pdf":
+		return ImportJobStatus{}, fmt.Errorf("%w: file is not a PDF", ErrInvalidPDF)
+	case req.Method != "" && req.Method != "heuristic" && req.Method != "llm":
+		return ImportJobStatus{}, fmt.Errorf("%w: method must be \"heuristic\" or \"llm\"", ErrInvalidPDF)
+	case req.MaxCards < 0 || req.MaxCards > maxGenerateCards:
+		return ImportJobStatus{}, fmt.Errorf("%w: max_cards must be between 1 and %d", ErrInvalidPDF, maxGenerateCards)
+	case req.Method == "llm" && llmURL == "":
+		return ImportJobStatus{}, ErrLLMDisabled
+	}
+	if req.Method == "" {
+		req.Method = "heuristic"
+	}
+	tags, err := normalizeTags(req.Tags)
+	if err != nil {
+		return ImportJobStatus{}, fmt.Errorf("%w: %v", ErrInvalidPDF, err)
+	}
+
+	text, err := pdfText(ctx, req.Data)
+	if err != nil {
+		return ImportJobStatus{}, err
+	}
+	sections := splitSections(text)
+	if len(sections) == 0 {
+		return ImportJobStatus{}, fmt.Errorf("%w: the PDF has no text; scanned pages can be read with /api/import/ocr", ErrInvalidPDF)
+	}
+
+	job := startImportJob(db, len(sections), 0, func(progress func(int)) (map[string]interface{}, int) {
+		// The job outlives the request that started it
+		ctx := context.Background()
+		count := 0
+		for i := range sections {
+			s := &sections[i]
+			deckName := req.DeckName
+			if req.Subdecks {
+				deckName += DeckSeparator + strings.ReplaceAll(s.Title, DeckSeparator, ":")
+			}
+			var err error
+			if req.Method == "llm" {
+				s.Cards, err = GenerateCards(db, ctx, GenerateRequest{Text: s.Text, DeckName: deckName, MaxCards: req.MaxCards, Tags: tags})
+			} else {
+				s.Cards, err = proposeCards(db, deckName, textCards(s.Text), tags)
+			}
+			if err != nil {
+				status := http.StatusInternalServerError
+				if errors.Is(err, ErrLLM) {
+					status = http.StatusBadGateway
+				}
+				return map[string]interface{}{"error": fmt.Sprintf("Section %q: %v", s.Title, err)}, status
+			}
+			count += len(s.Cards)
+			progress(i + 1)
+		}
+		return map[string]interface{}{
+			"deck_name":  req.DeckName,
+			"method":     req.Method,
+			"sections":   sections,
+			"card_count": count,
+			"message":    fmt.Sprintf("Proposed %d cards from %d sections", count, len(sections)),
+		}, http.StatusOK
+	})
+	return job, nil
+}
+
+// pdfText extracts the text of a PDF, its pages separated by form feeds.
+func pdfText(ctx context.Context, pdf []byte) (string, error) {
+	if _, err := exec.LookPath(pdftotextPath); err != nil {
+		return "", fmt.Errorf("%w: reading PDFs needs pdftotext from poppler; install it or set -pdftotext", ErrOCRUnavailable)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, pdftotextPath, "-l", fmt.Sprint(maxPDFPages), "-enc", "UTF-8", "-", "-")
+	cmd.Stdin = bytes.NewReader(pdf)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%w: could not read the PDF: %s", ErrInvalidPDF, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+// isPDFHeading reports whether a line of a PDF looks like a heading: a
+// numbered one, or a short line in capitals.
+func isPDFHeading(line string) bool {
+	if len(line) < 3 || len(line) > 80 || strings.ContainsAny(line[len(line)-1:], ".,;") {
+		return false
+	}
+	if pdfHeading.MatchString(line) {
+		return true
+	}
+	letters := 0
+	for _, r := range line {
+		if unicode.IsLower(r) {
+			return false
+		}
+		if unicode.IsLetter(r) {
+			letters++
+		}
+	}
+	return letters >= 4
+}
+
+// splitSections splits PDF text at its headings. Text without headings is
+// split into parts of about maxPDFSection characters.
+func splitSections(text string) []PDFSection {
+	var sections []PDFSection
+	var title string
+	var body []string
+	flush := func() {
+		t := strings.TrimSpace(strings.Join(body, "\n"))
+		body = nil
+		if t == "" {
+			return
+		}
+		if title == "" {
+			title = "Introduction"
+		}
+		if n := len(sections); n > 0 && len(t) < minPDFSection {
+			sections[n-1].Text += "\n\n" + title + "\n" + t
+			return
+		}
+		sections = append(sections, PDFSection{Title: title, Text: t})
+	}
+
+	lines := strings.Split(strings.ReplaceAll(text, "\f", "\n\n"), "\n")
+	headings := 0
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		// Bare page numbers are left out
+		if strings.Trim(line, "0123456789") == "" && line != "" {
+			continue
+		}
+		afterBreak := i == 0 || strings.TrimSpace(lines[i-1]) == ""
+		if afterBreak && isPDFHeading(line) {
+			flush()
+			title = line
+			headings++
+			continue
+		}
+		body = append(body, line)
+	}
+	flush()
+	if headings == 0 && len(sections) == 1 {
+		sections[0].Title = ""
+	}
+
+	// Long sections are split at paragraphs, so the LLM sees them in full
+	var split []PDFSection
+	for _, s := range sections {
+		parts := splitParagraphs(s.Text, maxPDFSection)
+		for i, part := range parts {
+			t := s.Title
+			switch {
+			case t == "":
+				t = fmt.Sprintf("Part %d", i+1)
+			case len(parts) > 1:
+				t = fmt.Sprintf("%s (%d)", t, i+1)
+			}
+			split = append(split, PDFSection{Title: t, Text: part})
+		}
+	}
+	if len(split) > maxPDFSections {
+		split = split[:maxPDFSections]
+	}
+	return split
+}
+
+// splitParagraphs splits text at blank lines into parts of at most size
+// bytes, unless a single paragraph is longer.
+func splitParagraphs(text string, size int) []string {
+	var parts []string
+	var current strings.Builder
+	for _, p := range strings.Split(text, "\n\n") {
+		if current.Len() > 0 && current.Len()+len(p)+2 > size {
+			parts = append(parts, strings.TrimSpace(current.String()))
+			current.Reset()
+		}
+		current.WriteString(p + "\n\n")
+	}
+	if t := strings.TrimSpace(current.String()); t != "" {
+		parts = append(parts, t)
+	}
+	return parts
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrInvalidQuery = errors.New("invalid search query")
+
+// SearchQuery is a parsed Anki-style search such as
+//
+//	deck:Japanese tag:verb is:due "te form" -is:suspended
+//
+// Terms are ANDed unless separated by "or"; "-" negates a term or a
+// parenthesized group. Supported terms:
+//
+//	word, "a phrase"   front or back contains the text
+//	deck:Name          cards in the deck or its subdecks
+//	tag:name           cards with the tag or one of its child tags
+//	front:text         front equals text ("*" matches anything)
+//	back:text          back equals text ("*" matches anything)
+//	is:due, is:new, is:learn, is:review, is:suspended, is:buried
+//	rated:N            answered in the last N study days (rated:1 is today)
+//	rated:N:S          answered with score S in the last N study days
+type SearchQuery struct {
+	where string // SQL condition on the cards table, empty to match all
+	args  []any
+	texts []string // FTS5 terms that are not negated, used for ranking
+}
+
+// queryToken is a word, a quoted string, "(", ")" or "-".
+type queryToken struct {
+	text   string
+	quoted bool
+}
+
+// tokenizeQuery splits a search into tokens. Quotes may surround a whole
+// term ("deck:My Deck") or only its value (deck:"My Deck").
+func tokenizeQuery(q string) ([]queryToken, error) {
+	var tokens []queryToken
+	runes := []rune(q)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case r == ' ' || r == '\t' || r == '\n':
+			i++
+		case r == '(' || r == ')':
+			tokens = append(tokens, queryToken{text: string(r)})
+			i++
+		case r == '-' && (i == 0 || runes[i-1] == ' ' || runes[i-1] == '('):
+			tokens = append(tokens, queryToken{text: "-"})
+			i++
+		default:
+			var b strings.Builder
+			quoted := false
+			for i < len(runes) && runes[i] != ' ' && runes[i] != '\t' && runes[i] != '\n' && runes[i] != ')' && (runes[i] != '(' || quoted) {
+				if runes[i] != '"' {
+					b.WriteRune(runes[i])
+					i++
+					continue
+				}
+				// Quoted section, taken literally
+				quoted = true
+				i++
+				for i < len(runes) && runes[i] != '"' {
+					b.WriteRune(runes[i])
+					i++
+				}
+				if i == len(runes) {
+					return nil, fmt.Errorf("%w: unterminated quote", ErrInvalidQuery)
+				}
+				i++
+			}
+			tokens = append(tokens, queryToken{text: b.String(), quoted: quoted})
+		}
+	}
+	return tokens, nil
+}
+
+// queryParser is a recursive descent parser over query tokens:
+//
+//	or    = and { "or" and }
+//	and   = unary { unary }
+//	unary = "-" unary | "(" or ")" | term
+type queryParser struct {
+	tokens []queryToken
+	pos    int
+	now    time.Time
+	texts  []string
+}
+
+// ParseQuery parses an Anki-style search query.
+func ParseQuery(q string) (*SearchQuery, error) {
+	tokens, err := tokenizeQuery(q)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &queryParser{tokens: tokens, now: time.Now()}
+	query := &SearchQuery{}
+	if len(tokens) == 0 {
+		return query, nil
+	}
+
+	query.where, query.args, err = p.parseOr(false)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("%w: unexpected %q", ErrInvalidQuery, p.tokens[p.pos].text)
+	}
+	query.texts = p.texts
+	return query, nil
+}
+
+func (p *queryParser) peek() (queryToken, bool) {
+	if p.pos >= len(p.tokens) {
+		return queryToken{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+func (p *queryParser) parseOr(negated bool) (string, []any, error) {
+	where, args, err := p.parseAnd(negated)
+	if err != nil {
+		return "", nil, err
+	}
+
+	conds := []string{where}
+	for {
+		tok, ok := p.peek()
+		if !ok || tok.quoted || !strings.EqualFold(tok.text, "or") {
+			break
+		}
+		p.pos++
+		next, nextArgs, err := p.parseAnd(negated)
+		if err != nil {
+			return "", nil, err
+		}
+		conds = append(conds, next)
+		args = append(args, nextArgs...)
+	}
+
+	if len(conds) == 1 {
+		return where, args, nil
+	}
+	return `(` + strings.Join(conds, ` OR `) + `)`, args, nil
+}
+
+func (p *queryParser) parseAnd(negated bool) (string, []any, error) {
+	var conds []string
+	var args []any
+	for {
+		tok, ok := p.peek()
+		if !ok || (!tok.quoted && (tok.text == ")" || strings.EqualFold(tok.text, "or"))) {
+			break
+		}
+		cond, condArgs, err := p.parseUnary(negated)
+		if err != nil {
+			return "", nil, err
+		}
+		conds = append(conds, cond)
+		args = append(args, condArgs...)
+	}
+
+	if len(conds) == 0 {
+		return "", nil, fmt.Errorf("%w: expected a search term", ErrInvalidQuery)
+	}
+	if len(conds) == 1 {
+		return conds[0], args, nil
+	}
+	return `(` + strings.Join(conds, ` AND `) + `)`, args, nil
+}
+
+func (p *queryParser) parseUnary(negated bool) (string, []any, error) {
+	tok, _ := p.peek()
+	p.pos++
+
+	if !tok.quoted {
+		switch tok.text {
+		case "-":
+			if _, ok := p.peek(); !ok {
+				return "", nil, fmt.Errorf("%w: nothing to negate", ErrInvalidQuery)
+			}
+			cond, args, err := p.parseUnary(!negated)
+			if err != nil {
+				return "", nil, err
+			}
+			return `NOT ` + cond, args, nil
+
+		case "(":
+			cond, args, err := p.parseOr(negated)
+			if err != nil {
+				return "", nil, err
+			}
+			if next, ok := p.peek(); !ok || next.text != ")" {
+				return "", nil, fmt.Errorf("%w: missing )", ErrInvalidQuery)
+			}
+			p.pos++
+			return cond, args, nil
+		}
+	}
+
+	return p.parseTerm(tok, negated)
+}
+
+// parseTerm turns a single term into a condition.
+func (p *queryParser) parseTerm(tok queryToken, negated bool) (string, []any, error) {
+	key, value, hasKey := strings.Cut(tok.text, ":")
+	if !hasKey || value == "" && !tok.quoted {
+		return p.textTerm(tok, negated)
+	}
+
+	switch strings.ToLower(key) {
+	case "deck":
+		cond, args := deckFilter("deck_name", value)
+		return cond, args, nil
+
+	case "tag":
+		cond, args := tagFilter("id", value)
+		return cond, args, nil
+
+	case "front", "back":
+		pattern := strings.ReplaceAll(escapeLike(value), "*", "%")
+		return strings.ToLower(key) + ` LIKE ? ESCAPE '\'`, []any{pattern}, nil
+
+	case "rated":
+		daysStr, scoreStr, hasScore := strings.Cut(value, ":")
+		days, err := strconv.Atoi(daysStr)
+		if err != nil || days < 1 {
+			return "", nil, fmt.Errorf("%w: rated needs a number of days", ErrInvalidQuery)
+		}
+		since := studyDayStart(p.now).AddDate(0, 0, 1-days).In(p.now.Location())
+		if !hasScore {
+			return `id IN (SELECT card_id FROM review_log WHERE reviewed_at >= ?)`, []any{since}, nil
+		}
+		score, err := strconv.Atoi(scoreStr)
+		if err != nil || score < 1 || score > 4 {
+			return "", nil, fmt.Errorf("%w: rated score must be between 1 and 4", ErrInvalidQuery)
+		}
+		return `id IN (SELECT card_id FROM review_log WHERE reviewed_at >= ? AND score = ?)`, []any{since, score}, nil
+
+	case "is":
+		switch strings.ToLower(value) {
+		case "due":
+			return `(state != 'new' AND next_review <= ?)`, []any{p.now}, nil
+		case "new":
+			return `state = 'new'`, nil, nil
+		case "learn":
+			return `state IN ('learning', 'relearning')`, nil, nil
+		case "review":
+			return `state IN ('review', 'relearning')`, nil, nil
+		case "suspended":
+			return `suspended = 1`, nil, nil
+		case "buried":
+			return `(buried_until IS NOT NULL AND buried_until > ?)`, []any{p.now}, nil
+		}
+		return "", nil, fmt.Errorf("%w: unknown is:%s", ErrInvalidQuery, value)
+	}
+
+	// Not a known key, so "a:b" is plain text
+	return p.textTerm(tok, negated)
+}
+
+// textTerm matches cards whose front or back contains the text. With FTS5,
+// unquoted words also match as word prefixes and quoted text as a phrase.
+func (p *queryParser) textTerm(tok queryToken, negated bool) (string, []any, error) {
+	if ftsEnabled {
+		term := ftsTerm(tok.text, !tok.quoted)
+		if !negated {
+			p.texts = append(p.texts, term)
+		}
+		return `id IN (SELECT rowid FROM cards_fts WHERE cards_fts MATCH ?)`, []any{term}, nil
+	}
+	pattern := "%" + escapeLike(tok.text) + "%"
+	return `(front LIKE ? ESCAPE '\' OR back LIKE ? ESCAPE '\')`, []any{pattern, pattern}, nil
+}
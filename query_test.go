@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestParseQuery(t *testing.T) {
+	db := openTestCollection(t)
+	for _, c := range []*Card{
+		{DeckName: "Spanish::Verbs", Front: "comer", Back: "to eat", Tags: []string{"verb"}},
+		{DeckName: "Spanish", Front: "hola", Back: "hello world"},
+		{DeckName: "Japanese", Front: "taberu", Back: "to eat", Tags: []string{"verb::ichidan"}},
+		{DeckName: "My Deck", Front: "cat", Back: "neko"},
+	} {
+		if err := CreateCard(db, c); err != nil {
+			t.Fatal(err)
+		}
+		switch c.Front {
+		case "hola":
+			if _, err := SubmitReview(db, ReviewResult{CardID: c.ID, Score: 3}); err != nil {
+				t.Fatal(err)
+			}
+		case "taberu":
+			if _, err := SetSuspended(db, c.ID, true); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"cat", "comer", "hola", "taberu"}},
+		{"deck:Spanish", []string{"comer", "hola"}},
+		{"tag:verb", []string{"comer", "taberu"}},
+		{`"to eat"`, []string{"comer", "taberu"}},
+		{"eat -is:suspended", []string{"comer"}},
+		{"deck:Spanish or deck:Japanese", []string{"comer", "hola", "taberu"}},
+		{"deck:Spanish OR tag:verb is:suspended", []string{"comer", "hola", "taberu"}},
+		{"-(deck:Spanish or tag:verb)", []string{"cat"}},
+		{`deck:"My Deck"`, []string{"cat"}},
+		{`"deck:My Deck"`, []string{"cat"}},
+		{"front:h*", []string{"hola"}},
+		{"back:to*", []string{"comer", "taberu"}},
+		{"is:suspended", []string{"taberu"}},
+		{"is:new", []string{"cat", "comer", "taberu"}},
+		{"is:learn", []string{"hola"}},
+		{"rated:1", []string{"hola"}},
+		{"rated:1:3", []string{"hola"}},
+		{"rated:1:1", nil},
+		{"unknown:key", nil},
+	}
+	for _, tt := range tests {
+		cards, err := SearchCards(db, tt.query, CardFilter{}, 100)
+		if err != nil {
+			t.Errorf("SearchCards(%q): %v", tt.query, err)
+			continue
+		}
+		var got []string
+		for _, c := range cards {
+			got = append(got, c.Front)
+		}
+		slices.Sort(got)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("SearchCards(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+
+	for _, q := range []string{`"unterminated`, "(deck:Spanish", "deck:Spanish )", "-", "is:bogus", "rated:x", "rated:0", "rated:1:5"} {
+		if _, err := ParseQuery(q); !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("ParseQuery(%q) = %v, want ErrInvalidQuery", q, err)
+		}
+	}
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// Daily limits, by the card state they apply to.
+var dailyLimits = map[string]func(SchedulerSettings) int{
+	StateReview: func(s SchedulerSettings) int { return s.ReviewsPerDay },
+	StateNew:    func(s SchedulerSettings) int { return s.NewCardsPerDay },
+}
+
+// GetDueCards returns the review queue, optionally limited by a filter (a
+// deck and its subdecks, a tag): due learning cards first, then due review
+// cards and new cards within the daily limits, at most limit cards unless
+// limit is 0 or less. A filtered deck serves all of its cards regardless of
+// due dates and daily limits.
+func GetDueCards(db *Collection, filter CardFilter, limit int) ([]Card, error) {
+	now := time.Now()
+
+	if filter.Deck != "" {
+		filtered, err := isFilteredDeck(db, filter.Deck)
+		if err != nil {
+			return nil, err
+		}
+		if filtered {
+			// Learning cards still wait for their step
+			return queryQueueCards(db, filter, `(state NOT IN ('learning', 'relearning') OR next_review <= ?)`, []any{now},
+				`state IN ('learning', 'relearning') DESC, next_review`, now, limit)
+		}
+	}
+
+	cards, err := queryQueueCards(db, filter, `state IN ('learning', 'relearning') AND next_review <= ?`, []any{now},
+		`next_review`, now, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	// Notes with a card in the queue, so their siblings wait
+	queued := make(map[int]bool)
+	for _, card := range cards {
+		if card.NoteID != nil {
+			queued[*card.NoteID] = true
+		}
+	}
+	for _, state := range []string{StateReview, StateNew} {
+		if limit > 0 && len(cards) >= limit {
+			break
+		}
+		more, err := getLimitedCards(db, filter, state, limit-len(cards), now, queued)
+		if err != nil {
+			return nil, err
+		}
+		cards = append(cards, more...)
+	}
+	return cards, nil
+}
+
+// Queues of a review session
+const (
+	QueueLearning = "learning" // Learning and relearning cards
+	QueueReview   = "review"
+	QueueNew      = "new"
+)
+
+// ReviewSession is a study queue: due learning cards, then reviews and new
+// cards in the deck's new/review order, then learning cards coming due
+// later in the study day, to be shown once due.
+type ReviewSession struct {
+	Cards            []SessionCard `json:"cards"`
+	Learning         int           `json:"learning"`
+	Review           int           `json:"review"`
+	New              int           `json:"new"`
+	NewReviewOrder   string        `json:"new_review_order"`
+	ReviewsRemaining int           `json:"reviews_remaining"` // Left today after this session
+	NewRemaining     int           `json:"new_remaining"`
+}
+
+// SessionCard is a card of a review session and the queue it came from.
+type SessionCard struct {
+	Queue string `json:"queue"`
+	Card
+}
+
+// GetReviewSession builds the review session of up to limit cards
+// matching the filter. The new/review order is that of the selected deck,
+// or the collection default. A filtered deck serves its cards as
+// GetDueCards does.
+func GetReviewSession(db *Collection, filter CardFilter, limit int) (*ReviewSession, error) {
+	now := time.Now()
+	settings := schedulerSettings
+	filtered := false
+	if filter.Deck != "" {
+		var err error
+		if settings, err = GetDeckSettings(db, filter.Deck); err != nil {
+			return nil, err
+		}
+		if filtered, err = isFilteredDeck(db, filter.Deck); err != nil {
+			return nil, err
+		}
+	}
+	session := &ReviewSession{Cards: []SessionCard{}, NewReviewOrder: settings.NewReviewOrder}
+	add := func(queue string, cards []Card) {
+		for _, card := range cards {
+			if len(session.Cards) == limit {
+				return
+			}
+			session.Cards = append(session.Cards, SessionCard{Queue: queue, Card: card})
+			switch queue {
+			case QueueLearning:
+				session.Learning++
+			case QueueReview:
+				session.Review++
+			case QueueNew:
+				session.New++
+			}
+		}
+	}
+
+	if filtered {
+		cards, err := GetDueCards(db, filter, limit)
+		if err != nil {
+			return nil, err
+		}
+		for _, card := range cards {
+			add(queueOf(card), []Card{card})
+		}
+		return session, nil
+	}
+
+	endOfDay := dueAfterDays(now, 1)
+	learning, err := queryQueueCards(db, filter, `state IN ('learning', 'relearning') AND next_review < ?`, []any{endOfDay},
+		`next_review`, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	var learningNow, learningLater []Card
+	queued := make(map[int]bool)
+	for _, card := range learning {
+		if card.NextReview.After(now) {
+			learningLater = append(learningLater, card)
+		} else {
+			learningNow = append(learningNow, card)
+		}
+		if card.NoteID != nil {
+			queued[*card.NoteID] = true
+		}
+	}
+
+	// Both queues are fetched in full, as the order decides which of them
+	// fills the rest of the session
+	reviews, err := getLimitedCards(db, filter, StateReview, limit-len(learningNow), now, queued)
+	if err != nil {
+		return nil, err
+	}
+	newCards, err := getLimitedCards(db, filter, StateNew, limit-len(learningNow), now, queued)
+	if err != nil {
+		return nil, err
+	}
+
+	add(QueueLearning, learningNow)
+	switch settings.NewReviewOrder {
+	case NewReviewBefore:
+		add(QueueNew, newCards)
+		add(QueueReview, reviews)
+	case NewReviewAfter:
+		add(QueueReview, reviews)
+		add(QueueNew, newCards)
+	default:
+		// New cards spread evenly among the reviews
+		r, n := 0, 0
+		for r < len(reviews) || n < len(newCards) {
+			if r < len(reviews) && (n == len(newCards) || (r+1)*len(newCards) <= (n+1)*len(reviews)) {
+				add(QueueReview, reviews[r:r+1])
+				r++
+			} else {
+				add(QueueNew, newCards[n:n+1])
+				n++
+			}
+		}
+	}
+	add(QueueLearning, learningLater)
+
+	if session.ReviewsRemaining, session.NewRemaining, err = RemainingToday(db, filter.Deck); err != nil {
+		return nil, err
+	}
+	session.ReviewsRemaining -= session.Review
+	session.NewRemaining -= session.New
+	return session, nil
+}
+
+// queueOf returns the queue a card belongs to by its state.
+func queueOf(card Card) string {
+	switch card.State {
+	case StateNew:
+		return QueueNew
+	case StateReview:
+		return QueueReview
+	default:
+		return QueueLearning
+	}
+}
+
+// GetCramCards returns up to limit cards matching the filter in random
+// order, whether due or not, for cram sessions that leave scheduling alone.
+// Suspended and buried cards are skipped.
+func GetCramCards(db *Collection, filter CardFilter, limit int) ([]Card, error) {
+	return queryQueueCards(db, filter, "", nil, `random()`, time.Now(), limit)
+}
+
+// RemainingToday reports how many more review cards and new cards can be
+// studied today in a deck and its subdecks (or the whole collection).
+func RemainingToday(db *Collection, deckName string) (reviews, newCards int, err error) {
+	since := startOfDay(time.Now())
+	if reviews, _, err = remainingInScope(db, deckName, StateReview, since); err != nil {
+		return 0, 0, err
+	}
+	if newCards, _, err = remainingInScope(db, deckName, StateNew, since); err != nil {
+		return 0, 0, err
+	}
+	return reviews, newCards, nil
+}
+
+// queryQueueCards returns up to limit cards matching the filter and
+// condition (if any) that are neither suspended nor buried at now.
+func queryQueueCards(db *Collection, filter CardFilter, condition string, condArgs []any, orderBy string, now time.Time, limit int) ([]Card, error) {
+	where := []string{`suspended = 0`, `(buried_until IS NULL OR buried_until <= ?)`}
+	args := []any{now}
+	if condition != "" {
+		where = append(where, condition)
+		args = append(args, condArgs...)
+	}
+
+	filterWhere, filterArgs := filter.where()
+	where = append(where, filterWhere...)
+	args = append(args, filterArgs...)
+
+	query := `SELECT ` + cardColumns + ` FROM cards WHERE ` + strings.Join(where, ` AND `) + ` ORDER BY ` + orderBy
+	if limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, limit)
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanCards(rows)
+}
+
+// getLimitedCards returns up to limit due cards in the given state (review
+// or new) matching the filter, with no limit but the daily ones if limit
+// is 0 or less. Each deck's daily limit applies to its own cards, and the
+// selected deck's limit (or the collection default when no deck is
+// selected) also caps the total. In decks burying siblings, cards of notes
+// in queued are skipped; the notes of the returned cards are added to it.
+func getLimitedCards(db *Collection, filter CardFilter, state string, limit int, now time.Time, queued map[int]bool) ([]Card, error) {
+	remaining, done, err := remainingInScope(db, filter.Deck, state, startOfDay(now))
+	if err != nil {
+		return nil, err
+	}
+	if limit <= 0 || remaining < limit {
+		limit = remaining
+	}
+	if limit <= 0 {
+		return nil, nil
+	}
+
+	// Reviews go by due date, new cards in the selected deck's order
+	orderBy := `next_review`
+	if state == StateNew {
+		if orderBy, err = newCardOrderBy(db, filter.Deck); err != nil {
+			return nil, err
+		}
+	}
+	candidates, err := queryQueueCards(db, filter, `state = ? AND next_review <= ?`, []any{state, now}, orderBy, now, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	perDay := dailyLimits[state]
+	deckSettings := make(map[string]SchedulerSettings)
+	deckRemaining := make(map[string]int)
+	var cards []Card
+	for _, card := range candidates {
+		settings, ok := deckSettings[card.DeckName]
+		if !ok {
+			if settings, err = GetDeckSettings(db, card.DeckName); err != nil {
+				return nil, err
+			}
+			deckSettings[card.DeckName] = settings
+			deckRemaining[card.DeckName] = perDay(settings) - done[card.DeckName]
+		}
+		if card.NoteID != nil && settings.BurySiblings && queued[*card.NoteID] {
+			continue
+		}
+		left := deckRemaining[card.DeckName]
+		if left <= 0 {
+			continue
+		}
+
+		cards = append(cards, card)
+		deckRemaining[card.DeckName] = left - 1
+		if card.NoteID != nil {
+			queued[*card.NoteID] = true
+		}
+		if len(cards) == limit {
+			break
+		}
+	}
+	return cards, nil
+}
+
+// newCardOrderBy returns the ORDER BY clause introducing new cards in the
+// new card order of a deck, or of the collection default. Random order
+// shuffles by a hash of the card ID, so it stays the same from one queue
+// to the next.
+func newCardOrderBy(db *Collection, deckName string) (string, error) {
+	settings := schedulerSettings
+	if deckName != "" {
+		var err error
+		if settings, err = GetDeckSettings(db, deckName); err != nil {
+			return "", err
+		}
+	}
+	switch settings.NewCardOrder {
+	case NewOrderRandom:
+		return `(id * 2654435761) % 4294967296, id`, nil
+	case NewOrderPosition:
+		return `position, id`, nil
+	default:
+		return `id`, nil
+	}
+}
+
+// remainingInScope returns how many more cards in the given state can be
+// studied today under the limit of the selected deck, along with the per
+// deck counts already studied since the start of the day.
+func remainingInScope(db *Collection, deckName, state string, since time.Time) (int, map[string]int, error) {
+	done, err := countReviewedSince(db, state, since)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	top := schedulerSettings
+	if deckName != "" {
+		if top, err = GetDeckSettings(db, deckName); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	remaining := dailyLimits[state](top)
+	for deck, n := range done {
+		if deckName == "" || isSubdeckOf(deck, deckName) {
+			remaining -= n
+		}
+	}
+	if remaining < 0 {
+		remaining = 0
+	}
+	return remaining, done, nil
+}
+
+// countReviewedSince counts, per deck, the answers given since the given
+// time to cards that were in the given state.
+func countReviewedSince(db *Collection, state string, since time.Time) (map[string]int, error) {
+	rows, err := db.Query(
+		`SELECT c.deck_name, COUNT(*)
+		 FROM review_log r JOIN cards c ON c.id = r.card_id
+		 WHERE r.state_before = ? AND r.reviewed_at >= ?
+		 GROUP BY c.deck_name`,
+		state, since,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var deck string
+		var n int
+		if err := rows.Scan(&deck, &n); err != nil {
+			return nil, err
+		}
+		counts[deck] = n
+	}
+	return counts, rows.Err()
+}
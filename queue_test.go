@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestGetDueCardsLimit(t *testing.T) {
+	db := openTestCollection(t)
+	for _, front := range []string{"uno", "dos", "tres"} {
+		if err := CreateCard(db, &Card{DeckName: "Spanish", Front: front, Back: "number"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct{ limit, want int }{{0, 3}, {-1, 3}, {2, 2}, {5, 3}} {
+		cards, err := GetDueCards(db, CardFilter{Deck: "Spanish"}, tt.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(cards) != tt.want {
+			t.Errorf("GetDueCards() with limit %d returned %d cards, want %d", tt.limit, len(cards), tt.want)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+// Quick add lets a browser extension or bookmarklet capture a card from
+// any web page. As those run on other origins, POST /api/quickadd answers
+// CORS requests from anywhere, and so it needs a token instead: the
+// QUICKADD_TOKEN environment variable, sent as "Authorization: Bearer
+// <token>", or with accounts an API token of the account. Without either
+// quick add is off. Cards keep the page they came from as their
+// source_url.
+
+var (
+	ErrQuickAddDisabled = errors.New("quick add is off; set the QUICKADD_TOKEN environment variable")
+	ErrQuickAddToken    = errors.New("missing or wrong quick add token")
+)
+
+// maxSourceURL bounds the length of a card's source URL.
+const maxSourceURL = 2048
+
+// QuickAddRequest is a card captured from a web page.
+type QuickAddRequest struct {
+	Front     string   `json:"front"`
+	Back      string   `json:"back"`
+	Deck      string   `json:"deck"`
+	SourceURL string   `json:"source_url"`
+	Tags      []string `json:"tags"`
+}
+
+// checkQuickAddToken checks the bearer token of a quick add request. With
+// accounts, requireLogin has checked it is an API token.
+func checkQuickAddToken(r *http.Request) error {
+	if accounts != nil {
+		if requestAPIToken(r) == nil {
+			return ErrQuickAddToken
+		}
+		return nil
+	}
+	token := os.Getenv("QUICKADD_TOKEN")
+	if token == "" {
+		return ErrQuickAddDisabled
+	}
+	given, ok := bearerToken(r)
+	if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+		return ErrQuickAddToken
+	}
+	return nil
+}
+
+// allowCORS lets pages on any origin call an endpoint with a bearer
+// token. It reports whether the request was a preflight, which it has
+// answered.
+func allowCORS(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method != "OPTIONS" {
+		return false
+	}
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+	w.Header().Set("Access-Control-Max-Age", "86400")
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// validateSourceURL checks the page a card was captured from: an http or
+// https URL.
+func validateSourceURL(raw string) error {
+	if raw == "" {
+		return nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || len(raw) > maxSourceURL {
+		return errors.New("source_url must be an http or https URL of at most 2048 characters")
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rate limiting keeps a server on the internet from being flooded or
+// having passwords guessed: each client gets a number of API requests a
+// minute, and fewer of the expensive ones that read or write the whole
+// collection, call out to an LLM or dictionary, or hash a password.
+// Requests count against their IP address, and those with a token against
+// the token as well, so a leaked token is limited wherever it is used.
+// Requests over a limit get 429 Too Many Requests with Retry-After.
+
+var (
+	// rateLimit is how many API requests a client may make a minute, 0
+	// for no limit, set from -rate-limit in main.
+	rateLimit = 0
+	// expensiveRateLimit is how many expensiveRequest requests a client
+	// may make a minute when rateLimit is set, 0 for no further limit, set
+	// from -rate-limit-expensive.
+	expensiveRateLimit = 10
+	// trustProxy takes a client's IP address from the X-Forwarded-For
+	// header of a reverse proxy, set from -trust-proxy.
+	trustProxy = false
+)
+
+// expensivePaths are the endpoints counted against expensiveRateLimit,
+// along with everything under /api/import/ but import jobs and under
+// /api/export/.
+var expensivePaths = map[string]bool{
+	"/api/import":           true,
+	"/api/search":           true,
+	"/api/generate":         true,
+	"/api/review/grade":     true,
+	"/api/lookup":           true,
+	"/api/cards/duplicates": true,
+	"/api/login":            true,
+	"/api/register":         true,
+}
+
+func expensiveRequest(path string) bool {
+	return expensivePaths[path] || strings.HasPrefix(path, "/api/export/") ||
+		strings.HasPrefix(path, "/api/import/") && !strings.HasPrefix(path, "/api/import/jobs/")
+}
+
+// bucket is a token bucket of one client.
+type bucket struct {
+	tokens float64
+	seen   time.Time
+}
+
+// rateLimiter gives each client perMinute requests a minute, up to
+// perMinute at once.
+type rateLimiter struct {
+	perMinute int
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+func newRateLimiter(perMinute int) *rateLimiter {
+	return &rateLimiter{perMinute: perMinute, buckets: map[string]*bucket{}, lastSweep: time.Now()}
+}
+
+// wait returns 0 if a request of a client is allowed, or else how long
+// until it would be.
+func (l *rateLimiter) wait(client string, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	perSecond := float64(l.perMinute) / 60
+	// Buckets that have filled up again are the same as none
+	if now.Sub(l.lastSweep) >= time.Minute {
+		for c, b := range l.buckets {
+			if now.Sub(b.seen).Seconds()*perSecond+b.tokens >= float64(l.perMinute) {
+				delete(l.buckets, c)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &bucket{tokens: float64(l.perMinute), seen: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(float64(l.perMinute), b.tokens+now.Sub(b.seen).Seconds()*perSecond)
+	b.seen = now
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / perSecond * float64(time.Second))
+	}
+	return 0
+}
+
+// take takes a request that wait allowed from the client's bucket.
+func (l *rateLimiter) take(client string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if b, ok := l.buckets[client]; ok {
+		b.tokens--
+	}
+}
+
+// rateLimitClients returns who a request counts against: its IP address
+// and its API or quick add token, if any.
+func rateLimitClients(r *http.Request) []string {
+	clients := []string{clientIP(r)}
+	if token, ok := bearerToken(r); ok {
+		clients = append(clients, "token "+hashToken(token))
+	}
+	return clients
+}
+
+// clientIP returns the IP address a request came from.
+func clientIP(r *http.Request) string {
+	if trustProxy {
+		// The proxy adds the address it got the request from last
+		forwarded := r.Header.Values("X-Forwarded-For")
+		if len(forwarded) > 0 {
+			last := forwarded[len(forwarded)-1]
+			if i := strings.LastIndex(last, ","); i >= 0 {
+				last = last[i+1:]
+			}
+			if ip := strings.TrimSpace(last); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// limitRate wraps the routes in rate limiting of the API, if it is on.
+func limitRate(next http.Handler) http.Handler {
+	if rateLimit <= 0 {
+		return next
+	}
+	all := newRateLimiter(rateLimit)
+	var expensive *rateLimiter
+	if expensiveRateLimit > 0 {
+		expensive = newRateLimiter(expensiveRateLimit)
+	}
+
+	// Held from checking a request's buckets to taking from them, so that
+	// two requests can't both be let through on the last token
+	var mu sync.Mutex
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/api/") || r.Method == "OPTIONS" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		now := time.Now()
+		limiters := []*rateLimiter{all}
+		if expensive != nil && expensiveRequest(r.URL.Path) {
+			limiters = append(limiters, expensive)
+		}
+		clients := rateLimitClients(r)
+
+		// A request refused by one bucket takes nothing from the others
+		mu.Lock()
+		var wait time.Duration
+		for _, client := range clients {
+			for _, l := range limiters {
+				if d := l.wait(client, now); d > wait {
+					wait = d
+				}
+			}
+		}
+		if wait == 0 {
+			for _, client := range clients {
+				for _, l := range limiters {
+					l.take(client)
+				}
+			}
+		}
+		mu.Unlock()
+		if wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			respondError(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
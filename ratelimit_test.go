@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRefusedRequestsTakeNoTokens(t *testing.T) {
+	defer func(all, expensive int) { rateLimit, expensiveRateLimit = all, expensive }(rateLimit, expensiveRateLimit)
+	rateLimit, expensiveRateLimit = 2, 1
+	handler := limitRate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	// The second search is refused by the expensive limit, leaving the
+	// client one request of the general one
+	for i, tt := range []struct {
+		path string
+		want int
+	}{
+		{"/api/search", http.StatusOK},
+		{"/api/search", http.StatusTooManyRequests},
+		{"/api/cards", http.StatusOK},
+		{"/api/cards", http.StatusTooManyRequests},
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", tt.path, nil)
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("request %d to %s = %d, want %d", i+1, tt.path, w.Code, tt.want)
+		}
+	}
+}
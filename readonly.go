@@ -0,0 +1,50 @@
+package main
+
+import "net/http"
+
+// A read-only server publishes a collection, such as a reference deck or
+// a demo, without letting anyone change it: requests that would change
+// the collection are refused, while cards can still be browsed, studied
+// in cram mode, which leaves the schedule alone, and exported.
+
+// readOnly refuses every request that could change a collection, set from
+// -readonly in main.
+var readOnly bool
+
+// readOnlyPaths take POST requests that change no collection: they check
+// or suggest something, or log in and out.
+var readOnlyPaths = map[string]bool{
+	"/api/review/check":  true,
+	"/api/review/grade":  true,
+	"/api/cloze/suggest": true,
+	"/api/generate":      true,
+	"/api/login":         true,
+	"/api/logout":        true,
+}
+
+// requireWritable wraps the routes so that a read-only server answers 403
+// to requests that could change the collection.
+func requireWritable(next http.Handler) http.Handler {
+	if !readOnly {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !changesNothing(r) {
+			respondError(w, "The server is read-only", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// changesNothing reports whether a request leaves the collection as it is.
+func changesNothing(r *http.Request) bool {
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return true
+	}
+	if r.URL.Path == "/api/review" && r.URL.Query().Get("mode") == "cram" {
+		return true
+	}
+	return readOnlyPaths[r.URL.Path]
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireWritable(t *testing.T) {
+	defer func(b bool) { readOnly = b }(readOnly)
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		method, target string
+		want           int
+	}{
+		{"GET", "/api/cards", http.StatusOK},
+		{"HEAD", "/api/cards", http.StatusOK},
+		{"OPTIONS", "/api/cards", http.StatusOK},
+		{"POST", "/api/cards", http.StatusForbidden},
+		{"PUT", "/api/cards/1", http.StatusForbidden},
+		{"PATCH", "/api/cards/1", http.StatusForbidden},
+		{"DELETE", "/api/cards/1", http.StatusForbidden},
+		{"POST", "/api/review", http.StatusForbidden},
+		{"POST", "/api/review?mode=cram", http.StatusOK},
+		{"POST", "/api/review/check", http.StatusOK},
+		{"POST", "/api/login", http.StatusOK},
+		{"POST", "/api/review/undo", http.StatusForbidden},
+	}
+
+	readOnly = false
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		requireWritable(next).ServeHTTP(w, httptest.NewRequest(tt.method, tt.target, nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("without -readonly, %s %s = %d", tt.method, tt.target, w.Code)
+		}
+	}
+
+	readOnly = true
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		requireWritable(next).ServeHTTP(w, httptest.NewRequest(tt.method, tt.target, nil))
+		if w.Code != tt.want {
+			t.Errorf("%s %s = %d, want %d", tt.method, tt.target, w.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// Recomputing replays the review history of cards under their deck's
+// current settings, for when the settings changed enough that the old
+// schedule no longer fits them. The review log itself is left as it was.
+
+// ScheduleChange is a card whose schedule recomputing changes, with its
+// scheduling state before and after.
+type ScheduleChange struct {
+	ID            int       `json:"id"`
+	DeckName      string    `json:"deck_name"`
+	Front         string    `json:"front"`
+	State         string    `json:"state"`
+	Interval      int       `json:"interval"`
+	Ease          float64   `json:"ease"`
+	NextReview    time.Time `json:"next_review"`
+	NewState      string    `json:"new_state"`
+	NewInterval   int       `json:"new_interval"`
+	NewEase       float64   `json:"new_ease"`
+	NewNextReview time.Time `json:"new_next_review"`
+}
+
+// RecomputeSchedules replays the answers of the selected cards that have
+// been studied and reschedules them as if their deck's current settings
+// had applied all along, returning the cards whose schedule changes. New
+// cards, including forgotten ones, and cards without reviews are left
+// alone. A dry run changes nothing.
+func RecomputeSchedules(db *Collection, sel CardSelection, dryRun bool) ([]ScheduleChange, error) {
+	where, args, err := sel.where()
+	if err != nil {
+		return nil, err
+	}
+	where = append(where, `state != 'new'`)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT `+cardColumns+` FROM cards`+whereClause(where)+` ORDER BY id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	cards, err := scanCards(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	history := map[int][]ReviewLog{}
+	rows, err = tx.Query(
+		`SELECT `+reviewLogColumns+` FROM review_log
+		 WHERE card_id IN (SELECT id FROM cards`+whereClause(where)+`)
+		 ORDER BY card_id, reviewed_at, id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var l ReviewLog
+		if err := scanReviewLog(rows, &l); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		history[l.CardID] = append(history[l.CardID], l)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	changes := []ScheduleChange{}
+	for i := range cards {
+		card := &cards[i]
+		logs := history[card.ID]
+		if len(logs) == 0 {
+			continue
+		}
+		settings, err := getCardSettings(tx, card)
+		if err != nil {
+			return nil, err
+		}
+
+		next := replaySchedule(*card, logs, settings)
+		if next.State == card.State && next.Step == card.Step && next.Interval == card.Interval &&
+			math.Abs(next.Ease-card.Ease) < 1e-9 && next.NextReview.Equal(card.NextReview) {
+			continue
+		}
+		changes = append(changes, ScheduleChange{
+			ID: card.ID, DeckName: card.DeckName, Front: card.Front,
+			State: card.State, Interval: card.Interval, Ease: card.Ease, NextReview: card.NextReview,
+			NewState: next.State, NewInterval: next.Interval, NewEase: next.Ease, NewNextReview: next.NextReview,
+		})
+		if dryRun {
+			continue
+		}
+		if err := updateCard(tx, &next); err != nil {
+			return nil, err
+		}
+	}
+
+	if dryRun {
+		return changes, nil
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// replaySchedule returns card scheduled by answering it as in logs, oldest
+// first, with settings. The replay starts from the state the card had
+// before its first logged answer, and over again from the start whenever
+// it was answered as a new card, as after being forgotten. The lapse
+// count is kept.
+//
+// Intervals are replayed without fuzz. If the last answer passed a review
+// card, its interval is fuzzed like a fresh answer, unless the card's
+// current interval already lies within the fuzz range, in which case the
+// card keeps its schedule.
+func replaySchedule(card Card, logs []ReviewLog, settings SchedulerSettings) Card {
+	unfuzzed := settings
+	unfuzzed.FuzzPercent = 0
+
+	next := card
+	passed := false
+	for i, l := range logs {
+		if i == 0 || l.StateBefore == StateNew {
+			next.State, next.Step, next.Interval, next.Ease = l.StateBefore, l.StepBefore, l.IntervalBefore, l.EaseBefore
+			if l.StateBefore == StateNew {
+				next.Step, next.Interval, next.Ease = 0, 0, settings.StartingEase
+			}
+		}
+
+		if next.State == StateReview {
+			scheduleReview(&next, l.Score, unfuzzed, l.ReviewedAt)
+			passed = next.State == StateReview
+		} else {
+			scheduleLearning(&next, l.Score, unfuzzed, l.ReviewedAt)
+			passed = false
+		}
+	}
+
+	if passed {
+		lo, hi := fuzzRange(next.Interval, settings.FuzzPercent)
+		if card.State == StateReview && card.Interval >= lo && card.Interval <= hi {
+			next.Interval, next.NextReview = card.Interval, card.NextReview
+		} else {
+			next.Interval = clampInterval(fuzzInterval(next.Interval, settings.FuzzPercent), settings)
+			next.NextReview = dueAfterDays(logs[len(logs)-1].ReviewedAt, next.Interval)
+		}
+	}
+	next.Lapses = card.Lapses
+	next.NextReview = next.NextReview.In(time.Local)
+	return next
+}
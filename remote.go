@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var ErrRemoteFetch = errors.New("could not fetch import URL")
+
+// remoteClient fetches import URLs. It only connects to public addresses,
+// so an import cannot be used to reach the server's own network.
+var remoteClient = &http.Client{
+	Timeout: 30 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: publicAddressOnly,
+		}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+}
+
+// nonPublicPrefixes are the address ranges that don't reach the public
+// internet: loopback, private, shared (CGNAT, used by Tailscale), link-local,
+// benchmarking, documentation and reserved ranges, multicast, and the IPv6
+// ranges that embed IPv4 addresses, such as NAT64, which could map to any
+// of them.
+var nonPublicPrefixes = func() []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, p := range []string{
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+		"172.16.0.0/12", "192.0.0.0/24", "192.0.2.0/24", "192.88.99.0/24", "192.168.0.0/16",
+		"198.18.0.0/15", "198.51.100.0/24", "203.0.113.0/24", "224.0.0.0/4", "240.0.0.0/4",
+		"::/128", "::1/128", "::ffff:0:0/96", "64:ff9b::/96", "64:ff9b:1::/48", "100::/64",
+		"2001::/32", "2001:db8::/32", "2002::/16", "fc00::/7", "fe80::/10", "fec0::/10", "ff00::/8",
+	} {
+		prefixes = append(prefixes, netip.MustParsePrefix(p))
+	}
+	return prefixes
+}()
+
+// publicAddress reports whether an IP address is on the public internet.
+// IPv4 addresses written as IPv6 are checked as IPv4.
+func publicAddress(addr netip.Addr) bool {
+	addr = addr.Unmap().WithZone("")
+	for _, p := range nonPublicPrefixes {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+	return addr.IsValid()
+}
+
+// publicAddressOnly refuses connections to addresses that aren't public
+// (see nonPublicPrefixes). It runs after name resolution, so it also
+// covers names resolving to such addresses and redirects to them.
+func publicAddressOnly(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil || !publicAddress(addr) {
+		return fmt.Errorf("%w: %s is not a public address", ErrRemoteFetch, host)
+	}
+	return nil
+}
+
+// googleSheet matches the editing link of a Google Sheets spreadsheet.
+var googleSheet = regexp.MustCompile(`^/spreadsheets/d/([\w-]+)(/.*)?$`)
+
+// remoteCSVURL turns Google Sheets links into their CSV download: an
+// editing link of a sheet shared by link becomes its export URL for the
+// same tab, and a "publish to web" link asks for CSV output. Other URLs
+// are returned unchanged.
+func remoteCSVURL(u *url.URL) *url.URL {
+	if u.Host != "docs.google.com" {
+		return u
+	}
+	out := *u
+	out.Fragment = ""
+
+	// Published sheets live under /spreadsheets/d/e/
+	if strings.HasPrefix(u.Path, "/spreadsheets/d/e/") {
+		out.Path = strings.TrimSuffix(strings.TrimSuffix(u.Path, "/pubhtml"), "/pub") + "/pub"
+		q := u.Query()
+		q.Set("output", "csv")
+		out.RawQuery = q.Encode()
+		return &out
+	}
+
+	m := googleSheet.FindStringSubmatch(u.Path)
+	if m == nil {
+		return u
+	}
+	gid := u.Query().Get("gid")
+	if frag, err := url.ParseQuery(u.Fragment); err == nil && frag.Get("gid") != "" {
+		gid = frag.Get("gid")
+	}
+	out.Path = "/spreadsheets/d/" + m[1] + "/export"
+	q := url.Values{"format": {"csv"}}
+	if gid != "" {
+		q.Set("gid", gid)
+	}
+	out.RawQuery = q.Encode()
+	return &out
+}
+
+// fetchRemoteCSV downloads a published CSV or TSV file for import and
+// returns it with its delimiter, taken from the content type or the URL.
+func fetchRemoteCSV(rawURL string) ([]byte, rune, error) {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, 0, fmt.Errorf("%w: url must be an http or https URL", ErrInvalidImport)
+	}
+	u = remoteCSVURL(u)
+
+	resp, err := remoteClient.Get(u.String())
+	if err != nil {
+		if errors.Is(err, ErrRemoteFetch) {
+			return nil, 0, err
+		}
+		return nil, 0, fmt.Errorf("%w: %v", ErrRemoteFetch, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("%w: server answered %s", ErrRemoteFetch, resp.Status)
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType == "text/html" {
+		// Private Google Sheets answer with a sign-in page
+		return nil, 0, fmt.Errorf("%w: URL gave a web page, not CSV; publish or share the sheet so anyone with the link can view it", ErrInvalidImport)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxImportUpload+1))
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: %v", ErrRemoteFetch, err)
+	}
+	if len(data) > maxImportUpload {
+		return nil, 0, fmt.Errorf("%w: file is larger than %d MB", ErrInvalidImport, maxImportUpload>>20)
+	}
+
+	delimiter := ','
+	if mediaType == "text/tab-separated-values" || strings.HasSuffix(strings.ToLower(u.Path), ".tsv") ||
+		u.Query().Get("output") == "tsv" || u.Query().Get("format") == "tsv" {
+		delimiter = '\t'
+	}
+	return data, delimiter, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"strings"
+)
+
+// Cards are shown as HTML made from their note type's templates, so every
+// client presents them the same way. A template's front_html and back_html
+// default to its text sides, with the back showing the front above an
+// <hr id="answer"> the way Anki does. Field values are rendered from
+// Markdown; the back can include the rendered front with {{FrontSide}}.
+// The rendered HTML and the CSS are sanitized (see sanitize.go).
+
+// defaultCardCSS styles note types that bring no CSS of their own.
+const defaultCardCSS = `.card {
+  font-family: arial;
+  font-size: 20px;
+  text-align: center;
+  color: black;
+  background-color: white;
+}
+
+.card pre {
+  text-align: left;
+  overflow-x: auto;
+}`
+
+// frontSideField is the placeholder for the rendered front on the back.
+const frontSideField = "FrontSide"
+
+// CardRender is a card's front and back as HTML, each wrapped in a
+// <div class="card"> for the note type's CSS to style.
+type CardRender struct {
+	CardID   int    `json:"card_id"`
+	NoteType string `json:"note_type"`
+	Template string `json:"template"`
+	Front    string `json:"front"`
+	Back     string `json:"back"`
+	CSS      string `json:"css"`
+	Math     bool   `json:"math"` // Front or back has math to typeset
+}
+
+// htmlSides returns the template's HTML sides.
+func (t CardTemplate) htmlSides() (string, string) {
+	front, back := t.FrontHTML, t.BackHTML
+	if front == "" {
+		front = strings.ReplaceAll(t.Front, "\n", "<br>")
+	}
+	if back == "" {
+		back = "{{" + frontSideField + "}}\n\n<hr id=\"answer\">\n\n" + strings.ReplaceAll(t.Back, "\n", "<br>")
+	}
+	return front, back
+}
+
+// renderHTML fills an HTML template side with field values rendered from
+// Markdown (see markdownhtml.go), and {{FrontSide}} with frontSide as is.
+func renderHTML(side string, fields map[string]string, frontSide string) string {
+	return strings.TrimSpace(templateField.ReplaceAllStringFunc(side, func(m string) string {
+		name := templateField.FindStringSubmatch(m)[1]
+		if name == frontSideField {
+			return frontSide
+		}
+		return renderMarkdown(fields[name])
+	}))
+}
+
+// RenderCard renders a card through its note type's HTML templates. Cards
+// without a note render as Basic notes of their front and back.
+func RenderCard(db *Collection, id int) (*CardRender, error) {
+	card, err := GetCard(db, id)
+	if err != nil {
+		return nil, err
+	}
+
+	nt, err := getNoteType(db, DefaultNoteType)
+	if err != nil {
+		return nil, err
+	}
+	fields := map[string]string{"Front": card.Front, "Back": card.Back}
+	if card.NoteID != nil {
+		note, err := GetNote(db, *card.NoteID)
+		if err != nil {
+			return nil, err
+		}
+		if nt, err = getNoteType(db, note.NoteType); err != nil {
+			return nil, err
+		}
+		fields = note.Fields
+	}
+
+	var front, back string
+	switch nt.Kind {
+	case noteKindOcclusion:
+		if front, back, err = occlusionHTML(fields, card.Template); err != nil {
+			return nil, err
+		}
+	case noteKindCloze:
+		if front, back, err = clozeHTML(fields, card.Template); err != nil {
+			return nil, err
+		}
+	default:
+		if card.Template >= len(nt.Templates) {
+			return nil, ErrInvalidNote
+		}
+		frontHTML, backHTML := nt.Templates[card.Template].htmlSides()
+		front = renderHTML(frontHTML, fields, "")
+		back = renderHTML(backHTML, fields, front)
+	}
+	front, back = sanitizeCardHTML(front), sanitizeCardHTML(back)
+	css := sanitizeCardCSS(nt.CSS)
+	if css == "" {
+		css = defaultCardCSS
+	}
+	if strings.Contains(front+back, codeClass) {
+		css += "\n\n" + codeCSS()
+	}
+	return &CardRender{
+		CardID:   card.ID,
+		NoteType: nt.Name,
+		Template: nt.cardName(card.Template),
+		Front:    `<div class="card">` + front + `</div>`,
+		Back:     `<div class="card">` + back + `</div>`,
+		CSS:      css,
+		Math:     strings.Contains(front+back, mathClass),
+	}, nil
+}
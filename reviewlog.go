@@ -0,0 +1,269 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ReviewLog records the scheduling state of a card before and after one review.
+type ReviewLog struct {
+	ID               int       `json:"id"`
+	CardID           int       `json:"card_id"`
+	Score            int       `json:"score"`
+	IntervalBefore   int       `json:"interval_before"`
+	IntervalAfter    int       `json:"interval_after"`
+	EaseBefore       float64   `json:"ease_before"`
+	EaseAfter        float64   `json:"ease_after"`
+	NextReviewBefore time.Time `json:"next_review_before"`
+	NextReviewAfter  time.Time `json:"next_review_after"`
+	ReviewedAt       time.Time `json:"reviewed_at"`
+	TimeTakenMs      int       `json:"time_taken_ms"`
+	StateBefore      string    `json:"state_before"`
+	StepBefore       int       `json:"step_before"`
+
+	// What the review changed besides scheduling, so that it can be undone
+	suspendedBefore bool
+	deckBefore      string
+	homeDeckBefore  string
+	buriedSiblings  string // Space-separated IDs of the siblings it buried
+	leechAdded      bool   // Whether it tagged the card as a leech
+}
+
+// reviewLogColumns lists the columns scanned by scanReviewLog, in order.
+const reviewLogColumns = `id, card_id, score, interval_before, interval_after, ease_before, ease_after,
+	next_review_before, next_review_after, reviewed_at, time_taken_ms, state_before, step_before,
+	suspended_before, deck_before, home_deck_before, buried_siblings, leech_added`
+
+func scanReviewLog(row scanner, l *ReviewLog) error {
+	return row.Scan(&l.ID, &l.CardID, &l.Score, &l.IntervalBefore, &l.IntervalAfter, &l.EaseBefore, &l.EaseAfter,
+		&l.NextReviewBefore, &l.NextReviewAfter, &l.ReviewedAt, &l.TimeTakenMs, &l.StateBefore, &l.StepBefore,
+		&l.suspendedBefore, &l.deckBefore, &l.homeDeckBefore, &l.buriedSiblings, &l.leechAdded)
+}
+
+// SubmitReview schedules the card for its next review and records the
+// change in the review log, all in one transaction.
+func SubmitReview(db *Collection, result ReviewResult) (*Card, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	card, err := getCard(tx, result.CardID)
+	if err != nil {
+		return nil, err
+	}
+	before := *card
+
+	if result.TimeMs < 0 {
+		result.TimeMs = 0
+	}
+
+	settings, err := getCardSettings(tx, card)
+	if err != nil {
+		return nil, err
+	}
+	if limit := settings.MaxAnswerSeconds * 1000; result.TimeMs > limit {
+		result.TimeMs = limit
+	}
+	if settings.LoadBalance && card.State == StateReview {
+		// Balancing takes the place of fuzz for the review interval
+		unfuzzed := settings
+		unfuzzed.FuzzPercent = 0
+		CalculateNextReview(card, result.Score, unfuzzed)
+		if card.State == StateReview {
+			if err := balanceReview(tx, card, settings); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		CalculateNextReview(card, result.Score, settings)
+	}
+
+	// Once out of learning, a card in a filtered deck goes back home
+	if card.HomeDeck != "" && card.State != StateLearning && card.State != StateRelearning {
+		card.DeckName = card.HomeDeck
+		card.HomeDeck = ""
+	}
+
+	var leechAdded bool
+	if card.Lapses > before.Lapses && isLeech(card.Lapses, settings) {
+		if err := addCardTag(tx, card.ID, LeechTag); err != nil {
+			return nil, err
+		}
+		leechAdded = !slices.Contains(before.Tags, LeechTag)
+		if settings.LeechSuspend {
+			card.Suspended = true
+		}
+	}
+
+	if err := updateCard(tx, card); err != nil {
+		return nil, err
+	}
+	var buried []string
+	if card.NoteID != nil && settings.BurySiblings {
+		if buried, err = burySiblings(tx, card); err != nil {
+			return nil, err
+		}
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO review_log (card_id, score, interval_before, interval_after, ease_before, ease_after,
+		                         next_review_before, next_review_after, reviewed_at, time_taken_ms,
+		                         state_before, step_before, suspended_before, deck_before, home_deck_before,
+		                         buried_siblings, leech_added)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		card.ID, result.Score, before.Interval, card.Interval, before.Ease, card.Ease,
+		before.NextReview, card.NextReview, time.Now(), result.TimeMs,
+		before.State, before.Step, before.Suspended, before.DeckName, before.HomeDeck,
+		strings.Join(buried, " "), leechAdded,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return card, nil
+}
+
+// burySiblings buries the other new and review cards of card's note that
+// would otherwise come up before the next study day, returning their IDs.
+func burySiblings(q querier, card *Card) ([]string, error) {
+	now := time.Now()
+	until := dueAfterDays(now, 1)
+	rows, err := q.Query(
+		`UPDATE cards SET buried_until = ?, updated_at = CURRENT_TIMESTAMP
+		 WHERE note_id = ? AND id != ? AND state IN ('new', 'review') AND suspended = 0 AND next_review < ?
+		   AND (buried_until IS NULL OR buried_until <= ?)
+		 RETURNING id`,
+		until, *card.NoteID, card.ID, until, now,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, strconv.Itoa(id))
+	}
+	return ids, rows.Err()
+}
+
+// UndoLastReview reverts the most recent review of a card that still exists:
+// the card's scheduling state, suspension and deck are restored from the
+// log, siblings the review buried are unburied, a leech tag it added is
+// removed, and so is the log entry. Returns sql.ErrNoRows if there is nothing to undo.
+func UndoLastReview(db *Collection) (*Card, *ReviewLog, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	var l ReviewLog
+	err = scanReviewLog(tx.QueryRow(
+		`SELECT `+reviewLogColumns+` FROM review_log
+		 WHERE card_id IN (SELECT id FROM cards)
+		 ORDER BY reviewed_at DESC, id DESC LIMIT 1`,
+	), &l)
+	if err != nil {
+		return nil, nil, err
+	}
+	card, err := getCard(tx, l.CardID)
+	if err != nil {
+		return nil, nil, err
+	}
+	card.Ease = l.EaseBefore
+	card.Interval = l.IntervalBefore
+	card.NextReview = l.NextReviewBefore
+	card.State = l.StateBefore
+	card.Step = l.StepBefore
+	card.Suspended = l.suspendedBefore
+	if l.StateBefore == StateReview && l.Score < 3 {
+		// The undone answer was a lapse
+		card.Lapses--
+	}
+	if l.leechAdded {
+		_, err := tx.Exec(
+			`DELETE FROM card_tags WHERE card_id = ? AND tag_id IN (SELECT id FROM tags WHERE name = ?)`,
+			card.ID, LeechTag,
+		)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// A card the review sent home from a filtered deck goes back to it,
+	// if it is still home and the filtered deck still exists
+	if l.homeDeckBefore != "" && card.HomeDeck == "" && card.DeckName == l.homeDeckBefore {
+		if _, err := getFilteredDeck(tx, l.deckBefore); err == nil {
+			card.DeckName, card.HomeDeck = l.deckBefore, l.homeDeckBefore
+		} else if !errors.Is(err, ErrDeckNotFound) {
+			return nil, nil, err
+		}
+	}
+
+	if err := updateCard(tx, card); err != nil {
+		return nil, nil, err
+	}
+	for _, id := range strings.Fields(l.buriedSiblings) {
+		_, err := tx.Exec(`UPDATE cards SET buried_until = NULL, updated_at = CURRENT_TIMESTAMP WHERE id = ?`, id)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if _, err := tx.Exec(`DELETE FROM review_log WHERE id = ?`, l.ID); err != nil {
+		return nil, nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, nil, err
+	}
+	return card, &l, nil
+}
+
+// GetProjections returns when a card would be due again after each answer.
+func GetProjections(db *Collection, cardID int) ([]Projection, error) {
+	card, err := getCard(db, cardID)
+	if err != nil {
+		return nil, err
+	}
+	settings, err := getCardSettings(db, card)
+	if err != nil {
+		return nil, err
+	}
+	return ProjectIntervals(*card, settings), nil
+}
+
+// GetReviewLogs returns the review history of a card, oldest first.
+func GetReviewLogs(db *Collection, cardID int) ([]ReviewLog, error) {
+	rows, err := db.Query(
+		`SELECT `+reviewLogColumns+` FROM review_log WHERE card_id = ? ORDER BY reviewed_at, id`,
+		cardID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	logs := []ReviewLog{}
+	for rows.Next() {
+		var l ReviewLog
+		if err := scanReviewLog(rows, &l); err != nil {
+			return nil, err
+		}
+		logs = append(logs, l)
+	}
+
+	return logs, rows.Err()
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestUndoLastReviewRestoresCards(t *testing.T) {
+	db := openTestCollection(t)
+	settings, err := GetDeckSettings(db, "Spanish")
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings.BurySiblings = true
+	settings.LeechThreshold = 1
+	settings.LeechSuspend = true
+	if err := SaveDeckSettings(db, "Spanish", settings); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CreateCard(db, &Card{DeckName: "Spanish", Front: "hola", Back: "hello", Reverse: true}); err != nil {
+		t.Fatal(err)
+	}
+	cards, _, err := GetAllCards(db, CardFilter{Deck: "Spanish"}, ListOptions{})
+	if err != nil || len(cards) != 2 {
+		t.Fatalf("note made %d cards (%v), want 2", len(cards), err)
+	}
+	// A review card, due now, with its new sibling
+	card := &cards[0]
+	card.State, card.Interval, card.NextReview = StateReview, 10, time.Now().Add(-time.Hour)
+	if err := updateCard(db, card); err != nil {
+		t.Fatal(err)
+	}
+
+	// snapshot returns both cards, without what an undo leaves changed
+	snapshot := func() []*Card {
+		t.Helper()
+		var got []*Card
+		for _, c := range cards {
+			c, err := GetCard(db, c.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.UpdatedAt = time.Time{}
+			got = append(got, c)
+		}
+		return got
+	}
+	roundTrip := func(name string, score int, changed func(before, after []*Card) bool) {
+		t.Helper()
+		before := snapshot()
+		if _, err := SubmitReview(db, ReviewResult{CardID: card.ID, Score: score}); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if after := snapshot(); !changed(before, after) {
+			t.Fatalf("%s: the review didn't change what it should: %+v", name, after[0])
+		}
+		if _, _, err := UndoLastReview(db); err != nil {
+			t.Fatalf("%s: undo: %v", name, err)
+		}
+		if after := snapshot(); !reflect.DeepEqual(before, after) {
+			t.Errorf("%s: undo left\n%+v\n%+v\nwant\n%+v\n%+v", name, after[0], after[1], before[0], before[1])
+		}
+	}
+
+	// Sent home from a filtered deck, burying its sibling
+	if err := CreateFilteredDeck(db, &FilteredDeck{Name: "Cram", Query: "deck:Spanish is:review"}); err != nil {
+		t.Fatal(err)
+	}
+	roundTrip("going home", 4, func(before, after []*Card) bool {
+		return after[0].DeckName == "Spanish" && after[0].HomeDeck == "" && after[1].BuriedUntil != nil
+	})
+
+	// A lapse tagging and suspending it as a leech
+	roundTrip("leech", 1, func(before, after []*Card) bool {
+		return after[0].Suspended && after[0].Lapses == before[0].Lapses+1 &&
+			reflect.DeepEqual(after[0].Tags, []string{LeechTag})
+	})
+
+	// A lapse of a card already suspended and tagged as a leech
+	if _, err := SetSuspended(db, card.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := AddCardTags(db, card.ID, []string{LeechTag}); err != nil {
+		t.Fatal(err)
+	}
+	roundTrip("suspended leech lapse", 1, func(before, after []*Card) bool {
+		return after[0].Lapses == before[0].Lapses+1
+	})
+}
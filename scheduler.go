@@ -0,0 +1,544 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Card states
+const (
+	StateNew        = "new"
+	StateLearning   = "learning"
+	StateReview     = "review"
+	StateRelearning = "relearning"
+)
+
+// Orders new cards are introduced in
+const (
+	NewOrderCreated  = "created"
+	NewOrderRandom   = "random"
+	NewOrderPosition = "position"
+)
+
+// New/review orders of a review session
+const (
+	NewReviewMix    = "mix"
+	NewReviewAfter  = "after"
+	NewReviewBefore = "before"
+)
+
+// Steps is a list of learning step delays. It is written to JSON as
+// strings like "10m" or "1d".
+type Steps []time.Duration
+
+// SchedulerSettings holds the tunable parts of the scheduler. The
+// collection-wide defaults come from flags; decks may override them.
+type SchedulerSettings struct {
+	// StartingEase is the ease given to newly created cards.
+	StartingEase float64 `json:"starting_ease"`
+
+	// MinEase and MaxEase bound the ease of review cards.
+	MinEase float64 `json:"min_ease"`
+	MaxEase float64 `json:"max_ease"`
+
+	// Ease deltas applied to review cards for each answer.
+	EaseAgain float64 `json:"ease_again"`
+	EaseHard  float64 `json:"ease_hard"`
+	EaseGood  float64 `json:"ease_good"`
+	EaseEasy  float64 `json:"ease_easy"`
+
+	// IntervalModifier scales every review interval (1.0 = unchanged).
+	IntervalModifier float64 `json:"interval_modifier"`
+
+	// MaxInterval caps review intervals, in days. Lower it (e.g. to 180)
+	// to keep everything in rotation until an exam.
+	MaxInterval int `json:"max_interval"`
+
+	// LearningSteps are the delays a new card goes through before it
+	// graduates to day-based review intervals.
+	LearningSteps Steps `json:"learning_steps"`
+
+	// RelearningSteps are the delays a lapsed review card goes through
+	// before returning to review.
+	RelearningSteps Steps `json:"relearning_steps"`
+
+	// NewIntervalPercent is the share of the old interval a lapsed card
+	// keeps once it has been relearned (0 starts over at 1 day).
+	NewIntervalPercent float64 `json:"new_interval_percent"`
+
+	// FuzzPercent spreads review intervals of 3 days or more randomly by up
+	// to this share, so cards answered together drift apart.
+	FuzzPercent float64 `json:"fuzz_percent"`
+
+	// LoadBalance picks the day within the fuzz range with the fewest
+	// reviews due instead of a random one, avoiding EasyDays, lowercase
+	// weekday names such as "sunday", where it can (see balance.go).
+	LoadBalance bool     `json:"load_balance"`
+	EasyDays    []string `json:"easy_days"`
+
+	// NewCardsPerDay and ReviewsPerDay are the daily limits of the deck.
+	NewCardsPerDay int `json:"new_cards_per_day"`
+	ReviewsPerDay  int `json:"reviews_per_day"`
+
+	// NewCardOrder is the order new cards are introduced in: by creation,
+	// at random, or by their position (see RepositionCards).
+	NewCardOrder string `json:"new_card_order"`
+
+	// NewReviewOrder is where a review session puts new cards: mixed in
+	// among the reviews, after them or before them.
+	NewReviewOrder string `json:"new_review_order"`
+
+	// LeechThreshold is the number of lapses after which a card is tagged
+	// as a leech (0 disables leech detection). With LeechSuspend set,
+	// leeches are also suspended.
+	LeechThreshold int  `json:"leech_threshold"`
+	LeechSuspend   bool `json:"leech_suspend"`
+
+	// BurySiblings keeps a note's new and review cards apart: answering
+	// one buries the others until the next day, and the queue serves only
+	// one of them at a time.
+	BurySiblings bool `json:"bury_siblings"`
+
+	// DailyGoal is the number of reviews a day to aim for (0 sets no goal).
+	DailyGoal int `json:"daily_goal"`
+
+	// MaxAnswerSeconds caps the time recorded for a review, so a card left
+	// on screen does not count as an hour of study.
+	MaxAnswerSeconds int `json:"max_answer_seconds"`
+
+	// Typed answers are compared with the back ignoring what these ask
+	// (see typeanswer.go).
+	AnswerIgnoreCase       bool `json:"answer_ignore_case"`
+	AnswerIgnoreWhitespace bool `json:"answer_ignore_whitespace"`
+	AnswerIgnoreDiacritics bool `json:"answer_ignore_diacritics"`
+}
+
+// schedulerSettings is the collection-wide default configuration, set from
+// flags in main.
+var schedulerSettings = SchedulerSettings{
+	StartingEase:       2.5,
+	MinEase:            1.3,
+	MaxEase:            5.0,
+	EaseAgain:          -0.2,
+	EaseHard:           -0.15,
+	EaseGood:           0,
+	EaseEasy:           0.15,
+	IntervalModifier:   1.0,
+	MaxInterval:        3650, // 10 years
+	LearningSteps:      Steps{1 * time.Minute, 10 * time.Minute},
+	RelearningSteps:    Steps{10 * time.Minute},
+	NewIntervalPercent: 0,
+	FuzzPercent:        5,
+	LoadBalance:        false,
+	EasyDays:           []string{},
+	NewCardsPerDay:     20,
+	ReviewsPerDay:      200,
+	NewCardOrder:       NewOrderCreated,
+	NewReviewOrder:     NewReviewMix,
+	LeechThreshold:     8,
+	LeechSuspend:       false,
+	BurySiblings:       true,
+	DailyGoal:          0,
+	MaxAnswerSeconds:   60,
+
+	AnswerIgnoreCase:       true,
+	AnswerIgnoreWhitespace: true,
+	AnswerIgnoreDiacritics: false,
+}
+
+// Study days start at dayStartHour in dayLocation rather than at midnight,
+// so late evening reviews still belong to that day. Set from flags in main.
+var (
+	dayStartHour = 4
+	dayLocation  = time.Local
+)
+
+// studyDayStart returns the start of the study day containing t, in dayLocation.
+func studyDayStart(t time.Time) time.Time {
+	local := t.In(dayLocation)
+	y, m, d := local.Date()
+	start := time.Date(y, m, d, dayStartHour, 0, 0, 0, dayLocation)
+	if local.Before(start) {
+		start = start.AddDate(0, 0, -1)
+	}
+	return start
+}
+
+// startOfDay returns the start of the study day containing t, in t's location.
+func startOfDay(t time.Time) time.Time {
+	return studyDayStart(t).In(t.Location())
+}
+
+// dueAfterDays returns when a card answered at now with an interval of days
+// becomes due: the start of the study day that many days later.
+func dueAfterDays(now time.Time, days int) time.Time {
+	return studyDayStart(now).AddDate(0, 0, days).In(now.Location())
+}
+
+// fuzzRand is the random source for interval fuzz. It is randomly seeded
+// unless SeedFuzz is called, which makes scheduling reproducible.
+var (
+	fuzzMu   sync.Mutex
+	fuzzRand = rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64()))
+)
+
+// SeedFuzz makes interval fuzz deterministic.
+func SeedFuzz(seed uint64) {
+	fuzzMu.Lock()
+	defer fuzzMu.Unlock()
+	fuzzRand = rand.New(rand.NewPCG(seed, seed))
+}
+
+// fuzzRange returns the shortest and longest intervals fuzz may turn an
+// interval into: for 3 days or more, up to percent of its length either
+// way (at least one day).
+func fuzzRange(days int, percent float64) (int, int) {
+	if days < 3 || percent <= 0 {
+		return days, days
+	}
+
+	spread := int(math.Round(float64(days) * percent / 100))
+	if spread < 1 {
+		spread = 1
+	}
+	return days - spread, days + spread
+}
+
+// fuzzInterval moves an interval by a random amount within its fuzzRange.
+func fuzzInterval(days int, percent float64) int {
+	lo, hi := fuzzRange(days, percent)
+	if lo == hi {
+		return days
+	}
+
+	fuzzMu.Lock()
+	defer fuzzMu.Unlock()
+	return lo + fuzzRand.IntN(hi-lo+1)
+}
+
+// Validate reports the first setting that is out of range.
+func (s SchedulerSettings) Validate() error {
+	switch {
+	case s.MinEase < 1:
+		return errors.New("min_ease must be at least 1.0")
+	case s.MaxEase < s.MinEase:
+		return errors.New("max_ease must not be below min_ease")
+	case s.StartingEase < s.MinEase || s.StartingEase > s.MaxEase:
+		return errors.New("starting_ease must be between min_ease and max_ease")
+	case s.IntervalModifier <= 0:
+		return errors.New("interval_modifier must be positive")
+	case s.MaxInterval < 1:
+		return errors.New("max_interval must be at least 1 day")
+	case s.NewIntervalPercent < 0 || s.NewIntervalPercent > 100:
+		return errors.New("new_interval_percent must be between 0 and 100")
+	case s.FuzzPercent < 0 || s.FuzzPercent > 25:
+		return errors.New("fuzz_percent must be between 0 and 25")
+	case s.easyDays() == nil:
+		return errors.New("easy_days must be weekday names such as sunday")
+	case s.NewCardsPerDay < 0:
+		return errors.New("new_cards_per_day cannot be negative")
+	case s.ReviewsPerDay < 0:
+		return errors.New("reviews_per_day cannot be negative")
+	case s.NewCardOrder != NewOrderCreated && s.NewCardOrder != NewOrderRandom && s.NewCardOrder != NewOrderPosition:
+		return errors.New("new_card_order must be created, random or position")
+	case s.NewReviewOrder != NewReviewMix && s.NewReviewOrder != NewReviewAfter && s.NewReviewOrder != NewReviewBefore:
+		return errors.New("new_review_order must be mix, after or before")
+	case s.LeechThreshold < 0:
+		return errors.New("leech_threshold cannot be negative")
+	case s.DailyGoal < 0:
+		return errors.New("daily_goal cannot be negative")
+	case s.MaxAnswerSeconds < 1:
+		return errors.New("max_answer_seconds must be at least 1")
+	}
+	return nil
+}
+
+// ParseSteps parses a comma-separated list of step durations such as
+// "1m,10m,1d". In addition to time.ParseDuration units, "d" means days.
+func ParseSteps(s string) (Steps, error) {
+	steps := Steps{}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		d, err := parseStep(part)
+		if err != nil {
+			return nil, err
+		}
+		steps = append(steps, d)
+	}
+	return steps, nil
+}
+
+func parseStep(s string) (time.Duration, error) {
+	var d time.Duration
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.ParseFloat(days, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid step %q", s)
+		}
+		d = time.Duration(n * float64(24*time.Hour))
+	} else {
+		var err error
+		d, err = time.ParseDuration(s)
+		if err != nil {
+			return 0, fmt.Errorf("invalid step %q", s)
+		}
+	}
+
+	if d <= 0 {
+		return 0, fmt.Errorf("step %q must be positive", s)
+	}
+	return d, nil
+}
+
+// formatStep writes a step in the largest whole unit, e.g. "1d" or "10m".
+func formatStep(d time.Duration) string {
+	switch {
+	case d%(24*time.Hour) == 0:
+		return strconv.FormatInt(int64(d/(24*time.Hour)), 10) + "d"
+	case d%time.Hour == 0:
+		return strconv.FormatInt(int64(d/time.Hour), 10) + "h"
+	case d%time.Minute == 0:
+		return strconv.FormatInt(int64(d/time.Minute), 10) + "m"
+	}
+	return d.String()
+}
+
+func (s Steps) String() string {
+	parts := make([]string, len(s))
+	for i, d := range s {
+		parts[i] = formatStep(d)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (s Steps) MarshalJSON() ([]byte, error) {
+	parts := make([]string, len(s))
+	for i, d := range s {
+		parts[i] = formatStep(d)
+	}
+	return json.Marshal(parts)
+}
+
+func (s *Steps) UnmarshalJSON(data []byte) error {
+	var parts []string
+	if err := json.Unmarshal(data, &parts); err != nil {
+		return errors.New("steps must be a list of durations like \"10m\" or \"1d\"")
+	}
+
+	steps := Steps{}
+	for _, part := range parts {
+		d, err := parseStep(strings.TrimSpace(part))
+		if err != nil {
+			return err
+		}
+		steps = append(steps, d)
+	}
+	*s = steps
+	return nil
+}
+
+// stepDelay returns the delay for learning step i. Without any configured
+// steps a failed card is retried after one minute.
+func stepDelay(steps Steps, i int) time.Duration {
+	if len(steps) == 0 {
+		return 1 * time.Minute
+	}
+	if i >= len(steps) {
+		i = len(steps) - 1
+	}
+	return steps[i]
+}
+
+// Simple SM-2 algorithm implementation with learning steps, using the
+// settings of the card's deck.
+func CalculateNextReview(card *Card, score int, settings SchedulerSettings) {
+	// score: 1=Again, 2=Hard, 3=Good, 4=Easy
+	now := time.Now()
+
+	if card.State == StateReview {
+		scheduleReview(card, score, settings, now)
+	} else {
+		scheduleLearning(card, score, settings, now)
+	}
+}
+
+// scheduleLearning moves a new, learning or relearning card through its
+// steps. Again restarts the steps, Hard repeats the current step, Good
+// advances to the next step and Easy graduates immediately.
+func scheduleLearning(card *Card, score int, settings SchedulerSettings, now time.Time) {
+	steps := settings.LearningSteps
+	if card.State == StateRelearning {
+		steps = settings.RelearningSteps
+	}
+
+	switch score {
+	case 1:
+		card.Step = 0
+	case 2:
+		// Hard - repeat the current step
+	case 3:
+		card.Step++
+	case 4:
+		graduate(card, settings, now)
+		return
+	}
+
+	if card.Step >= len(steps) {
+		graduate(card, settings, now)
+		return
+	}
+
+	if card.State != StateRelearning {
+		card.State = StateLearning
+		card.Interval = 0
+	}
+	card.NextReview = now.Add(stepDelay(steps, card.Step))
+}
+
+// graduate moves a card out of (re)learning into day-based review. Relearned
+// cards keep the interval assigned when they lapsed.
+func graduate(card *Card, settings SchedulerSettings, now time.Time) {
+	card.Interval = clampInterval(card.Interval, settings)
+	card.State = StateReview
+	card.Step = 0
+	card.NextReview = dueAfterDays(now, card.Interval)
+}
+
+// scheduleReview applies SM-2 to a graduated card.
+func scheduleReview(card *Card, score int, settings SchedulerSettings, now time.Time) {
+	if score < 3 {
+		// Failed: relearn, keeping a share of the old interval
+		card.State = StateRelearning
+		card.Step = 0
+		card.Lapses++
+		card.Interval = int(float64(card.Interval) * settings.NewIntervalPercent / 100)
+		if score == 1 {
+			card.Ease = clampEase(card.Ease+settings.EaseAgain, settings)
+		} else {
+			card.Ease = clampEase(card.Ease+settings.EaseHard, settings)
+		}
+		card.NextReview = now.Add(stepDelay(settings.RelearningSteps, 0))
+		return
+	}
+
+	// Passed: increase interval
+	if card.Interval == 0 {
+		card.Interval = 1
+	} else if card.Interval == 1 {
+		card.Interval = 6
+	} else {
+		card.Interval = int(float64(card.Interval) * card.Ease)
+	}
+	card.Interval = int(float64(card.Interval) * settings.IntervalModifier)
+	card.Interval = clampInterval(fuzzInterval(card.Interval, settings.FuzzPercent), settings)
+
+	// Adjust ease factor
+	if score == 3 {
+		card.Ease = clampEase(card.Ease+settings.EaseGood, settings)
+	} else if score == 4 {
+		card.Ease = clampEase(card.Ease+settings.EaseEasy, settings)
+	}
+
+	card.NextReview = dueAfterDays(now, card.Interval)
+}
+
+// Projection is when a card would be due again after an answer, for
+// labelling the answer buttons.
+type Projection struct {
+	Score   int    `json:"score"`
+	State   string `json:"state"`   // The card's state after the answer
+	Seconds int64  `json:"seconds"` // Until the card is due, a day per day of a review interval
+	Label   string `json:"label"`   // Such as "10m", "3d" or "1.5mo"
+}
+
+// ProjectIntervals returns the projection of each score for a card. Fuzz
+// is left out, as it is random, so review intervals may come out a little
+// different.
+func ProjectIntervals(card Card, settings SchedulerSettings) []Projection {
+	now := time.Now()
+	settings.FuzzPercent = 0
+	var projections []Projection
+	for score := 1; score <= 4; score++ {
+		next := card
+		if next.State == StateReview {
+			scheduleReview(&next, score, settings, now)
+		} else {
+			scheduleLearning(&next, score, settings, now)
+		}
+		d := next.NextReview.Sub(now)
+		if next.State == StateReview {
+			d = time.Duration(next.Interval) * 24 * time.Hour
+		}
+		projections = append(projections, Projection{Score: score, State: next.State, Seconds: int64(d / time.Second), Label: formatInterval(d)})
+	}
+	return projections
+}
+
+// formatInterval writes an interval briefly in its largest unit, as on
+// Anki's answer buttons: "45s", "10m", "2h", "3d", "1.5mo" or "2.1y".
+func formatInterval(d time.Duration) string {
+	day := 24 * time.Hour
+	unit := func(n float64, suffix string) string {
+		return strconv.FormatFloat(math.Round(n*10)/10, 'f', -1, 64) + suffix
+	}
+	switch {
+	case d < time.Minute:
+		return strconv.FormatInt(int64(d/time.Second), 10) + "s"
+	case d < time.Hour:
+		return strconv.FormatInt(int64(math.Round(d.Minutes())), 10) + "m"
+	case d < day:
+		return unit(d.Hours(), "h")
+	case d < 30*day:
+		return strconv.FormatInt(int64(math.Round(d.Hours()/24)), 10) + "d"
+	case d < 365*day:
+		return unit(d.Hours()/24/30, "mo")
+	default:
+		return unit(d.Hours()/24/365, "y")
+	}
+}
+
+// isLeech reports whether a card with the given number of lapses is a leech.
+func isLeech(lapses int, settings SchedulerSettings) bool {
+	return settings.LeechThreshold > 0 && lapses >= settings.LeechThreshold
+}
+
+// clampEase keeps an ease factor within the deck's bounds.
+func clampEase(ease float64, settings SchedulerSettings) float64 {
+	return min(max(ease, settings.MinEase), settings.MaxEase)
+}
+
+// clampInterval keeps a review interval between 1 day and the maximum.
+func clampInterval(days int, settings SchedulerSettings) int {
+	if days < 1 {
+		return 1
+	}
+	if settings.MaxInterval > 0 && days > settings.MaxInterval {
+		return settings.MaxInterval
+	}
+	return days
+}
+
+func max(a, b float64) float64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func min(a, b float64) float64 {
+	if a < b {
+		return a
+	}
+	return b
+}
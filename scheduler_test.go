@@ -0,0 +1,195 @@
+package main
+
+import (
+	"math"
+	"math/rand/v2"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestScheduleLearning(t *testing.T) {
+	settings := schedulerSettings
+	settings.LearningSteps = Steps{time.Minute, 10 * time.Minute, time.Hour}
+	now := time.Date(2026, 3, 2, 12, 0, 0, 0, time.Local)
+
+	tests := []struct {
+		score int
+		state string
+		step  int
+		due   time.Time
+	}{
+		{3, StateLearning, 1, now.Add(10 * time.Minute)},
+		{2, StateLearning, 1, now.Add(10 * time.Minute)},
+		{1, StateLearning, 0, now.Add(time.Minute)},
+		{3, StateLearning, 1, now.Add(10 * time.Minute)},
+		{3, StateLearning, 2, now.Add(time.Hour)},
+		{3, StateReview, 0, dueAfterDays(now, 1)},
+	}
+	card := &Card{State: StateNew, Ease: settings.StartingEase}
+	for i, tt := range tests {
+		scheduleLearning(card, tt.score, settings, now)
+		if card.State != tt.state || card.Step != tt.step || !card.NextReview.Equal(tt.due) {
+			t.Fatalf("answer %d (%d): %s step %d due %v, want %s step %d due %v",
+				i+1, tt.score, card.State, card.Step, card.NextReview, tt.state, tt.step, tt.due)
+		}
+	}
+	if card.Interval != 1 {
+		t.Errorf("graduated with an interval of %d days, want 1", card.Interval)
+	}
+
+	// Easy graduates from any step
+	card = &Card{State: StateNew, Ease: settings.StartingEase}
+	scheduleLearning(card, 4, settings, now)
+	if card.State != StateReview || card.Interval != 1 {
+		t.Errorf("easy left the card %s with an interval of %d days", card.State, card.Interval)
+	}
+
+	// Without steps, a card graduates on its first answer
+	settings.LearningSteps = Steps{}
+	card = &Card{State: StateNew, Ease: settings.StartingEase}
+	scheduleLearning(card, 3, settings, now)
+	if card.State != StateReview {
+		t.Errorf("without steps, good left the card %s", card.State)
+	}
+}
+
+func TestParseSteps(t *testing.T) {
+	steps, err := ParseSteps(" 1m, 10m,1h30m, 1d,,1.5d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Steps{time.Minute, 10 * time.Minute, 90 * time.Minute, 24 * time.Hour, 36 * time.Hour}
+	if !reflect.DeepEqual(steps, want) {
+		t.Errorf("ParseSteps = %v, want %v", steps, want)
+	}
+	if s := steps.String(); s != "1m,10m,90m,1d,36h" {
+		t.Errorf("String() = %q", s)
+	}
+
+	for _, s := range []string{"10", "xd", "0m", "-1d"} {
+		if _, err := ParseSteps(s); err == nil {
+			t.Errorf("ParseSteps(%q) succeeded", s)
+		}
+	}
+}
+
+func TestRelearning(t *testing.T) {
+	settings := schedulerSettings
+	settings.RelearningSteps = Steps{10 * time.Minute, time.Hour}
+	settings.NewIntervalPercent = 50
+	now := time.Date(2026, 3, 2, 12, 0, 0, 0, time.Local)
+	card := &Card{State: StateReview, Interval: 20, Ease: 2.5}
+
+	CalculateNextReview(card, 1, settings)
+	if card.State != StateRelearning || card.Lapses != 1 || card.Interval != 10 {
+		t.Fatalf("lapse left the card %s with %d lapses and an interval of %d days, want relearning, 1, 10",
+			card.State, card.Lapses, card.Interval)
+	}
+
+	scheduleLearning(card, 3, settings, now)
+	if card.State != StateRelearning || card.Step != 1 || !card.NextReview.Equal(now.Add(time.Hour)) {
+		t.Fatalf("good left the card %s step %d due %v, want relearning step 1 due in an hour",
+			card.State, card.Step, card.NextReview)
+	}
+	scheduleLearning(card, 3, settings, now)
+	if card.State != StateReview || card.Interval != 10 || !card.NextReview.Equal(dueAfterDays(now, 10)) {
+		t.Errorf("relearned card is %s with an interval of %d days due %v, want review, 10 days",
+			card.State, card.Interval, card.NextReview)
+	}
+
+	// Without a share of the old interval, it starts over at one day
+	settings.NewIntervalPercent = 0
+	card = &Card{State: StateReview, Interval: 20, Ease: 2.5}
+	CalculateNextReview(card, 1, settings)
+	scheduleLearning(card, 4, settings, now)
+	if card.Interval != 1 {
+		t.Errorf("relearned card has an interval of %d days, want 1", card.Interval)
+	}
+}
+
+func TestFuzzInterval(t *testing.T) {
+	defer func(r *rand.Rand) { fuzzRand = r }(fuzzRand)
+
+	tests := []struct {
+		days    int
+		percent float64
+		lo, hi  int
+	}{
+		{1, 5, 1, 1},
+		{2, 25, 2, 2},
+		{3, 5, 2, 4},
+		{10, 0, 10, 10},
+		{100, 5, 95, 105},
+		{100, 25, 75, 125},
+	}
+	for _, tt := range tests {
+		if lo, hi := fuzzRange(tt.days, tt.percent); lo != tt.lo || hi != tt.hi {
+			t.Errorf("fuzzRange(%d, %v) = %d, %d, want %d, %d", tt.days, tt.percent, lo, hi, tt.lo, tt.hi)
+		}
+	}
+
+	draw := func() []int {
+		var days []int
+		for range 50 {
+			days = append(days, fuzzInterval(100, 5))
+		}
+		return days
+	}
+	SeedFuzz(42)
+	first := draw()
+	SeedFuzz(42)
+	if again := draw(); !reflect.DeepEqual(first, again) {
+		t.Errorf("the same seed fuzzed %v, then %v", first, again)
+	}
+	seen := map[int]bool{}
+	for _, d := range first {
+		if d < 95 || d > 105 {
+			t.Fatalf("fuzzed 100 days to %d", d)
+		}
+		seen[d] = true
+	}
+	if len(seen) < 2 {
+		t.Errorf("50 fuzzed intervals were all %v", first)
+	}
+}
+
+func TestEaseBounds(t *testing.T) {
+	settings := schedulerSettings
+	settings.MinEase, settings.MaxEase = 1.5, 3
+	settings.EaseAgain, settings.EaseHard, settings.EaseGood, settings.EaseEasy = -0.3, -0.1, 0.05, 0.2
+	settings.FuzzPercent = 0
+
+	tests := []struct {
+		ease  float64
+		score int
+		want  float64
+	}{
+		{2.5, 1, 2.2},
+		{2.5, 2, 2.4},
+		{2.5, 3, 2.55},
+		{2.5, 4, 2.7},
+		{1.6, 1, 1.5},
+		{1.5, 2, 1.5},
+		{2.9, 4, 3},
+		{3, 3, 3},
+	}
+	for _, tt := range tests {
+		card := &Card{State: StateReview, Interval: 10, Ease: tt.ease}
+		CalculateNextReview(card, tt.score, settings)
+		if math.Abs(card.Ease-tt.want) > 1e-9 {
+			t.Errorf("answering %d at ease %v gave %v, want %v", tt.score, tt.ease, card.Ease, tt.want)
+		}
+	}
+
+	for _, s := range []SchedulerSettings{
+		{MinEase: 0.5, MaxEase: 3, StartingEase: 2},
+		{MinEase: 2, MaxEase: 1.5, StartingEase: 2},
+		{MinEase: 1.3, MaxEase: 2, StartingEase: 2.5},
+	} {
+		settings.MinEase, settings.MaxEase, settings.StartingEase = s.MinEase, s.MaxEase, s.StartingEase
+		if settings.Validate() == nil {
+			t.Errorf("ease %v between %v and %v validated", s.StartingEase, s.MinEase, s.MaxEase)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"strings"
+)
+
+// ftsEnabled reports whether cards are indexed in the cards_fts table.
+// FTS5 is only compiled into go-sqlite3 with the sqlite_fts5 build tag;
+// without it, search falls back to LIKE matching. Set by initSearch.
+var ftsEnabled bool
+
+// initSearch creates the FTS5 index of card fronts and backs and the
+// triggers keeping it in sync with the cards table. The index is rebuilt
+// whenever the triggers had to be created, since cards may have changed
+// while they were missing.
+func initSearch(db *Collection) error {
+	if err := db.QueryRow(`SELECT sqlite_compileoption_used('ENABLE_FTS5')`).Scan(&ftsEnabled); err != nil {
+		return err
+	}
+	if !ftsEnabled {
+		// Triggers left by a build with FTS5 would make every card write fail
+		_, err := db.Exec(`
+			DROP TRIGGER IF EXISTS cards_fts_insert;
+			DROP TRIGGER IF EXISTS cards_fts_delete;
+			DROP TRIGGER IF EXISTS cards_fts_update;`)
+		return err
+	}
+
+	var synced int
+	err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'trigger' AND name = 'cards_fts_insert'`).Scan(&synced)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE VIRTUAL TABLE IF NOT EXISTS cards_fts USING fts5(front, back, content='cards', content_rowid='id')`)
+	if err != nil {
+		return err
+	}
+
+	triggers := `
+	CREATE TRIGGER IF NOT EXISTS cards_fts_insert AFTER INSERT ON cards BEGIN
+		INSERT INTO cards_fts (rowid, front, back) VALUES (new.id, new.front, new.back);
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS cards_fts_delete AFTER DELETE ON cards BEGIN
+		INSERT INTO cards_fts (cards_fts, rowid, front, back) VALUES ('delete', old.id, old.front, old.back);
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS cards_fts_update AFTER UPDATE OF front, back ON cards BEGIN
+		INSERT INTO cards_fts (cards_fts, rowid, front, back) VALUES ('delete', old.id, old.front, old.back);
+		INSERT INTO cards_fts (rowid, front, back) VALUES (new.id, new.front, new.back);
+	END;
+	`
+	if _, err := db.Exec(triggers); err != nil {
+		return err
+	}
+
+	if synced == 0 {
+		if _, err := db.Exec(`INSERT INTO cards_fts (cards_fts) VALUES ('rebuild')`); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ftsTerm quotes text as an FTS5 phrase so FTS5 syntax characters in it
+// are taken literally. With prefix set its last word also matches longer
+// words ("conj" finds "conjugation").
+func ftsTerm(text string, prefix bool) string {
+	term := `"` + strings.ReplaceAll(text, `"`, `""`) + `"`
+	if prefix {
+		term += "*"
+	}
+	return term
+}
+
+// SearchCards returns up to limit cards matching an Anki-style search query
+// (see SearchQuery) and the filter. Cards matching the query's text terms
+// best come first, then the newest.
+func SearchCards(db *Collection, q string, filter CardFilter, limit int) ([]Card, error) {
+	parsed, err := ParseQuery(q)
+	if err != nil {
+		return nil, err
+	}
+
+	where, args := filter.where()
+	if parsed.where != "" {
+		where = append(where, parsed.where)
+		args = append(args, parsed.args...)
+	}
+
+	query := `SELECT ` + cardColumns + ` FROM cards`
+	orderBy := `created_at DESC`
+	if ftsEnabled && len(parsed.texts) > 0 {
+		query += ` LEFT JOIN (SELECT rowid, bm25(cards_fts) AS score FROM cards_fts WHERE cards_fts MATCH ?) m
+			ON m.rowid = cards.id`
+		args = append([]any{strings.Join(parsed.texts, " OR ")}, args...)
+		orderBy = `m.score IS NULL, m.score, ` + orderBy
+	}
+
+	if len(where) > 0 {
+		query += ` WHERE ` + strings.Join(where, ` AND `)
+	}
+	query += ` ORDER BY ` + orderBy + ` LIMIT ?`
+	args = append(args, limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanCards(rows)
+}
+
+// escapeLike escapes the LIKE wildcards in s for use with ESCAPE '\'.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
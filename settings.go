@@ -0,0 +1,60 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+)
+
+// GetDeckSettings returns the scheduler settings of a deck: the collection
+// defaults with any values stored for the deck applied on top.
+func GetDeckSettings(db *Collection, deckName string) (SchedulerSettings, error) {
+	return getDeckSettings(db, deckName)
+}
+
+func getDeckSettings(q querier, deckName string) (SchedulerSettings, error) {
+	settings := schedulerSettings
+
+	var stored string
+	err := q.QueryRow(`SELECT settings FROM deck_settings WHERE deck_name = ?`, deckName).Scan(&stored)
+	if errors.Is(err, sql.ErrNoRows) {
+		return settings, nil
+	}
+	if err != nil {
+		return settings, err
+	}
+
+	if err := json.Unmarshal([]byte(stored), &settings); err != nil {
+		return settings, err
+	}
+	return settings, nil
+}
+
+// getCardSettings returns the scheduler settings a card is studied with.
+// Cards in a filtered deck keep the settings of their home deck.
+func getCardSettings(q querier, card *Card) (SchedulerSettings, error) {
+	if card.HomeDeck != "" {
+		return getDeckSettings(q, card.HomeDeck)
+	}
+	return getDeckSettings(q, card.DeckName)
+}
+
+// SaveDeckSettings stores the complete settings of a deck, creating the
+// deck if needed.
+func SaveDeckSettings(db *Collection, deckName string, settings SchedulerSettings) error {
+	data, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+
+	if err := ensureDeck(db, deckName); err != nil {
+		return err
+	}
+
+	_, err = db.Exec(
+		`INSERT INTO deck_settings (deck_name, settings) VALUES (?, ?)
+		 ON CONFLICT(deck_name) DO UPDATE SET settings = excluded.settings`,
+		deckName, string(data),
+	)
+	return err
+}
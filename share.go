@@ -0,0 +1,279 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A deck can be shared through a link holding a random token, so a
+// teacher can hand a deck to students without an account. The link shows
+// the deck and its subdecks read-only, and lets anyone practice them
+// without any scheduling; nothing else in the collection can be reached
+// with it. Unlike API tokens, share tokens are stored as they are, so the
+// link can be copied again later. With accounts, a token starts with the
+// account's ID, which says which collection it belongs to.
+
+var ErrShareNotFound = errors.New("share not found")
+
+const (
+	// defaultSharedCards is how many cards of a shared deck are returned
+	// at once, unless asked otherwise.
+	defaultSharedCards = 50
+	// maxSharedCards bounds how many cards are returned at once.
+	maxSharedCards = 500
+)
+
+// sharePageCSP is the Content Security Policy of the shared deck page.
+// Anyone can open a share link, perhaps while logged in to the server, so
+// the page runs no script but its own and KaTeX's, and the cards it shows
+// can't send anything anywhere.
+const sharePageCSP = "default-src 'none'; script-src 'self' https://cdn.jsdelivr.net; " +
+	"style-src 'self' 'unsafe-inline' https://cdn.jsdelivr.net; font-src https://cdn.jsdelivr.net; " +
+	"img-src 'self' https:; media-src 'self'; connect-src 'self'; " +
+	"base-uri 'none'; form-action 'none'; frame-ancestors 'none'"
+
+// sharedPagePaths are the files of the shared deck page, served to
+// anyone.
+var sharedPagePaths = map[string]bool{
+	"/static/share.html": true,
+	"/static/share.js":   true,
+}
+
+// protectSharePage serves the shared deck page with its Content Security
+// Policy, keeping the share token in its URL from other sites.
+func protectSharePage(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Security-Policy", sharePageCSP)
+		w.Header().Set("Referrer-Policy", "no-referrer")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// DeckShare is a link sharing a deck and its subdecks.
+type DeckShare struct {
+	ID        int       `json:"id"`
+	Deck      string    `json:"deck"`
+	Token     string    `json:"token"`
+	URL       string    `json:"url"` // Path of the shared deck's page
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// fill sets the fields derived from the token.
+func (s *DeckShare) fill() {
+	s.URL = "/static/share.html?token=" + s.Token
+}
+
+// SharedDeck is what a share link shows of its deck.
+type SharedDeck struct {
+	Deck      string   `json:"deck"`
+	Decks     []string `json:"decks"` // The deck and its subdecks with cards
+	CardCount int      `json:"card_count"`
+}
+
+// CreateDeckShare creates a link sharing a deck. userID is the account
+// whose collection it is, or 0 without accounts.
+func CreateDeckShare(db *Collection, deckName string, userID int) (*DeckShare, error) {
+	if err := checkDeckExists(db, deckName); err != nil {
+		return nil, err
+	}
+	token, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	if userID != 0 {
+		token = strconv.Itoa(userID) + "-" + token
+	}
+
+	res, err := db.Exec(`INSERT INTO deck_shares (deck_name, token) VALUES (?, ?)`, deckName, token)
+	if err != nil {
+		return nil, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	return getDeckShare(db, `id = ?`, id)
+}
+
+// GetDeckShares lists the share links of the collection, or of a deck.
+func GetDeckShares(db *Collection, deckName string) ([]DeckShare, error) {
+	query := `SELECT id, deck_name, token, created_at FROM deck_shares`
+	var args []any
+	if deckName != "" {
+		query += ` WHERE deck_name = ?`
+		args = append(args, deckName)
+	}
+	rows, err := db.Query(query+` ORDER BY deck_name, id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	shares := []DeckShare{}
+	for rows.Next() {
+		var s DeckShare
+		if err := rows.Scan(&s.ID, &s.Deck, &s.Token, &s.CreatedAt); err != nil {
+			return nil, err
+		}
+		s.fill()
+		shares = append(shares, s)
+	}
+	return shares, rows.Err()
+}
+
+// DeleteDeckShare revokes a share link.
+func DeleteDeckShare(db *Collection, id int) error {
+	res, err := db.Exec(`DELETE FROM deck_shares WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrShareNotFound
+	}
+	return nil
+}
+
+func getDeckShare(db *Collection, where string, arg any) (*DeckShare, error) {
+	s := &DeckShare{}
+	err := db.QueryRow(`SELECT id, deck_name, token, created_at FROM deck_shares WHERE `+where, arg).
+		Scan(&s.ID, &s.Deck, &s.Token, &s.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrShareNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.fill()
+	return s, nil
+}
+
+// sharedCollection returns the collection and share of a share token.
+func sharedCollection(token string) (*Collection, *DeckShare, error) {
+	db := defaultCollection
+	if accounts != nil {
+		idStr, _, ok := strings.Cut(token, "-")
+		userID, err := strconv.Atoi(idStr)
+		if !ok || err != nil {
+			return nil, nil, ErrShareNotFound
+		}
+		// Only open the collections of accounts there are, and stop
+		// sharing those of disabled ones
+		user, err := accounts.user(userID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil, ErrShareNotFound
+		} else if err != nil {
+			return nil, nil, err
+		}
+		if user.Disabled {
+			return nil, nil, ErrShareNotFound
+		}
+		if db, err = accounts.collection(userID); err != nil {
+			return nil, nil, err
+		}
+	}
+	s, err := getDeckShare(db, `token = ?`, token)
+	if err != nil {
+		return nil, nil, err
+	}
+	return db, s, nil
+}
+
+// sharedCardFilter returns the conditions matching the cards of a shared
+// deck and its subdecks, including those borrowed by filtered decks.
+func sharedCardFilter(deckName string) (string, []any) {
+	filter, args := deckFilter("deck_name", deckName)
+	homeFilter, homeArgs := deckFilter("home_deck", deckName)
+	return `(` + filter + ` OR ` + homeFilter + `)`, append(args, homeArgs...)
+}
+
+// GetSharedDeck returns what a share link shows of its deck.
+func GetSharedDeck(db *Collection, s *DeckShare) (*SharedDeck, error) {
+	filter, args := sharedCardFilter(s.Deck)
+	rows, err := db.Query(
+		`SELECT CASE WHEN home_deck != '' THEN home_deck ELSE deck_name END AS deck, COUNT(*)
+		 FROM cards WHERE `+filter+` GROUP BY deck ORDER BY deck`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	shared := &SharedDeck{Deck: s.Deck, Decks: []string{}}
+	for rows.Next() {
+		var deck string
+		var count int
+		if err := rows.Scan(&deck, &count); err != nil {
+			return nil, err
+		}
+		shared.Decks = append(shared.Decks, deck)
+		shared.CardCount += count
+	}
+	return shared, rows.Err()
+}
+
+// GetSharedCards renders a page of the cards of a shared deck, in the
+// order they were added. Media in them is linked through the share.
+func GetSharedCards(db *Collection, s *DeckShare, limit, offset int) ([]CardRender, int, error) {
+	filter, args := sharedCardFilter(s.Deck)
+	var total int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM cards WHERE `+filter, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := db.Query(`SELECT id FROM cards WHERE `+filter+` ORDER BY id LIMIT ? OFFSET ?`, append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	mediaPath := `"/api/shared/` + s.Token + `/media/`
+	cards := []CardRender{}
+	for _, id := range ids {
+		render, err := RenderCard(db, id)
+		if err != nil {
+			return nil, 0, err
+		}
+		render.Front = strings.ReplaceAll(render.Front, `"/media/`, mediaPath)
+		render.Back = strings.ReplaceAll(render.Back, `"/media/`, mediaPath)
+		cards = append(cards, *render)
+	}
+	return cards, total, nil
+}
+
+// sharedMediaFile returns the path of a media file used by the cards of a
+// shared deck, or of their notes.
+func sharedMediaFile(db *Collection, s *DeckShare, name string) (string, error) {
+	if !mediaName.MatchString(name) {
+		return "", ErrMediaNotFound
+	}
+	filter, args := sharedCardFilter(s.Deck)
+	var used int
+	err := db.QueryRow(
+		`SELECT COUNT(*) FROM cards WHERE `+filter+`
+		 AND (instr(front, ?) > 0 OR instr(back, ?) > 0 OR note_id IN (SELECT id FROM notes WHERE instr(fields, ?) > 0))`,
+		append(args, name, name, name)...,
+	).Scan(&used)
+	if err != nil {
+		return "", err
+	}
+	if used == 0 {
+		return "", ErrMediaNotFound
+	}
+	return mediaFile(db, name)
+}
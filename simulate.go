@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"time"
+)
+
+// The workload simulator plays the scheduler forward over the coming days
+// to see how many answers a day a deck would take with different numbers
+// of new cards a day. Review cards are remembered at the rate they were
+// over the last year and answered Good, or else Again; learning steps are
+// answered Good. Daily review limits and fuzz are left out.
+
+const (
+	// defaultPassRate is the share of reviews assumed remembered without
+	// any review history to go by.
+	defaultPassRate = 0.9
+	// maxSimulatedDays bounds how far ahead the workload is simulated.
+	maxSimulatedDays = 365
+	// maxSimulations bounds the new cards per day settings simulated at once.
+	maxSimulations = 10
+	// maxSimulatedNewCards bounds the new cards per day simulated.
+	maxSimulatedNewCards = 1000
+)
+
+// Simulation is the projected workload of a deck, or the collection, for
+// each number of new cards per day simulated.
+type Simulation struct {
+	Deck             string               `json:"deck,omitempty"`
+	Dates            []string             `json:"dates"`
+	PassRate         float64              `json:"pass_rate"`          // Share of reviews assumed remembered
+	SecondsPerAnswer float64              `json:"seconds_per_answer"` // Average over the last year, 0 if unknown
+	NewCards         int                  `json:"new_cards"`          // New cards there are to introduce
+	Scenarios        []SimulationScenario `json:"scenarios"`
+}
+
+// SimulationScenario is the workload with one number of new cards a day.
+// Answers include the learning steps of new cards.
+type SimulationScenario struct {
+	NewCardsPerDay int     `json:"new_cards_per_day"`
+	Answers        []int   `json:"answers"` // On each day
+	New            []int   `json:"new"`     // New cards introduced each day
+	Total          int     `json:"total"`
+	Average        float64 `json:"average"` // Answers a day
+	Peak           int     `json:"peak"`
+	AverageMinutes float64 `json:"average_minutes"` // A day, at SecondsPerAnswer
+}
+
+// simCard is a card in a simulation, with the settings of its deck.
+type simCard struct {
+	Card
+	settings *SchedulerSettings
+}
+
+// SimulateWorkload simulates the next days study days of a deck and its
+// subdecks, or of the collection, once for each of newPerDay, or with the
+// deck's new cards per day if newPerDay is empty.
+func SimulateWorkload(db *Collection, deckName string, days int, newPerDay []int) (*Simulation, error) {
+	if days < 1 || days > maxSimulatedDays {
+		return nil, fmt.Errorf("%w: days must be between 1 and %d", ErrInvalidStats, maxSimulatedDays)
+	}
+	if len(newPerDay) > maxSimulations {
+		return nil, fmt.Errorf("%w: at most %d new_cards_per_day values can be simulated", ErrInvalidStats, maxSimulations)
+	}
+	for _, n := range newPerDay {
+		if n < 0 || n > maxSimulatedNewCards {
+			return nil, fmt.Errorf("%w: new_cards_per_day must be between 0 and %d", ErrInvalidStats, maxSimulatedNewCards)
+		}
+	}
+	if len(newPerDay) == 0 {
+		settings, err := GetDeckSettings(db, deckName)
+		if err != nil {
+			return nil, err
+		}
+		newPerDay = []int{settings.NewCardsPerDay}
+	}
+
+	now := time.Now()
+	sim := &Simulation{Deck: deckName, PassRate: defaultPassRate, Scenarios: []SimulationScenario{}}
+	for day := 0; day < days; day++ {
+		sim.Dates = append(sim.Dates, studyDate(dueAfterDays(now, day)))
+	}
+
+	from, where, args := reviewScope(deckName)
+	where = append(where, `r.reviewed_at >= ?`)
+	args = append(args, studyDayStart(now).AddDate(-1, 0, 0).In(time.Local))
+	var reviews, passed int
+	var averageMs *float64
+	err := db.QueryRow(
+		`SELECT COALESCE(SUM(r.state_before = 'review'), 0), COALESCE(SUM(r.state_before = 'review' AND r.score >= 3), 0),
+		        AVG(CASE WHEN r.time_taken_ms > 0 THEN r.time_taken_ms END)
+		 FROM `+from+whereClause(where), args...,
+	).Scan(&reviews, &passed, &averageMs)
+	if err != nil {
+		return nil, err
+	}
+	if reviews > 0 {
+		sim.PassRate = math.Round(float64(passed)/float64(reviews)*1000) / 1000
+	}
+	if averageMs != nil {
+		sim.SecondsPerAnswer = math.Round(*averageMs/100) / 10
+	}
+
+	orderBy, err := newCardOrderBy(db, deckName)
+	if err != nil {
+		return nil, err
+	}
+	where, args = CardFilter{Deck: deckName}.where()
+	where = append(where, `suspended = 0`)
+	rows, err := db.Query(`SELECT `+cardColumns+` FROM cards`+whereClause(where)+` ORDER BY state = 'new', `+orderBy, args...)
+	if err != nil {
+		return nil, err
+	}
+	cards, err := scanCards(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	settingsByDeck := map[string]*SchedulerSettings{}
+	var studied, fresh []simCard
+	for _, card := range cards {
+		deck := card.DeckName
+		if card.HomeDeck != "" {
+			deck = card.HomeDeck
+		}
+		settings, ok := settingsByDeck[deck]
+		if !ok {
+			s, err := GetDeckSettings(db, deck)
+			if err != nil {
+				return nil, err
+			}
+			// Fuzz would draw on the scheduler's random source
+			s.FuzzPercent = 0
+			settings = &s
+			settingsByDeck[deck] = settings
+		}
+		if card.State == StateNew {
+			fresh = append(fresh, simCard{card, settings})
+		} else {
+			studied = append(studied, simCard{card, settings})
+		}
+	}
+	sim.NewCards = len(fresh)
+
+	for _, n := range newPerDay {
+		sim.Scenarios = append(sim.Scenarios, sim.run(now, days, n, studied, fresh))
+	}
+	return sim, nil
+}
+
+// run simulates one scenario. Each scenario draws from the same random
+// sequence, so the results are repeatable.
+func (sim *Simulation) run(now time.Time, days, newPerDay int, studied, fresh []simCard) SimulationScenario {
+	random := rand.New(rand.NewPCG(1, 2))
+	scenario := SimulationScenario{NewCardsPerDay: newPerDay, Answers: make([]int, days), New: make([]int, days)}
+
+	// Cards by the day they are due on, overdue ones today
+	due := make([][]simCard, days)
+	schedule := func(c simCard) {
+		day := daysFromToday(now, c.NextReview)
+		if day < 0 {
+			day = 0
+		}
+		if day < days {
+			due[day] = append(due[day], c)
+		}
+	}
+	for _, c := range studied {
+		schedule(c)
+	}
+
+	next := 0
+	for day := 0; day < days; day++ {
+		start := studyDayStart(now).AddDate(0, 0, day)
+		for i := 0; i < newPerDay && next < len(fresh); i++ {
+			c := fresh[next]
+			c.NextReview = start
+			due[day] = append(due[day], c)
+			scenario.New[day]++
+			next++
+		}
+
+		// Cards answered come back later the same day until they leave
+		// their learning steps
+		for i := 0; i < len(due[day]); i++ {
+			c := due[day][i]
+			at := c.NextReview
+			if at.Before(start) {
+				at = start
+			}
+			score := 3
+			if c.State == StateReview && random.Float64() >= sim.PassRate {
+				score = 1
+			}
+			if c.State == StateReview {
+				scheduleReview(&c.Card, score, *c.settings, at)
+			} else {
+				scheduleLearning(&c.Card, score, *c.settings, at)
+			}
+			scenario.Answers[day]++
+			schedule(c)
+		}
+		due[day] = nil
+	}
+
+	for _, n := range scenario.Answers {
+		scenario.Total += n
+		if n > scenario.Peak {
+			scenario.Peak = n
+		}
+	}
+	scenario.Average = math.Round(float64(scenario.Total)/float64(days)*10) / 10
+	scenario.AverageMinutes = math.Round(scenario.Average*sim.SecondsPerAnswer/6) / 10
+	return scenario
+}
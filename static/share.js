@@ -0,0 +1,158 @@
+const token = new URLSearchParams(location.search).get('token') || '';
+const api = `/api/shared/${encodeURIComponent(token)}`;
+let cards = [];
+let total = 0;
+let practice = [];
+let practiceIndex = 0;
+
+document.addEventListener('DOMContentLoaded', async () => {
+    // Handlers are attached here, as the page's Content Security Policy
+    // allows no inline script
+    document.getElementById('browse-tab').addEventListener('click', showBrowse);
+    document.getElementById('practice-tab').addEventListener('click', startPractice);
+    document.getElementById('load-more').addEventListener('click', loadCards);
+    document.getElementById('practice-show').addEventListener('click', showAnswer);
+    document.getElementById('practice-next').onclick = nextCard;
+
+    const response = await fetch(api);
+    const deck = await response.json();
+    if (!response.ok) {
+        document.getElementById('deck-summary').textContent = deck.error;
+        document.querySelector('.nav-tabs').classList.add('hidden');
+        document.getElementById('browse-view').classList.add('hidden');
+        return;
+    }
+    document.title = `${deck.deck} - Simple Anki`;
+    document.getElementById('deck-name').textContent = deck.deck;
+    document.getElementById('deck-summary').textContent = `${deck.card_count} cards`;
+    loadCards();
+});
+
+async function loadCards() {
+    const response = await fetch(`${api}/cards?limit=100&offset=${cards.length}`);
+    const page = await response.json();
+    if (!response.ok) {
+        alert(page.error);
+        return;
+    }
+    total = Number(response.headers.get('X-Total-Count'));
+    cards = cards.concat(page);
+    if (page.length > 0) document.getElementById('card-css').textContent = page[0].css;
+
+    const list = document.getElementById('card-list');
+    page.forEach(card => {
+        const item = document.createElement('div');
+        item.className = 'shared-card';
+        item.innerHTML = card.back;
+        list.appendChild(item);
+        if (card.math) typesetMath(item);
+    });
+    document.getElementById('load-more').classList.toggle('hidden', cards.length >= total);
+}
+
+function showBrowse() {
+    document.getElementById('browse-tab').classList.add('active');
+    document.getElementById('practice-tab').classList.remove('active');
+    document.getElementById('browse-view').classList.remove('hidden');
+    document.getElementById('practice-view').classList.add('hidden');
+}
+
+async function startPractice() {
+    document.getElementById('practice-tab').classList.add('active');
+    document.getElementById('browse-tab').classList.remove('active');
+    document.getElementById('practice-view').classList.remove('hidden');
+    document.getElementById('browse-view').classList.add('hidden');
+
+    while (cards.length < total) {
+        const before = cards.length;
+        await loadCards();
+        if (cards.length === before) break;
+    }
+    practice = cards.slice();
+    for (let i = practice.length - 1; i > 0; i--) {
+        const j = Math.floor(Math.random() * (i + 1));
+        [practice[i], practice[j]] = [practice[j], practice[i]];
+    }
+    practiceIndex = 0;
+    showCard();
+}
+
+function showCard() {
+    const container = document.getElementById('practice-card');
+    if (practiceIndex >= practice.length) {
+        document.getElementById('practice-progress').textContent = '';
+        container.innerHTML = '<p>All cards practiced.</p>';
+        document.getElementById('practice-show').classList.add('hidden');
+        document.getElementById('practice-next').classList.remove('hidden');
+        document.getElementById('practice-next').textContent = 'Start Over';
+        document.getElementById('practice-next').onclick = startPractice;
+        return;
+    }
+    const card = practice[practiceIndex];
+    document.getElementById('practice-progress').textContent = `Card ${practiceIndex + 1} of ${practice.length}`;
+    document.getElementById('card-css').textContent = card.css;
+    container.innerHTML = card.front;
+    if (card.math) typesetMath(container);
+    document.getElementById('practice-show').classList.remove('hidden');
+    document.getElementById('practice-next').classList.add('hidden');
+    document.getElementById('practice-next').textContent = 'Next';
+    document.getElementById('practice-next').onclick = nextCard;
+}
+
+function showAnswer() {
+    const card = practice[practiceIndex];
+    const container = document.getElementById('practice-card');
+    container.innerHTML = card.back;
+    if (card.math) typesetMath(container);
+    document.getElementById('practice-show').classList.add('hidden');
+    document.getElementById('practice-next').classList.remove('hidden');
+}
+
+function nextCard() {
+    practiceIndex++;
+    showCard();
+}
+
+// KaTeX is only loaded once a card has math; without it the TeX
+// source is shown. The files are pinned by hash, so the CDN can't
+// change what runs on the page
+const katexURL = 'https://cdn.jsdelivr.net/npm/katex@0.16.11/dist';
+const katexJSHash = 'sha384-7zkQWkzuo3B5mTepMUcHkMB5jZaolc2xDwL6VFqjFALcbeS9Ggm/Yr2r3Dy4lfFg';
+const katexCSSHash = 'sha384-nB0miv6/jRmo5UMMR1wu3Gz6NLsoTkbqJghGIsx//Rlm+ZU03BU6SQNC66uf4l5+';
+let katexLoading = null;
+
+function loadKatex() {
+    if (!katexLoading) {
+        const load = (src, integrity) => new Promise((resolve, reject) => {
+            const script = document.createElement('script');
+            script.src = src;
+            script.integrity = integrity;
+            script.crossOrigin = 'anonymous';
+            script.onload = resolve;
+            script.onerror = reject;
+            document.head.appendChild(script);
+        });
+        const css = document.createElement('link');
+        css.rel = 'stylesheet';
+        css.href = `${katexURL}/katex.min.css`;
+        css.integrity = katexCSSHash;
+        css.crossOrigin = 'anonymous';
+        document.head.appendChild(css);
+        katexLoading = load(`${katexURL}/katex.min.js`, katexJSHash);
+    }
+    return katexLoading;
+}
+
+async function typesetMath(element) {
+    try {
+        await loadKatex();
+    } catch (error) {
+        console.error('Could not load KaTeX:', error);
+        return;
+    }
+    element.querySelectorAll('.math').forEach(el => {
+        const display = el.classList.contains('math-display');
+        const tex = el.textContent.slice(2, -2);
+        katex.render(tex, el, { displayMode: display, throwOnError: false });
+    });
+}
@@ -0,0 +1,768 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Statistics are computed from the cards and the review log, for the whole
+// collection or a deck and its subdecks. Without a deck, reviews of cards
+// deleted since still count. Days are study days (see studyDayStart).
+
+// matureInterval is the interval in days from which a review card counts
+// as mature rather than young, as in Anki.
+const matureInterval = 21
+
+// Stats is an overview of a deck's or the collection's progress.
+type Stats struct {
+	Deck string `json:"deck,omitempty"`
+
+	ReviewsToday    int   `json:"reviews_today"`
+	ReviewsThisWeek int   `json:"reviews_this_week"` // Today and the 6 days before
+	TotalReviews    int   `json:"total_reviews"`
+	TimeTodayMs     int64 `json:"time_today_ms"`
+	TotalTimeMs     int64 `json:"total_time_ms"`
+
+	Cards       CardCounts `json:"cards"`
+	AverageEase float64    `json:"average_ease"` // Of cards studied at least once, 0 if none
+
+	DueToday      int `json:"due_today"` // Including overdue cards
+	DueNext7Days  int `json:"due_next_7_days"`
+	DueNext30Days int `json:"due_next_30_days"`
+}
+
+// CardCounts counts cards by maturity. Young and mature cards are review
+// cards with an interval below and from matureInterval days.
+type CardCounts struct {
+	Total     int `json:"total"`
+	New       int `json:"new"`
+	Learning  int `json:"learning"` // Learning and relearning
+	Young     int `json:"young"`
+	Mature    int `json:"mature"`
+	Suspended int `json:"suspended"`
+}
+
+// reviewScope returns the FROM clause and conditions selecting the review
+// log entries of a deck (and its subdecks) as r, or all of them.
+func reviewScope(deckName string) (string, []string, []any) {
+	if deckName == "" {
+		return `review_log r`, nil, nil
+	}
+	cond, args := deckFilter("c.deck_name", deckName)
+	return `review_log r JOIN cards c ON c.id = r.card_id`, []string{cond}, args
+}
+
+// whereClause joins conditions into a WHERE clause, or returns "" if there
+// are none.
+func whereClause(where []string) string {
+	if len(where) == 0 {
+		return ""
+	}
+	return ` WHERE ` + strings.Join(where, ` AND `)
+}
+
+// GetStats returns the statistics of a deck and its subdecks, or of the
+// whole collection if deckName is empty.
+func GetStats(db *Collection, deckName string) (*Stats, error) {
+	today := startOfDay(time.Now())
+	stats := &Stats{Deck: deckName}
+
+	from, where, args := reviewScope(deckName)
+	err := db.QueryRow(
+		`SELECT COUNT(*), COALESCE(SUM(r.time_taken_ms), 0),
+		        COALESCE(SUM(r.reviewed_at >= ?), 0), COALESCE(SUM(CASE WHEN r.reviewed_at >= ? THEN r.time_taken_ms END), 0),
+		        COALESCE(SUM(r.reviewed_at >= ?), 0)
+		 FROM `+from+whereClause(where),
+		append([]any{today, today, today.AddDate(0, 0, -6)}, args...)...,
+	).Scan(&stats.TotalReviews, &stats.TotalTimeMs, &stats.ReviewsToday, &stats.TimeTodayMs, &stats.ReviewsThisWeek)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := CardFilter{Deck: deckName}
+	where, args = filter.where()
+	var averageEase *float64
+	err = db.QueryRow(
+		`SELECT COUNT(*), COALESCE(SUM(state = 'new'), 0), COALESCE(SUM(state IN ('learning', 'relearning')), 0),
+		        COALESCE(SUM(state = 'review' AND interval < ?), 0), COALESCE(SUM(state = 'review' AND interval >= ?), 0),
+		        COALESCE(SUM(suspended), 0), AVG(CASE WHEN state != 'new' THEN ease END),
+		        COALESCE(SUM(state != 'new' AND suspended = 0 AND next_review < ?), 0),
+		        COALESCE(SUM(state != 'new' AND suspended = 0 AND next_review < ?), 0),
+		        COALESCE(SUM(state != 'new' AND suspended = 0 AND next_review < ?), 0)
+		 FROM cards`+whereClause(where),
+		append([]any{matureInterval, matureInterval, today.AddDate(0, 0, 1), today.AddDate(0, 0, 7), today.AddDate(0, 0, 30)}, args...)...,
+	).Scan(&stats.Cards.Total, &stats.Cards.New, &stats.Cards.Learning, &stats.Cards.Young, &stats.Cards.Mature,
+		&stats.Cards.Suspended, &averageEase, &stats.DueToday, &stats.DueNext7Days, &stats.DueNext30Days)
+	if err != nil {
+		return nil, err
+	}
+	if averageEase != nil {
+		stats.AverageEase = math.Round(*averageEase*100) / 100
+	}
+	return stats, nil
+}
+
+var ErrInvalidStats = errors.New("invalid stats request")
+
+// maxStatsDays bounds the days of history and forecast asked for.
+const maxStatsDays = 3650
+
+// Heatmap is the number of reviews on each day of a period, as for a
+// calendar heatmap, with the study streaks. Days lists only the days with
+// reviews, oldest first.
+type Heatmap struct {
+	Start         string       `json:"start"` // First day of the period, YYYY-MM-DD
+	End           string       `json:"end"`   // Today
+	Days          []DayReviews `json:"days"`
+	Total         int          `json:"total"`       // Reviews in the period
+	ActiveDays    int          `json:"active_days"` // Days with reviews in the period
+	CurrentStreak int          `json:"current_streak"`
+	LongestStreak int          `json:"longest_streak"`
+}
+
+// DayReviews is the number of reviews on a study day.
+type DayReviews struct {
+	Date  string `json:"date"`
+	Count int    `json:"count"`
+}
+
+// GetHeatmap returns the reviews per day over the last days days of a deck
+// and its subdecks, or of the whole collection. Streaks are days in a row
+// with reviews, over all of the history; the current streak runs up to
+// today, or up to yesterday while today has no reviews yet.
+func GetHeatmap(db *Collection, deckName string, days int) (*Heatmap, error) {
+	if days < 1 || days > maxStatsDays {
+		return nil, fmt.Errorf("%w: days must be between 1 and %d", ErrInvalidStats, maxStatsDays)
+	}
+
+	history, err := reviewDays(db, deckName)
+	if err != nil {
+		return nil, err
+	}
+
+	today := studyDayStart(time.Now())
+	start := today.AddDate(0, 0, 1-days).Format("2006-01-02")
+	heatmap := &Heatmap{Start: start, End: today.Format("2006-01-02"), Days: []DayReviews{}}
+	heatmap.CurrentStreak, heatmap.LongestStreak = streaks(history, 1)
+	for _, day := range history {
+		if day.Date >= start {
+			heatmap.Days = append(heatmap.Days, day)
+			heatmap.Total += day.Count
+			heatmap.ActiveDays++
+		}
+	}
+	return heatmap, nil
+}
+
+// reviewDays returns the number of reviews on each study day with reviews
+// of a deck and its subdecks, or of the whole collection, oldest first.
+func reviewDays(db *Collection, deckName string) ([]DayReviews, error) {
+	from, where, args := reviewScope(deckName)
+	rows, err := db.Query(`SELECT r.reviewed_at FROM `+from+whereClause(where)+` ORDER BY r.reviewed_at`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var days []DayReviews
+	for rows.Next() {
+		var reviewedAt time.Time
+		if err := rows.Scan(&reviewedAt); err != nil {
+			return nil, err
+		}
+		date := studyDate(reviewedAt)
+		if n := len(days); n == 0 || days[n-1].Date != date {
+			days = append(days, DayReviews{Date: date})
+		}
+		days[len(days)-1].Count++
+	}
+	return days, rows.Err()
+}
+
+// streaks returns the current and longest runs of days in a row with at
+// least minReviews reviews. The current streak runs up to today, or up to
+// yesterday while today has not reached minReviews yet.
+func streaks(days []DayReviews, minReviews int) (current, longest int) {
+	streak := 0
+	var previous time.Time
+	for _, d := range days {
+		if d.Count < minReviews {
+			continue
+		}
+		day, _ := time.ParseInLocation("2006-01-02", d.Date, dayLocation)
+		if !previous.IsZero() && day.AddDate(0, 0, -1).Equal(previous) {
+			streak++
+		} else {
+			streak = 1
+		}
+		previous = day
+		if streak > longest {
+			longest = streak
+		}
+	}
+	// Compared as dates, as study days around daylight saving changes are
+	// not 24 hours long
+	today := studyDayStart(time.Now())
+	last := previous.Format("2006-01-02")
+	if last == today.Format("2006-01-02") || last == today.AddDate(0, 0, -1).Format("2006-01-02") {
+		current = streak
+	}
+	return current, longest
+}
+
+// Today sums up the study day so far: the reviews done, progress towards
+// the daily goal, and the streaks of days studied and of days the goal was
+// met.
+type Today struct {
+	Deck string `json:"deck,omitempty"`
+	Date string `json:"date"` // YYYY-MM-DD
+
+	Reviews int   `json:"reviews"`
+	TimeMs  int64 `json:"time_ms"`
+	Due     int   `json:"due"` // Cards still due today
+
+	Goal          int  `json:"goal"` // Reviews per day, 0 without a goal
+	GoalMet       bool `json:"goal_met"`
+	GoalRemaining int  `json:"goal_remaining"`
+
+	CurrentStreak     int `json:"current_streak"`
+	LongestStreak     int `json:"longest_streak"`
+	CurrentGoalStreak int `json:"current_goal_streak"`
+	LongestGoalStreak int `json:"longest_goal_streak"`
+}
+
+// GetToday returns the summary of today of a deck and its subdecks, or of
+// the whole collection, with the daily goal of its settings.
+func GetToday(db *Collection, deckName string) (*Today, error) {
+	stats, err := GetStats(db, deckName)
+	if err != nil {
+		return nil, err
+	}
+	settings, err := GetDeckSettings(db, deckName)
+	if err != nil {
+		return nil, err
+	}
+	history, err := reviewDays(db, deckName)
+	if err != nil {
+		return nil, err
+	}
+
+	today := &Today{
+		Deck:    deckName,
+		Date:    studyDate(time.Now()),
+		Reviews: stats.ReviewsToday,
+		TimeMs:  stats.TimeTodayMs,
+		Due:     stats.DueToday,
+		Goal:    settings.DailyGoal,
+	}
+	today.CurrentStreak, today.LongestStreak = streaks(history, 1)
+	if today.Goal > 0 {
+		today.GoalMet = today.Reviews >= today.Goal
+		if !today.GoalMet {
+			today.GoalRemaining = today.Goal - today.Reviews
+		}
+		today.CurrentGoalStreak, today.LongestGoalStreak = streaks(history, today.Goal)
+	}
+	return today, nil
+}
+
+// studyDate returns the date of the study day containing t, YYYY-MM-DD.
+func studyDate(t time.Time) string {
+	return studyDayStart(t).Format("2006-01-02")
+}
+
+// Forecast is how many cards come due on each of the next days, per deck.
+// The first day, today, includes overdue cards.
+type Forecast struct {
+	Dates []string       `json:"dates"` // YYYY-MM-DD, starting today
+	Total []int          `json:"total"`
+	Decks []DeckForecast `json:"decks"`
+}
+
+// DeckForecast is the due counts of one deck, by day of Forecast.Dates.
+type DeckForecast struct {
+	Deck   string `json:"deck"`
+	Counts []int  `json:"counts"`
+}
+
+// GetForecast returns the cards coming due over the next days days in a
+// deck and each of its subdecks, or in every deck. New and suspended cards
+// are left out, as they are not due by date.
+func GetForecast(db *Collection, deckName string, days int) (*Forecast, error) {
+	if days < 1 || days > maxStatsDays {
+		return nil, fmt.Errorf("%w: days must be between 1 and %d", ErrInvalidStats, maxStatsDays)
+	}
+
+	today := studyDayStart(time.Now())
+	where, args := CardFilter{Deck: deckName}.where()
+	where = append(where, `state != 'new'`, `suspended = 0`, `next_review < ?`)
+	args = append(args, today.AddDate(0, 0, days).In(time.Local))
+	rows, err := db.Query(`SELECT deck_name, next_review FROM cards`+whereClause(where)+` ORDER BY deck_name`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	forecast := &Forecast{Total: make([]int, days), Decks: []DeckForecast{}}
+	for i := 0; i < days; i++ {
+		forecast.Dates = append(forecast.Dates, today.AddDate(0, 0, i).Format("2006-01-02"))
+	}
+	first, _ := time.Parse("2006-01-02", forecast.Dates[0])
+	for rows.Next() {
+		var deck string
+		var due time.Time
+		if err := rows.Scan(&deck, &due); err != nil {
+			return nil, err
+		}
+		// Counted in calendar dates, which daylight saving leaves alone
+		date, _ := time.Parse("2006-01-02", studyDate(due))
+		day := int(date.Sub(first).Hours() / 24)
+		if day < 0 {
+			day = 0
+		}
+		if day >= days {
+			continue
+		}
+		if n := len(forecast.Decks); n == 0 || forecast.Decks[n-1].Deck != deck {
+			forecast.Decks = append(forecast.Decks, DeckForecast{Deck: deck, Counts: make([]int, days)})
+		}
+		forecast.Decks[len(forecast.Decks)-1].Counts[day]++
+		forecast.Total[day]++
+	}
+	return forecast, rows.Err()
+}
+
+// Retention windows, by name and how many study days they reach back; 0
+// is all time.
+var retentionWindows = []struct {
+	Name string
+	Days int
+}{{"today", 1}, {"week", 7}, {"month", 30}, {"year", 365}, {"all", 0}}
+
+// Retention is how well cards are remembered over each of the
+// retentionWindows, by window name.
+type Retention struct {
+	Total map[string]*RetentionRates `json:"total"`
+	Decks []DeckRetention            `json:"decks"`
+}
+
+// DeckRetention is the retention of one deck, not counting its subdecks.
+type DeckRetention struct {
+	Deck    string                     `json:"deck"`
+	Windows map[string]*RetentionRates `json:"windows"`
+}
+
+// RetentionRates sums up the answers given in a window. Answers of Good
+// or Easy pass; Again and Hard fail, as they do for lapses. A rate is
+// null without any answers to base it on.
+type RetentionRates struct {
+	MatureReviews int      `json:"mature_reviews"`
+	MaturePassed  int      `json:"mature_passed"`
+	Retention     *float64 `json:"retention"` // Pass rate of mature review cards
+
+	YoungReviews   int      `json:"young_reviews"`
+	YoungAgain     int      `json:"young_again"`
+	YoungAgainRate *float64 `json:"young_again_rate"`
+
+	LearningReviews   int      `json:"learning_reviews"` // New, learning and relearning cards
+	LearningAgain     int      `json:"learning_again"`
+	LearningAgainRate *float64 `json:"learning_again_rate"`
+}
+
+func newRetentionWindows() map[string]*RetentionRates {
+	windows := make(map[string]*RetentionRates)
+	for _, w := range retentionWindows {
+		windows[w.Name] = &RetentionRates{}
+	}
+	return windows
+}
+
+// add counts an answer of score to a card that was in state with interval.
+func (r *RetentionRates) add(state string, interval, score int) {
+	switch {
+	case state == StateReview && interval >= matureInterval:
+		r.MatureReviews++
+		if score >= 3 {
+			r.MaturePassed++
+		}
+	case state == StateReview:
+		r.YoungReviews++
+		if score == 1 {
+			r.YoungAgain++
+		}
+	default:
+		r.LearningReviews++
+		if score == 1 {
+			r.LearningAgain++
+		}
+	}
+}
+
+func (r *RetentionRates) computeRates() {
+	rate := func(n, of int) *float64 {
+		if of == 0 {
+			return nil
+		}
+		v := math.Round(float64(n)/float64(of)*1000) / 1000
+		return &v
+	}
+	r.Retention = rate(r.MaturePassed, r.MatureReviews)
+	r.YoungAgainRate = rate(r.YoungAgain, r.YoungReviews)
+	r.LearningAgainRate = rate(r.LearningAgain, r.LearningReviews)
+}
+
+// GetRetention returns the retention of a deck and its subdecks, or of the
+// whole collection, in total and per deck. Without a deck, the total also
+// counts reviews of cards deleted since.
+func GetRetention(db *Collection, deckName string) (*Retention, error) {
+	today := studyDayStart(time.Now())
+	where, args := []string{}, []any{}
+	if deckName != "" {
+		cond, condArgs := deckFilter("c.deck_name", deckName)
+		where, args = append(where, cond), condArgs
+	}
+	rows, err := db.Query(
+		`SELECT COALESCE(c.deck_name, ''), r.reviewed_at, r.state_before, r.interval_before, r.score
+		 FROM review_log r LEFT JOIN cards c ON c.id = r.card_id`+whereClause(where)+`
+		 ORDER BY c.deck_name`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	retention := &Retention{Total: newRetentionWindows(), Decks: []DeckRetention{}}
+	for rows.Next() {
+		var deck, state string
+		var reviewedAt time.Time
+		var interval, score int
+		if err := rows.Scan(&deck, &reviewedAt, &state, &interval, &score); err != nil {
+			return nil, err
+		}
+		if deck != "" {
+			if n := len(retention.Decks); n == 0 || retention.Decks[n-1].Deck != deck {
+				retention.Decks = append(retention.Decks, DeckRetention{Deck: deck, Windows: newRetentionWindows()})
+			}
+		}
+		for _, w := range retentionWindows {
+			if w.Days > 0 && reviewedAt.Before(today.AddDate(0, 0, 1-w.Days)) {
+				continue
+			}
+			retention.Total[w.Name].add(state, interval, score)
+			if deck != "" {
+				retention.Decks[len(retention.Decks)-1].Windows[w.Name].add(state, interval, score)
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, r := range retention.Total {
+		r.computeRates()
+	}
+	for _, d := range retention.Decks {
+		for _, r := range d.Windows {
+			r.computeRates()
+		}
+	}
+	return retention, nil
+}
+
+// Histogram counts cards by interval or ease, in total and per deck, to
+// tell whether a collection matures and whether eases are stuck at their
+// minimum ("ease hell").
+type Histogram struct {
+	Buckets []HistogramBucket `json:"buckets"`
+	Total   HistogramCounts   `json:"total"`
+	Decks   []DeckHistogram   `json:"decks"`
+}
+
+// HistogramBucket is a range of values, from Min up to the Min of the
+// next bucket.
+type HistogramBucket struct {
+	Label string  `json:"label"`
+	Min   float64 `json:"min"`
+}
+
+// HistogramCounts is the number of cards in each of Histogram.Buckets.
+type HistogramCounts struct {
+	Counts  []int   `json:"counts"`
+	Cards   int     `json:"cards"`
+	Average float64 `json:"average"`
+	// Of ease histograms, the cards at the minimum ease of their deck
+	AtMinEase *int `json:"at_min_ease,omitempty"`
+}
+
+// DeckHistogram is the histogram of one deck, not counting its subdecks.
+type DeckHistogram struct {
+	Deck string `json:"deck"`
+	HistogramCounts
+}
+
+// intervalBuckets are the buckets of interval histograms, in days. Young
+// and mature cards part at matureInterval.
+var intervalBuckets = []HistogramBucket{
+	{"1d", 1}, {"2d", 2}, {"3d", 3}, {"4-6d", 4}, {"1-2w", 7}, {"2-3w", 14}, {"3w-1m", matureInterval},
+	{"1-2m", 30}, {"2-3m", 60}, {"3-6m", 90}, {"6m-1y", 180}, {"1-2y", 365}, {"2y+", 730},
+}
+
+// newHistogram returns an empty histogram over buckets.
+func newHistogram(buckets []HistogramBucket) *Histogram {
+	return &Histogram{Buckets: buckets, Total: HistogramCounts{Counts: make([]int, len(buckets))}, Decks: []DeckHistogram{}}
+}
+
+// add counts a card of deck with value in bucket.
+func (h *Histogram) add(deck string, bucket int, value float64) {
+	if n := len(h.Decks); n == 0 || h.Decks[n-1].Deck != deck {
+		h.Decks = append(h.Decks, DeckHistogram{Deck: deck, HistogramCounts: HistogramCounts{Counts: make([]int, len(h.Buckets))}})
+	}
+	for _, c := range []*HistogramCounts{&h.Total, &h.Decks[len(h.Decks)-1].HistogramCounts} {
+		c.Counts[bucket]++
+		c.Cards++
+		c.Average += value // Summed until finish
+	}
+}
+
+// finish turns the sums of values into averages.
+func (h *Histogram) finish() {
+	counts := []*HistogramCounts{&h.Total}
+	for i := range h.Decks {
+		counts = append(counts, &h.Decks[i].HistogramCounts)
+	}
+	for _, c := range counts {
+		if c.Cards > 0 {
+			c.Average = math.Round(c.Average/float64(c.Cards)*100) / 100
+		}
+	}
+}
+
+// GetIntervalHistogram returns the intervals of the review cards in a deck
+// and each of its subdecks, or in every deck.
+func GetIntervalHistogram(db *Collection, deckName string) (*Histogram, error) {
+	where, args := CardFilter{Deck: deckName}.where()
+	where = append(where, `state = 'review'`)
+	rows, err := db.Query(`SELECT deck_name, interval FROM cards`+whereClause(where)+` ORDER BY deck_name`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	histogram := newHistogram(intervalBuckets)
+	for rows.Next() {
+		var deck string
+		var interval int
+		if err := rows.Scan(&deck, &interval); err != nil {
+			return nil, err
+		}
+		bucket := 0
+		for bucket+1 < len(intervalBuckets) && float64(interval) >= intervalBuckets[bucket+1].Min {
+			bucket++
+		}
+		histogram.add(deck, bucket, float64(interval))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	histogram.finish()
+	return histogram, nil
+}
+
+// GetEaseHistogram returns the eases of the cards studied at least once in
+// a deck and each of its subdecks, or in every deck, in buckets 0.1 wide
+// from the lowest ease to the highest.
+func GetEaseHistogram(db *Collection, deckName string) (*Histogram, error) {
+	where, args := CardFilter{Deck: deckName}.where()
+	where = append(where, `state != 'new'`)
+	rows, err := db.Query(`SELECT deck_name, ease FROM cards`+whereClause(where)+` ORDER BY deck_name`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	type deckEase struct {
+		deck string
+		ease float64
+	}
+	var cards []deckEase
+	lowest, highest := math.Inf(1), math.Inf(-1)
+	for rows.Next() {
+		var c deckEase
+		if err := rows.Scan(&c.deck, &c.ease); err != nil {
+			return nil, err
+		}
+		cards = append(cards, c)
+		lowest, highest = min(lowest, c.ease), max(highest, c.ease)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Eases are in tenths, give or take rounding
+	tenth := func(ease float64) int { return int(math.Floor(ease*10 + 1e-6)) }
+	buckets := []HistogramBucket{}
+	if len(cards) > 0 {
+		for t := tenth(lowest); t <= tenth(highest); t++ {
+			buckets = append(buckets, HistogramBucket{Label: fmt.Sprintf("%.1f", float64(t)/10), Min: float64(t) / 10})
+		}
+	}
+	histogram := newHistogram(buckets)
+	atMinEase := 0
+	histogram.Total.AtMinEase = &atMinEase
+	minEase := make(map[string]float64)
+	for _, c := range cards {
+		histogram.add(c.deck, tenth(c.ease)-tenth(lowest), c.ease)
+		deck := &histogram.Decks[len(histogram.Decks)-1]
+		if deck.AtMinEase == nil {
+			settings, err := GetDeckSettings(db, c.deck)
+			if err != nil {
+				return nil, err
+			}
+			minEase[c.deck] = settings.MinEase
+			deck.AtMinEase = new(int)
+		}
+		if c.ease <= minEase[c.deck]+1e-6 {
+			*deck.AtMinEase++
+			atMinEase++
+		}
+	}
+	histogram.finish()
+	return histogram, nil
+}
+
+// maxSlowestCards bounds the cards listed in AnswerTimes.SlowestCards.
+const maxSlowestCards = 20
+
+// AnswerTimes is how long reviews took over a period: the time studied on
+// each day, and the average answer time per deck and of the slowest cards.
+// Averages count only reviews whose time was recorded, in milliseconds.
+type AnswerTimes struct {
+	Start string `json:"start"` // First day of the period, YYYY-MM-DD
+	End   string `json:"end"`   // Today
+	ReviewTime
+	Days         []DayTime  `json:"days"` // Days with reviews, oldest first
+	Decks        []DeckTime `json:"decks"`
+	SlowestCards []CardTime `json:"slowest_cards"`
+}
+
+// ReviewTime sums up the time taken by reviews.
+type ReviewTime struct {
+	Reviews   int   `json:"reviews"`
+	TimeMs    int64 `json:"time_ms"`
+	AverageMs int64 `json:"average_ms"`
+	timed     int   // Reviews with a time
+}
+
+func (t *ReviewTime) add(ms int64) {
+	t.Reviews++
+	t.TimeMs += ms
+	if ms > 0 {
+		t.timed++
+		t.AverageMs = t.TimeMs / int64(t.timed)
+	}
+}
+
+// DayTime is the time studied on a study day.
+type DayTime struct {
+	Date string `json:"date"`
+	ReviewTime
+}
+
+// DeckTime is the time spent on one deck, not counting its subdecks.
+type DeckTime struct {
+	Deck string `json:"deck"`
+	ReviewTime
+}
+
+// CardTime is the time spent on a card.
+type CardTime struct {
+	CardID int    `json:"card_id"`
+	Deck   string `json:"deck"`
+	Front  string `json:"front"`
+	ReviewTime
+}
+
+// GetAnswerTimes returns how long the reviews of the last days days took in
+// a deck and its subdecks, or in the whole collection. Without a deck, the
+// days and total also count reviews of cards deleted since.
+func GetAnswerTimes(db *Collection, deckName string, days int) (*AnswerTimes, error) {
+	if days < 1 || days > maxStatsDays {
+		return nil, fmt.Errorf("%w: days must be between 1 and %d", ErrInvalidStats, maxStatsDays)
+	}
+
+	today := studyDayStart(time.Now())
+	start := today.AddDate(0, 0, 1-days)
+	where, args := []string{`r.reviewed_at >= ?`}, []any{start.In(time.Local)}
+	if deckName != "" {
+		cond, condArgs := deckFilter("c.deck_name", deckName)
+		where, args = append(where, cond), append(args, condArgs...)
+	}
+	rows, err := db.Query(
+		`SELECT r.card_id, COALESCE(c.deck_name, ''), COALESCE(c.front, ''), r.reviewed_at, r.time_taken_ms
+		 FROM review_log r LEFT JOIN cards c ON c.id = r.card_id`+whereClause(where)+`
+		 ORDER BY r.reviewed_at`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	times := &AnswerTimes{
+		Start: start.Format("2006-01-02"), End: today.Format("2006-01-02"),
+		Days: []DayTime{}, Decks: []DeckTime{}, SlowestCards: []CardTime{},
+	}
+	decks := make(map[string]*DeckTime)
+	cards := make(map[int]*CardTime)
+	for rows.Next() {
+		var cardID int
+		var deck, front string
+		var reviewedAt time.Time
+		var ms int64
+		if err := rows.Scan(&cardID, &deck, &front, &reviewedAt, &ms); err != nil {
+			return nil, err
+		}
+		times.ReviewTime.add(ms)
+		date := studyDate(reviewedAt)
+		if n := len(times.Days); n == 0 || times.Days[n-1].Date != date {
+			times.Days = append(times.Days, DayTime{Date: date})
+		}
+		times.Days[len(times.Days)-1].add(ms)
+		if deck == "" {
+			continue
+		}
+		if decks[deck] == nil {
+			decks[deck] = &DeckTime{Deck: deck}
+		}
+		decks[deck].add(ms)
+		if cards[cardID] == nil {
+			cards[cardID] = &CardTime{CardID: cardID, Deck: deck, Front: front}
+		}
+		cards[cardID].add(ms)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, d := range decks {
+		times.Decks = append(times.Decks, *d)
+	}
+	sort.Slice(times.Decks, func(i, j int) bool { return times.Decks[i].Deck < times.Decks[j].Deck })
+	for _, c := range cards {
+		if c.timed > 0 {
+			times.SlowestCards = append(times.SlowestCards, *c)
+		}
+	}
+	sort.Slice(times.SlowestCards, func(i, j int) bool {
+		a, b := times.SlowestCards[i], times.SlowestCards[j]
+		if a.AverageMs != b.AverageMs {
+			return a.AverageMs > b.AverageMs
+		}
+		return a.CardID < b.CardID
+	})
+	if len(times.SlowestCards) > maxSlowestCards {
+		times.SlowestCards = times.SlowestCards[:maxSlowestCards]
+	}
+	return times, nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// LeechTag is added to cards that keep lapsing.
+const LeechTag = "leech"
+
+// TagSeparator separates the levels of a nested tag, e.g.
+// "grammar::verbs::irregular".
+const TagSeparator = "::"
+
+var ErrInvalidTag = errors.New("tags must be non-empty and cannot contain whitespace")
+
+// TagNode is one level of the tag hierarchy returned by GetTagTree.
+type TagNode struct {
+	Name      string     `json:"name"`       // Last path component, e.g. "irregular"
+	FullName  string     `json:"full_name"`  // e.g. "grammar::verbs::irregular"
+	CardCount int        `json:"card_count"` // Cards with this tag or any child tag
+	Children  []*TagNode `json:"children"`
+}
+
+// normalizeTags trims tags and drops duplicates. Tags are stored space
+// separated in query results, so they cannot contain whitespace.
+func normalizeTags(tags []string) ([]string, error) {
+	seen := make(map[string]bool)
+	normalized := []string{}
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || strings.IndexFunc(tag, unicode.IsSpace) >= 0 {
+			return nil, ErrInvalidTag
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			normalized = append(normalized, tag)
+		}
+	}
+	sort.Strings(normalized)
+	return normalized, nil
+}
+
+// tagFilter returns a WHERE fragment matching cards (by their id column)
+// that carry the given tag or one of its child tags. Tags nest like decks,
+// so deckFilter's prefix range works for them too.
+func tagFilter(column, tag string) (string, []any) {
+	cond, args := deckFilter("t.name", tag)
+	return column + ` IN (SELECT ct.card_id FROM card_tags ct JOIN tags t ON t.id = ct.tag_id WHERE ` + cond + `)`, args
+}
+
+// addCardTag tags a card, creating the tag if needed. Tagging a card twice
+// has no effect.
+func addCardTag(q querier, cardID int, tag string) error {
+	if _, err := q.Exec(`INSERT OR IGNORE INTO tags (name) VALUES (?)`, tag); err != nil {
+		return err
+	}
+	_, err := q.Exec(
+		`INSERT OR IGNORE INTO card_tags (card_id, tag_id) SELECT ?, id FROM tags WHERE name = ?`,
+		cardID, tag,
+	)
+	return err
+}
+
+// AddCardTags adds tags to a card and returns the updated card.
+func AddCardTags(db *Collection, cardID int, tags []string) (*Card, error) {
+	tags, err := normalizeTags(tags)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := getCard(tx, cardID); err != nil {
+		return nil, err
+	}
+	for _, tag := range tags {
+		if err := addCardTag(tx, cardID, tag); err != nil {
+			return nil, err
+		}
+	}
+
+	card, err := getCard(tx, cardID)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return card, nil
+}
+
+// RemoveCardTag removes a tag from a card and returns the updated card.
+// Removing a tag the card does not have is not an error.
+func RemoveCardTag(db *Collection, cardID int, tag string) (*Card, error) {
+	_, err := db.Exec(
+		`DELETE FROM card_tags WHERE card_id = ? AND tag_id IN (SELECT id FROM tags WHERE name = ?)`,
+		cardID, tag,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return GetCard(db, cardID)
+}
+
+// GetTagTree returns every tag in use arranged by its "::" hierarchy. Each
+// node counts the distinct cards tagged with it or any of its children.
+func GetTagTree(db *Collection) ([]*TagNode, error) {
+	rows, err := db.Query(
+		`SELECT ct.card_id, t.name FROM card_tags ct JOIN tags t ON t.id = ct.tag_id ORDER BY t.name`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	seenName := make(map[string]bool)
+	cardPaths := make(map[int]map[string]bool)
+	for rows.Next() {
+		var cardID int
+		var name string
+		if err := rows.Scan(&cardID, &name); err != nil {
+			return nil, err
+		}
+		if !seenName[name] {
+			seenName[name] = true
+			names = append(names, name)
+		}
+
+		// A card counts once for each level above its tags
+		if cardPaths[cardID] == nil {
+			cardPaths[cardID] = make(map[string]bool)
+		}
+		parts := strings.Split(name, TagSeparator)
+		for i := range parts {
+			cardPaths[cardID][strings.Join(parts[:i+1], TagSeparator)] = true
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int)
+	for _, paths := range cardPaths {
+		for path := range paths {
+			counts[path]++
+		}
+	}
+
+	roots, nodes := buildTagTree(names)
+	for path, node := range nodes {
+		node.CardCount = counts[path]
+	}
+	return roots, nil
+}
+
+// buildTagTree arranges sorted tag names into a tree, adding nodes for
+// parents that are not used as tags themselves. It also returns the nodes
+// by full name.
+func buildTagTree(names []string) ([]*TagNode, map[string]*TagNode) {
+	roots := []*TagNode{}
+	nodes := make(map[string]*TagNode)
+
+	for _, name := range names {
+		parts := strings.Split(name, TagSeparator)
+		for i := range parts {
+			fullName := strings.Join(parts[:i+1], TagSeparator)
+			if _, ok := nodes[fullName]; ok {
+				continue
+			}
+
+			node := &TagNode{Name: parts[i], FullName: fullName, Children: []*TagNode{}}
+			nodes[fullName] = node
+			if i == 0 {
+				roots = append(roots, node)
+			} else {
+				parent := nodes[strings.Join(parts[:i], TagSeparator)]
+				parent.Children = append(parent.Children, node)
+			}
+		}
+	}
+
+	return roots, nodes
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// The server can serve HTTPS itself rather than behind a reverse proxy,
+// either with a certificate and key of its own or with certificates it
+// gets from Let's Encrypt for -acme-domain and renews before they expire.
+// Let's Encrypt checks the domain by connecting to it on port 443, so the
+// server listens there; it also answers plain HTTP on port 80,
+// if it can, redirecting to HTTPS.
+
+var (
+	// tlsCert and tlsKey are the PEM files of the server's certificate
+	// and private key, set from -tls-cert and -tls-key in main.
+	tlsCert, tlsKey string
+	// acmeDomain are the comma-separated domains to get certificates for
+	// from Let's Encrypt, set from -acme-domain.
+	acmeDomain string
+	// acmeCache is the directory Let's Encrypt certificates and the
+	// account key are kept in, so restarts don't ask for new ones, set
+	// from -acme-cache.
+	acmeCache = "acme-cache"
+	// acmeEmail is the address Let's Encrypt may contact about the
+	// certificates, set from -acme-email.
+	acmeEmail string
+)
+
+// checkTLSFlags checks that the TLS flags make sense together and with
+// -port. With -acme-domain the port is 443 unless set, and can't be set to
+// anything else, as that is where Let's Encrypt and the redirect from port
+// 80 go.
+func checkTLSFlags(port *string) error {
+	if (tlsCert != "") != (tlsKey != "") {
+		return errors.New("-tls-cert and -tls-key must be set together")
+	}
+	if tlsCert != "" && acmeDomain != "" {
+		return errors.New("-tls-cert and -acme-domain can't be used together")
+	}
+	if acmeDomain != "" {
+		portSet := false
+		flag.Visit(func(f *flag.Flag) {
+			portSet = portSet || f.Name == "port"
+		})
+		if portSet && *port != "443" {
+			return fmt.Errorf("-acme-domain serves HTTPS on port 443, not -port %s", *port)
+		}
+		*port = "443"
+	}
+	return nil
+}
+
+// serveTLS reports whether the server serves HTTPS itself.
+func serveTLS() bool {
+	return tlsCert != "" || acmeDomain != ""
+}
+
+// listenAndServe serves the routes on addr over HTTPS with the
+// certificate of -tls-cert or from Let's Encrypt, or else over plain HTTP.
+func listenAndServe(addr string, handler http.Handler) error {
+	switch {
+	case acmeDomain != "":
+		var domains []string
+		for _, d := range strings.Split(acmeDomain, ",") {
+			if d = strings.TrimSpace(d); d != "" {
+				domains = append(domains, d)
+			}
+		}
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(domains...),
+			Cache:      autocert.DirCache(acmeCache),
+			Email:      acmeEmail,
+		}
+		go func() {
+			if err := http.ListenAndServe(":80", m.HTTPHandler(nil)); err != nil {
+				log.Printf("Not redirecting HTTP to HTTPS: %v", err)
+			}
+		}()
+		server := &http.Server{Addr: addr, Handler: handler, TLSConfig: m.TLSConfig()}
+		return server.ListenAndServeTLS("", "")
+	case tlsCert != "":
+		return http.ListenAndServeTLS(addr, tlsCert, tlsKey, handler)
+	default:
+		return http.ListenAndServe(addr, handler)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// A typed answer is checked against the plain text of the card's back,
+// after both are normalized the way the deck's settings ask: ignoring case,
+// runs of whitespace and accents. The check reports whether they match,
+// a character diff of what was typed against the expected answer, and a
+// score to suggest.
+
+// AnswerCheck is the outcome of checking a typed answer.
+type AnswerCheck struct {
+	Correct        bool       `json:"correct"`
+	Similarity     float64    `json:"similarity"` // 0 to 1, by matching characters
+	Expected       string     `json:"expected"`
+	Typed          string     `json:"typed"`
+	Diff           []DiffPart `json:"diff"`
+	SuggestedScore int        `json:"suggested_score"`
+}
+
+// DiffPart is a run of the diff turning the typed answer into the expected
+// one: "equal" text is in both, "delete" text was typed but is not
+// expected, and "insert" text is expected but was not typed.
+type DiffPart struct {
+	Op   string `json:"op"`
+	Text string `json:"text"`
+}
+
+// answerCloseEnough is the similarity from which a wrong answer, like one
+// with a typo, is suggested Hard rather than Again.
+const answerCloseEnough = 0.9
+
+// maxDiffRunes bounds the answers diffed character by character, as the
+// diff takes time and memory in the product of their lengths.
+const maxDiffRunes = 2000
+
+// CheckTypedAnswer checks a typed answer to a card with the normalization
+// of its deck, or of its home deck if it is in a filtered deck.
+func CheckTypedAnswer(db *Collection, cardID int, typed string) (*AnswerCheck, error) {
+	card, err := GetCard(db, cardID)
+	if err != nil {
+		return nil, err
+	}
+	settings, err := getCardSettings(db, card)
+	if err != nil {
+		return nil, err
+	}
+	return checkAnswer(typed, answerText(card.Back), settings), nil
+}
+
+// answerText returns the text a typed answer is compared with: the back
+// as it shows, without markup or media.
+func answerText(back string) string {
+	return htmlToText(mediaTag.ReplaceAllString(renderMarkdown(back), ""))
+}
+
+// checkAnswer compares typed with expected.
+func checkAnswer(typed, expected string, settings SchedulerSettings) *AnswerCheck {
+	a := normalizeAnswer(typed, settings)
+	b := normalizeAnswer(expected, settings)
+	check := &AnswerCheck{
+		Expected: expected,
+		Typed:    typed,
+		Diff:     diffAnswer(a, b),
+	}
+
+	same := 0
+	for _, part := range check.Diff {
+		if part.Op == "equal" {
+			same += len([]rune(part.Text))
+		}
+	}
+	if total := len(a) + len(b); total > 0 {
+		check.Similarity = 2 * float64(same) / float64(total)
+	}
+	check.Correct = len(a) > 0 && len(check.Diff) == 1 && check.Diff[0].Op == "equal"
+
+	switch {
+	case check.Correct:
+		check.SuggestedScore = 3
+	case len(a) > 0 && check.Similarity >= answerCloseEnough:
+		check.SuggestedScore = 2
+	default:
+		check.SuggestedScore = 1
+	}
+	return check
+}
+
+// answerRune is a character of a normalized answer: key is compared, and
+// text is what the diff shows.
+type answerRune struct {
+	key  rune
+	text rune
+}
+
+// normalizeAnswer prepares an answer for comparing. Whitespace is always
+// trimmed; with AnswerIgnoreWhitespace its runs count as one space.
+func normalizeAnswer(s string, settings SchedulerSettings) []answerRune {
+	s = strings.TrimSpace(s)
+	out := make([]answerRune, 0, len(s))
+	space := false
+	for _, r := range s {
+		if settings.AnswerIgnoreWhitespace && unicode.IsSpace(r) {
+			space = true
+			continue
+		}
+		if space {
+			out = append(out, answerRune{' ', ' '})
+			space = false
+		}
+		key := r
+		if settings.AnswerIgnoreDiacritics {
+			key = foldDiacritic(key)
+		}
+		if settings.AnswerIgnoreCase {
+			key = unicode.ToLower(key)
+		}
+		out = append(out, answerRune{key, r})
+	}
+	return out
+}
+
+// diffAnswer diffs two normalized answers by their longest common
+// subsequence. Equal runs show the typed text.
+func diffAnswer(a, b []answerRune) []DiffPart {
+	var parts []DiffPart
+	add := func(op string, r rune) {
+		if n := len(parts); n > 0 && parts[n-1].Op == op {
+			parts[n-1].Text += string(r)
+			return
+		}
+		parts = append(parts, DiffPart{Op: op, Text: string(r)})
+	}
+
+	if len(a) > maxDiffRunes || len(b) > maxDiffRunes {
+		// Too long to diff; unless they match, all of it differs
+		if equalAnswers(a, b) {
+			for _, r := range a {
+				add("equal", r.text)
+			}
+			return parts
+		}
+		for _, r := range a {
+			add("delete", r.text)
+		}
+		for _, r := range b {
+			add("insert", r.text)
+		}
+		return parts
+	}
+
+	// lcs[i][j] is the length of the common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case a[i].key == b[j].key:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i].key == b[j].key:
+			add("equal", a[i].text)
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			add("delete", a[i].text)
+			i++
+		default:
+			add("insert", b[j].text)
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		add("delete", a[i].text)
+	}
+	for ; j < len(b); j++ {
+		add("insert", b[j].text)
+	}
+	if parts == nil {
+		parts = []DiffPart{}
+	}
+	return parts
+}
+
+func equalAnswers(a, b []answerRune) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].key != b[i].key {
+			return false
+		}
+	}
+	return true
+}
+
+// diacriticFolds maps accented Latin letters to their base letter.
+var diacriticFolds = func() map[rune]rune {
+	folds := make(map[rune]rune)
+	for base, accented := range map[rune]string{
+		'a': "àáâãäåāăą", 'A': "ÀÁÂÃÄÅĀĂĄ",
+		'c': "çćĉċč", 'C': "ÇĆĈĊČ",
+		'd': "ďđ", 'D': "ĎĐ",
+		'e': "èéêëēĕėęě", 'E': "ÈÉÊËĒĔĖĘĚ",
+		'g': "ĝğġģ", 'G': "ĜĞĠĢ",
+		'h': "ĥħ", 'H': "ĤĦ",
+		'i': "ìíîïĩīĭįı", 'I': "ÌÍÎÏĨĪĬĮİ",
+		'j': "ĵ", 'J': "Ĵ",
+		'k': "ķ", 'K': "Ķ",
+		'l': "ĺļľŀł", 'L': "ĹĻĽĿŁ",
+		'n': "ñńņňŉ", 'N': "ÑŃŅŇ",
+		'o': "òóôõöøōŏő", 'O': "ÒÓÔÕÖØŌŎŐ",
+		'r': "ŕŗř", 'R': "ŔŖŘ",
+		's': "śŝşšș", 'S': "ŚŜŞŠȘ",
+		't': "ţťŧț", 'T': "ŢŤŦȚ",
+		'u': "ùúûüũūŭůűų", 'U': "ÙÚÛÜŨŪŬŮŰŲ",
+		'w': "ŵ", 'W': "Ŵ",
+		'y': "ýÿŷ", 'Y': "ÝŶŸ",
+		'z': "źżž", 'Z': "ŹŻŽ",
+	} {
+		for _, r := range accented {
+			folds[r] = base
+		}
+	}
+	return folds
+}()
+
+// foldDiacritic returns r without its accent, or r itself.
+func foldDiacritic(r rune) rune {
+	if base, ok := diacriticFolds[r]; ok {
+		return base
+	}
+	return r
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Time away from studying is planned in one of two ways: postponing every
+// due date of a deck or the collection by some days, keeping the gaps
+// between cards, or marking the days away, after which the cards due by
+// the return are spread over the days that follow rather than all coming
+// due on the first one. New and suspended cards are left alone.
+
+var ErrInvalidVacation = errors.New("invalid vacation")
+
+const (
+	// maxPostponeDays bounds how far due dates can be postponed at once.
+	maxPostponeDays = 365
+	// defaultSpreadDays is how many days the backlog of an away period is
+	// spread over, unless asked otherwise.
+	defaultSpreadDays = 7
+)
+
+// PostponeCards moves the due dates of the studied cards in a deck and its
+// subdecks, or in the whole collection, days later, and returns how many
+// cards were postponed.
+func PostponeCards(db *Collection, deckName string, days int) (int, error) {
+	if days < 1 || days > maxPostponeDays {
+		return 0, fmt.Errorf("%w: days must be between 1 and %d", ErrInvalidVacation, maxPostponeDays)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	where, args := CardFilter{Deck: deckName}.where()
+	where = append(where, `state != 'new'`, `suspended = 0`)
+	cards, err := queryDue(tx, where, args)
+	if err != nil {
+		return 0, err
+	}
+	for _, c := range cards {
+		if _, err := tx.Exec(`UPDATE cards SET next_review = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?`,
+			c.due.AddDate(0, 0, days).In(time.Local), c.id); err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return len(cards), nil
+}
+
+// AwayRequest marks the study days From to Until (YYYY-MM-DD) as away.
+type AwayRequest struct {
+	Deck       string `json:"deck"`
+	From       string `json:"from"`
+	Until      string `json:"until"`
+	SpreadDays int    `json:"spread_days"` // defaultSpreadDays if 0
+}
+
+// AwayResult is how the backlog of an away period was spread.
+type AwayResult struct {
+	Rescheduled int          `json:"rescheduled_count"`
+	Days        []DayReviews `json:"days"` // Cards now due on each day
+}
+
+// SpreadBacklog reschedules the studied cards in a deck and its subdecks,
+// or in the whole collection, that come due during an away period, and
+// once it has begun the overdue ones too. They are spread evenly over the
+// spread days from the return, or from today if that has passed, in the
+// order they were due.
+func SpreadBacklog(db *Collection, req AwayRequest) (*AwayResult, error) {
+	if req.SpreadDays == 0 {
+		req.SpreadDays = defaultSpreadDays
+	}
+	from, err := time.ParseInLocation("2006-01-02", req.From, dayLocation)
+	if err != nil {
+		return nil, fmt.Errorf("%w: from must be YYYY-MM-DD", ErrInvalidVacation)
+	}
+	until, err := time.ParseInLocation("2006-01-02", req.Until, dayLocation)
+	if err != nil {
+		return nil, fmt.Errorf("%w: until must be YYYY-MM-DD", ErrInvalidVacation)
+	}
+	switch {
+	case until.Before(from):
+		return nil, fmt.Errorf("%w: until must not be before from", ErrInvalidVacation)
+	case until.Sub(from) > maxPostponeDays*24*time.Hour:
+		return nil, fmt.Errorf("%w: the away period can be at most %d days", ErrInvalidVacation, maxPostponeDays)
+	case req.SpreadDays < 1 || req.SpreadDays > 90:
+		return nil, fmt.Errorf("%w: spread_days must be between 1 and 90", ErrInvalidVacation)
+	}
+
+	// The first study day away and back, as days from today, counted in
+	// calendar dates, which daylight saving leaves alone
+	now := time.Now()
+	today, _ := time.ParseInLocation("2006-01-02", studyDate(now), dayLocation)
+	away := int(math.Round(from.Sub(today).Hours() / 24))
+	back := int(math.Round(until.AddDate(0, 0, 1).Sub(today).Hours() / 24))
+	if back < 0 {
+		back = 0
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	where, args := CardFilter{Deck: req.Deck}.where()
+	where = append(where, `state != 'new'`, `suspended = 0`, `next_review < ?`)
+	args = append(args, dueAfterDays(now, back))
+	if away > 0 {
+		// Cards due before leaving are studied as usual
+		where = append(where, `next_review >= ?`)
+		args = append(args, dueAfterDays(now, away))
+	}
+	cards, err := queryDue(tx, where, args)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &AwayResult{Rescheduled: len(cards), Days: []DayReviews{}}
+	for i, c := range cards {
+		day := back + i*req.SpreadDays/len(cards)
+		due := dueAfterDays(now, day)
+		if _, err := tx.Exec(`UPDATE cards SET next_review = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?`, due, c.id); err != nil {
+			return nil, err
+		}
+		date := studyDate(due)
+		if n := len(result.Days); n == 0 || result.Days[n-1].Date != date {
+			result.Days = append(result.Days, DayReviews{Date: date})
+		}
+		result.Days[len(result.Days)-1].Count++
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+type dueCard struct {
+	id  int
+	due time.Time
+}
+
+// queryDue returns the IDs and due dates of the cards matching where, in
+// the order they are due.
+func queryDue(q querier, where []string, args []any) ([]dueCard, error) {
+	rows, err := q.Query(`SELECT id, next_review FROM cards`+whereClause(where)+` ORDER BY next_review, id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var cards []dueCard
+	for rows.Next() {
+		var c dueCard
+		if err := rows.Scan(&c.id, &c.due); err != nil {
+			return nil, err
+		}
+		cards = append(cards, c)
+	}
+	return cards, rows.Err()
+}